@@ -1,39 +1,44 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"log"
 	"net"
-	"strings"
+	"os"
 	"time"
 
 	"github.com/siddarthpai/wardrobe/respgo"
 	"github.com/siddarthpai/wardrobe/store"
 )
 
+const usage = `Usage: wardrobe [/path/to/config.conf] [--directive arg...]
+
+Directives are those of a Redis config file, e.g.
+
+  wardrobe --port 6380 --replicaof 127.0.0.1 6379
+  wardrobe /etc/wardrobe.conf --dir /var/lib/wardrobe --appendonly yes
+
+Options on the command line override the config file.
+`
+
 func main() {
-	var (
-		portOpt   string
-		replicaOf string
-	)
-	flag.StringVar(&portOpt, "port", "8000", "port to listen on")
-	flag.StringVar(&replicaOf, "replicaof ", "", "master address in form host:port")
-	flag.Parse()
+	args := os.Args[1:]
+	if len(args) == 1 && (args[0] == "-h" || args[0] == "--help") {
+		fmt.Print(usage)
+		return
+	}
 
 	cacheSvc := store.New()
-	cacheSvc.Info.Port = portOpt
-
-	if replicaOf != "" {
-		parts := strings.Split(replicaOf, ":")
-		if len(parts) != 2 {
-			log.Fatalf("invalid replicaof argument: %s", replicaOf)
-		}
-		cacheSvc.Info.Role = "slave"
-		cacheSvc.Info.MasterIP = parts[0]
-		cacheSvc.Info.MasterPort = parts[1]
+	if err := cacheSvc.ParseCommandLine(args); err != nil {
+		log.Fatalf("invalid configuration: %v\n\n%s", err, usage)
+	}
+	if err := cacheSvc.LoadDataFromDisk(); err != nil {
+		log.Fatalf("failed to load data: %v\n"+
+			"fix or move the file aside, or start with --start-empty-on-load-error yes to start without it", err)
+	}
 
-		log.Printf("Starting in slave mode, syncing with master at %s:%s", parts[0], parts[1])
+	if cacheSvc.Info.Role == "slave" {
+		log.Printf("Starting in slave mode, syncing with master at %s:%s", cacheSvc.Info.MasterIP, cacheSvc.Info.MasterPort)
 		go cacheSvc.HandleReplication()
 
 		time.Sleep(100 * time.Millisecond)
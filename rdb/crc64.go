@@ -0,0 +1,14 @@
+package rdb
+
+import "hash/crc64"
+
+// jonesTable is for the CRC-64 variant Redis checksums dumps with: the Jones
+// polynomial, reflected, starting from 0 with no final xor.
+var jonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// CRC64 extends crc, which is 0 for a fresh checksum, with p. hash/crc64
+// inverts the checksum on the way in and out, which Redis's variant does
+// not, hence the inversions here.
+func CRC64(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, jonesTable, p)
+}
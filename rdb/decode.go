@@ -0,0 +1,646 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// readObject reads a value of the given object type into one of the value
+// types.
+func (p *DumpParser) readObject(typ byte) (any, error) {
+	switch typ {
+	case TypeString:
+		return p.readString()
+	case TypeList:
+		items, err := p.readStrings()
+		return List(items), err
+	case TypeSet:
+		items, err := p.readStrings()
+		return Set(items), err
+	case TypeZSet, TypeZSet2:
+		return p.readSortedSet(typ == TypeZSet2)
+	case TypeHash:
+		return p.readPlainHash()
+	case TypeSetIntset:
+		return p.readIntset()
+	case TypeHashListpack:
+		elems, err := p.readListpack()
+		if err != nil {
+			return nil, err
+		}
+		return hashFromListpack(elems, false)
+	case TypeZSetListpack:
+		return p.readSortedSetListpack()
+	case TypeListQuicklist2:
+		return p.readQuicklist2()
+	case TypeSetListpack:
+		elems, err := p.readListpack()
+		return Set(elems), err
+	case TypeStreamListpacks, TypeStreamListpacks2, TypeStreamListpacks3:
+		return p.readStream(typ)
+	case TypeHashMetadata:
+		return p.readHashMetadata()
+	case TypeHashListpackEx:
+		// the earliest deadline comes first but the listpack has them all
+		if _, err := p.readMillis(); err != nil {
+			return nil, err
+		}
+		elems, err := p.readListpack()
+		if err != nil {
+			return nil, err
+		}
+		return hashFromListpack(elems, true)
+	case TypeHashZipmap:
+		blob, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		elems, err := parseZipmap([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		return hashFromListpack(elems, false)
+	case TypeListZiplist:
+		elems, err := p.readZiplist()
+		return List(elems), err
+	case TypeZSetZiplist:
+		elems, err := p.readZiplist()
+		if err != nil {
+			return nil, err
+		}
+		return sortedSetFromElems(elems)
+	case TypeHashZiplist:
+		elems, err := p.readZiplist()
+		if err != nil {
+			return nil, err
+		}
+		return hashFromListpack(elems, false)
+	case TypeListQuicklist:
+		n, _, err := p.readLength()
+		if err != nil {
+			return nil, err
+		}
+		var l List
+		for i := 0; i < n; i++ {
+			elems, err := p.readZiplist()
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, elems...)
+		}
+		return l, nil
+	case TypeModule2:
+		id, _, err := p.readLength()
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("values of module type %s cannot be loaded", moduleTypeName(uint64(id)))
+	case TypeModule:
+		return nil, fmt.Errorf("values of pre-GA module types cannot be loaded")
+	}
+	return nil, fmt.Errorf("unsupported object type %d", typ)
+}
+
+// Items of a module value saved in the self-describing form of module AUX
+// fields and TypeModule2.
+const (
+	moduleOpEOF    = 0
+	moduleOpSInt   = 1
+	moduleOpUInt   = 2
+	moduleOpFloat  = 3
+	moduleOpDouble = 4
+	moduleOpString = 5
+)
+
+// skipModuleAux skips a module AUX field, which a module saves along with
+// the dataset: the module type ID, when it was saved, which is an unsigned
+// item, and the module's data.
+func (p *DumpParser) skipModuleAux() error {
+	id, _, err := p.readLength()
+	if err != nil {
+		return err
+	}
+	op, _, err := p.readLength()
+	if err != nil {
+		return err
+	}
+	if op != moduleOpUInt {
+		return fmt.Errorf("module %s AUX field has item type %d for its save point", moduleTypeName(uint64(id)), op)
+	}
+	if _, _, err := p.readLength(); err != nil {
+		return err
+	}
+	return p.skipModuleValue()
+}
+
+// skipModuleValue skips typed items up to the end marker.
+func (p *DumpParser) skipModuleValue() error {
+	for {
+		op, _, err := p.readLength()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case moduleOpEOF:
+			return nil
+		case moduleOpSInt, moduleOpUInt:
+			_, _, err = p.readLength()
+		case moduleOpFloat:
+			_, err = p.readBytes(4)
+		case moduleOpDouble:
+			_, err = p.readBytes(8)
+		case moduleOpString:
+			_, err = p.readString()
+		default:
+			err = fmt.Errorf("unknown module item type %d", op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// moduleTypeName recovers the nine-character name of a module type from its
+// ID, which holds the name in its top 54 bits, six bits a character, and a
+// version in the rest.
+func moduleTypeName(id uint64) string {
+	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	name := make([]byte, 9)
+	for i := range name {
+		name[i] = charset[id>>(64-6*(i+1))&63]
+	}
+	return string(name)
+}
+
+// readStrings reads a count followed by that many strings.
+func (p *DumpParser) readStrings() ([]string, error) {
+	n, _, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	var items []string
+	for i := 0; i < n; i++ {
+		s, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, s)
+	}
+	return items, nil
+}
+
+// readMillis reads a unix millisecond time: 8 bytes, little endian.
+func (p *DumpParser) readMillis() (int64, error) {
+	buf, err := p.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// readStreamID reads a stream ID stored as 16 bytes, big endian.
+func (p *DumpParser) readStreamID() (StreamID, error) {
+	buf, err := p.readBytes(16)
+	if err != nil {
+		return StreamID{}, err
+	}
+	return streamIDFromKey(buf), nil
+}
+
+func streamIDFromKey(buf []byte) StreamID {
+	return StreamID{binary.BigEndian.Uint64(buf), binary.BigEndian.Uint64(buf[8:])}
+}
+
+// readLengthID reads a stream ID stored as two lengths.
+func (p *DumpParser) readLengthID() (StreamID, error) {
+	ms, _, err := p.readLength()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, _, err := p.readLength()
+	return StreamID{uint64(ms), uint64(seq)}, err
+}
+
+// readListpack reads a string holding a listpack and decodes it.
+func (p *DumpParser) readListpack() ([]string, error) {
+	blob, err := p.readString()
+	if err != nil {
+		return nil, err
+	}
+	return parseListpack([]byte(blob))
+}
+
+// readZiplist reads a string holding a ziplist and decodes it.
+func (p *DumpParser) readZiplist() ([]string, error) {
+	blob, err := p.readString()
+	if err != nil {
+		return nil, err
+	}
+	return parseZiplist([]byte(blob))
+}
+
+func (p *DumpParser) readSortedSet(binaryScores bool) (SortedSet, error) {
+	n, _, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	var z SortedSet
+	for i := 0; i < n; i++ {
+		member, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if binaryScores {
+			score, err = p.readBinaryDouble()
+		} else {
+			score, err = p.readStringDouble()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(score) {
+			return nil, fmt.Errorf("sorted set member %q has a NaN score", member)
+		}
+		z = append(z, ScoredMember{member, score})
+	}
+	return z, nil
+}
+
+func (p *DumpParser) readSortedSetListpack() (SortedSet, error) {
+	elems, err := p.readListpack()
+	if err != nil {
+		return nil, err
+	}
+	return sortedSetFromElems(elems)
+}
+
+// sortedSetFromElems builds a sorted set from the member, score pairs of a
+// listpack or ziplist.
+func sortedSetFromElems(elems []string) (SortedSet, error) {
+	if len(elems)%2 != 0 {
+		return nil, fmt.Errorf("sorted set has an odd number of elements")
+	}
+	var z SortedSet
+	for i := 0; i < len(elems); i += 2 {
+		score, err := strconv.ParseFloat(elems[i+1], 64)
+		if err != nil || math.IsNaN(score) {
+			return nil, fmt.Errorf("sorted set has a bad score %q", elems[i+1])
+		}
+		z = append(z, ScoredMember{elems[i], score})
+	}
+	return z, nil
+}
+
+func (p *DumpParser) readPlainHash() (Hash, error) {
+	n, _, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	var h Hash
+	for i := 0; i < n; i++ {
+		field, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		h = append(h, HashField{Field: field, Value: value})
+	}
+	return h, nil
+}
+
+// readHashMetadata reads a hash with field deadlines; see appendHash.
+func (p *DumpParser) readHashMetadata() (Hash, error) {
+	minExpire, err := p.readMillis()
+	if err != nil {
+		return nil, err
+	}
+	n, _, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	var h Hash
+	for i := 0; i < n; i++ {
+		ttl, _, err := p.readLength()
+		if err != nil {
+			return nil, err
+		}
+		field, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		f := HashField{Field: field, Value: value}
+		if ttl != 0 {
+			f.ExpireAt = minExpire + int64(ttl) - 1
+		}
+		h = append(h, f)
+	}
+	return h, nil
+}
+
+// hashFromListpack builds a hash from the field, value pairs of a listpack,
+// ziplist or zipmap, or from field, value, deadline triplets if withTTL is
+// set.
+func hashFromListpack(elems []string, withTTL bool) (Hash, error) {
+	width := 2
+	if withTTL {
+		width = 3
+	}
+	if len(elems)%width != 0 {
+		return nil, fmt.Errorf("hash listpack has %d elements", len(elems))
+	}
+	var h Hash
+	for i := 0; i < len(elems); i += width {
+		f := HashField{Field: elems[i], Value: elems[i+1]}
+		if withTTL {
+			at, err := strconv.ParseInt(elems[i+2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("hash listpack has a bad deadline %q", elems[i+2])
+			}
+			f.ExpireAt = at
+		}
+		h = append(h, f)
+	}
+	return h, nil
+}
+
+// readIntset reads a string holding an intset: the width of its elements
+// and their count as 32-bit little-endian integers, then the elements,
+// sorted and little endian.
+func (p *DumpParser) readIntset() (Set, error) {
+	blob, err := p.readString()
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < 8 {
+		return nil, fmt.Errorf("intset too short")
+	}
+	enc := int(binary.LittleEndian.Uint32([]byte(blob)))
+	n := int(binary.LittleEndian.Uint32([]byte(blob[4:])))
+	if (enc != 2 && enc != 4 && enc != 8) || len(blob)-8 != n*enc {
+		return nil, fmt.Errorf("intset of %d bytes has encoding %d and length %d", len(blob), enc, n)
+	}
+	s := make(Set, 0, n)
+	for i := 0; i < n; i++ {
+		b := []byte(blob[8+i*enc:])
+		var v int64
+		switch enc {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(b)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(b)))
+		default:
+			v = int64(binary.LittleEndian.Uint64(b))
+		}
+		s = append(s, strconv.FormatInt(v, 10))
+	}
+	return s, nil
+}
+
+// Container types of a quicklist node.
+const (
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// readQuicklist2 reads a list as a sequence of nodes, each a listpack or,
+// for a single large element, the element itself.
+func (p *DumpParser) readQuicklist2() (List, error) {
+	n, _, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	var l List
+	for i := 0; i < n; i++ {
+		container, _, err := p.readLength()
+		if err != nil {
+			return nil, err
+		}
+		switch container {
+		case quicklistNodePlain:
+			s, err := p.readString()
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, s)
+		case quicklistNodePacked:
+			elems, err := p.readListpack()
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, elems...)
+		default:
+			return nil, fmt.Errorf("unknown quicklist container %d", container)
+		}
+	}
+	return l, nil
+}
+
+// listpackReader walks the elements of a decoded listpack.
+type listpackReader struct {
+	elems []string
+	err   error
+}
+
+func (r *listpackReader) next() string {
+	if len(r.elems) == 0 {
+		r.err = fmt.Errorf("stream listpack ends early")
+		return ""
+	}
+	s := r.elems[0]
+	r.elems = r.elems[1:]
+	return s
+}
+
+func (r *listpackReader) nextInt() int64 {
+	s := r.next()
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("stream listpack has %q for an integer", s)
+	}
+	return v
+}
+
+// readStream reads a stream in any of the listpack-based types; see
+// appendStream for the layout. The older types lack the first ID, maximal
+// deleted ID, entries added and entries read, and consumer active times.
+func (p *DumpParser) readStream(typ byte) (*Stream, error) {
+	nodes, _, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	s := &Stream{}
+	for i := 0; i < nodes; i++ {
+		key, err := p.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, fmt.Errorf("stream node key of %d bytes", len(key))
+		}
+		master := streamIDFromKey([]byte(key))
+		elems, err := p.readListpack()
+		if err != nil {
+			return nil, err
+		}
+		if err := s.appendNode(master, elems); err != nil {
+			return nil, err
+		}
+	}
+
+	length, _, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	s.Length = uint64(length)
+	if s.LastID, err = p.readLengthID(); err != nil {
+		return nil, err
+	}
+	if typ >= TypeStreamListpacks2 {
+		if s.FirstID, err = p.readLengthID(); err != nil {
+			return nil, err
+		}
+		if s.MaxDeletedID, err = p.readLengthID(); err != nil {
+			return nil, err
+		}
+		added, _, err := p.readLength()
+		if err != nil {
+			return nil, err
+		}
+		s.EntriesAdded = uint64(added)
+	} else {
+		if len(s.Entries) > 0 {
+			s.FirstID = s.Entries[0].ID
+		}
+		s.EntriesAdded = s.Length
+	}
+
+	groups, _, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < groups; i++ {
+		g, err := p.readStreamGroup(typ)
+		if err != nil {
+			return nil, err
+		}
+		s.Groups = append(s.Groups, g)
+	}
+	return s, nil
+}
+
+// appendNode adds the live entries of one stream listpack.
+func (s *Stream) appendNode(master StreamID, elems []string) error {
+	r := &listpackReader{elems: elems}
+	r.nextInt() // live entries
+	r.nextInt() // deleted entries
+	nfields := r.nextInt()
+	if nfields < 0 || nfields > int64(len(r.elems)) {
+		return fmt.Errorf("stream master entry has %d fields", nfields)
+	}
+	masterFields := make([]string, nfields)
+	for i := range masterFields {
+		masterFields[i] = r.next()
+	}
+	r.next() // master entry terminator
+	for r.err == nil && len(r.elems) > 0 {
+		flags := r.nextInt()
+		id := StreamID{master.Ms + uint64(r.nextInt()), master.Seq + uint64(r.nextInt())}
+		var fields []string
+		if flags&streamItemSameFields != 0 {
+			for _, name := range masterFields {
+				fields = append(fields, name, r.next())
+			}
+		} else {
+			n := r.nextInt()
+			if n < 0 || n > int64(len(r.elems)) {
+				return fmt.Errorf("stream entry has %d fields", n)
+			}
+			for j := int64(0); j < 2*n; j++ {
+				fields = append(fields, r.next())
+			}
+		}
+		r.next() // element count
+		if flags&streamItemDeleted == 0 && r.err == nil {
+			s.Entries = append(s.Entries, StreamEntry{ID: id, Fields: fields})
+		}
+	}
+	return r.err
+}
+
+func (p *DumpParser) readStreamGroup(typ byte) (StreamGroup, error) {
+	g := StreamGroup{EntriesRead: -1}
+	var err error
+	if g.Name, err = p.readString(); err != nil {
+		return g, err
+	}
+	if g.LastID, err = p.readLengthID(); err != nil {
+		return g, err
+	}
+	if typ >= TypeStreamListpacks2 {
+		read, _, err := p.readLength()
+		if err != nil {
+			return g, err
+		}
+		g.EntriesRead = int64(read)
+	}
+	n, _, err := p.readLength()
+	if err != nil {
+		return g, err
+	}
+	for i := 0; i < n; i++ {
+		var e StreamPending
+		if e.ID, err = p.readStreamID(); err != nil {
+			return g, err
+		}
+		if e.DeliveryTime, err = p.readMillis(); err != nil {
+			return g, err
+		}
+		count, _, err := p.readLength()
+		if err != nil {
+			return g, err
+		}
+		e.DeliveryCount = uint64(count)
+		g.Pending = append(g.Pending, e)
+	}
+	if n, _, err = p.readLength(); err != nil {
+		return g, err
+	}
+	for i := 0; i < n; i++ {
+		var c StreamConsumer
+		if c.Name, err = p.readString(); err != nil {
+			return g, err
+		}
+		if c.SeenTime, err = p.readMillis(); err != nil {
+			return g, err
+		}
+		c.ActiveTime = c.SeenTime
+		if typ >= TypeStreamListpacks3 {
+			if c.ActiveTime, err = p.readMillis(); err != nil {
+				return g, err
+			}
+		}
+		pending, _, err := p.readLength()
+		if err != nil {
+			return g, err
+		}
+		for j := 0; j < pending; j++ {
+			id, err := p.readStreamID()
+			if err != nil {
+				return g, err
+			}
+			c.Pending = append(c.Pending, id)
+		}
+		g.Consumers = append(g.Consumers, c)
+	}
+	return g, nil
+}
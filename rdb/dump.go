@@ -0,0 +1,55 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxVersion is the newest RDB version this package reads.
+const maxVersion = 12
+
+// ErrDumpChecksum is returned by Restore for a payload whose footer does
+// not check out.
+var ErrDumpChecksum = errors.New("DUMP payload version or checksum are wrong")
+
+// Dump serializes v the way Redis's DUMP does: the object type and value
+// as in a dump file, followed by the RDB version as two little-endian bytes
+// and a CRC64 of everything before it, little endian.
+func Dump(v any) []byte {
+	typ := ObjectType(v)
+	buf := AppendValue([]byte{typ}, v)
+	version := Version
+	if typ == TypeHashMetadata {
+		version = hashMetadataVersion
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(version))
+	return binary.LittleEndian.AppendUint64(buf, CRC64(0, buf))
+}
+
+// Restore decodes a payload produced by Dump or by Redis's DUMP into one
+// of the value types.
+func Restore(payload []byte) (any, error) {
+	if len(payload) < 10 {
+		return nil, ErrDumpChecksum
+	}
+	body, footer := payload[:len(payload)-10], payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > maxVersion ||
+		binary.LittleEndian.Uint64(footer[2:]) != CRC64(0, payload[:len(payload)-8]) {
+		return nil, ErrDumpChecksum
+	}
+	if len(body) == 0 {
+		return nil, fmt.Errorf("empty payload")
+	}
+	p := &DumpParser{reader: newReader(bytes.NewReader(body[1:]))}
+	v, err := p.readObject(body[0])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.reader.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("trailing data after value")
+	}
+	return v, nil
+}
@@ -0,0 +1,93 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCRC64(t *testing.T) {
+	// the check value of the Jones polynomial that Redis's crc64.c tests
+	if got := CRC64(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("CRC64 = %016x, want e9c6d914c4b8d9ca", got)
+	}
+	// the checksum continues across calls
+	if got := CRC64(CRC64(0, []byte("1234")), []byte("56789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("CRC64 in two parts = %016x", got)
+	}
+}
+
+// TestRestoreRedisPayloads restores payloads produced by Redis's DUMP.
+func TestRestoreRedisPayloads(t *testing.T) {
+	for _, tc := range []struct {
+		name, payload string
+		want          any
+	}{
+		// the integer 10, from RDB version 6 and version 9 servers
+		{"integer v6", "\x00\xc0\n\x06\x00\xf8r?\xc5\xfb\xfb_(", "10"},
+		{"integer v9", "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n", "10"},
+		// the list 1, 2, 3 as a ziplist, from the RESTORE documentation
+		{"ziplist", "\n\x17\x17\x00\x00\x00\x12\x00\x00\x00\x03\x00\x00\xc0\x01\x00\x04\xc0\x02\x00\x04\xc0\x03\x00\xff\x04\x00u#<\xc0;.\xe9\xdd",
+			List{"1", "2", "3"}},
+	} {
+		got, err := Restore([]byte(tc.payload))
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: Restore = %#v, %v, want %#v", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestRestoreRejects(t *testing.T) {
+	good := Dump("value")
+	for _, tc := range []struct {
+		name    string
+		payload func() []byte
+	}{
+		{"a short payload", func() []byte { return good[:9] }},
+		{"a wrong checksum", func() []byte {
+			b := []byte(string(good))
+			b[len(b)-1] ^= 1
+			return b
+		}},
+		{"a changed value", func() []byte {
+			b := []byte(string(good))
+			b[2] = 'V'
+			return b
+		}},
+		// with a checksum that matches
+		{"a newer version", func() []byte {
+			b := binary.LittleEndian.AppendUint16([]byte(string(good[:len(good)-10])), maxVersion+1)
+			return binary.LittleEndian.AppendUint64(b, CRC64(0, b))
+		}},
+	} {
+		if _, err := Restore(tc.payload()); !errors.Is(err, ErrDumpChecksum) {
+			t.Errorf("%s: Restore returned %v, want ErrDumpChecksum", tc.name, err)
+		}
+	}
+}
+
+// TestDumpRoundTrip dumps every value type and restores it.
+func TestDumpRoundTrip(t *testing.T) {
+	for _, v := range []any{
+		"",
+		"12",
+		strings.Repeat("compressible ", 100),
+		List{"a", "", "3"},
+		Set{"x"},
+		SortedSet{{"m", 1.5}, {"n", -2}},
+		Hash{{Field: "f", Value: "v"}},
+		Hash{{Field: "f", Value: "v", ExpireAt: 1700000000000}, {Field: "g", Value: "w"}},
+		&Stream{
+			Entries: []StreamEntry{{ID: StreamID{1, 1}, Fields: []string{"f", "v"}}},
+			Length:  1, LastID: StreamID{1, 1}, FirstID: StreamID{1, 1}, EntriesAdded: 1,
+		},
+	} {
+		payload := Dump(v)
+		got, err := Restore(payload)
+		if err != nil || !reflect.DeepEqual(got, v) {
+			t.Errorf("Restore(Dump(%#v)) = %#v, %v", v, got, err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// streamNodeMaxEntries is how many entries go in each listpack of an
+// encoded stream, as with Redis's stream-node-max-entries.
+const streamNodeMaxEntries = 100
+
+// hashMetadataVersion is the RDB version that introduced field deadlines.
+const hashMetadataVersion = 12
+
+// ObjectType returns the type byte AppendValue encodes v as.
+func ObjectType(v any) byte {
+	switch v := v.(type) {
+	case string:
+		return TypeString
+	case List:
+		return TypeList
+	case Set:
+		return TypeSet
+	case SortedSet:
+		return TypeZSet2
+	case Hash:
+		for _, f := range v {
+			if f.ExpireAt != 0 {
+				return TypeHashMetadata
+			}
+		}
+		return TypeHash
+	case *Stream:
+		return TypeStreamListpacks3
+	}
+	panic(fmt.Sprintf("rdb: cannot encode %T", v))
+}
+
+// AppendValue appends the encoding of v, which must be one of the value
+// types, as the type ObjectType reports.
+func AppendValue(buf []byte, v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return appendString(buf, v)
+	case List:
+		return appendStrings(buf, v)
+	case Set:
+		return appendStrings(buf, v)
+	case SortedSet:
+		buf = appendLength(buf, uint64(len(v)))
+		for _, m := range v {
+			buf = appendString(buf, m.Member)
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(m.Score))
+		}
+		return buf
+	case Hash:
+		return appendHash(buf, v)
+	case *Stream:
+		return appendStream(buf, v)
+	}
+	panic(fmt.Sprintf("rdb: cannot encode %T", v))
+}
+
+// appendLength appends n in the length encoding: 6 or 14 bits with the
+// two high bits saying which, or a marker byte followed by 32 or 64 bits,
+// big endian.
+func appendLength(buf []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(buf, byte(n))
+	case n < 1<<14:
+		return append(buf, 0x40|byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		buf = append(buf, 0x80)
+		return binary.BigEndian.AppendUint32(buf, uint32(n))
+	}
+	buf = append(buf, 0x81)
+	return binary.BigEndian.AppendUint64(buf, n)
+}
+
+// appendString appends s, as an 8, 16 or 32-bit integer if it is the
+// canonical form of one, the way Redis saves strings.
+func appendString(buf []byte, s string) []byte {
+	if len(s) <= 11 {
+		if v, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(v, 10) == s {
+			switch {
+			case v >= math.MinInt8 && v <= math.MaxInt8:
+				return append(buf, 0xC0, byte(v))
+			case v >= math.MinInt16 && v <= math.MaxInt16:
+				buf = append(buf, 0xC1)
+				return binary.LittleEndian.AppendUint16(buf, uint16(v))
+			default:
+				buf = append(buf, 0xC2)
+				return binary.LittleEndian.AppendUint32(buf, uint32(v))
+			}
+		}
+	}
+	buf = appendLength(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// appendBlob appends b as a plain string, for binary data such as an
+// embedded listpack.
+func appendBlob(buf, b []byte) []byte {
+	buf = appendLength(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendStrings(buf []byte, items []string) []byte {
+	buf = appendLength(buf, uint64(len(items)))
+	for _, s := range items {
+		buf = appendString(buf, s)
+	}
+	return buf
+}
+
+// appendMillis appends a unix millisecond time as 8 bytes, little endian.
+func appendMillis(buf []byte, ms int64) []byte {
+	return binary.LittleEndian.AppendUint64(buf, uint64(ms))
+}
+
+// appendStreamID appends id as 16 bytes, big endian, the form stream IDs
+// take as radix tree keys.
+func appendStreamID(buf []byte, id StreamID) []byte {
+	buf = binary.BigEndian.AppendUint64(buf, id.Ms)
+	return binary.BigEndian.AppendUint64(buf, id.Seq)
+}
+
+// appendHash appends a hash. Without field deadlines it is a count
+// followed by field, value pairs. With them it is TypeHashMetadata: the
+// earliest deadline, then for every field its deadline relative to that
+// one, plus one, or 0 for none, ahead of the field and value.
+func appendHash(buf []byte, h Hash) []byte {
+	var minExpire int64
+	for _, f := range h {
+		if f.ExpireAt != 0 && (minExpire == 0 || f.ExpireAt < minExpire) {
+			minExpire = f.ExpireAt
+		}
+	}
+	if minExpire != 0 {
+		buf = appendMillis(buf, minExpire)
+	}
+	buf = appendLength(buf, uint64(len(h)))
+	for _, f := range h {
+		if minExpire != 0 {
+			var ttl uint64
+			if f.ExpireAt != 0 {
+				ttl = uint64(f.ExpireAt-minExpire) + 1
+			}
+			buf = appendLength(buf, ttl)
+		}
+		buf = appendString(buf, f.Field)
+		buf = appendString(buf, f.Value)
+	}
+	return buf
+}
+
+// appendStream appends a stream as TypeStreamListpacks3. The entries go in
+// listpacks laid out as Redis lays out its stream nodes: a master entry
+// with the live and deleted counts and the field names of the first entry,
+// then every entry as flags, ID deltas from the master ID and either just
+// the values, when it has the master's field names, or the field count and
+// field, value pairs, followed by the number of elements it took up.
+func appendStream(buf []byte, s *Stream) []byte {
+	nodes := (len(s.Entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	buf = appendLength(buf, uint64(nodes))
+	for start := 0; start < len(s.Entries); start += streamNodeMaxEntries {
+		entries := s.Entries[start:min(start+streamNodeMaxEntries, len(s.Entries))]
+		master := entries[0]
+		lb := newListpackBuilder()
+		lb.appendInt(int64(len(entries)))
+		lb.appendInt(0)
+		lb.appendInt(int64(len(master.Fields) / 2))
+		for i := 0; i < len(master.Fields); i += 2 {
+			lb.appendString(master.Fields[i])
+		}
+		lb.appendInt(0)
+		for _, e := range entries {
+			same := sameFieldNames(master.Fields, e.Fields)
+			flags := int64(0)
+			if same {
+				flags = streamItemSameFields
+			}
+			lb.appendInt(flags)
+			lb.appendInt(int64(e.ID.Ms - master.ID.Ms))
+			lb.appendInt(int64(e.ID.Seq - master.ID.Seq))
+			n := len(e.Fields) / 2
+			if same {
+				for i := 1; i < len(e.Fields); i += 2 {
+					lb.appendString(e.Fields[i])
+				}
+				lb.appendInt(int64(n + 3))
+			} else {
+				lb.appendInt(int64(n))
+				for _, f := range e.Fields {
+					lb.appendString(f)
+				}
+				lb.appendInt(int64(2*n + 4))
+			}
+		}
+		buf = appendBlob(buf, appendStreamID(nil, master.ID))
+		buf = appendBlob(buf, lb.bytes())
+	}
+
+	buf = appendLength(buf, s.Length)
+	for _, id := range []StreamID{s.LastID, s.FirstID, s.MaxDeletedID} {
+		buf = appendLength(buf, id.Ms)
+		buf = appendLength(buf, id.Seq)
+	}
+	buf = appendLength(buf, s.EntriesAdded)
+
+	buf = appendLength(buf, uint64(len(s.Groups)))
+	for _, g := range s.Groups {
+		buf = appendString(buf, g.Name)
+		buf = appendLength(buf, g.LastID.Ms)
+		buf = appendLength(buf, g.LastID.Seq)
+		buf = appendLength(buf, uint64(g.EntriesRead))
+		buf = appendLength(buf, uint64(len(g.Pending)))
+		for _, e := range g.Pending {
+			buf = appendStreamID(buf, e.ID)
+			buf = appendMillis(buf, e.DeliveryTime)
+			buf = appendLength(buf, e.DeliveryCount)
+		}
+		buf = appendLength(buf, uint64(len(g.Consumers)))
+		for _, c := range g.Consumers {
+			buf = appendString(buf, c.Name)
+			buf = appendMillis(buf, c.SeenTime)
+			buf = appendMillis(buf, c.ActiveTime)
+			buf = appendLength(buf, uint64(len(c.Pending)))
+			for _, id := range c.Pending {
+				buf = appendStreamID(buf, id)
+			}
+		}
+	}
+	return buf
+}
+
+// Flags of a stream listpack entry.
+const (
+	streamItemDeleted    = 1 << 0
+	streamItemSameFields = 1 << 1
+)
+
+// sameFieldNames reports whether two field, value lists have the same
+// field names in the same order.
+func sameFieldNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i += 2 {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
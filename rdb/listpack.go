@@ -0,0 +1,200 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// parseListpack decodes a listpack, the compact encoding Redis 7 uses for
+// small hashes, lists, sets and sorted sets, into its elements. Integer
+// elements are returned in their decimal string form.
+func parseListpack(buf []byte) ([]string, error) {
+	if len(buf) < 7 {
+		return nil, fmt.Errorf("listpack: too short (%d bytes)", len(buf))
+	}
+	if total := binary.LittleEndian.Uint32(buf); int(total) != len(buf) {
+		return nil, fmt.Errorf("listpack: header says %d bytes, have %d", total, len(buf))
+	}
+	var elems []string
+	pos := 6
+	for {
+		if pos >= len(buf) {
+			return nil, fmt.Errorf("listpack: missing terminator")
+		}
+		if buf[pos] == 0xFF {
+			return elems, nil
+		}
+		elem, size, err := listpackEntry(buf[pos:])
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+		pos += size + listpackBacklenSize(size)
+	}
+}
+
+// listpackEntry decodes the entry at the start of b and returns it along
+// with the size of its encoding and data, excluding the trailing backlen.
+func listpackEntry(b []byte) (string, int, error) {
+	need := func(n int) error {
+		if len(b) < n {
+			return fmt.Errorf("listpack: truncated entry")
+		}
+		return nil
+	}
+	c := b[0]
+	switch {
+	case c&0x80 == 0: // 7-bit unsigned int
+		return strconv.Itoa(int(c & 0x7F)), 1, nil
+	case c&0xC0 == 0x80: // 6-bit string length
+		n := int(c & 0x3F)
+		if err := need(1 + n); err != nil {
+			return "", 0, err
+		}
+		return string(b[1 : 1+n]), 1 + n, nil
+	case c&0xE0 == 0xC0: // 13-bit signed int
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		v := int(c&0x1F)<<8 | int(b[1])
+		if v >= 1<<12 {
+			v -= 1 << 13
+		}
+		return strconv.Itoa(v), 2, nil
+	case c&0xF0 == 0xE0: // 12-bit string length
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		n := int(c&0x0F)<<8 | int(b[1])
+		if err := need(2 + n); err != nil {
+			return "", 0, err
+		}
+		return string(b[2 : 2+n]), 2 + n, nil
+	}
+	switch c {
+	case 0xF0: // 32-bit string length
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		n := int(binary.LittleEndian.Uint32(b[1:]))
+		if err := need(5 + n); err != nil {
+			return "", 0, err
+		}
+		return string(b[5 : 5+n]), 5 + n, nil
+	case 0xF1: // 16-bit int
+		if err := need(3); err != nil {
+			return "", 0, err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b[1:])))), 3, nil
+	case 0xF2: // 24-bit int
+		if err := need(4); err != nil {
+			return "", 0, err
+		}
+		v := int32(uint32(b[1])<<8|uint32(b[2])<<16|uint32(b[3])<<24) >> 8
+		return strconv.Itoa(int(v)), 4, nil
+	case 0xF3: // 32-bit int
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b[1:])))), 5, nil
+	case 0xF4: // 64-bit int
+		if err := need(9); err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(b[1:])), 10), 9, nil
+	}
+	return "", 0, fmt.Errorf("listpack: invalid entry encoding %02x", c)
+}
+
+// listpackBacklenSize returns how many bytes the backlen of an entry of the
+// given size takes up.
+func listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// listpackBuilder encodes a listpack one element at a time.
+type listpackBuilder struct {
+	buf []byte
+	n   int
+}
+
+func newListpackBuilder() *listpackBuilder {
+	return &listpackBuilder{buf: make([]byte, 6, 64)}
+}
+
+// appendInt adds v in the smallest integer encoding that holds it.
+func (lb *listpackBuilder) appendInt(v int64) {
+	start := len(lb.buf)
+	switch {
+	case v >= 0 && v <= 127:
+		lb.buf = append(lb.buf, byte(v))
+	case v >= -4096 && v <= 4095:
+		u := uint64(v) & 0x1FFF
+		lb.buf = append(lb.buf, 0xC0|byte(u>>8), byte(u))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		lb.buf = append(lb.buf, 0xF1)
+		lb.buf = binary.LittleEndian.AppendUint16(lb.buf, uint16(v))
+	case v >= -1<<23 && v < 1<<23:
+		lb.buf = append(lb.buf, 0xF2, byte(v), byte(v>>8), byte(v>>16))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		lb.buf = append(lb.buf, 0xF3)
+		lb.buf = binary.LittleEndian.AppendUint32(lb.buf, uint32(v))
+	default:
+		lb.buf = append(lb.buf, 0xF4)
+		lb.buf = binary.LittleEndian.AppendUint64(lb.buf, uint64(v))
+	}
+	lb.finishEntry(start)
+}
+
+// appendString adds s as a string, even if it looks like a number.
+func (lb *listpackBuilder) appendString(s string) {
+	start := len(lb.buf)
+	switch n := len(s); {
+	case n < 64:
+		lb.buf = append(lb.buf, 0x80|byte(n))
+	case n < 4096:
+		lb.buf = append(lb.buf, 0xE0|byte(n>>8), byte(n))
+	default:
+		lb.buf = append(lb.buf, 0xF0)
+		lb.buf = binary.LittleEndian.AppendUint32(lb.buf, uint32(n))
+	}
+	lb.buf = append(lb.buf, s...)
+	lb.finishEntry(start)
+}
+
+// finishEntry appends the backlen of the entry that starts at start: its
+// size in 7-bit groups, most significant first, with the high bit set on
+// all but the first so it can be read backwards.
+func (lb *listpackBuilder) finishEntry(start int) {
+	size := len(lb.buf) - start
+	n := listpackBacklenSize(size)
+	for i := n - 1; i >= 0; i-- {
+		b := byte(size>>(7*i)) & 0x7F
+		if i != n-1 {
+			b |= 0x80
+		}
+		lb.buf = append(lb.buf, b)
+	}
+	lb.n++
+}
+
+// bytes returns the finished listpack. The builder must not be used after.
+func (lb *listpackBuilder) bytes() []byte {
+	lb.buf = append(lb.buf, 0xFF)
+	binary.LittleEndian.PutUint32(lb.buf, uint32(len(lb.buf)))
+	binary.LittleEndian.PutUint16(lb.buf[4:], uint16(min(lb.n, math.MaxUint16)))
+	return lb.buf
+}
@@ -0,0 +1,50 @@
+package rdb
+
+import "fmt"
+
+// lzfDecompress expands an LZF-compressed string, the compression Redis
+// applies to long strings in a dump, into a buffer of exactly outLen bytes.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	// outLen comes from the dump, so it only sizes the buffer if plausible
+	out := make([]byte, 0, min(outLen, 8*len(in)))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// literal run of ctrl+1 bytes
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > outLen {
+				return nil, fmt.Errorf("lzf: literal run overflows buffer")
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		// back reference
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, fmt.Errorf("lzf: truncated back reference")
+			}
+			n += int(in[i])
+			i++
+		}
+		n += 2
+		if i >= len(in) {
+			return nil, fmt.Errorf("lzf: truncated back reference")
+		}
+		ref := len(out) - ((ctrl&0x1f)<<8 | int(in[i])) - 1
+		i++
+		if ref < 0 || len(out)+n > outLen {
+			return nil, fmt.Errorf("lzf: back reference out of range")
+		}
+		// byte by byte, as the reference may overlap what it produces
+		for j := 0; j < n; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != outLen {
+		return nil, fmt.Errorf("lzf: expected %d bytes, got %d", outLen, len(out))
+	}
+	return out, nil
+}
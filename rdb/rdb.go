@@ -1,55 +1,105 @@
 package rdb
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"strconv"
 )
 
 // DumpParser handles reading and interpreting a Redis RDB dump.
 type DumpParser struct {
-	reader    *bufio.Reader
-	version   int
-	metadata  map[string]string
+	reader *reader
+	// closer is the file NewParser opened, which Close closes.
+	closer   io.Closer
+	version  int
+	metadata map[string]string
+	// Functions holds the code of the function libraries in the dump.
+	Functions []string
 	Databases []DatabaseSection
 }
 
 // DatabaseSection  represents one logical Redis database from the dump.
 type DatabaseSection struct {
-	ID           int
+	ID int
+	// TotalEntries and TTL are the number of keys, and of keys with a
+	// deadline, the dump announced for the database.
 	TotalEntries int
 	TTL          uint64
-	KeyValues    map[string]string
-	TTLRecords   []TTLRecord
+	Entries      []Entry
 }
 
-type TTLRecord struct {
+// Entry is a key read from a dump, with a value of one of the value types.
+// ExpireAt is its deadline in unix milliseconds, or 0 for none.
+type Entry struct {
 	Key      string
-	Value    string
-	ExpireAt uint64
+	Value    any
+	ExpireAt int64
 }
 
+// ParseError is a failure to parse a dump. Offset is where in the dump the
+// item that could not be parsed starts.
+type ParseError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("rdb: at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// NewParserFromBytes returns a parser for a dump held in memory.
 func NewParserFromBytes(data []byte) (*DumpParser, error) {
-	tmp := "dump.rdb"
-	if err := os.WriteFile(tmp, data, 0644); err != nil {
-		return nil, err
-	}
-	return NewParser(tmp)
+	return NewParserFromReader(bytes.NewReader(data)), nil
 }
 
+// NewParser opens the dump file at path. The parser must be closed once
+// done with.
 func NewParser(path string) (*DumpParser, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	p := NewParserFromReader(f)
+	p.closer = f
+	return p, nil
+}
+
+// NewParserFromReader returns a parser for the dump read from r, such as a
+// replica's link to its master. The parser only ever buffers a small part
+// of r, but it may read past the end of the dump, so r should end where
+// the dump does.
+func NewParserFromReader(r io.Reader) *DumpParser {
 	return &DumpParser{
-		reader:    bufio.NewReader(f),
+		reader:    newReader(r),
 		metadata:  make(map[string]string),
 		Databases: make([]DatabaseSection, 0),
-	}, nil
+	}
+}
+
+// Close closes the file opened by NewParser. A reader passed to
+// NewParserFromReader is left open, as it belongs to the caller.
+func (p *DumpParser) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	err := p.closer.Close()
+	p.closer = nil
+	return err
+}
+
+// Offset returns how many bytes of the input have been parsed. After
+// Parse, that is the length of the dump, which the parser may have read
+// past into whatever follows it.
+func (p *DumpParser) Offset() int64 {
+	return p.reader.offset()
 }
 
 // readLength decodes the length or integer encoding prefix.
@@ -68,6 +118,22 @@ func (p *DumpParser) readLength() (length int, integer bool, err error) {
 			return 0, false, err
 		}
 		length = int((uint16(first&0x3F) << 8) | uint16(second))
+	case 2: // 32 or 64-bit big-endian length
+		var buf []byte
+		switch first {
+		case 0x80:
+			buf, err = p.readBytes(4)
+			if err == nil {
+				length = int(binary.BigEndian.Uint32(buf))
+			}
+		case 0x81:
+			buf, err = p.readBytes(8)
+			if err == nil {
+				length = int(binary.BigEndian.Uint64(buf))
+			}
+		default:
+			err = fmt.Errorf("invalid length prefix: %02x", first)
+		}
 	case 3: // integer encoding
 		integer = true
 		switch first & 0x3F {
@@ -81,147 +147,232 @@ func (p *DumpParser) readLength() (length int, integer bool, err error) {
 			err = fmt.Errorf("unsupported integer code: %d", first&0x3F)
 			return
 		}
-	default:
-		err = fmt.Errorf("invalid length prefix: %02x", first)
 	}
 	return
 }
 
+// readBytes reads exactly n bytes. The buffer grows as data arrives rather
+// than up front, so a corrupt length fails with EOF instead of exhausting
+// memory.
+func (p *DumpParser) readBytes(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("invalid length %d", n)
+	}
+	if n <= 1<<16 {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(p.reader, buf)
+		return buf, err
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, p.reader, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // readString reads a raw string or integer as string from the dump.
 func (p *DumpParser) readString() (string, error) {
+	first, err := p.reader.peekByte()
+	if err != nil {
+		return "", err
+	}
+	if first == 0xC3 {
+		p.reader.ReadByte()
+		return p.readCompressed()
+	}
+
 	length, isInt, err := p.readLength()
 	if err != nil {
 		return "", err
 	}
-	buf := make([]byte, length)
-	if _, err := io.ReadFull(p.reader, buf); err != nil {
+	buf, err := p.readBytes(length)
+	if err != nil {
 		return "", err
 	}
 	if isInt {
-		val, _ := binary.Varint(buf)
+		var val int64
+		switch length {
+		case 1:
+			val = int64(int8(buf[0]))
+		case 2:
+			val = int64(int16(binary.LittleEndian.Uint16(buf)))
+		default:
+			val = int64(int32(binary.LittleEndian.Uint32(buf)))
+		}
 		return strconv.FormatInt(val, 10), nil
 	}
 	return string(buf), nil
 }
 
-// readMetadata extracts an AUX field if present.
-func (p *DumpParser) readMetadata() error {
-	b, err := p.reader.ReadByte()
+// readCompressed reads an LZF-compressed string, whose 0xC3 marker has
+// already been consumed.
+func (p *DumpParser) readCompressed() (string, error) {
+	clen, _, err := p.readLength()
 	if err != nil {
-		return err
-	}
-	if b != 0xFA {
-		p.reader.UnreadByte()
-		return fmt.Errorf("no metadata marker")
+		return "", err
 	}
-	key, err := p.readString()
+	ulen, _, err := p.readLength()
 	if err != nil {
-		return err
+		return "", err
 	}
-	val, err := p.readString()
-	if err != nil {
-		return err
+	if ulen < 0 {
+		return "", fmt.Errorf("invalid compressed length %d", ulen)
 	}
-	p.metadata[key] = val
-	return nil
-}
-
-// readDatabase reads one SELECTDB block and its entries.
-func (p *DumpParser) readDatabase() error {
-	b, err := p.reader.ReadByte()
+	buf, err := p.readBytes(clen)
 	if err != nil {
-		return err
-	}
-	if b != 0xFE {
-		p.reader.UnreadByte()
-		return fmt.Errorf("no DB marker")
+		return "", err
 	}
-	idx, _, err := p.readLength()
+	out, err := lzfDecompress(buf, ulen)
 	if err != nil {
-		return err
-	}
-	section := DatabaseSection{
-		ID:         idx,
-		KeyValues:  make(map[string]string),
-		TTLRecords: []TTLRecord{},
+		return "", err
 	}
-	p.Databases = append(p.Databases, section)
+	return string(out), nil
+}
 
-	// skip DB count flag
-	if _, err := p.reader.ReadByte(); err != nil {
-		return err
+// readBinaryDouble reads a little-endian IEEE 754 double.
+func (p *DumpParser) readBinaryDouble() (float64, error) {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(p.reader, buf); err != nil {
+		return 0, err
 	}
-	count, _, err := p.readLength()
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// readStringDouble reads a double written as text behind a one-byte length.
+// Lengths 253, 254 and 255 stand for NaN, +inf and -inf.
+func (p *DumpParser) readStringDouble() (float64, error) {
+	n, err := p.reader.ReadByte()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	ttlCount, _, err := p.readLength()
-	if err != nil {
-		return err
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
 	}
-	p.Databases[idx].TotalEntries = count
-	p.Databases[idx].TTL = uint64(ttlCount)
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(p.reader, buf); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
 
-	// load all key-value entries
+// Parse processes the entire RDB stream, collecting the keys in Databases.
+func (p *DumpParser) Parse() error {
+	return p.ParseEach(func(db int, e Entry) error {
+		section := p.section()
+		section.Entries = append(section.Entries, e)
+		return nil
+	})
+}
+
+// ParseEach processes the entire RDB stream, handing each key to fn as it
+// is read, along with its database, instead of keeping it, so that a dump
+// of any size is parsed in bounded memory. Databases still lists the
+// sections. Like Redis, it reads the dump as a sequence of opcodes and
+// keys, which may come in any order, and checks the checksum at the end
+// against everything before it. An error from fn stops it, and is returned
+// as is.
+func (p *DumpParser) ParseEach(fn func(db int, e Entry) error) error {
+	if err := p.readHeader(); err != nil {
+		return &ParseError{Offset: 0, Err: err}
+	}
+	var expireAt int64
 	for {
-		var expireAt uint64
-		hasTTL := false
-		b, err := p.reader.ReadByte()
-		if err != nil {
-			return err
-		}
-		if b == 0xFC {
-			hasTTL = true
-			buf := make([]byte, 8)
-			if _, err := io.ReadFull(p.reader, buf); err != nil {
-				return err
+		start := p.reader.offset()
+		fail := func(err error) error {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
 			}
-			expireAt = binary.LittleEndian.Uint64(buf)
-		} else {
-			p.reader.UnreadByte()
+			return &ParseError{Offset: start, Err: err}
 		}
-
-		kv, err := p.readKeyValue()
+		op, err := p.reader.ReadByte()
 		if err != nil {
-			if err.Error() == "not keyvalue" {
+			return fail(err)
+		}
+		switch op {
+		case opEOF:
+			if err := p.readChecksum(); err != nil {
+				return fail(err)
+			}
+			return nil
+		case opExpireMs:
+			expireAt, err = p.readMillis()
+		case opExpire:
+			var buf []byte
+			if buf, err = p.readBytes(4); err == nil {
+				expireAt = int64(binary.LittleEndian.Uint32(buf)) * 1000
+			}
+		case opFreq:
+			_, err = p.reader.ReadByte()
+		case opIdle:
+			_, _, err = p.readLength()
+		case opSelectDB:
+			var id int
+			if id, _, err = p.readLength(); err == nil {
+				p.Databases = append(p.Databases, DatabaseSection{ID: id})
+			}
+		case opResizeDB:
+			var size, expires int
+			if size, _, err = p.readLength(); err == nil {
+				expires, _, err = p.readLength()
+			}
+			db := p.section()
+			db.TotalEntries, db.TTL = size, uint64(expires)
+		case opSlotInfo:
+			// slot, keys in it and keys in it with deadlines
+			for range 3 {
+				if _, _, err = p.readLength(); err != nil {
+					break
+				}
+			}
+		case opAux:
+			var key, value string
+			if key, err = p.readString(); err == nil {
+				value, err = p.readString()
+			}
+			p.metadata[key] = value
+		case opModuleAux:
+			err = p.skipModuleAux()
+		case opFunction2:
+			var code string
+			if code, err = p.readString(); err == nil {
+				p.Functions = append(p.Functions, code)
+			}
+		case opFunctionPreGA:
+			err = fmt.Errorf("functions in the pre-GA format are not supported")
+		default:
+			var key string
+			if key, err = p.readString(); err != nil {
+				break
+			}
+			var v any
+			if v, err = p.readObject(op); err != nil {
+				err = fmt.Errorf("key %q: %w", key, err)
 				break
 			}
-			return err
+			e := Entry{Key: key, Value: v, ExpireAt: expireAt}
+			expireAt = 0
+			if err := fn(p.section().ID, e); err != nil {
+				return err
+			}
 		}
-		if hasTTL {
-			p.Databases[idx].TTLRecords = append(p.Databases[idx].TTLRecords, TTLRecord{kv[0], kv[1], expireAt})
-		} else {
-			p.Databases[idx].KeyValues[kv[0]] = kv[1]
+		if err != nil {
+			return fail(err)
 		}
 	}
-	return nil
 }
 
-// readKeyValue reads a single key-value pair (zero prefix).
-func (p *DumpParser) readKeyValue() ([]string, error) {
-	b, err := p.reader.ReadByte()
-	if err != nil {
-		return nil, err
-	}
-	if b != 0 {
-		p.reader.UnreadByte()
-		return nil, fmt.Errorf("not keyvalue")
-	}
-	key, err := p.readString()
-	if err != nil {
-		return nil, err
-	}
-	val, err := p.readString()
+// readHeader reads the magic string and the format version.
+func (p *DumpParser) readHeader() error {
+	head, err := p.readBytes(9)
 	if err != nil {
-		return nil, err
-	}
-	return []string{key, val}, nil
-}
-
-// Parse processes the entire RDB stream.
-func (p *DumpParser) Parse() error {
-	head := make([]byte, 9)
-	if _, err := io.ReadFull(p.reader, head); err != nil {
 		return err
 	}
 	if string(head[:5]) != "REDIS" {
@@ -229,29 +380,38 @@ func (p *DumpParser) Parse() error {
 	}
 	ver, err := strconv.Atoi(string(head[5:9]))
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid version %q", head[5:9])
+	}
+	if ver < 1 || ver > maxVersion {
+		return fmt.Errorf("can't handle RDB format version %d", ver)
 	}
 	p.version = ver
+	return nil
+}
 
-	// read all metadata blocks
-	for {
-		if err := p.readMetadata(); err != nil {
-			break
-		}
+// readChecksum reads the CRC64 that follows the end marker from version 5
+// on, and checks it against everything read so far. A checksum of 0 means
+// the dump was saved with checksums turned off.
+func (p *DumpParser) readChecksum() error {
+	if p.version < 5 {
+		return nil
 	}
-
-	// read all DB sections
-	for {
-		if err := p.readDatabase(); err != nil {
-			break
-		}
+	want := p.reader.checksum()
+	buf, err := p.readBytes(8)
+	if err != nil {
+		return fmt.Errorf("missing checksum: %w", err)
 	}
-
-	// expect closing marker 0xFF
-	if b, err := p.reader.ReadByte(); err != nil {
-		return err
-	} else if b != 0xFF {
-		return fmt.Errorf("unexpected end byte: %02x", b)
+	if got := binary.LittleEndian.Uint64(buf); got != 0 && got != want {
+		return fmt.Errorf("wrong checksum %016x, expected %016x", got, want)
 	}
 	return nil
 }
+
+// section returns the database keys are being read into. Keys ahead of
+// any SELECTDB go to database 0.
+func (p *DumpParser) section() *DatabaseSection {
+	if len(p.Databases) == 0 {
+		p.Databases = append(p.Databases, DatabaseSection{ID: 0})
+	}
+	return &p.Databases[len(p.Databases)-1]
+}
@@ -0,0 +1,489 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// parseFixture parses a dump from testdata.
+func parseFixture(t *testing.T, name string) *DumpParser {
+	t.Helper()
+	p, err := NewParser(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Parse(); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return p
+}
+
+// lookup finds a key in a parsed dump.
+func lookup(p *DumpParser, db int, key string) (Entry, bool) {
+	for _, section := range p.Databases {
+		if section.ID != db {
+			continue
+		}
+		for _, e := range section.Entries {
+			if e.Key == key {
+				return e, true
+			}
+		}
+	}
+	return Entry{}, false
+}
+
+func hashMap(h Hash) map[string]string {
+	m := make(map[string]string, len(h))
+	for _, f := range h {
+		m[f.Field] = f.Value
+	}
+	return m
+}
+
+// TestFixtures reads dumps saved by Redis itself, with the values
+// redis-rdb-tools checks them for.
+func TestFixtures(t *testing.T) {
+	for _, tc := range []struct {
+		file, key string
+		check     func(v any) bool
+	}{
+		{"easily_compressible_string_key.rdb", strings.Repeat("a", 200), func(v any) bool {
+			return v == "Key that redis should compress easily"
+		}},
+		{"integer_keys.rdb", "-183358245", func(v any) bool { return v == "Negative 32 bit integer" }},
+		{"integer_keys.rdb", "43947", func(v any) bool { return v == "Positive 16 bit integer" }},
+		{"integer_keys.rdb", "-123", func(v any) bool { return v == "Negative 8 bit integer" }},
+		{"zipmap_that_compresses_easily.rdb", "zipmap_compresses_easily", func(v any) bool {
+			return reflect.DeepEqual(hashMap(v.(Hash)), map[string]string{"a": "aa", "aa": "aaaa", "aaaaa": "aaaaaaaaaaaaaa"})
+		}},
+		{"zipmap_that_doesnt_compress.rdb", "zimap_doesnt_compress", func(v any) bool {
+			return reflect.DeepEqual(hashMap(v.(Hash)), map[string]string{"MKD1G6": "2", "YNNXK": "F7TI"})
+		}},
+		{"zipmap_with_big_values.rdb", "zipmap_with_big_values", func(v any) bool {
+			m := hashMap(v.(Hash))
+			return len(m["253bytes"]) == 253 && len(m["254bytes"]) == 254 && len(m["255bytes"]) == 255 &&
+				len(m["300bytes"]) == 300 && len(m["20kbytes"]) == 20000
+		}},
+		{"hash_as_ziplist.rdb", "zipmap_compresses_easily", func(v any) bool {
+			return reflect.DeepEqual(hashMap(v.(Hash)), map[string]string{"a": "aa", "aa": "aaaa", "aaaaa": "aaaaaaaaaaaaaa"})
+		}},
+		{"dictionary.rdb", "force_dictionary", func(v any) bool {
+			m := hashMap(v.(Hash))
+			return len(m) == 1000 &&
+				m["ZMU5WEJDG7KU89AOG5LJT6K7HMNB3DEI43M6EYTJ83VRJ6XNXQ"] == "T63SOS8DQJF0Q0VJEZ0D1IQFCYTIPSBOUIAI9SB0OV57MQR1FI" &&
+				m["UHS5ESW4HLK8XOGTM39IK1SJEUGVV9WOPK6JYA5QBZSJU84491"] == "6VULTCV52FXJ8MGVSFTZVAGK2JXZMGQ5F8OVJI0X6GEDDR27RZ"
+		}},
+		{"ziplist_that_compresses_easily.rdb", "ziplist_compresses_easily", func(v any) bool {
+			var want List
+			for _, n := range []int{6, 12, 18, 24, 30, 36} {
+				want = append(want, strings.Repeat("a", n))
+			}
+			return reflect.DeepEqual(v, want)
+		}},
+		{"ziplist_that_doesnt_compress.rdb", "ziplist_doesnt_compress", func(v any) bool {
+			return reflect.DeepEqual(v, List{"aj2410", "cc953a17a8e096e76a44169ad3f9ac87c5f8248a403274416179aa9fbd852344"})
+		}},
+		{"ziplist_with_integers.rdb", "ziplist_with_integers", func(v any) bool {
+			return reflect.DeepEqual(v, List{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12",
+				"-2", "13", "25", "-61", "63", "16380", "-16000", "65535", "-65523", "4194304", "9223372036854775807"})
+		}},
+		{"linkedlist.rdb", "force_linkedlist", func(v any) bool { return len(v.(List)) == 1000 }},
+		{"rdb_v7_list_quicklist.rdb", "foo", func(v any) bool { return reflect.DeepEqual(v, List{"bar", "baz", "boo"}) }},
+		{"intset_16.rdb", "intset_16", func(v any) bool { return reflect.DeepEqual(v, Set{"32764", "32765", "32766"}) }},
+		{"intset_32.rdb", "intset_32", func(v any) bool {
+			return reflect.DeepEqual(v, Set{"2147418108", "2147418109", "2147418110"})
+		}},
+		{"intset_64.rdb", "intset_64", func(v any) bool {
+			return reflect.DeepEqual(v, Set{"9223090557583032316", "9223090557583032317", "9223090557583032318"})
+		}},
+		{"regular_set.rdb", "regular_set", func(v any) bool {
+			return reflect.DeepEqual(v, Set{"beta", "delta", "alpha", "phi", "gamma", "kappa"})
+		}},
+		{"sorted_set_as_ziplist.rdb", "sorted_set_as_ziplist", func(v any) bool {
+			return reflect.DeepEqual(v, SortedSet{
+				{"8b6ba6718a786daefa69438148361901", 1},
+				{"cb7a24bb7528f934b841b34c3a73e0c7", 2.37},
+				{"523af537946b79c4f8369ed39ba78605", 3.423},
+			})
+		}},
+		{"regular_sorted_set.rdb", "force_sorted_set", func(v any) bool { return len(v.(SortedSet)) == 500 }},
+		{"rdb_version_5_with_checksum.rdb", "longerstring", func(v any) bool {
+			return v == "thisisalongerstring.idontknowwhatitmeans"
+		}},
+	} {
+		p := parseFixture(t, tc.file)
+		e, ok := lookup(p, 0, tc.key)
+		if !ok {
+			t.Errorf("%s: no key %q", tc.file, tc.key)
+			continue
+		}
+		if !tc.check(e.Value) {
+			t.Errorf("%s: %q holds %T %.200v", tc.file, tc.key, e.Value, e.Value)
+		}
+	}
+}
+
+func TestFixtureMetadata(t *testing.T) {
+	p := parseFixture(t, "empty_database.rdb")
+	if len(p.Databases) != 0 {
+		t.Errorf("an empty dump has databases %v", p.Databases)
+	}
+
+	p = parseFixture(t, "multiple_databases.rdb")
+	if len(p.Databases) != 2 || p.Databases[0].ID != 0 || p.Databases[1].ID != 2 {
+		t.Fatalf("SELECTDB gave databases %+v, want 0 and 2", p.Databases)
+	}
+	if e, ok := lookup(p, 2, "key_in_second_database"); !ok || e.Value != "second" {
+		t.Errorf("database 2 holds %+v", p.Databases[1].Entries)
+	}
+
+	// keys with lengths in each of the length encodings
+	p = parseFixture(t, "uncompressible_string_keys.rdb")
+	lengths := map[string]int{
+		"Key length within 6 bits":                          60,
+		"Key length more than 6 bits but less than 14 bits": 16382,
+		"Key length more than 14 bits but less than 32":     16386,
+	}
+	for _, e := range p.Databases[0].Entries {
+		if n, ok := lengths[e.Value.(string)]; !ok || len(e.Key) != n {
+			t.Errorf("%q has a key of %d bytes", e.Value, len(e.Key))
+		}
+		delete(lengths, e.Value.(string))
+	}
+	if len(lengths) != 0 {
+		t.Errorf("missing keys for %v", lengths)
+	}
+
+	// AUX fields and RESIZEDB
+	p = parseFixture(t, "rdb_v7_list_quicklist.rdb")
+	for k, want := range map[string]string{"redis-ver": "3.2.0", "redis-bits": "64", "ctime": "1465243651", "used-mem": "314648"} {
+		if got := p.metadata[k]; got != want {
+			t.Errorf("AUX %s = %q, want %q", k, got, want)
+		}
+	}
+	if db := p.Databases[0]; db.TotalEntries != 1 || db.TTL != 0 {
+		t.Errorf("RESIZEDB gave %d keys, %d with deadlines, want 1 and 0", db.TotalEntries, db.TTL)
+	}
+
+	// expiries in milliseconds, on some keys and not others
+	p = parseFixture(t, "keys_with_expiry.rdb")
+	if e, _ := lookup(p, 0, "expires_ms_precision"); e.ExpireAt != 1671963072573 {
+		t.Errorf("expires_ms_precision expires at %d, want 1671963072573", e.ExpireAt)
+	}
+	p = parseFixture(t, "keys_with_mixed_expiry.rdb")
+	for key, want := range map[string]int64{"key01": 2080245030932, "key02": 0, "key03": 0, "key04": 2080245034115} {
+		if e, _ := lookup(p, 0, key); e.ExpireAt != want {
+			t.Errorf("%s expires at %d, want %d", key, e.ExpireAt, want)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	dump, err := os.ReadFile(filepath.Join("testdata", "rdb_version_5_with_checksum.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func(b []byte) error {
+		p, _ := NewParserFromBytes(b)
+		return p.Parse()
+	}
+	if err := parse(dump); err != nil {
+		t.Fatal(err)
+	}
+
+	crcAt := int64(len(dump) - 9)
+	for _, tc := range []struct {
+		name   string
+		modify func(b []byte)
+		ok     bool
+	}{
+		{"a wrong checksum", func(b []byte) { b[len(b)-1] ^= 1 }, false},
+		{"a changed value", func(b []byte) { b[bytes.Index(b, []byte("efgh"))] = 'E' }, false},
+		// a dump saved with rdbchecksum no has a checksum of 0
+		{"a checksum of 0", func(b []byte) { clear(b[len(b)-8:]) }, true},
+	} {
+		b := bytes.Clone(dump)
+		tc.modify(b)
+		err := parse(b)
+		if tc.ok {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+			continue
+		}
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Offset != crcAt || !strings.Contains(err.Error(), "wrong checksum") {
+			t.Errorf("%s: got %v, want a wrong checksum at offset %d", tc.name, err, crcAt)
+		}
+	}
+}
+
+// rdbString encodes s with a 6 or 14-bit length.
+func rdbString(s string) []byte {
+	if len(s) < 1<<6 {
+		return append([]byte{byte(len(s))}, s...)
+	}
+	return append([]byte{0x40 | byte(len(s)>>8), byte(len(s))}, s...)
+}
+
+func millis(ms int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(ms))
+}
+
+// TestTruncated cuts a dump at every byte and checks that the error points
+// at the start of the item that was cut.
+func TestTruncated(t *testing.T) {
+	items := [][]byte{
+		[]byte("REDIS0011"),
+		append(append([]byte{opAux}, rdbString("redis-ver")...), rdbString("7.2.4")...),
+		{opSelectDB, 0},
+		{opResizeDB, 2, 2},
+		// an expiry in seconds, as Redis before 2.6 saved them
+		{opExpire, 0x00, 0xe1, 0xf5, 0x05},
+		append(append([]byte{TypeString}, rdbString("a")...), rdbString("1")...),
+		append([]byte{opExpireMs}, millis(1700000000123)...),
+		// "abcabcabc" compressed with LZF: a literal run of "abc", then a
+		// back reference to it of length 6
+		append(append([]byte{TypeString}, rdbString("b")...), 0xc3, 6, 9, 0x02, 'a', 'b', 'c', 0x80, 0x02),
+	}
+	var dump []byte
+	var starts []int64
+	for _, item := range items {
+		starts = append(starts, int64(len(dump)))
+		dump = append(dump, item...)
+	}
+	starts = append(starts, int64(len(dump)))
+	dump = append(dump, opEOF)
+	dump = binary.LittleEndian.AppendUint64(dump, CRC64(0, dump))
+
+	p, _ := NewParserFromBytes(dump)
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := lookup(p, 0, "a")
+	b, _ := lookup(p, 0, "b")
+	if a.Value != "1" || a.ExpireAt != 100000000*1000 || b.Value != "abcabcabc" || b.ExpireAt != 1700000000123 {
+		t.Fatalf("the dump holds %+v and %+v", a, b)
+	}
+	if db := p.Databases[0]; db.TotalEntries != 2 || db.TTL != 2 || p.metadata["redis-ver"] != "7.2.4" {
+		t.Errorf("RESIZEDB and AUX gave %+v and %v", db, p.metadata)
+	}
+
+	for n := range len(dump) {
+		want := int64(0)
+		if n >= len(items[0]) {
+			for _, s := range starts {
+				if s <= int64(n) {
+					want = s
+				}
+			}
+		}
+		p, _ := NewParserFromBytes(dump[:n])
+		err := p.Parse()
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Offset != want {
+			t.Fatalf("cut at %d: got %v, want an error at offset %d", n, err, want)
+		}
+	}
+}
+
+// listpack assembles a listpack the way listpack.c lays one out: the total
+// size and element count, each element as its encoding, data and the size
+// of both, then 0xFF. Integers go in the smallest integer encoding that
+// holds them, strings in the 6 or 12-bit string encodings.
+func listpack(elems ...any) []byte {
+	buf := []byte{0, 0, 0, 0, byte(len(elems)), byte(len(elems) >> 8)}
+	for _, e := range elems {
+		var enc []byte
+		switch e := e.(type) {
+		case int:
+			switch {
+			case e >= 0 && e < 128:
+				enc = []byte{byte(e)}
+			case e >= -4096 && e < 4096:
+				enc = []byte{0xc0 | byte(e>>8)&0x1f, byte(e)}
+			default:
+				enc = binary.LittleEndian.AppendUint64([]byte{0xf4}, uint64(e))
+			}
+		case string:
+			if len(e) < 64 {
+				enc = append([]byte{0x80 | byte(len(e))}, e...)
+			} else {
+				enc = append([]byte{0xe0 | byte(len(e)>>8), byte(len(e))}, e...)
+			}
+		}
+		buf = append(buf, enc...)
+		// the back length, here always under 16383 bytes
+		if len(enc) < 128 {
+			buf = append(buf, byte(len(enc)))
+		} else {
+			buf = append(buf, byte(len(enc)>>7), 0x80|byte(len(enc)&0x7f))
+		}
+	}
+	buf = append(buf, 0xff)
+	binary.LittleEndian.PutUint32(buf, uint32(len(buf)))
+	return buf
+}
+
+func streamID(ms, seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, ms), seq)
+}
+
+// TestRedis7Encodings reads values in the encodings Redis 7 saves small
+// values and streams in, and those Redis 7.4 added for field deadlines.
+func TestRedis7Encodings(t *testing.T) {
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	str := func(s string) []byte { return rdbString(s) }
+	const at = 1700000000000
+	keys := []struct {
+		typ   byte
+		key   string
+		value []byte
+		want  any
+	}{
+		{TypeSetListpack, "set", str(string(listpack("a", "b", "c"))), Set{"a", "b", "c"}},
+		{TypeZSetListpack, "zset", str(string(listpack("m1", 1, "m2", "2.5", "m3", -3000))),
+			SortedSet{{"m1", 1}, {"m2", 2.5}, {"m3", -3000}}},
+		{TypeHashListpack, "hash", str(string(listpack("f1", "v1", "f2", 12))),
+			Hash{{Field: "f1", Value: "v1"}, {Field: "f2", Value: "12"}}},
+		// two nodes: a listpack, and a plain node holding one big element
+		{TypeListQuicklist2, "list", cat([]byte{2},
+			[]byte{quicklistNodePacked}, str(string(listpack("a", 1))),
+			[]byte{quicklistNodePlain}, str(strings.Repeat("x", 100))),
+			List{"a", "1", strings.Repeat("x", 100)}},
+		// field, value and deadline triplets, 0 for none, behind the
+		// earliest deadline
+		{TypeHashListpackEx, "hashex", cat(millis(at+5000), str(string(listpack("f1", "v1", 0, "f2", "v2", at+5000)))),
+			Hash{{Field: "f1", Value: "v1"}, {Field: "f2", Value: "v2", ExpireAt: at + 5000}}},
+		// the earliest deadline, then each field's deadline relative to it
+		// plus one, 0 for none
+		{TypeHashMetadata, "hashmeta", cat(millis(at), []byte{3},
+			[]byte{0}, str("f1"), str("v1"),
+			[]byte{1}, str("f2"), str("v2"),
+			[]byte{0x40 | 5001>>8, 5001 & 0xff}, str("f3"), str("v3")),
+			Hash{{Field: "f1", Value: "v1"}, {Field: "f2", Value: "v2", ExpireAt: at}, {Field: "f3", Value: "v3", ExpireAt: at + 5000}}},
+	}
+
+	// a stream of one node with master ID 1-1 and entries 1-1 and 2-1,
+	// which have the master's fields and their own, and 3-1, deleted
+	node := listpack(
+		2, 1, 1, "f", 0, // live, deleted, master fields, terminator
+		streamItemSameFields, 0, 0, "v1", 4,
+		0, 1, 0, 2, "a", "x", "b", "y", 8,
+		streamItemSameFields|streamItemDeleted, 2, 0, "v3", 4,
+	)
+	stream := cat([]byte{1}, str(string(streamID(1, 1))), str(string(node)),
+		// the length, the last, first and max deleted IDs, entries added
+		[]byte{2}, []byte{3, 1}, []byte{1, 1}, []byte{3, 1}, []byte{3},
+		// group g with its last ID and entries read, its pending entry,
+		// delivered twice, and the consumer that has it
+		[]byte{1}, str("g"), []byte{2, 1}, []byte{2},
+		[]byte{1}, streamID(2, 1), millis(at), []byte{2},
+		[]byte{1}, str("alice"), millis(at+500), millis(at+400), []byte{1}, streamID(2, 1),
+	)
+
+	dump := []byte("REDIS0012")
+	dump = append(dump, opSelectDB, 0)
+	for _, k := range keys {
+		dump = cat(dump, []byte{k.typ}, str(k.key), k.value)
+	}
+	dump = cat(dump, []byte{TypeStreamListpacks3}, str("stream"), stream)
+	dump = append(dump, opEOF)
+	dump = binary.LittleEndian.AppendUint64(dump, CRC64(0, dump))
+
+	p, _ := NewParserFromBytes(dump)
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if e, _ := lookup(p, 0, k.key); !reflect.DeepEqual(e.Value, k.want) {
+			t.Errorf("%s (type %d) = %#v, want %#v", k.key, k.typ, e.Value, k.want)
+		}
+	}
+	want := &Stream{
+		Entries: []StreamEntry{
+			{ID: StreamID{1, 1}, Fields: []string{"f", "v1"}},
+			{ID: StreamID{2, 1}, Fields: []string{"a", "x", "b", "y"}},
+		},
+		Length: 2, LastID: StreamID{3, 1}, FirstID: StreamID{1, 1}, MaxDeletedID: StreamID{3, 1}, EntriesAdded: 3,
+		Groups: []StreamGroup{{
+			Name: "g", LastID: StreamID{2, 1}, EntriesRead: 2,
+			Pending:   []StreamPending{{ID: StreamID{2, 1}, DeliveryTime: at, DeliveryCount: 2}},
+			Consumers: []StreamConsumer{{Name: "alice", SeenTime: at + 500, ActiveTime: at + 400, Pending: []StreamID{{2, 1}}}},
+		}},
+	}
+	if e, _ := lookup(p, 0, "stream"); !reflect.DeepEqual(e.Value, want) {
+		t.Errorf("stream = %+v, want %+v", e.Value, want)
+	}
+}
+
+// TestWriterRoundTrip writes every value type and reads the dump back.
+func TestWriterRoundTrip(t *testing.T) {
+	values := map[string]any{
+		"string": "v",
+		"int":    "-12345",
+		"long":   strings.Repeat("long value ", 1000),
+		"list":   List{"a", "b", "a"},
+		"set":    Set{"x", "y"},
+		"zset":   SortedSet{{"a", -1.5}, {"b", 2}},
+		"hash":   Hash{{Field: "f", Value: "v"}},
+		"hashex": Hash{{Field: "f", Value: "v"}, {Field: "g", Value: "w", ExpireAt: 1700000000000}},
+	}
+	entries := make([]StreamEntry, 250)
+	for i := range entries {
+		entries[i] = StreamEntry{ID: StreamID{uint64(i + 1), 0}, Fields: []string{"n", strconv.Itoa(i)}}
+	}
+	entries[7].Fields = []string{"other", "fields", "n", "7"}
+	values["stream"] = &Stream{
+		Entries: entries, Length: 250, LastID: StreamID{300, 0}, FirstID: StreamID{1, 0},
+		MaxDeletedID: StreamID{299, 0}, EntriesAdded: 300,
+		Groups: []StreamGroup{{
+			Name: "g", LastID: StreamID{2, 0}, EntriesRead: 2,
+			Pending:   []StreamPending{{ID: StreamID{2, 0}, DeliveryTime: 5, DeliveryCount: 1}},
+			Consumers: []StreamConsumer{{Name: "c", SeenTime: 6, ActiveTime: 5, Pending: []StreamID{{2, 0}}}},
+		}},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteAux("redis-ver", "7.2.4")
+	w.SelectDB(3, len(values), 1)
+	for key, v := range values {
+		var expireAt int64
+		if key == "string" {
+			expireAt = 1700000000000
+		}
+		w.WriteEntry(key, v, expireAt)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := NewParserFromBytes(buf.Bytes())
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Offset() != int64(buf.Len()) {
+		t.Errorf("parsed %d bytes of %d", p.Offset(), buf.Len())
+	}
+	if db := p.Databases[0]; db.ID != 3 || db.TotalEntries != len(values) || db.TTL != 1 {
+		t.Errorf("the database section is %d with %d keys and %d deadlines", db.ID, db.TotalEntries, db.TTL)
+	}
+	for key, want := range values {
+		e, ok := lookup(p, 3, key)
+		if !ok || !reflect.DeepEqual(e.Value, want) {
+			t.Errorf("%s read back as %.200v", key, e.Value)
+		}
+	}
+	if e, _ := lookup(p, 3, "string"); e.ExpireAt != 1700000000000 {
+		t.Errorf("string expires at %d", e.ExpireAt)
+	}
+}
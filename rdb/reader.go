@@ -0,0 +1,102 @@
+package rdb
+
+import "io"
+
+// readerBufSize is the size of a reader's buffer. Only that much of the
+// input is ever held at once.
+const readerBufSize = 64 << 10
+
+// reader is a buffered reader that keeps track of how far into the input it
+// is, for error messages, and of the CRC64 of everything consumed, for the
+// checksum at the end of a dump.
+type reader struct {
+	rd   io.Reader
+	buf  []byte
+	r, w int
+	// off is the offset of buf[0] in the input, and crc covers the input
+	// up to buf[hashed].
+	off    int64
+	hashed int
+	crc    uint64
+	err    error
+}
+
+func newReader(rd io.Reader) *reader {
+	return &reader{rd: rd, buf: make([]byte, readerBufSize)}
+}
+
+// fill discards the consumed part of the buffer and reads more input. It
+// returns an error only if nothing could be read.
+func (r *reader) fill() error {
+	if r.err != nil {
+		return r.err
+	}
+	r.crc = CRC64(r.crc, r.buf[r.hashed:r.r])
+	r.off += int64(r.r)
+	r.w = copy(r.buf, r.buf[r.r:r.w])
+	r.r, r.hashed = 0, 0
+	for range 100 {
+		n, err := r.rd.Read(r.buf[r.w:])
+		r.w += n
+		if err != nil {
+			r.err = err
+		}
+		if n > 0 || err != nil {
+			break
+		}
+	}
+	if r.w == 0 && r.err == nil {
+		r.err = io.ErrNoProgress
+	}
+	if r.r < r.w {
+		return nil
+	}
+	return r.err
+}
+
+func (r *reader) ReadByte() (byte, error) {
+	if r.r == r.w {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	b := r.buf[r.r]
+	r.r++
+	return b, nil
+}
+
+// peekByte returns the next byte without consuming it.
+func (r *reader) peekByte() (byte, error) {
+	if r.r == r.w {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf[r.r], nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.r == r.w {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf[r.r:r.w])
+	r.r += n
+	return n, nil
+}
+
+// offset returns how many bytes have been consumed.
+func (r *reader) offset() int64 {
+	return r.off + int64(r.r)
+}
+
+// checksum returns the CRC64 of everything consumed.
+func (r *reader) checksum() uint64 {
+	r.crc = CRC64(r.crc, r.buf[r.hashed:r.r])
+	r.hashed = r.r
+	return r.crc
+}
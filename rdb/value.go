@@ -0,0 +1,129 @@
+package rdb
+
+// Object types, the byte that precedes each value in a dump. Several types
+// store the same kind of value in different encodings; the older ones are
+// still read, but only the plain ones are written.
+const (
+	TypeString           = 0
+	TypeList             = 1
+	TypeSet              = 2
+	TypeZSet             = 3
+	TypeHash             = 4
+	TypeZSet2            = 5
+	TypeModule           = 6
+	TypeModule2          = 7
+	TypeHashZipmap       = 9
+	TypeListZiplist      = 10
+	TypeSetIntset        = 11
+	TypeZSetZiplist      = 12
+	TypeHashZiplist      = 13
+	TypeListQuicklist    = 14
+	TypeStreamListpacks  = 15
+	TypeHashListpack     = 16
+	TypeZSetListpack     = 17
+	TypeListQuicklist2   = 18
+	TypeStreamListpacks2 = 19
+	TypeSetListpack      = 20
+	TypeStreamListpacks3 = 21
+	TypeHashMetadata     = 24
+	TypeHashListpackEx   = 25
+)
+
+// Opcodes, which take the place of an object type to introduce the parts
+// of a dump other than keys.
+const (
+	opSlotInfo      = 0xF4
+	opFunction2     = 0xF5
+	opFunctionPreGA = 0xF6
+	opModuleAux     = 0xF7
+	opIdle          = 0xF8
+	opFreq          = 0xF9
+	opAux           = 0xFA
+	opResizeDB      = 0xFB
+	opExpireMs      = 0xFC
+	opExpire        = 0xFD
+	opSelectDB      = 0xFE
+	opEOF           = 0xFF
+)
+
+// Version is the RDB format version written to dumps. Payloads that need a
+// newer type, such as hashes with field deadlines, say so themselves.
+const Version = 11
+
+// A value read from or written to a dump is a string or one of the types
+// below.
+
+// List is the value of a list key, head first.
+type List []string
+
+// Set is the value of a set key.
+type Set []string
+
+// Hash is the value of a hash key.
+type Hash []HashField
+
+// HashField is a field of a hash. ExpireAt is its deadline in unix
+// milliseconds, or 0 for none.
+type HashField struct {
+	Field, Value string
+	ExpireAt     int64
+}
+
+// SortedSet is the value of a sorted set key.
+type SortedSet []ScoredMember
+
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// StreamID is a stream entry ID.
+type StreamID struct {
+	Ms, Seq uint64
+}
+
+// Stream is the value of a stream key. Entries holds the live entries in
+// ID order; deleted ones are not kept.
+type Stream struct {
+	Entries      []StreamEntry
+	Length       uint64
+	LastID       StreamID
+	FirstID      StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+	Groups       []StreamGroup
+}
+
+// StreamEntry is an entry of a stream. Fields alternates field names and
+// values.
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string
+}
+
+// StreamGroup is a consumer group. EntriesRead is -1 when unknown.
+type StreamGroup struct {
+	Name        string
+	LastID      StreamID
+	EntriesRead int64
+	Pending     []StreamPending
+	Consumers   []StreamConsumer
+}
+
+// StreamPending is an entry of a group's pending entries list.
+// DeliveryTime is in unix milliseconds.
+type StreamPending struct {
+	ID            StreamID
+	DeliveryTime  int64
+	DeliveryCount uint64
+}
+
+// StreamConsumer is a consumer of a group. Pending lists the IDs of the
+// group's pending entries that belong to it. SeenTime and ActiveTime are in
+// unix milliseconds; ActiveTime is -1 if the consumer never got anything.
+type StreamConsumer struct {
+	Name       string
+	SeenTime   int64
+	ActiveTime int64
+	Pending    []StreamID
+}
@@ -0,0 +1,82 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Writer writes a dump file: the header, AUX fields, then each database's
+// keys, and finally the end marker and a CRC64 of everything before it.
+// The first error sticks, and is returned by every later call.
+type Writer struct {
+	w   *bufio.Writer
+	crc uint64
+	buf []byte
+	err error
+}
+
+// NewWriter starts a dump on w with the header for Version.
+func NewWriter(w io.Writer) *Writer {
+	wr := &Writer{w: bufio.NewWriter(w)}
+	wr.write(fmt.Appendf(nil, "REDIS%04d", Version))
+	return wr
+}
+
+func (w *Writer) write(p []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.crc = CRC64(w.crc, p)
+	_, w.err = w.w.Write(p)
+	return w.err
+}
+
+// WriteAux writes an AUX field, such as redis-ver or ctime.
+func (w *Writer) WriteAux(key, value string) error {
+	w.buf = append(w.buf[:0], opAux)
+	w.buf = appendString(w.buf, key)
+	w.buf = appendString(w.buf, value)
+	return w.write(w.buf)
+}
+
+// SelectDB starts the keys of database id, which has size keys, expires of
+// them with a deadline.
+func (w *Writer) SelectDB(id, size, expires int) error {
+	w.buf = append(w.buf[:0], opSelectDB)
+	w.buf = appendLength(w.buf, uint64(id))
+	w.buf = append(w.buf, opResizeDB)
+	w.buf = appendLength(w.buf, uint64(size))
+	w.buf = appendLength(w.buf, uint64(expires))
+	return w.write(w.buf)
+}
+
+// WriteEntry writes a key of the current database. value is one of the
+// value types, and expireAt the key's deadline in unix milliseconds, or 0
+// for none.
+func (w *Writer) WriteEntry(key string, value any, expireAt int64) error {
+	w.buf = w.buf[:0]
+	if expireAt != 0 {
+		w.buf = append(w.buf, opExpireMs)
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, uint64(expireAt))
+	}
+	w.buf = append(w.buf, ObjectType(value))
+	w.buf = appendString(w.buf, key)
+	w.buf = AppendValue(w.buf, value)
+	return w.write(w.buf)
+}
+
+// Close ends the dump and flushes it. It does not close the underlying
+// writer.
+func (w *Writer) Close() error {
+	if err := w.write([]byte{opEOF}); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(binary.LittleEndian.AppendUint64(nil, w.crc)); err != nil {
+		w.err = err
+		return err
+	}
+	w.err = w.w.Flush()
+	return w.err
+}
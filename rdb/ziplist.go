@@ -0,0 +1,168 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// parseZiplist decodes a ziplist, the compact encoding Redis used before
+// listpacks, into its elements. After a header with the total size, the
+// offset of the last entry and the entry count, every entry is the length
+// of the previous one, an encoding byte saying whether a string length or
+// an integer follows, and the data.
+func parseZiplist(buf []byte) ([]string, error) {
+	if len(buf) < 11 {
+		return nil, fmt.Errorf("ziplist: too short (%d bytes)", len(buf))
+	}
+	if total := binary.LittleEndian.Uint32(buf); int(total) != len(buf) {
+		return nil, fmt.Errorf("ziplist: header says %d bytes, have %d", total, len(buf))
+	}
+	var elems []string
+	pos := 10
+	for {
+		if pos >= len(buf) {
+			return nil, fmt.Errorf("ziplist: missing terminator")
+		}
+		if buf[pos] == 0xFF {
+			return elems, nil
+		}
+		// the previous entry's length takes 1 byte, or 5 from 254 up
+		if buf[pos] == 0xFE {
+			pos += 5
+		} else {
+			pos++
+		}
+		elem, size, err := ziplistEntry(buf[min(pos, len(buf)):])
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+		pos += size
+	}
+}
+
+// ziplistEntry decodes the entry, less its previous entry length, at the
+// start of b, and returns it along with the size of its encoding and data.
+func ziplistEntry(b []byte) (string, int, error) {
+	need := func(n int) error {
+		if len(b) < n {
+			return fmt.Errorf("ziplist: truncated entry")
+		}
+		return nil
+	}
+	if err := need(1); err != nil {
+		return "", 0, err
+	}
+	c := b[0]
+	var n, hdr int
+	switch c >> 6 {
+	case 0: // 6-bit string length
+		n, hdr = int(c&0x3F), 1
+	case 1: // 14-bit string length, big endian
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		n, hdr = int(c&0x3F)<<8|int(b[1]), 2
+	case 2: // 32-bit string length, big endian
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		n, hdr = int(binary.BigEndian.Uint32(b[1:])), 5
+	}
+	if c>>6 != 3 {
+		if n < 0 || need(hdr+n) != nil {
+			return "", 0, fmt.Errorf("ziplist: truncated entry")
+		}
+		return string(b[hdr : hdr+n]), hdr + n, nil
+	}
+
+	var v int64
+	switch {
+	case c == 0xC0: // int16
+		n = 2
+	case c == 0xD0: // int32
+		n = 4
+	case c == 0xE0: // int64
+		n = 8
+	case c == 0xF0: // int24
+		n = 3
+	case c == 0xFE: // int8
+		n = 1
+	case c >= 0xF1 && c <= 0xFD: // 4-bit immediate, 0 to 12
+		return strconv.Itoa(int(c&0x0F) - 1), 1, nil
+	default:
+		return "", 0, fmt.Errorf("ziplist: unknown encoding %#02x", c)
+	}
+	if err := need(1 + n); err != nil {
+		return "", 0, err
+	}
+	d := b[1 : 1+n]
+	switch n {
+	case 1:
+		v = int64(int8(d[0]))
+	case 2:
+		v = int64(int16(binary.LittleEndian.Uint16(d)))
+	case 3:
+		v = int64(int32(uint32(d[0])<<8|uint32(d[1])<<16|uint32(d[2])<<24) >> 8)
+	case 4:
+		v = int64(int32(binary.LittleEndian.Uint32(d)))
+	case 8:
+		v = int64(binary.LittleEndian.Uint64(d))
+	}
+	return strconv.FormatInt(v, 10), 1 + n, nil
+}
+
+// parseZipmap decodes a zipmap, the encoding of small hashes before Redis
+// 2.6, into alternating fields and values. After a one-byte count, every
+// field is its length and data, and every value its length, a count of
+// unused bytes, its data and those unused bytes. Lengths take a byte, or
+// 254 and four more bytes, little endian.
+func parseZipmap(buf []byte) ([]string, error) {
+	pos := 1
+	length := func() (int, error) {
+		if pos >= len(buf) {
+			return 0, fmt.Errorf("zipmap: truncated")
+		}
+		b := buf[pos]
+		pos++
+		if b < 254 {
+			return int(b), nil
+		}
+		if b == 255 || pos+4 > len(buf) {
+			return 0, fmt.Errorf("zipmap: bad length")
+		}
+		n := int(binary.LittleEndian.Uint32(buf[pos:]))
+		pos += 4
+		return n, nil
+	}
+	var elems []string
+	for {
+		if pos >= len(buf) {
+			return nil, fmt.Errorf("zipmap: missing terminator")
+		}
+		if buf[pos] == 0xFF {
+			if len(elems)%2 != 0 {
+				return nil, fmt.Errorf("zipmap: field without a value")
+			}
+			return elems, nil
+		}
+		n, err := length()
+		if err != nil {
+			return nil, err
+		}
+		free := 0
+		if len(elems)%2 == 1 {
+			if pos >= len(buf) {
+				return nil, fmt.Errorf("zipmap: truncated")
+			}
+			free = int(buf[pos])
+			pos++
+		}
+		if n < 0 || pos+n+free > len(buf) {
+			return nil, fmt.Errorf("zipmap: truncated")
+		}
+		elems = append(elems, string(buf[pos:pos+n]))
+		pos += n + free
+	}
+}
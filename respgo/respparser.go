@@ -65,6 +65,29 @@ func (p *RespParser) ParseBulk() ([]byte, error) {
 	return buf[:n], nil
 }
 
+// ParseBulkStream reads the header of a bulk string, "$" included, and
+// returns a reader for its body rather than the body itself, for payloads
+// too large to hold in memory, such as the dump a master sends a replica.
+// Such a payload has no CRLF after it. The body must be read to the end
+// before anything else is parsed.
+func (p *RespParser) ParseBulkStream() (io.Reader, error) {
+	prefix, err := p.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if prefix != '$' {
+		return nil, fmt.Errorf("expected bulk string, got %q", prefix)
+	}
+	n, err := p.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("invalid bulk length %d", n)
+	}
+	return io.LimitReader(p.r, int64(n)), nil
+}
+
 func (p *RespParser) ParseArray() ([]string, error) {
 	countLine, err := p.readLine()
 	if err != nil {
@@ -137,3 +160,11 @@ func EncodeArray(items []string) []byte {
 func EncodeInteger(n int) []byte {
 	return []byte(fmt.Sprintf(":%d\r\n", n))
 }
+
+func EncodeSimpleString(s string) []byte {
+	return []byte("+" + s + "\r\n")
+}
+
+func EncodeError(msg string) []byte {
+	return []byte("-" + msg + "\r\n")
+}
@@ -0,0 +1,697 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddarthpai/wardrobe/rdb"
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// The append only file is laid out the way Redis 7 lays it out: a
+// directory holding a base file, a dump taken by the last rewrite, and
+// incremental files with the commands run since, which a manifest lists in
+// the order they are replayed. A rewrite switches to a new incremental file
+// as it starts, so commands run while it is under way need no catching up:
+// once the new base is written, it and the incremental files opened since
+// replace everything else.
+
+// Manifest entry types: the base file, the incremental files, and files
+// a rewrite has replaced that are yet to be deleted.
+const (
+	aofBase    = 'b'
+	aofIncr    = 'i'
+	aofHistory = 'h'
+)
+
+// aofRewriteRetryDelay is how long after a failed rewrite that was meant
+// to turn the AOF on the next attempt waits.
+const aofRewriteRetryDelay = 5 * time.Second
+
+// aofFile is one file listed in the manifest.
+type aofFile struct {
+	name string
+	seq  int64
+	kind byte
+}
+
+// aofManifest lists the files the AOF is made of. baseSeq and incrSeq are
+// the highest sequence numbers given to a base and an incremental file,
+// which new ones follow on from.
+type aofManifest struct {
+	base    *aofFile
+	incrs   []aofFile
+	history []aofFile
+	baseSeq int64
+	incrSeq int64
+}
+
+// parseManifest parses a manifest, one file a line, each line a list of
+// key-value pairs naming the file, its sequence number and its type. Keys
+// it does not know are ignored.
+func parseManifest(data []byte) (*aofManifest, error) {
+	m := &aofManifest{}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid manifest line %d", n+1)
+		}
+		var f aofFile
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				f.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil || seq < 1 {
+					return nil, fmt.Errorf("invalid sequence number on manifest line %d", n+1)
+				}
+				f.seq = seq
+			case "type":
+				if len(fields[i+1]) != 1 {
+					return nil, fmt.Errorf("invalid file type on manifest line %d", n+1)
+				}
+				f.kind = fields[i+1][0]
+			}
+		}
+		if f.name == "" || f.seq == 0 || strings.ContainsRune(f.name, '/') {
+			return nil, fmt.Errorf("invalid manifest line %d", n+1)
+		}
+		switch f.kind {
+		case aofBase:
+			if m.base != nil {
+				return nil, fmt.Errorf("more than one base file in the manifest")
+			}
+			m.base, m.baseSeq = &f, f.seq
+		case aofIncr:
+			if f.seq <= m.incrSeq {
+				return nil, fmt.Errorf("incremental files out of order in the manifest")
+			}
+			m.incrs, m.incrSeq = append(m.incrs, f), f.seq
+		case aofHistory:
+			m.history = append(m.history, f)
+		default:
+			return nil, fmt.Errorf("unknown file type on manifest line %d", n+1)
+		}
+	}
+	return m, nil
+}
+
+func (m *aofManifest) String() string {
+	var sb strings.Builder
+	write := func(f aofFile) {
+		fmt.Fprintf(&sb, "file %s seq %d type %c\n", f.name, f.seq, f.kind)
+	}
+	if m.base != nil {
+		write(*m.base)
+	}
+	for _, f := range m.history {
+		write(f)
+	}
+	for _, f := range m.incrs {
+		write(f)
+	}
+	return sb.String()
+}
+
+// appendOnly is the state of the AOF. The settings come first; file and
+// the fields after it are only in use while the AOF is on.
+type appendOnly struct {
+	enabled        bool
+	fsync          string
+	loadTruncated  bool
+	dirname        string
+	filename       string
+	rewritePerc    int
+	rewriteMinSize int64
+
+	// file is the incremental file commands are appended to, and manifest
+	// lists it and the rest. buf holds what is yet to be written, and
+	// selectedDB is the database the file last told its reader to SELECT,
+	// or -1.
+	file       *os.File
+	manifest   *aofManifest
+	buf        []byte
+	selectedDB int
+	needsFsync bool
+	// waitRewrite is set while the AOF is being turned on, until a rewrite
+	// has written its first base. Until then the manifest on disk is not
+	// touched.
+	waitRewrite bool
+	// size is how large the AOF is, and baseSize how large it was after
+	// the last rewrite, which the automatic rewrite measures growth from.
+	size     int64
+	baseSize int64
+
+	rewriteInProgress bool
+	rewriteScheduled  bool
+	lastRewriteOK     bool
+	lastRewriteTry    time.Time
+}
+
+func newAppendOnly() appendOnly {
+	return appendOnly{
+		fsync:          "everysec",
+		loadTruncated:  true,
+		dirname:        "appendonlydir",
+		filename:       "appendonly.aof",
+		rewritePerc:    100,
+		rewriteMinSize: 64 << 20,
+		selectedDB:     -1,
+		lastRewriteOK:  true,
+	}
+}
+
+// on reports whether commands are being appended to the AOF, or will be
+// once it has been turned on.
+func (aof *appendOnly) on() bool {
+	return aof.file != nil || aof.waitRewrite
+}
+
+// aofDir returns the directory the AOF files go in. The caller must hold
+// kv.mu.
+func (kv *KVStore) aofDir() string {
+	return filepath.Join(kv.dir, kv.aof.dirname)
+}
+
+func (kv *KVStore) aofManifestPath() string {
+	return filepath.Join(kv.aofDir(), kv.aof.filename+".manifest")
+}
+
+// readManifest reads the manifest on disk. The caller must hold kv.mu.
+func (kv *KVStore) readManifest() (*aofManifest, error) {
+	data, err := os.ReadFile(kv.aofManifestPath())
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data)
+}
+
+// currentManifest returns the manifest of the AOF being appended to, or
+// else the one on disk, or else an empty one. The caller must hold kv.mu.
+func (kv *KVStore) currentManifest() *aofManifest {
+	if kv.aof.manifest != nil {
+		return kv.aof.manifest
+	}
+	if m, err := kv.readManifest(); err == nil {
+		return m
+	}
+	return &aofManifest{}
+}
+
+// writeManifest replaces the manifest on disk with m, by way of a
+// temporary file, so that it is always either the old one or the new one.
+// The caller must hold kv.mu.
+func (kv *KVStore) writeManifest(m *aofManifest) error {
+	dir := kv.aofDir()
+	f, err := os.CreateTemp(dir, fmt.Sprintf("temp-%d-*.manifest", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(m.String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), kv.aofManifestPath()); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir flushes a directory, so that files renamed into it stay there
+// after a crash. Errors are ignored, as not every system allows it.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// openIncrFile creates the next incremental file listed after those in m.
+// The caller must hold kv.mu.
+func (kv *KVStore) openIncrFile(m *aofManifest) (*os.File, aofFile, error) {
+	incr := aofFile{seq: m.incrSeq + 1, kind: aofIncr}
+	incr.name = fmt.Sprintf("%s.%d.incr.aof", kv.aof.filename, incr.seq)
+	f, err := os.OpenFile(filepath.Join(kv.aofDir(), incr.name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	return f, incr, err
+}
+
+// feedAppendOnlyFile adds a command run against database db to the AOF
+// buffer, along with a SELECT if the file last selected another database.
+// The caller must hold kv.mu.
+func (kv *KVStore) feedAppendOnlyFile(db int, args []string) {
+	if kv.aof.file == nil {
+		return
+	}
+	if kv.aof.selectedDB != db {
+		kv.aof.buf = append(kv.aof.buf, respgo.EncodeArray([]string{"SELECT", strconv.Itoa(db)})...)
+		kv.aof.selectedDB = db
+	}
+	kv.aof.buf = append(kv.aof.buf, respgo.EncodeArray(args)...)
+}
+
+// flushAppendOnlyFile writes the AOF buffer out. It is called before the
+// replies to the commands in it are sent, so with appendfsync always a
+// client never hears of a write that would not survive a crash. The
+// caller must hold kv.mu.
+func (kv *KVStore) flushAppendOnlyFile() {
+	if kv.aof.file == nil || len(kv.aof.buf) == 0 {
+		return
+	}
+	n, err := kv.aof.file.Write(kv.aof.buf)
+	kv.aof.size += int64(n)
+	kv.aof.buf = kv.aof.buf[n:]
+	if err != nil {
+		log.Println("error writing to the AOF:", err)
+		return
+	}
+	kv.aof.buf = kv.aof.buf[:0]
+	switch kv.aof.fsync {
+	case "always":
+		if err := kv.aof.file.Sync(); err != nil {
+			log.Println("error syncing the AOF:", err)
+		}
+	case "everysec":
+		kv.aof.needsFsync = true
+	}
+}
+
+// appendOnlyCron syncs the AOF under appendfsync everysec, retries turning
+// it on after a failed rewrite, and starts a rewrite once the AOF has
+// grown by auto-aof-rewrite-percentage since the last one. The caller must
+// hold kv.mu.
+func (kv *KVStore) appendOnlyCron() {
+	kv.flushAppendOnlyFile()
+	if kv.aof.needsFsync {
+		kv.aof.needsFsync = false
+		// syncing can take a while, and need not hold up commands; a file
+		// closed by a rewrite meanwhile was synced when it was closed
+		f := kv.aof.file
+		go f.Sync()
+	}
+	if kv.aof.rewriteInProgress {
+		return
+	}
+	if kv.aof.waitRewrite && time.Since(kv.aof.lastRewriteTry) >= aofRewriteRetryDelay {
+		kv.rewriteAppendOnlyFileBackground()
+		return
+	}
+	if kv.aof.file == nil || kv.aof.rewritePerc == 0 || kv.aof.size < kv.aof.rewriteMinSize {
+		return
+	}
+	base := max(kv.aof.baseSize, 1)
+	if growth := (kv.aof.size - base) * 100 / base; growth >= int64(kv.aof.rewritePerc) {
+		log.Printf("Starting automatic rewriting of AOF on %d%% growth", growth)
+		kv.rewriteAppendOnlyFileBackground()
+	}
+}
+
+// startAppendOnly turns the AOF on. Commands are appended from now on, but
+// the AOF only takes over from the one on disk, if any, once a rewrite has
+// written a base with the dataset in it. The caller must hold kv.mu.
+func (kv *KVStore) startAppendOnly() error {
+	kv.aof.waitRewrite = true
+	if kv.aof.rewriteInProgress {
+		kv.aof.rewriteScheduled = true
+		return nil
+	}
+	if err := kv.rewriteAppendOnlyFileBackground(); err != nil {
+		kv.aof.waitRewrite = false
+		return err
+	}
+	return nil
+}
+
+// stopAppendOnly turns the AOF off, leaving the files as they are. The
+// caller must hold kv.mu.
+func (kv *KVStore) stopAppendOnly() {
+	if kv.aof.file != nil {
+		kv.flushAppendOnlyFile()
+		kv.aof.file.Sync()
+		kv.aof.file.Close()
+	}
+	kv.aof.file = nil
+	kv.aof.manifest = nil
+	kv.aof.buf = kv.aof.buf[:0]
+	kv.aof.needsFsync = false
+	kv.aof.waitRewrite = false
+	kv.aof.rewriteScheduled = false
+}
+
+var errAOFRewriteInProgress = errors.New("background append only file rewriting already in progress")
+
+// rewriteAppendOnlyFileBackground starts rewriting the AOF while commands
+// keep running. Commands are appended to a new incremental file from here
+// on, and the dataset as it is now becomes the new base, written as a dump.
+// Once it is, the manifest is updated and the files it replaces deleted.
+// The caller must hold kv.mu.
+func (kv *KVStore) rewriteAppendOnlyFileBackground() error {
+	if kv.aof.rewriteInProgress {
+		return errAOFRewriteInProgress
+	}
+	kv.aof.lastRewriteTry = time.Now()
+	dir := kv.aofDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Println("error creating the AOF directory:", err)
+		return err
+	}
+	m := kv.currentManifest()
+	firstIncr := m.incrSeq + 1
+	sizeAtStart := kv.aof.size
+	if kv.aof.on() {
+		f, incr, err := kv.openIncrFile(m)
+		if err != nil {
+			log.Println("error opening a new AOF file:", err)
+			return err
+		}
+		next := *m
+		next.incrs = append(m.incrs[:len(m.incrs):len(m.incrs)], incr)
+		next.incrSeq = incr.seq
+		// while the AOF is being turned on the one on disk is stale, and
+		// must not be extended
+		if !kv.aof.waitRewrite {
+			if err := kv.writeManifest(&next); err != nil {
+				log.Println("error writing the AOF manifest:", err)
+				f.Close()
+				os.Remove(f.Name())
+				return err
+			}
+		}
+		if kv.aof.file != nil {
+			kv.flushAppendOnlyFile()
+			kv.aof.file.Sync()
+			kv.aof.file.Close()
+		}
+		kv.aof.file, kv.aof.manifest = f, &next
+		kv.aof.selectedDB = -1
+	}
+
+	snap := kv.takeSnapshot()
+	snap.aofBase = true
+	base := aofFile{seq: m.baseSeq + 1, kind: aofBase}
+	base.name = fmt.Sprintf("%s.%d.base.rdb", kv.aof.filename, base.seq)
+	basePath := filepath.Join(dir, base.name)
+	kv.aof.rewriteInProgress = true
+	go func() {
+		err := kv.saveSnapshot(snap, basePath, &kv.mu)
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		kv.aof.rewriteInProgress = false
+		if err == nil {
+			err = kv.finishRewrite(base, firstIncr, sizeAtStart)
+		}
+		kv.aof.lastRewriteOK = err == nil
+		if err != nil {
+			log.Println("error rewriting the AOF:", err)
+			os.Remove(basePath)
+		} else {
+			log.Println("Background AOF rewrite finished successfully")
+		}
+		if kv.aof.rewriteScheduled {
+			kv.aof.rewriteScheduled = false
+			kv.rewriteAppendOnlyFileBackground()
+		}
+	}()
+	return nil
+}
+
+// finishRewrite makes base, along with the incremental files from
+// firstIncr on, the AOF, and deletes the files they replace. sizeAtStart
+// is how large the AOF was when the rewrite started. The caller must hold
+// kv.mu.
+func (kv *KVStore) finishRewrite(base aofFile, firstIncr, sizeAtStart int64) error {
+	dir := kv.aofDir()
+	info, err := os.Stat(filepath.Join(dir, base.name))
+	if err != nil {
+		return err
+	}
+	m := kv.currentManifest()
+	next := &aofManifest{base: &base, baseSeq: base.seq, incrSeq: m.incrSeq}
+	stale := m.history
+	if m.base != nil {
+		stale = append(stale, *m.base)
+	}
+	for _, f := range m.incrs {
+		if f.seq >= firstIncr {
+			next.incrs = append(next.incrs, f)
+		} else {
+			stale = append(stale, f)
+		}
+	}
+	if err := kv.writeManifest(next); err != nil {
+		return err
+	}
+	for _, f := range stale {
+		if f.name != base.name {
+			os.Remove(filepath.Join(dir, f.name))
+		}
+	}
+	// if the AOF was turned on only after the rewrite started, its
+	// commands are in none of these files, and it waits for the next one
+	if kv.aof.file != nil {
+		kv.aof.manifest = next
+		kv.aof.waitRewrite = false
+		kv.aof.baseSize = info.Size()
+		kv.aof.size = info.Size() + kv.aof.size - sizeAtStart
+	}
+	return nil
+}
+
+// LoadAppendOnlyFile replays the AOF, if appendonly is on, and keeps
+// appending to it from there. With no AOF on disk, one is started from the
+// dataset as it is; a single file AOF from before Redis 7 is moved into
+// the AOF directory as the base of a new one.
+func (kv *KVStore) LoadAppendOnlyFile() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if !kv.aof.enabled {
+		return nil
+	}
+	m, err := kv.readManifest()
+	if errors.Is(err, fs.ErrNotExist) {
+		legacy := filepath.Join(kv.dir, kv.aof.filename)
+		if _, err := os.Stat(legacy); err != nil {
+			return kv.startAppendOnly()
+		}
+		if err := os.MkdirAll(kv.aofDir(), 0755); err != nil {
+			return err
+		}
+		m = &aofManifest{base: &aofFile{name: kv.aof.filename, seq: 1, kind: aofBase}, baseSeq: 1}
+		if err := os.Rename(legacy, filepath.Join(kv.aofDir(), m.base.name)); err != nil {
+			return err
+		}
+		if err := kv.writeManifest(m); err != nil {
+			return err
+		}
+		log.Printf("Upgraded %s to the multi part AOF in %s", legacy, kv.aofDir())
+	} else if err != nil {
+		return fmt.Errorf("reading the AOF manifest: %w", err)
+	}
+
+	files := m.incrs
+	if m.base != nil {
+		files = append([]aofFile{*m.base}, files...)
+	}
+	for _, db := range kv.dbs {
+		db.clear()
+	}
+	for i, f := range files {
+		if err := kv.replayAppendOnlyFile(filepath.Join(kv.aofDir(), f.name), i == len(files)-1); err != nil {
+			return err
+		}
+	}
+	kv.dirtyAtSave = kv.dirty
+	return kv.openAppendOnly(m)
+}
+
+// openAppendOnly turns the AOF on with the files in m, which hold the
+// dataset already, appending to the last incremental file. The caller
+// must hold kv.mu.
+func (kv *KVStore) openAppendOnly(m *aofManifest) error {
+	dir := kv.aofDir()
+	var f *os.File
+	var err error
+	if len(m.incrs) == 0 {
+		var incr aofFile
+		if f, incr, err = kv.openIncrFile(m); err != nil {
+			return err
+		}
+		m.incrs, m.incrSeq = append(m.incrs, incr), incr.seq
+		if err := kv.writeManifest(m); err != nil {
+			f.Close()
+			return err
+		}
+	} else {
+		last := m.incrs[len(m.incrs)-1]
+		if f, err = os.OpenFile(filepath.Join(dir, last.name), os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+	}
+	files := m.incrs
+	if m.base != nil {
+		files = append(files[:len(files):len(files)], *m.base)
+	}
+	var size int64
+	for _, file := range files {
+		if info, err := os.Stat(filepath.Join(dir, file.name)); err == nil {
+			size += info.Size()
+		}
+	}
+	kv.aof.file, kv.aof.manifest = f, m
+	kv.aof.selectedDB = -1
+	kv.aof.size, kv.aof.baseSize = size, size
+	return nil
+}
+
+// replayAppendOnlyFile runs the commands in one of the AOF files, after
+// loading the dump it starts with, if it does. A transaction is only run
+// once its EXEC has been read. If the last file ends partway through a
+// command or a transaction, it is cut back to the end of the last complete
+// one when aof-load-truncated is on. The caller must hold kv.mu.
+func (kv *KVStore) replayAppendOnlyFile(path string, last bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening the append only file %s: %w", path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var valid int64
+	head := make([]byte, 5)
+	if n, _ := io.ReadFull(f, head); string(head[:n]) == "REDIS" {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		dump := rdb.NewParserFromReader(f)
+		if err := kv.readDump(dump); err != nil {
+			return fmt.Errorf("loading the dump at the start of %s: %w", path, err)
+		}
+		valid = dump.Offset()
+	}
+	// the dump parser reads ahead, so the commands are read from where the
+	// dump ended rather than from where it left the file
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		return err
+	}
+
+	parser := respgo.NewParser(f)
+	conn := &Connection{}
+	var multi [][]string
+	var multiStart int64
+	truncated := false
+	for valid < info.Size() {
+		msg, err := parser.ParseMessage()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			truncated = true
+			break
+		}
+		args, ok := msg.([]string)
+		if err != nil || !ok || len(args) == 0 {
+			return fmt.Errorf("bad file format reading the append only file %s at offset %d", path, valid)
+		}
+		start := valid
+		valid += int64(len(respgo.EncodeArray(args)))
+
+		switch strings.ToUpper(args[0]) {
+		case "MULTI":
+			multi, multiStart = [][]string{}, start
+		case "EXEC":
+			for _, queued := range multi {
+				if err := kv.replayCommand(queued, conn, path); err != nil {
+					return err
+				}
+			}
+			multi = nil
+		default:
+			if multi != nil {
+				multi = append(multi, args)
+			} else if err := kv.replayCommand(args, conn, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !truncated && multi == nil {
+		return nil
+	}
+	if !last || !kv.aof.loadTruncated {
+		return fmt.Errorf("unexpected end of file reading the append only file %s; "+
+			"set aof-load-truncated to yes to load what precedes it", path)
+	}
+	if multi != nil {
+		valid = multiStart
+	}
+	log.Printf("AOF %s ends with an incomplete command, truncating it to %d bytes", path, valid)
+	return os.Truncate(path, valid)
+}
+
+// replayCommand runs a command read from the AOF at path. The caller must
+// hold kv.mu.
+func (kv *KVStore) replayCommand(args []string, conn *Connection, path string) error {
+	reply := kv.call(args, conn)
+	kv.pending = kv.pending[:0]
+	if strings.HasPrefix(string(reply), "-ERR unknown command") {
+		return fmt.Errorf("unknown command '%s' reading the append only file %s", args[0], path)
+	}
+	return nil
+}
+
+// aofInfo writes the AOF fields of INFO's persistence section. The caller
+// must hold kv.mu.
+func (kv *KVStore) aofInfo(sb *strings.Builder) {
+	flag := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	status := "ok"
+	if !kv.aof.lastRewriteOK {
+		status = "err"
+	}
+	fmt.Fprintf(sb, "aof_enabled:%d\r\n", flag(kv.aof.on()))
+	fmt.Fprintf(sb, "aof_rewrite_in_progress:%d\r\n", flag(kv.aof.rewriteInProgress))
+	fmt.Fprintf(sb, "aof_rewrite_scheduled:%d\r\n", flag(kv.aof.rewriteScheduled))
+	fmt.Fprintf(sb, "aof_last_bgrewrite_status:%s\r\n", status)
+	if kv.aof.file != nil {
+		fmt.Fprintf(sb, "aof_current_size:%d\r\n", kv.aof.size)
+		fmt.Fprintf(sb, "aof_base_size:%d\r\n", kv.aof.baseSize)
+	}
+}
+
+func (kv *KVStore) bgrewriteaofCommand(args []string) []byte {
+	if len(args) != 1 {
+		return wrongArgs("bgrewriteaof")
+	}
+	switch err := kv.rewriteAppendOnlyFileBackground(); {
+	case errors.Is(err, errAOFRewriteInProgress):
+		return respgo.EncodeError("ERR Background append only file rewriting already in progress")
+	case err != nil:
+		return respgo.EncodeError("ERR Can't execute an AOF background rewriting. Please check the server logs for more information.")
+	}
+	return respgo.EncodeSimpleString("Background append only file rewriting started")
+}
@@ -0,0 +1,367 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/siddarthpai/wardrobe/rdb"
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// aofCommands encodes commands the way they are appended to the AOF.
+func aofCommands(cmds ...string) []byte {
+	var buf []byte
+	for _, cmd := range cmds {
+		buf = append(buf, respgo.EncodeArray(strings.Fields(cmd))...)
+	}
+	return buf
+}
+
+// rdbPreamble returns a dump holding the string keys in values, as a base
+// file starts when aof-use-rdb-preamble is on.
+func rdbPreamble(t *testing.T, values map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := rdb.NewWriter(&buf)
+	w.SelectDB(0, len(values), 0)
+	for k, v := range values {
+		w.WriteEntry(k, v, 0)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeAOF writes the files of an AOF into the AOF directory under dir.
+func writeAOF(t *testing.T, dir, manifest string, files map[string][]byte) {
+	t.Helper()
+	aofDir := filepath.Join(dir, "appendonlydir")
+	if err := os.MkdirAll(aofDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files["appendonly.aof.manifest"] = []byte(manifest)
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(aofDir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// loadAOF starts a store with appendonly on and loads the AOF in dir.
+func loadAOF(t *testing.T, dir string) (*KVStore, error) {
+	t.Helper()
+	kv := newTestStore(t)
+	kv.mu.Lock()
+	kv.dir = dir
+	kv.aof.enabled = true
+	kv.mu.Unlock()
+	return kv, kv.LoadAppendOnlyFile()
+}
+
+func TestParseManifest(t *testing.T) {
+	for _, tc := range []struct {
+		manifest string
+		want     string
+		err      string
+	}{
+		{"file a.1.base.rdb seq 1 type b\nfile a.1.incr.aof seq 1 type i\nfile a.2.incr.aof seq 2 type i\n",
+			"file a.1.base.rdb seq 1 type b\nfile a.1.incr.aof seq 1 type i\nfile a.2.incr.aof seq 2 type i\n", ""},
+		// keys it does not know, comments and blank lines are skipped,
+		// and history files are listed after the base
+		{"# comment\n\nfile a.2.incr.aof seq 2 type i startoffset 5\nfile old seq 1 type h\n",
+			"file old seq 1 type h\nfile a.2.incr.aof seq 2 type i\n", ""},
+		{"", "", ""},
+		{"file a seq 1 type b\nfile b seq 2 type b\n", "", "more than one base file in the manifest"},
+		{"file a seq 2 type i\nfile b seq 1 type i\n", "", "incremental files out of order in the manifest"},
+		{"file a seq 1 type x\n", "", "unknown file type on manifest line 1"},
+		{"file a seq 1 type bb\n", "", "invalid file type on manifest line 1"},
+		{"file a seq 0 type b\n", "", "invalid sequence number on manifest line 1"},
+		{"file a seq x type b\n", "", "invalid sequence number on manifest line 1"},
+		{"\nfile a seq 1 type\n", "", "invalid manifest line 2"},
+		{"file ../a seq 1 type b\n", "", "invalid manifest line 1"},
+		{"seq 1 type b\n", "", "invalid manifest line 1"},
+	} {
+		m, err := parseManifest([]byte(tc.manifest))
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("parseManifest(%q) returned %v, want %q", tc.manifest, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || m.String() != tc.want {
+			t.Errorf("parseManifest(%q) = %q, %v, want %q", tc.manifest, m, err, tc.want)
+		}
+	}
+}
+
+// TestAOFReplay loads an AOF made of a base dump and two incremental files,
+// and checks that commands are appended to the last of them afterwards.
+func TestAOFReplay(t *testing.T) {
+	dir := t.TempDir()
+	writeAOF(t, dir, "file appendonly.aof.1.base.rdb seq 1 type b\n"+
+		"file appendonly.aof.0.incr.aof seq 1 type h\n"+
+		"file appendonly.aof.1.incr.aof seq 1 type i\n"+
+		"file appendonly.aof.2.incr.aof seq 2 type i\n",
+		map[string][]byte{
+			"appendonly.aof.1.base.rdb": append(rdbPreamble(t, map[string]string{"a": "1", "n": "5", "gone": "x"}),
+				aofCommands("HSET h f v")...),
+			// a file the last rewrite replaced is not replayed
+			"appendonly.aof.0.incr.aof": aofCommands("SET a stale"),
+			"appendonly.aof.1.incr.aof": aofCommands("SELECT 0", "SET a 2", "RPUSH l x y", "SELECT 1", "SET b 1"),
+			"appendonly.aof.2.incr.aof": aofCommands("SELECT 0", "MULTI", "INCR n", "INCR n", "EXEC", "DEL gone"),
+		})
+	kv, err := loadAOF(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connect(t, kv)
+	runSteps(c, []step{
+		{"GET a", "2"},
+		{"GET n", "7"},
+		{"HGET h f", "v"},
+		{"LRANGE l 0 -1", "[x y]"},
+		{"EXISTS gone", "0"},
+		{"SELECT 1", "+OK"},
+		{"GET b", "1"},
+		{"SET c 3", "+OK"},
+	})
+
+	last := filepath.Join(dir, "appendonlydir", "appendonly.aof.2.incr.aof")
+	data, err := os.ReadFile(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := aofCommands("SELECT 1", "SET c 3"); !bytes.HasSuffix(data, want) {
+		t.Errorf("the last incremental file ends with %q, want %q", data, want)
+	}
+	reloaded, err := loadAOF(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, got := dumpAll(c), dumpAll(connect(t, reloaded))
+	if len(got) != len(want) {
+		t.Fatalf("after reloading the AOF holds %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s differs after reloading the AOF", k)
+		}
+	}
+}
+
+func TestAOFTruncated(t *testing.T) {
+	complete := aofCommands("SET a 1", "SET b 2")
+	cut := respgo.EncodeArray([]string{"SET", "c", "3"})[:10]
+	for _, tc := range []struct {
+		name      string
+		incrs     [][]byte
+		truncated bool
+		// err is part of the error expected, or "" if the AOF loads and its
+		// last file is cut back to len(complete)
+		err string
+	}{
+		{"a partial command", [][]byte{append(bytes.Clone(complete), cut...)}, true, ""},
+		{"a partial command without aof-load-truncated", [][]byte{append(bytes.Clone(complete), cut...)}, false,
+			"unexpected end of file"},
+		{"a MULTI with no EXEC", [][]byte{append(bytes.Clone(complete), aofCommands("MULTI", "SET c 3")...)}, true, ""},
+		{"a partial command in a MULTI", [][]byte{slices.Concat(complete, aofCommands("MULTI", "SET c 3"), cut)}, true, ""},
+		{"a MULTI with no EXEC without aof-load-truncated", [][]byte{append(bytes.Clone(complete), aofCommands("MULTI")...)}, false,
+			"unexpected end of file"},
+		{"a partial command before the last file", [][]byte{append(bytes.Clone(complete), cut...), aofCommands("SET d 4")}, true,
+			"unexpected end of file"},
+		{"a reply in place of a command", [][]byte{append(bytes.Clone(complete), "+OK\r\n"...)}, true,
+			"bad file format reading the append only file"},
+		{"an unknown command", [][]byte{append(bytes.Clone(complete), aofCommands("NOPE")...)}, true,
+			"unknown command 'NOPE'"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var manifest strings.Builder
+			files := make(map[string][]byte)
+			for i, data := range tc.incrs {
+				name := "appendonly.aof." + strconv.Itoa(i+1) + ".incr.aof"
+				manifest.WriteString("file " + name + " seq " + strconv.Itoa(i+1) + " type i\n")
+				files[name] = data
+			}
+			writeAOF(t, dir, manifest.String(), files)
+			last := filepath.Join(dir, "appendonlydir", "appendonly.aof."+strconv.Itoa(len(tc.incrs))+".incr.aof")
+
+			kv := newTestStore(t)
+			kv.mu.Lock()
+			kv.dir = dir
+			kv.aof.enabled = true
+			kv.aof.loadTruncated = tc.truncated
+			kv.mu.Unlock()
+			err := kv.LoadAppendOnlyFile()
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("loading returned %v, want an error with %q", err, tc.err)
+				}
+				if data, _ := os.ReadFile(last); !bytes.Equal(data, tc.incrs[len(tc.incrs)-1]) {
+					t.Errorf("a failed load changed the last file to %q", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := os.ReadFile(last); !bytes.Equal(data, complete) {
+				t.Errorf("the last file holds %q, want it cut back to %q", data, complete)
+			}
+			c := connect(t, kv)
+			runSteps(c, []step{
+				{"MGET a b c", "[1 2 (nil)]"},
+				{"SET e 5", "+OK"},
+			})
+			// what is appended follows on from the last complete command
+			reloaded, err := loadAOF(t, dir)
+			if err != nil {
+				t.Fatalf("reloading after the cut: %v", err)
+			}
+			runSteps(connect(t, reloaded), []step{{"MGET a b c e", "[1 2 (nil) 5]"}})
+		})
+	}
+}
+
+// TestRewriteWhileWriting rewrites the AOF while another client keeps
+// writing, and checks that loading the result gives what the server holds.
+func TestRewriteWhileWriting(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	runSteps(c, []step{{"CONFIG SET appendonly yes", "+OK"}})
+	rewritten := func() bool { return !kv.aof.rewriteInProgress && kv.aof.file != nil && !kv.aof.waitRewrite }
+	waitFor(t, kv, "the AOF to be turned on", rewritten)
+	for i := range 2000 {
+		k := strconv.Itoa(i)
+		c.do("SET", "s"+k, k)
+		c.do("RPUSH", "l"+strconv.Itoa(i%10), k)
+		c.do("HSET", "h", k, k)
+		c.do("ZADD", "z", k, k)
+	}
+	c.do("SELECT", "1")
+	c.do("SET", "db1", "x", "EX", "1000")
+	c.do("SELECT", "0")
+
+	w := connect(t, kv)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			k := strconv.Itoa(i % 3000)
+			w.try("SET", "s"+k, "w"+strconv.Itoa(i))
+			w.try("INCR", "counter")
+			w.try("LPOP", "l"+strconv.Itoa(i%10))
+			w.try("HDEL", "h", k)
+			w.try("XADD", "x", "*", "i", k)
+		}
+	}()
+	runSteps(c, []step{
+		{"BGREWRITEAOF", "+Background append only file rewriting started"},
+	})
+	waitFor(t, kv, "the rewrite to finish", rewritten)
+	c.do("INCR", "counter")
+	close(done)
+	<-stopped
+
+	// only the files the manifest lists are left
+	kv.mu.Lock()
+	m := kv.aof.manifest
+	status := kv.aof.lastRewriteOK
+	kv.mu.Unlock()
+	if !status || m.base == nil || m.base.seq != 2 || len(m.history) != 0 {
+		t.Fatalf("after the rewrite the manifest is %q", m)
+	}
+	want := []string{"appendonly.aof.manifest", m.base.name}
+	for _, f := range m.incrs {
+		want = append(want, f.name)
+	}
+	entries, _ := os.ReadDir(filepath.Join(kv.dir, "appendonlydir"))
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	slices.Sort(want)
+	if !slices.Equal(names, want) {
+		t.Errorf("the AOF directory holds %v, want %v", names, want)
+	}
+
+	loaded, err := loadAOF(t, kv.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, wantValues := dumpAll(connect(t, loaded)), dumpAll(c)
+	if len(got) != len(wantValues) {
+		t.Fatalf("the rewritten AOF holds %d keys, the server %d", len(got), len(wantValues))
+	}
+	for k, v := range wantValues {
+		if got[k] != v {
+			t.Errorf("%s differs between the rewritten AOF and the server", k)
+		}
+	}
+}
+
+// TestLegacyAOFUpgrade loads an AOF from before Redis 7, a single file in
+// dir, which is moved into the AOF directory as the base of a new one.
+func TestLegacyAOFUpgrade(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data func(t *testing.T) []byte
+	}{
+		{"commands", func(*testing.T) []byte { return aofCommands("SET a 1", "SELECT 1", "RPUSH l x") }},
+		{"a dump and commands", func(t *testing.T) []byte {
+			return append(rdbPreamble(t, map[string]string{"a": "1"}), aofCommands("SELECT 1", "RPUSH l x")...)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			data := tc.data(t)
+			if err := os.WriteFile(filepath.Join(dir, "appendonly.aof"), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			kv, err := loadAOF(t, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "appendonly.aof")); !os.IsNotExist(err) {
+				t.Errorf("the single file AOF is still in place: %v", err)
+			}
+			aofDir := filepath.Join(dir, "appendonlydir")
+			if moved, _ := os.ReadFile(filepath.Join(aofDir, "appendonly.aof")); !bytes.Equal(moved, data) {
+				t.Errorf("the base holds %q, want the single file AOF", moved)
+			}
+			manifest, _ := os.ReadFile(filepath.Join(aofDir, "appendonly.aof.manifest"))
+			if want := "file appendonly.aof seq 1 type b\nfile appendonly.aof.1.incr.aof seq 1 type i\n"; string(manifest) != want {
+				t.Errorf("the manifest is %q, want %q", manifest, want)
+			}
+
+			c := connect(t, kv)
+			runSteps(c, []step{
+				{"GET a", "1"},
+				{"SELECT 1", "+OK"},
+				{"LRANGE l 0 -1", "[x]"},
+				{"RPUSH l y", "2"},
+			})
+			reloaded, err := loadAOF(t, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runSteps(connect(t, reloaded), []step{
+				{"GET a", "1"},
+				{"SELECT 1", "+OK"},
+				{"LRANGE l 0 -1", "[x y]"},
+			})
+		})
+	}
+}
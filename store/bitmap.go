@@ -0,0 +1,635 @@
+package store
+
+import (
+	"math"
+	"math/bits"
+	"strings"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// Bitmaps are plain strings addressed bit by bit. Bit 0 is the most
+// significant bit of the first byte, and bits past the end of the string
+// read as 0.
+
+var (
+	errBitOffset    = respgo.EncodeError("ERR bit offset is not an integer or out of range")
+	errBitfieldType = respgo.EncodeError("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+)
+
+// parseBitOffset parses a bit offset argument. With hash set an offset of
+// the form #N means N*width, as in BITFIELD.
+func parseBitOffset(arg string, hash bool, width int) (int64, bool) {
+	multiply := int64(1)
+	if hash && strings.HasPrefix(arg, "#") {
+		arg, multiply = arg[1:], int64(width)
+	}
+	n, ok := parseInt(arg)
+	if !ok || n < 0 || n > math.MaxInt64/multiply {
+		return 0, false
+	}
+	n *= multiply
+	if n>>3 >= maxStringSize {
+		return 0, false
+	}
+	return n, true
+}
+
+// getBit returns bit off of p, 0 past its end.
+func getBit(p []byte, off int64) uint64 {
+	if off>>3 >= int64(len(p)) {
+		return 0
+	}
+	return uint64(p[off>>3]>>(7-off&7)) & 1
+}
+
+func setBit(p []byte, off int64, v uint64) {
+	mask := byte(1) << (7 - off&7)
+	if v != 0 {
+		p[off>>3] |= mask
+	} else {
+		p[off>>3] &^= mask
+	}
+}
+
+// lookupBitmap returns the bytes of the string at key for reading. ok is
+// false if key holds another type. The caller must hold kv.mu.
+func (kv *KVStore) lookupBitmap(key string) (p []byte, ok bool) {
+	v, _, ok := kv.lookupString(key)
+	return []byte(v), ok
+}
+
+// bitmapForWrite returns the bytes of the string at key, zero-padded to
+// hold bit maxBit, and whether it had to be created or grown. The caller
+// stores the bytes back with updateString.
+func (kv *KVStore) bitmapForWrite(key string, maxBit int64) (p []byte, grown, ok bool) {
+	v, found, ok := kv.lookupString(key)
+	if !ok {
+		return nil, false, false
+	}
+	p = []byte(v)
+	if need := int(maxBit>>3) + 1; need > len(p) {
+		p = append(p, make([]byte, need-len(p))...)
+		grown = true
+	}
+	return p, grown || !found, true
+}
+
+func (kv *KVStore) setbitCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs("setbit")
+	}
+	off, ok := parseBitOffset(args[2], false, 0)
+	if !ok {
+		return errBitOffset
+	}
+	if args[3] != "0" && args[3] != "1" {
+		return respgo.EncodeError("ERR bit is not an integer or out of range")
+	}
+	p, _, ok := kv.bitmapForWrite(args[1], off)
+	if !ok {
+		return errWrongType
+	}
+	old := getBit(p, off)
+	setBit(p, off, uint64(args[3][0]-'0'))
+	kv.updateString(args[1], string(p))
+	kv.dirty++
+	return respgo.EncodeInteger(int(old))
+}
+
+func (kv *KVStore) getbitCommand(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs("getbit")
+	}
+	off, ok := parseBitOffset(args[2], false, 0)
+	if !ok {
+		return errBitOffset
+	}
+	v, _, ok := kv.lookupString(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if off>>3 >= int64(len(v)) {
+		return respgo.EncodeInteger(0)
+	}
+	return respgo.EncodeInteger(int(v[off>>3]>>(7-off&7)) & 1)
+}
+
+// bitRange is a BITCOUNT or BITPOS range, resolved to bytes start..end
+// (inclusive) and masks of the bits outside the range in the first and
+// last byte.
+type bitRange struct {
+	start, end          int64
+	firstMask, lastMask byte
+}
+
+// parseBitRange reads start, end and an optional BYTE or BIT unit.
+func parseBitRange(args []string) (start, end int64, isBit bool, errReply []byte) {
+	start, ok1 := parseInt(args[0])
+	end, ok2 := parseInt(args[1])
+	if !ok1 || !ok2 {
+		return 0, 0, false, errNotInteger
+	}
+	if len(args) == 3 {
+		switch strings.ToUpper(args[2]) {
+		case "BIT":
+			isBit = true
+		case "BYTE":
+		default:
+			return 0, 0, false, errSyntax
+		}
+	}
+	return start, end, isBit, nil
+}
+
+// resolveBitRange turns start and end, counted from the end when negative,
+// into a byte range of a string of n bytes. It reports false when the range
+// is empty.
+func resolveBitRange(start, end int64, isBit bool, n int) (bitRange, bool) {
+	total := int64(n)
+	if isBit {
+		total *= 8
+	}
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	start, end = max(start, 0), max(end, 0)
+	end = min(end, total-1)
+	r := bitRange{start: start, end: end}
+	if start > end {
+		return r, false
+	}
+	if isBit {
+		r.firstMask = ^byte(0xff >> (start & 7))
+		r.lastMask = byte(1<<(7-end&7)) - 1
+		r.start, r.end = start>>3, end>>3
+	}
+	return r, true
+}
+
+// bitcountCommand implements BITCOUNT key [start end [BYTE | BIT]].
+func (kv *KVStore) bitcountCommand(args []string) []byte {
+	var start, end int64
+	var isBit bool
+	switch len(args) {
+	case 2:
+		start, end = 0, -1
+	case 4, 5:
+		var errReply []byte
+		if start, end, isBit, errReply = parseBitRange(args[2:]); errReply != nil {
+			return errReply
+		}
+	case 1:
+		return wrongArgs("bitcount")
+	default:
+		return errSyntax
+	}
+	p, ok := kv.lookupBitmap(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if start < 0 && end < 0 && start > end {
+		return respgo.EncodeInteger(0)
+	}
+	r, ok := resolveBitRange(start, end, isBit, len(p))
+	if !ok {
+		return respgo.EncodeInteger(0)
+	}
+	count := 0
+	for _, b := range p[r.start : r.end+1] {
+		count += bits.OnesCount8(b)
+	}
+	count -= bits.OnesCount8(p[r.start] & r.firstMask)
+	count -= bits.OnesCount8(p[r.end] & r.lastMask)
+	return respgo.EncodeInteger(count)
+}
+
+// firstBit returns the position of the first bit set to bit in p. When p
+// has no such bit it returns -1 when looking for a 1, and the position
+// just past p when looking for a 0, since the string reads as zero-padded.
+func firstBit(p []byte, bit byte) int64 {
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xff
+	}
+	for i, b := range p {
+		if b != skip {
+			if bit == 0 {
+				b = ^b
+			}
+			return int64(i)*8 + int64(bits.LeadingZeros8(b))
+		}
+	}
+	if bit == 1 {
+		return -1
+	}
+	return int64(len(p)) * 8
+}
+
+// bitposCommand implements BITPOS key bit [start [end [BYTE | BIT]]].
+func (kv *KVStore) bitposCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("bitpos")
+	}
+	if args[2] != "0" && args[2] != "1" {
+		if _, ok := parseInt(args[2]); !ok {
+			return errNotInteger
+		}
+		return respgo.EncodeError("ERR The bit argument must be 1 or 0.")
+	}
+	bit := args[2][0] - '0'
+	start, end := int64(0), int64(-1)
+	var isBit bool
+	endGiven := false
+	switch len(args) {
+	case 3:
+	case 4:
+		var ok bool
+		if start, ok = parseInt(args[3]); !ok {
+			return errNotInteger
+		}
+	case 5, 6:
+		var errReply []byte
+		if start, end, isBit, errReply = parseBitRange(args[3:]); errReply != nil {
+			return errReply
+		}
+		endGiven = true
+	default:
+		return errSyntax
+	}
+	v, found, ok := kv.lookupString(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if !found {
+		// a missing key is an endless run of 0 bits
+		if bit == 1 {
+			return respgo.EncodeInteger(-1)
+		}
+		return respgo.EncodeInteger(0)
+	}
+	p := []byte(v)
+	r, ok := resolveBitRange(start, end, isBit, len(p))
+	if !ok {
+		return respgo.EncodeInteger(-1)
+	}
+
+	// look in the masked first byte, the whole bytes in between and the
+	// masked last byte in turn; masked bits never match
+	masked := func(b, mask byte) byte {
+		if bit == 1 {
+			return b &^ mask
+		}
+		return b | mask
+	}
+	bytes := r.end - r.start + 1
+	start = r.start
+	search := func() int64 {
+		if r.firstMask != 0 {
+			b := masked(p[start], r.firstMask)
+			if bytes == 1 && r.lastMask != 0 {
+				b = masked(b, r.lastMask)
+			}
+			pos := firstBit([]byte{b}, bit)
+			if bytes == 1 || (pos != -1 && pos != 8) {
+				return pos
+			}
+			start++
+			bytes--
+		}
+		whole := bytes
+		if r.lastMask != 0 {
+			whole--
+		}
+		if whole > 0 {
+			pos := firstBit(p[start:start+whole], bit)
+			if bytes == whole || (pos != -1 && pos != whole*8) {
+				return pos
+			}
+			start += whole
+			bytes -= whole
+		}
+		return firstBit([]byte{masked(p[r.end], r.lastMask)}, bit)
+	}
+	pos := search()
+	if endGiven && bit == 0 && pos == bytes*8 {
+		// an explicit range is not zero-padded past its end
+		return respgo.EncodeInteger(-1)
+	}
+	if pos != -1 {
+		pos += start * 8
+	}
+	return respgo.EncodeInteger(int(pos))
+}
+
+// bitopCommand implements BITOP AND | OR | XOR | NOT destkey key [key ...].
+// Missing keys read as empty strings and shorter strings as zero-padded.
+func (kv *KVStore) bitopCommand(args []string) []byte {
+	if len(args) < 4 {
+		return wrongArgs("bitop")
+	}
+	op := strings.ToUpper(args[1])
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(args) != 4 {
+			return respgo.EncodeError("ERR BITOP NOT must be called with a single source key.")
+		}
+	default:
+		return errSyntax
+	}
+	srcs := make([]string, 0, len(args)-3)
+	maxLen := 0
+	for _, key := range args[3:] {
+		v, _, ok := kv.lookupString(key)
+		if !ok {
+			return errWrongType
+		}
+		srcs = append(srcs, v)
+		maxLen = max(maxLen, len(v))
+	}
+
+	out := make([]byte, maxLen)
+	for i := range out {
+		at := func(s string) byte {
+			if i < len(s) {
+				return s[i]
+			}
+			return 0
+		}
+		b := at(srcs[0])
+		switch op {
+		case "NOT":
+			b = ^b
+		default:
+			for _, s := range srcs[1:] {
+				switch op {
+				case "AND":
+					b &= at(s)
+				case "OR":
+					b |= at(s)
+				case "XOR":
+					b ^= at(s)
+				}
+			}
+		}
+		out[i] = b
+	}
+
+	dest := args[2]
+	if maxLen == 0 {
+		if kv.removeKey(dest) {
+			kv.dirty++
+		}
+		return respgo.EncodeInteger(0)
+	}
+	kv.setKey(dest, string(out), 0, false)
+	kv.dirty++
+	return respgo.EncodeInteger(maxLen)
+}
+
+const (
+	overflowWrap = iota
+	overflowSat
+	overflowFail
+)
+
+// bitfieldOp is one GET, SET or INCRBY of a BITFIELD call.
+type bitfieldOp struct {
+	op       string
+	signed   bool
+	width    int
+	offset   int64
+	value    int64
+	overflow int
+}
+
+// parseBitfieldType parses a type such as i16 or u8.
+func parseBitfieldType(arg string) (signed bool, width int, ok bool) {
+	if len(arg) < 2 || (arg[0] != 'i' && arg[0] != 'u') {
+		return false, 0, false
+	}
+	signed = arg[0] == 'i'
+	n, ok := parseInt(arg[1:])
+	if !ok || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return false, 0, false
+	}
+	return signed, int(n), true
+}
+
+// getBitfield reads width bits at off as an unsigned integer.
+func getBitfield(p []byte, off int64, width int) uint64 {
+	var v uint64
+	for j := 0; j < width; j++ {
+		v = v<<1 | getBit(p, off+int64(j))
+	}
+	return v
+}
+
+func getSignedBitfield(p []byte, off int64, width int) int64 {
+	v := getBitfield(p, off, width)
+	if width < 64 && v&(1<<(width-1)) != 0 {
+		v |= math.MaxUint64 << width
+	}
+	return int64(v)
+}
+
+func setBitfield(p []byte, off int64, width int, v uint64) {
+	for j := 0; j < width; j++ {
+		setBit(p, off+int64(j), v>>(width-1-j)&1)
+	}
+}
+
+// unsignedOverflow reports whether value+incr leaves the range of a width
+// bit unsigned field, 1 above and -1 below, and the value WRAP or SAT
+// settles on.
+func unsignedOverflow(value uint64, incr int64, width, mode int) (int, uint64) {
+	limit := uint64(1)<<width - 1
+	maxIncr := int64(limit - value)
+	minIncr := -int64(value)
+	wrap := (value + uint64(incr)) & limit
+	switch {
+	case value > limit || (incr > 0 && incr > maxIncr):
+		if mode == overflowWrap {
+			return 1, wrap
+		}
+		return 1, limit
+	case incr < 0 && incr < minIncr:
+		if mode == overflowWrap {
+			return -1, wrap
+		}
+		return -1, 0
+	}
+	return 0, 0
+}
+
+// signedOverflow is unsignedOverflow for a width bit signed field.
+func signedOverflow(value, incr int64, width, mode int) (int, int64) {
+	limit := int64(math.MaxInt64)
+	if width < 64 {
+		limit = 1<<(width-1) - 1
+	}
+	lowest := -limit - 1
+	maxIncr := limit - value
+	minIncr := lowest - value
+
+	wrap := uint64(value) + uint64(incr)
+	if width < 64 {
+		if wrap&(1<<(width-1)) != 0 {
+			wrap |= math.MaxUint64 << width
+		} else {
+			wrap &^= math.MaxUint64 << width
+		}
+	}
+	switch {
+	case value > limit || (width != 64 && incr > maxIncr) || (value >= 0 && incr > 0 && incr > maxIncr):
+		if mode == overflowWrap {
+			return 1, int64(wrap)
+		}
+		return 1, limit
+	case value < lowest || (width != 64 && incr < minIncr) || (value < 0 && incr < 0 && incr < minIncr):
+		if mode == overflowWrap {
+			return -1, int64(wrap)
+		}
+		return -1, lowest
+	}
+	return 0, 0
+}
+
+// bitfieldCommand implements BITFIELD and, with readOnly set, BITFIELD_RO,
+// which only allows GET. Every subcommand is parsed before any runs.
+func (kv *KVStore) bitfieldCommand(args []string, readOnly bool) []byte {
+	name := strings.ToLower(args[0])
+	if len(args) < 2 {
+		return wrongArgs(name)
+	}
+	var ops []bitfieldOp
+	mode := overflowWrap
+	writes := false
+	maxBit := int64(0)
+	for j := 2; j < len(args); j++ {
+		sub := strings.ToUpper(args[j])
+		remaining := len(args) - j - 1
+		switch {
+		case sub == "GET" && remaining >= 2, sub == "SET" && remaining >= 3, sub == "INCRBY" && remaining >= 3:
+		case sub == "OVERFLOW" && remaining >= 1:
+			switch strings.ToUpper(args[j+1]) {
+			case "WRAP":
+				mode = overflowWrap
+			case "SAT":
+				mode = overflowSat
+			case "FAIL":
+				mode = overflowFail
+			default:
+				return respgo.EncodeError("ERR Invalid OVERFLOW type specified")
+			}
+			j++
+			continue
+		default:
+			return errSyntax
+		}
+
+		signed, width, ok := parseBitfieldType(args[j+1])
+		if !ok {
+			return errBitfieldType
+		}
+		off, ok := parseBitOffset(args[j+2], true, width)
+		if !ok {
+			return errBitOffset
+		}
+		op := bitfieldOp{op: sub, signed: signed, width: width, offset: off, overflow: mode}
+		if sub != "GET" {
+			if op.value, ok = parseInt(args[j+3]); !ok {
+				return errNotInteger
+			}
+			writes = true
+			maxBit = max(maxBit, off+int64(width)-1)
+			j++
+		}
+		j += 2
+		ops = append(ops, op)
+	}
+	if readOnly && writes {
+		return respgo.EncodeError("ERR BITFIELD_RO only supports the GET subcommand")
+	}
+
+	key := args[1]
+	var p []byte
+	grown, ok := false, true
+	if writes {
+		p, grown, ok = kv.bitmapForWrite(key, maxBit)
+	} else {
+		p, ok = kv.lookupBitmap(key)
+	}
+	if !ok {
+		return errWrongType
+	}
+
+	out := make([][]byte, 0, len(ops))
+	changes := 0
+	for _, op := range ops {
+		if op.op == "GET" {
+			if op.signed {
+				out = append(out, respgo.EncodeInteger(int(getSignedBitfield(p, op.offset, op.width))))
+			} else {
+				out = append(out, respgo.EncodeInteger(int(getBitfield(p, op.offset, op.width))))
+			}
+			continue
+		}
+		var newVal, reply int64
+		var overflow int
+		if op.signed {
+			old := getSignedBitfield(p, op.offset, op.width)
+			var wrapped int64
+			if op.op == "INCRBY" {
+				overflow, wrapped = signedOverflow(old, op.value, op.width, op.overflow)
+				newVal = old + op.value
+				if overflow != 0 {
+					newVal = wrapped
+				}
+				reply = newVal
+			} else {
+				overflow, wrapped = signedOverflow(op.value, 0, op.width, op.overflow)
+				newVal = op.value
+				if overflow != 0 {
+					newVal = wrapped
+				}
+				reply = old
+			}
+		} else {
+			old := getBitfield(p, op.offset, op.width)
+			var wrapped uint64
+			nv := uint64(op.value)
+			if op.op == "INCRBY" {
+				overflow, wrapped = unsignedOverflow(old, op.value, op.width, op.overflow)
+				nv = old + uint64(op.value)
+				if overflow != 0 {
+					nv = wrapped
+				}
+				reply = int64(nv)
+			} else {
+				overflow, wrapped = unsignedOverflow(nv, 0, op.width, op.overflow)
+				if overflow != 0 {
+					nv = wrapped
+				}
+				reply = int64(old)
+			}
+			newVal = int64(nv)
+		}
+		if overflow != 0 && op.overflow == overflowFail {
+			out = append(out, nilBulk)
+			continue
+		}
+		setBitfield(p, op.offset, op.width, uint64(newVal))
+		out = append(out, respgo.EncodeInteger(int(reply)))
+		changes++
+	}
+	if grown || changes > 0 {
+		kv.updateString(key, string(p))
+		kv.dirty += max(changes, 1)
+	}
+	return respgo.EncodeRawArray(out...)
+}
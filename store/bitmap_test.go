@@ -0,0 +1,261 @@
+package store
+
+import (
+	"math/big"
+	oldrand "math/rand"
+	"math/rand/v2"
+	"strconv"
+	"testing"
+)
+
+// naiveBitRange resolves a BITCOUNT or BITPOS range to bit positions the
+// slow way.
+func naiveBitRange(p []byte, start, end int64, isBit bool) (from, to int64) {
+	total := int64(len(p))
+	if isBit {
+		total *= 8
+	}
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	start, end = max(start, 0), min(max(end, 0), total-1)
+	if !isBit {
+		return start * 8, end*8 + 7
+	}
+	return start, end
+}
+
+func TestBitcountAndBitpos(t *testing.T) {
+	rng := rand.New(rand.NewPCG(9, 10))
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	for range 300 {
+		p := make([]byte, 1+rng.IntN(6))
+		for i := range p {
+			// mostly all-zero and all-one bytes, so runs cross byte edges
+			switch rng.IntN(3) {
+			case 0:
+				p[i] = 0xff
+			case 1:
+				p[i] = byte(rng.IntN(256))
+			}
+		}
+		c.do("SET", "b", string(p))
+		n := int64(len(p)) * 8
+		start, end := rng.Int64N(2*n)-n, rng.Int64N(2*n)-n
+		unit := []string{"BYTE", "BIT"}[rng.IntN(2)]
+		from, to := naiveBitRange(p, start, end, unit == "BIT")
+		if start < 0 && end < 0 && start > end {
+			from, to = 0, -1
+		}
+		count := 0
+		for i := from; i <= to; i++ {
+			count += int(getBit(p, i))
+		}
+		args := []string{"b", strconv.FormatInt(start, 10), strconv.FormatInt(end, 10), unit}
+		if got := c.do(append([]string{"BITCOUNT"}, args...)...); got != count {
+			t.Fatalf("BITCOUNT %v on %08b = %v, want %d", args, p, got, count)
+		}
+
+		from, to = naiveBitRange(p, start, end, unit == "BIT")
+		for bit := range uint64(2) {
+			want := int64(-1)
+			for i := from; i <= to; i++ {
+				if getBit(p, i) == bit {
+					want = i
+					break
+				}
+			}
+			bitArgs := append([]string{"BITPOS", "b", strconv.FormatUint(bit, 10)}, args[1:]...)
+			if got := c.do(bitArgs...); got != int(want) {
+				t.Fatalf("%v on %08b = %v, want %d", bitArgs, p, got, want)
+			}
+		}
+		// with no end, a search for a 0 runs into the padding past the string
+		from, to = naiveBitRange(p, start, -1, false)
+		want := int64(-1)
+		for i := from; i <= to && want < 0; i++ {
+			if getBit(p, i) == 0 {
+				want = i
+			}
+		}
+		if want < 0 && from <= to {
+			want = n
+		}
+		if got := c.do("BITPOS", "b", "0", strconv.FormatInt(start, 10)); got != int(want) {
+			t.Fatalf("BITPOS b 0 %d on %08b = %v, want %d", start, p, got, want)
+		}
+	}
+}
+
+func TestBitmapCommands(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("RPUSH", "list", "a")
+	runSteps(c, []step{
+		{"SETBIT b 7 1", "0"},
+		{"SETBIT b 7 1", "1"},
+		{"GET b", "\x01"},
+		{"SETBIT b 17 1", "0"},
+		{"STRLEN b", "3"},
+		{"GETBIT b 17", "1"},
+		{"GETBIT b 16", "0"},
+		{"GETBIT b 1000", "0"},
+		{"GETBIT nokey 0", "0"},
+		{"SETBIT b 7 0", "1"},
+		{"SETBIT b 0 2", "-ERR bit is not an integer or out of range"},
+		{"SETBIT b -1 1", "-ERR bit offset is not an integer or out of range"},
+		{"SETBIT b 4294967296 1", "-ERR bit offset is not an integer or out of range"},
+		{"SETBIT list 0 1", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+
+		{"SET s foobar", "+OK"},
+		{"BITCOUNT s", "26"},
+		{"BITCOUNT s 0 0", "4"},
+		{"BITCOUNT s 1 1", "6"},
+		{"BITCOUNT s 1 1 BYTE", "6"},
+		{"BITCOUNT s 5 30 BIT", "17"},
+		{"BITCOUNT s -1 -2", "0"},
+		{"BITCOUNT nokey", "0"},
+		{"BITCOUNT s 0", "-ERR syntax error"},
+		{"BITCOUNT s 0 1 WORD", "-ERR syntax error"},
+
+		{"SET p \xff\xf0\x00", "+OK"},
+		{"BITPOS p 0", "12"},
+		{"SET p \x00\xff\xf0", "+OK"},
+		{"BITPOS p 1 0", "8"},
+		{"BITPOS p 1 2", "16"},
+		{"BITPOS p 1 2 -1 BYTE", "16"},
+		{"BITPOS p 1 7 15 BIT", "8"},
+		{"SET p \xff\xff\xff", "+OK"},
+		{"BITPOS p 0", "24"},
+		{"BITPOS p 0 0 -1", "-1"},
+		{"BITPOS nokey 0", "0"},
+		{"BITPOS nokey 1", "-1"},
+		{"BITPOS p 2", "-ERR The bit argument must be 1 or 0."},
+		{"BITPOS p x", "-ERR value is not an integer or out of range"},
+
+		{"SET x1 foobar", "+OK"},
+		{"SET x2 abcdef", "+OK"},
+		{"BITOP AND dest x1 x2", "6"},
+		{"GET dest", "`bc`ab"},
+		{"BITOP OR dest x1 x2", "6"},
+		{"GET dest", "goofev"},
+		{"SET y \x0f", "+OK"},
+		{"BITOP XOR dest y x1", "6"},
+		{"GET dest", "ioobar"},
+		{"BITOP NOT dest y", "1"},
+		{"GET dest", "\xf0"},
+		{"BITOP AND dest nokey nokey", "0"},
+		{"EXISTS dest", "0"},
+		{"BITOP NOT dest x1 x2", "-ERR BITOP NOT must be called with a single source key."},
+		{"BITOP NAND dest x1", "-ERR syntax error"},
+		{"BITOP AND dest list", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+}
+
+func TestBitfield(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	runSteps(c, []step{
+		// the examples from the BITFIELD documentation
+		{"BITFIELD mykey INCRBY i5 100 1 GET u4 0", "[1 0]"},
+		{"BITFIELD k INCRBY u2 100 1 OVERFLOW SAT INCRBY u2 102 1", "[1 1]"},
+		{"BITFIELD k INCRBY u2 100 1 OVERFLOW SAT INCRBY u2 102 1", "[2 2]"},
+		{"BITFIELD k INCRBY u2 100 1 OVERFLOW SAT INCRBY u2 102 1", "[3 3]"},
+		{"BITFIELD k INCRBY u2 100 1 OVERFLOW SAT INCRBY u2 102 1", "[0 3]"},
+		{"BITFIELD k OVERFLOW FAIL INCRBY u2 102 1", "[(nil)]"},
+
+		{"BITFIELD f SET u8 0 255 GET u8 0 GET i8 0", "[0 255 -1]"},
+		{"BITFIELD f SET i8 #1 -128 GET i8 8 GET u16 0", "[0 -128 65408]"},
+		{"BITFIELD f SET u8 0 256", "[255]"},
+		{"BITFIELD f GET u8 0", "[0]"},
+		{"BITFIELD f OVERFLOW SAT SET u8 0 256 SET i8 8 -129", "[0 -128]"},
+		{"BITFIELD f GET u8 0 GET i8 8", "[255 -128]"},
+		{"BITFIELD f OVERFLOW FAIL SET u8 0 -1 GET u8 0", "[(nil) 255]"},
+		{"BITFIELD f SET i64 0 -1 GET i64 0 GET u63 1", "[-36028797018963968 -1 9223372036854775807]"},
+		{"BITFIELD f INCRBY i64 0 -9223372036854775808", "[9223372036854775807]"},
+		{"BITFIELD_RO f GET u4 0", "[7]"},
+		{"BITFIELD nokey GET u8 100", "[0]"},
+		{"EXISTS nokey", "0"},
+		{"BITFIELD_RO f SET u4 0 1", "-ERR BITFIELD_RO only supports the GET subcommand"},
+		{"BITFIELD f GET u64 0", "-ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."},
+		{"BITFIELD f GET i65 0", "-ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."},
+		{"BITFIELD f GET u8 -1", "-ERR bit offset is not an integer or out of range"},
+		{"BITFIELD f OVERFLOW MAYBE", "-ERR Invalid OVERFLOW type specified"},
+		{"BITFIELD f SET u8 0", "-ERR syntax error"},
+		{"BITFIELD f SET u8 0 x", "-ERR value is not an integer or out of range"},
+	})
+}
+
+// TestBitfieldOverflow checks the overflow handling of INCRBY against
+// exact arithmetic for every width and mode.
+func TestBitfieldOverflow(t *testing.T) {
+	rng := rand.New(rand.NewPCG(11, 12))
+	bigRng := oldrand.New(randSource{rng})
+	one := big.NewInt(1)
+	for range 20000 {
+		signed := rng.IntN(2) == 0
+		width := 1 + rng.IntN(63)
+		if signed {
+			width = 1 + rng.IntN(64)
+		}
+		mode := rng.IntN(3)
+		// the range of the field, and a value inside it
+		lo, hi := new(big.Int), new(big.Int).Sub(new(big.Int).Lsh(one, uint(width)), one)
+		if signed {
+			lo.Neg(new(big.Int).Lsh(one, uint(width-1)))
+			hi.Sub(new(big.Int).Lsh(one, uint(width-1)), one)
+		}
+		span := new(big.Int).Add(new(big.Int).Sub(hi, lo), one)
+		value := new(big.Int).Add(lo, new(big.Int).Rand(bigRng, span))
+		incr := rng.Int64()
+		if rng.IntN(2) == 0 {
+			incr = -incr
+		}
+		if rng.IntN(2) == 0 {
+			incr >>= rng.IntN(64)
+		}
+
+		exact := new(big.Int).Add(value, big.NewInt(incr))
+		wantDir := exact.Cmp(hi)
+		if exact.Cmp(lo) < 0 {
+			wantDir = -1
+		} else if wantDir < 0 {
+			wantDir = 0
+		}
+		wrapped := new(big.Int).Mod(new(big.Int).Sub(exact, lo), span)
+		wrapped.Add(wrapped, lo)
+		want := wrapped
+		if mode == overflowSat && wantDir > 0 {
+			want = hi
+		} else if mode == overflowSat && wantDir < 0 {
+			want = lo
+		}
+
+		var dir int
+		var got *big.Int
+		if signed {
+			var v int64
+			dir, v = signedOverflow(value.Int64(), incr, width, mode)
+			got = big.NewInt(v)
+		} else {
+			var v uint64
+			dir, v = unsignedOverflow(value.Uint64(), incr, width, mode)
+			got = new(big.Int).SetUint64(v)
+		}
+		if dir != wantDir || dir != 0 && mode != overflowFail && got.Cmp(want) != 0 {
+			t.Fatalf("signed=%v width %d mode %d: %v%+d gave direction %d and %v, want %d and %v",
+				signed, width, mode, value, incr, dir, got, wantDir, want)
+		}
+	}
+}
+
+// randSource adapts a math/rand/v2 generator for big.Int.Rand, which still
+// takes a math/rand one.
+type randSource struct{ rng *rand.Rand }
+
+func (r randSource) Int63() int64 { return r.rng.Int64() }
+func (r randSource) Seed(int64)   {}
@@ -0,0 +1,246 @@
+package store
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// blockedClient is a client parked in a blocking command until one of its
+// keys can serve it.
+type blockedClient struct {
+	db   *database
+	keys []string
+	// serve retries the command on the client's behalf and reports whether
+	// it produced a reply, which includes errors. It runs with kv.mu held
+	// and may call rewriteCommand like any command.
+	serve func() ([]byte, bool)
+	// reply receives the reply once the client has been served.
+	reply chan []byte
+	// gone is closed if the client disconnects while blocked.
+	gone chan struct{}
+}
+
+// readyKey is a key signalled as ready, with the database it is in.
+type readyKey struct {
+	db  *database
+	key string
+}
+
+// signalKeyAsReady notes that key, in the selected database, may now be able
+// to serve clients blocked on it. They are served once the current command
+// completes. The caller must hold kv.mu.
+func (kv *KVStore) signalKeyAsReady(key string) {
+	ready := readyKey{kv.database, key}
+	if len(kv.blocked[key]) == 0 || slices.Contains(kv.readyKeys, ready) {
+		return
+	}
+	kv.readyKeys = append(kv.readyKeys, ready)
+}
+
+// handleClientsBlockedOnKeys serves the clients blocked on keys signalled
+// as ready, in the order they blocked. Serving a client may make more keys
+// ready, e.g. the destination of BLMOVE, so this runs until none are left.
+// The caller must hold kv.mu.
+func (kv *KVStore) handleClientsBlockedOnKeys() {
+	for len(kv.readyKeys) > 0 {
+		ready := kv.readyKeys[0]
+		kv.readyKeys = kv.readyKeys[1:]
+		kv.withDB(ready.db, func() {
+			for _, b := range slices.Clone(kv.blocked[ready.key]) {
+				dirty := kv.changes()
+				kv.rewritten = nil
+				kv.fromMaster = false
+				kv.preserve(b.keys...)
+				reply, ok := b.serve()
+				if !ok {
+					continue
+				}
+				kv.propagate(nil, dirty)
+				kv.unblock(b)
+				b.reply <- reply
+			}
+		})
+	}
+}
+
+// unblock removes b from the queues of all its keys. The caller must hold
+// kv.mu.
+func (kv *KVStore) unblock(b *blockedClient) {
+	for _, key := range b.keys {
+		queue := slices.DeleteFunc(b.db.blocked[key], func(other *blockedClient) bool {
+			return other == b
+		})
+		if len(queue) == 0 {
+			delete(b.db.blocked, key)
+		} else {
+			b.db.blocked[key] = queue
+		}
+	}
+}
+
+// block parks the calling client on keys until serve succeeds, timeout
+// passes or the client disconnects, and returns the reply to send. A zero
+// timeout waits forever. The caller must hold kv.mu, which is released while
+// waiting.
+func (kv *KVStore) block(connection *Connection, keys []string, timeout time.Duration, serve func() ([]byte, bool), timeoutReply []byte) []byte {
+	if connection.disconnected {
+		// there is nobody left to serve
+		return timeoutReply
+	}
+	b := &blockedClient{db: kv.database, keys: keys, serve: serve, reply: make(chan []byte, 1), gone: make(chan struct{})}
+	for _, key := range keys {
+		if !slices.Contains(kv.blocked[key], b) {
+			kv.blocked[key] = append(kv.blocked[key], b)
+		}
+	}
+	connection.blocked = b
+	defer func() { connection.blocked = nil }()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var reply []byte
+	kv.waitUnlocked(func() {
+		select {
+		case reply = <-b.reply:
+		case <-expired:
+		case <-b.gone:
+		}
+	})
+	if reply != nil {
+		return reply
+	}
+	// the client may have been served between the timer firing and the
+	// lock being taken back
+	select {
+	case reply = <-b.reply:
+		return reply
+	default:
+		kv.unblock(b)
+		return timeoutReply
+	}
+}
+
+// parseTimeout parses the timeout of a blocking command, given in seconds
+// with an optional fractional part.
+func parseTimeout(s string) (time.Duration, []byte) {
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(secs) || strings.TrimSpace(s) != s {
+		return 0, respgo.EncodeError("ERR timeout is not a float or out of range")
+	}
+	if secs < 0 {
+		return 0, respgo.EncodeError("ERR timeout is negative")
+	}
+	if secs > float64(math.MaxInt64)/float64(time.Second) {
+		return 0, respgo.EncodeError("ERR timeout is out of range")
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// blockOrReply runs serve, and if it cannot reply yet blocks the client on
+// keys. Inside MULTI a blocking command never blocks: it behaves as if the
+// timeout had passed.
+func (kv *KVStore) blockOrReply(connection *Connection, keys []string, timeout time.Duration, serve func() ([]byte, bool), timeoutReply []byte) []byte {
+	if reply, ok := serve(); ok {
+		return reply
+	}
+	// TxnStarted stays set while EXEC runs the queued commands
+	if connection.TxnStarted {
+		return timeoutReply
+	}
+	return kv.block(connection, keys, timeout, serve, timeoutReply)
+}
+
+// bpopCommand implements BLPOP and BRPOP.
+func (kv *KVStore) bpopCommand(args []string, connection *Connection, right bool) []byte {
+	name := strings.ToLower(args[0])
+	if len(args) < 3 {
+		return wrongArgs(name)
+	}
+	timeout, errReply := parseTimeout(args[len(args)-1])
+	if errReply != nil {
+		return errReply
+	}
+	keys := args[1 : len(args)-1]
+	serve := func() ([]byte, bool) {
+		for _, key := range keys {
+			l, ok := kv.lookupList(key)
+			if !ok {
+				return errWrongType, true
+			}
+			if l == nil {
+				continue
+			}
+			v := listPop(l, 1, right)[0]
+			kv.listChanged(key, l)
+			kv.dirty++
+			cmd := "LPOP"
+			if right {
+				cmd = "RPOP"
+			}
+			kv.rewriteCommand(cmd, key)
+			return respgo.EncodeArray([]string{key, v}), true
+		}
+		return nil, false
+	}
+	return kv.blockOrReply(connection, keys, timeout, serve, nilArray)
+}
+
+// blmoveCommand implements BLMOVE and BRPOPLPUSH.
+func (kv *KVStore) blmoveCommand(args []string, connection *Connection) []byte {
+	name := strings.ToLower(args[0])
+	from, to := true, false
+	switch {
+	case name == "brpoplpush" && len(args) == 4:
+	case name == "blmove" && len(args) == 6:
+		var ok1, ok2 bool
+		from, ok1 = parseWhere(args[3])
+		to, ok2 = parseWhere(args[4])
+		if !ok1 || !ok2 {
+			return errSyntax
+		}
+	default:
+		return wrongArgs(name)
+	}
+	timeout, errReply := parseTimeout(args[len(args)-1])
+	if errReply != nil {
+		return errReply
+	}
+	src, dst := args[1], args[2]
+	serve := func() ([]byte, bool) {
+		// dst is not among the keys blocked on, which are preserved for
+		// snapshots by whoever serves the client
+		kv.preserve(dst)
+		reply, ok := kv.lmove(src, dst, from, to)
+		if ok && reply[0] != '-' {
+			kv.rewriteCommand("LMOVE", src, dst, whereName(from), whereName(to))
+		}
+		return reply, ok
+	}
+	return kv.blockOrReply(connection, []string{src}, timeout, serve, nilBulk)
+}
+
+func (kv *KVStore) blmpopCommand(args []string, connection *Connection) []byte {
+	if len(args) < 5 {
+		return wrongArgs("blmpop")
+	}
+	timeout, errReply := parseTimeout(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	keys, right, count, errReply := parseMpopArgs(args[2:])
+	if errReply != nil {
+		return errReply
+	}
+	serve := func() ([]byte, bool) {
+		return kv.lmpop(keys, right, count)
+	}
+	return kv.blockOrReply(connection, keys, timeout, serve, nilArray)
+}
@@ -0,0 +1,44 @@
+package store
+
+import "testing"
+
+func TestPushAfterBlockedClientDisconnects(t *testing.T) {
+	kv := newTestStore(t)
+	blocked := connect(t, kv)
+	blocked.send("BLPOP", "jobs", "0")
+	waitFor(t, kv, "the client to block", func() bool { return len(kv.dbs[0].blocked["jobs"]) == 1 })
+	blocked.conn.Close()
+	waitFor(t, kv, "the client to be unblocked", func() bool { return len(kv.dbs[0].blocked["jobs"]) == 0 })
+
+	c := connect(t, kv)
+	if got := c.do("RPUSH", "jobs", "job1"); got != 1 {
+		t.Fatalf("RPUSH = %v, want 1", got)
+	}
+	if got := c.do("LLEN", "jobs"); got != 1 {
+		t.Fatalf("LLEN = %v, want 1", got)
+	}
+	if got := c.do("LPOP", "jobs"); got != "job1" {
+		t.Fatalf("LPOP = %v, want job1", got)
+	}
+}
+
+func TestBlockedClientDisconnectsWithOthersWaiting(t *testing.T) {
+	kv := newTestStore(t)
+	gone := connect(t, kv)
+	gone.send("BLMOVE", "src", "dst", "LEFT", "RIGHT", "0")
+	waitFor(t, kv, "the first client to block", func() bool { return len(kv.dbs[0].blocked["src"]) == 1 })
+	waiting := connect(t, kv)
+	waiting.send("BLPOP", "src", "0")
+	waitFor(t, kv, "the second client to block", func() bool { return len(kv.dbs[0].blocked["src"]) == 2 })
+	gone.conn.Close()
+	waitFor(t, kv, "the first client to be unblocked", func() bool { return len(kv.dbs[0].blocked["src"]) == 1 })
+
+	c := connect(t, kv)
+	c.do("RPUSH", "src", "a")
+	if reply := formatReply(waiting.read()); reply != "[src a]" {
+		t.Fatalf("BLPOP = %v, want [src a]", reply)
+	}
+	if got := c.do("EXISTS", "dst"); got != 0 {
+		t.Fatalf("EXISTS dst = %v, want 0", got)
+	}
+}
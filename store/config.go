@@ -0,0 +1,193 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// errUnknownConfig is returned by setConfig for a setting it does not know.
+var errUnknownConfig = errors.New("unknown option")
+
+// setConfig changes a setting. The caller must hold kv.mu.
+func (kv *KVStore) setConfig(name, value string) error {
+	switch strings.ToLower(name) {
+	case "dir":
+		kv.dir = value
+	case "dbfilename":
+		if value == "" || strings.ContainsRune(value, '/') {
+			return errors.New("dbfilename can't be a path, just a filename")
+		}
+		kv.dbfilename = value
+	case "save":
+		params, ok := parseSaveParams(value)
+		if !ok {
+			return errors.New("Invalid save parameters")
+		}
+		kv.saveParams = params
+	case "appendonly":
+		on, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		kv.aof.enabled = on
+	case "appendfsync":
+		switch v := strings.ToLower(value); v {
+		case "always", "everysec", "no":
+			kv.aof.fsync = v
+		default:
+			return errors.New("argument(s) must be one of the following: always, everysec, no")
+		}
+	case "aof-load-truncated":
+		on, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		kv.aof.loadTruncated = on
+	case "appenddirname", "appendfilename":
+		if value == "" || strings.ContainsAny(value, "/ ") {
+			return errors.New(strings.ToLower(name) + " can't be a path, just a filename")
+		}
+		if kv.aof.on() {
+			return errors.New("can't change " + strings.ToLower(name) + " while appendonly is on")
+		}
+		if strings.EqualFold(name, "appenddirname") {
+			kv.aof.dirname = value
+		} else {
+			kv.aof.filename = value
+		}
+	case "start-empty-on-load-error":
+		on, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		kv.startEmpty = on
+	case "auto-aof-rewrite-percentage":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return errors.New("argument must be a non-negative integer")
+		}
+		kv.aof.rewritePerc = n
+	case "auto-aof-rewrite-min-size":
+		n, err := parseMemory(value)
+		if err != nil {
+			return err
+		}
+		kv.aof.rewriteMinSize = n
+	default:
+		return errUnknownConfig
+	}
+	return nil
+}
+
+func parseYesNo(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.New("argument must be 'yes' or 'no'")
+}
+
+func formatYesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// parseMemory parses a number of bytes, which may carry a unit as in
+// Redis's configuration: k, kb, m, mb, g or gb.
+func parseMemory(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{{"kb", 1024}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}}
+	s = strings.ToLower(s)
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mul = strings.TrimSuffix(s, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * mul, nil
+}
+
+// configGet returns the value of a setting. Settings not handled by
+// setConfig come from the command line. The caller must hold kv.mu.
+func (kv *KVStore) configGet(name string) (string, bool) {
+	switch strings.ToLower(name) {
+	case "dir":
+		return kv.dir, true
+	case "dbfilename":
+		return kv.dbfilename, true
+	case "save":
+		return formatSaveParams(kv.saveParams), true
+	case "appendonly":
+		return formatYesNo(kv.aof.enabled), true
+	case "appendfsync":
+		return kv.aof.fsync, true
+	case "aof-load-truncated":
+		return formatYesNo(kv.aof.loadTruncated), true
+	case "appenddirname":
+		return kv.aof.dirname, true
+	case "appendfilename":
+		return kv.aof.filename, true
+	case "start-empty-on-load-error":
+		return formatYesNo(kv.startEmpty), true
+	case "auto-aof-rewrite-percentage":
+		return strconv.Itoa(kv.aof.rewritePerc), true
+	case "auto-aof-rewrite-min-size":
+		return strconv.FormatInt(kv.aof.rewriteMinSize, 10), true
+	}
+	v, ok := kv.Info.flags[name]
+	return v, ok
+}
+
+func (kv *KVStore) configCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs("config")
+	}
+	switch strings.ToUpper(args[1]) {
+	case "GET":
+		if len(args) != 3 {
+			return wrongArgs("config|get")
+		}
+		v, ok := kv.configGet(args[2])
+		if !ok {
+			return []byte("*0\r\n")
+		}
+		return respgo.EncodeArray([]string{args[2], v})
+	case "SET":
+		if len(args) != 4 {
+			return wrongArgs("config|set")
+		}
+		err := kv.setConfig(args[2], args[3])
+		switch {
+		case errors.Is(err, errUnknownConfig):
+			return respgo.EncodeError("ERR Unknown option or number of arguments for CONFIG SET - '" + args[2] + "'")
+		case err != nil:
+			return respgo.EncodeError("ERR CONFIG SET failed (possibly related to argument '" + args[2] + "') - " + err.Error())
+		}
+		if strings.EqualFold(args[2], "appendonly") {
+			switch {
+			case kv.aof.enabled && !kv.aof.on():
+				if kv.startAppendOnly() != nil {
+					kv.aof.enabled = false
+					return respgo.EncodeError("ERR CONFIG SET failed (possibly related to argument 'appendonly') - Unable to turn on AOF. Check server logs.")
+				}
+			case !kv.aof.enabled && kv.aof.on():
+				kv.stopAppendOnly()
+			}
+		}
+	}
+	return respgo.EncodeSimpleString("OK")
+}
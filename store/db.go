@@ -0,0 +1,229 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// defaultDatabases is how many databases a server has unless configured
+// otherwise, as in Redis.
+const defaultDatabases = 16
+
+// database is one of the numbered keyspaces SELECT switches between. keys
+// maps each key to the object holding its value, whatever its type.
+type database struct {
+	id      int
+	keys    *dict[*object]
+	expires *expiryIndex
+
+	// volatileHashes holds the keys of hashes with field deadlines, for
+	// the active expire cycle.
+	volatileHashes map[string]struct{}
+	// blocked queues the clients blocked on each key, oldest first. It
+	// belongs to the database number rather than its contents, so SWAPDB
+	// leaves it in place.
+	blocked map[string][]*blockedClient
+}
+
+func newDatabase(id int) *database {
+	db := &database{id: id, keys: newDict[*object](), blocked: make(map[string][]*blockedClient)}
+	db.clear()
+	return db
+}
+
+// clear empties the keyspace and returns how many keys it held.
+func (db *database) clear() int {
+	n := db.size()
+	db.keys = newDict[*object]()
+	db.expires = newExpiryIndex()
+	db.volatileHashes = make(map[string]struct{})
+	return n
+}
+
+// size returns the number of keys, counting keys that have expired but
+// not been reclaimed yet.
+func (db *database) size() int {
+	return db.keys.len()
+}
+
+// swapContents exchanges the keyspaces of two databases. Blocked clients
+// stay with their database number.
+func (db *database) swapContents(other *database) {
+	db.keys, other.keys = other.keys, db.keys
+	db.expires, other.expires = other.expires, db.expires
+	db.volatileHashes, other.volatileHashes = other.volatileHashes, db.volatileHashes
+}
+
+// SetDatabases sets how many databases the server has, discarding their
+// contents. It is meant to be called once at startup, before any data is
+// loaded.
+func (kv *KVStore) SetDatabases(n int) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.setDatabases(n)
+}
+
+// setDatabases is SetDatabases for callers that hold kv.mu.
+func (kv *KVStore) setDatabases(n int) {
+	kv.dbs = make([]*database, n)
+	for i := range kv.dbs {
+		kv.dbs[i] = newDatabase(i)
+	}
+	kv.database = kv.dbs[0]
+}
+
+// selectDB makes database id the one commands operate on. The caller must
+// hold kv.mu.
+func (kv *KVStore) selectDB(id int) {
+	kv.database = kv.dbs[id]
+}
+
+// withDB runs fn with db selected, then selects the previous database
+// again. The caller must hold kv.mu.
+func (kv *KVStore) withDB(db *database, fn func()) {
+	prev := kv.database
+	kv.database = db
+	defer func() { kv.database = prev }()
+	fn()
+}
+
+var errDBIndex = respgo.EncodeError("ERR DB index is out of range")
+
+// parseDBIndex parses a database number, replying with invalidMsg if it is
+// not a number and errDBIndex if there is no such database.
+func (kv *KVStore) parseDBIndex(arg, invalidMsg string) (int, []byte) {
+	id, err := strconv.Atoi(arg)
+	if err != nil || id < -1<<31 || id >= 1<<31 {
+		return 0, respgo.EncodeError("ERR " + invalidMsg)
+	}
+	if id < 0 || id >= len(kv.dbs) {
+		return 0, errDBIndex
+	}
+	return id, nil
+}
+
+func (kv *KVStore) selectCommand(args []string, connection *Connection) []byte {
+	if len(args) != 2 {
+		return wrongArgs("select")
+	}
+	id, errReply := kv.parseDBIndex(args[1], "invalid DB index")
+	if errReply != nil {
+		return errReply
+	}
+	connection.db = id
+	kv.selectDB(id)
+	return respgo.EncodeSimpleString("OK")
+}
+
+// moveCommand implements MOVE key db, which moves key along with its
+// deadline unless the target database already has it.
+func (kv *KVStore) moveCommand(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs("move")
+	}
+	id, err := strconv.Atoi(args[2])
+	if err != nil || id < -1<<31 || id >= 1<<31 {
+		return errNotInteger
+	}
+	if id < 0 || id >= len(kv.dbs) {
+		return errDBIndex
+	}
+	src, dst := kv.database, kv.dbs[id]
+	if src == dst {
+		return respgo.EncodeError("ERR source and destination objects are the same")
+	}
+	key := args[1]
+	v := kv.lookupValue(key)
+	if v == nil {
+		return respgo.EncodeInteger(0)
+	}
+	exists := false
+	kv.withDB(dst, func() {
+		kv.expireIfNeeded(key)
+		exists = kv.keyExists(key)
+	})
+	if exists {
+		return respgo.EncodeInteger(0)
+	}
+
+	at, volatile := src.expires.get(key)
+	kv.removeKey(key)
+	kv.withDB(dst, func() {
+		kv.storeValue(key, v)
+		if volatile {
+			kv.setExpiry(key, at)
+		}
+		kv.signalKeyAsReady(key)
+	})
+	kv.dirty++
+	return respgo.EncodeInteger(1)
+}
+
+func (kv *KVStore) swapdbCommand(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs("swapdb")
+	}
+	id1, errReply := kv.parseDBIndex(args[1], "invalid first DB index")
+	if errReply != nil {
+		return errReply
+	}
+	id2, errReply := kv.parseDBIndex(args[2], "invalid second DB index")
+	if errReply != nil {
+		return errReply
+	}
+	if id1 != id2 {
+		a, b := kv.dbs[id1], kv.dbs[id2]
+		a.swapContents(b)
+		// clients blocked on either database may find their keys now
+		for _, db := range []*database{a, b} {
+			kv.withDB(db, func() {
+				for key := range db.blocked {
+					if kv.keyExists(key) {
+						kv.signalKeyAsReady(key)
+					}
+				}
+			})
+		}
+	}
+	kv.dirty++
+	return respgo.EncodeSimpleString("OK")
+}
+
+// parseFlushMode checks the optional ASYNC or SYNC argument of FLUSHDB and
+// FLUSHALL. Either way the keyspace is replaced at once and the old one
+// left to the garbage collector, which is as asynchronous as it gets.
+func parseFlushMode(args []string) []byte {
+	switch {
+	case len(args) == 1:
+	case len(args) == 2 && (strings.EqualFold(args[1], "ASYNC") || strings.EqualFold(args[1], "SYNC")):
+	default:
+		return errSyntax
+	}
+	return nil
+}
+
+// flushCommand implements FLUSHDB and, with all set, FLUSHALL. Both are
+// always propagated, even when there was nothing to delete.
+func (kv *KVStore) flushCommand(args []string, all bool) []byte {
+	if errReply := parseFlushMode(args); errReply != nil {
+		return errReply
+	}
+	if all {
+		for _, db := range kv.dbs {
+			kv.dirty += db.clear()
+		}
+	} else {
+		kv.dirty += kv.database.clear()
+	}
+	kv.rewriteCommand(args...)
+	return respgo.EncodeSimpleString("OK")
+}
+
+func (kv *KVStore) dbsizeCommand(args []string) []byte {
+	if len(args) != 1 {
+		return wrongArgs("dbsize")
+	}
+	return respgo.EncodeInteger(kv.size())
+}
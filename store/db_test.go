@@ -0,0 +1,169 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelectAndMove(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	runSteps(c, []step{
+		{"SET k zero", "+OK"},
+		{"SELECT 1", "+OK"},
+		{"GET k", "(nil)"},
+		{"SET k one", "+OK"},
+		{"DBSIZE", "1"},
+		{"SELECT 0", "+OK"},
+		{"GET k", "zero"},
+		{"SELECT 16", "-ERR DB index is out of range"},
+		{"SELECT -1", "-ERR DB index is out of range"},
+		{"SELECT x", "-ERR invalid DB index"},
+		{"SELECT 4294967296", "-ERR invalid DB index"},
+		{"SELECT", "-ERR wrong number of arguments for 'select' command"},
+
+		// a key the target database has already stays put
+		{"MOVE k 1", "0"},
+		{"GET k", "zero"},
+		{"MOVE nokey 1", "0"},
+		{"MOVE k 0", "-ERR source and destination objects are the same"},
+		{"MOVE k 16", "-ERR DB index is out of range"},
+		{"MOVE k x", "-ERR value is not an integer or out of range"},
+
+		// MOVE takes the deadline along
+		{"RPUSH l a b", "2"},
+		{"PEXPIRE l 100000", "1"},
+		{"MOVE l 2", "1"},
+		{"EXISTS l", "0"},
+		{"SELECT 2", "+OK"},
+		{"LRANGE l 0 -1", "[a b]"},
+		{"PERSIST l", "1"},
+		{"MOVE l 0", "1"},
+		{"SELECT 0", "+OK"},
+		{"TTL l", "-1"},
+	})
+
+	// a key that has expired in the target does not stop the move
+	c.do("SELECT", "3")
+	c.do("SET", "gone", "x", "PX", "1")
+	c.do("SELECT", "0")
+	c.do("SET", "gone", "y")
+	time.Sleep(5 * time.Millisecond)
+	runSteps(c, []step{
+		{"MOVE gone 3", "1"},
+		{"SELECT 3", "+OK"},
+		{"GET gone", "y"},
+	})
+}
+
+func TestSwapdb(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	runSteps(c, []step{
+		{"SET a 0", "+OK"},
+		{"PEXPIRE a 100000", "1"},
+		{"SELECT 1", "+OK"},
+		{"SADD s x", "1"},
+		{"SWAPDB 0 1", "+OK"},
+		// the connection keeps its database number, which now holds a
+		{"GET a", "0"},
+		{"EXISTS s", "0"},
+		{"SELECT 0", "+OK"},
+		{"SMEMBERS s", "[x]"},
+		{"EXISTS a", "0"},
+		{"SWAPDB 0 0", "+OK"},
+		{"SMEMBERS s", "[x]"},
+		{"SELECT 1", "+OK"},
+	})
+	if ttl, _ := c.do("PTTL", "a").(int); ttl <= 0 || ttl > 100000 {
+		t.Errorf("PTTL a after SWAPDB = %d, want the deadline kept", ttl)
+	}
+	runSteps(c, []step{
+		{"SWAPDB 0 16", "-ERR DB index is out of range"},
+		{"SWAPDB x 0", "-ERR invalid first DB index"},
+		{"SWAPDB 0 x", "-ERR invalid second DB index"},
+		{"SWAPDB 0", "-ERR wrong number of arguments for 'swapdb' command"},
+	})
+}
+
+func TestSwapdbAndMoveWakeBlockedClients(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	swapped, moved := connect(t, kv), connect(t, kv)
+	swapped.send("BLPOP", "l", "5")
+	waitFor(t, kv, "BLPOP to block", func() bool { return len(kv.dbs[0].blocked["l"]) == 1 })
+	moved.do("SELECT", "2")
+	moved.send("BLPOP", "m", "5")
+	waitFor(t, kv, "BLPOP to block", func() bool { return len(kv.dbs[2].blocked["m"]) == 1 })
+
+	c.do("SELECT", "1")
+	c.do("RPUSH", "l", "from 1")
+	c.do("SWAPDB", "0", "1")
+	if got := formatReply(swapped.read()); got != "[l from 1]" {
+		t.Errorf("BLPOP on database 0 after SWAPDB = %s", got)
+	}
+	c.do("RPUSH", "m", "moved")
+	c.do("MOVE", "m", "2")
+	if got := formatReply(moved.read()); got != "[m moved]" {
+		t.Errorf("BLPOP on database 2 after MOVE = %s", got)
+	}
+	// SWAPDB leaves the queues with their database numbers
+	if n := len(kv.dbs[1].blocked["l"]) + len(kv.dbs[0].blocked["l"]); n != 0 {
+		t.Errorf("%d clients still queued on l", n)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	for _, db := range []string{"0", "1"} {
+		c.do("SELECT", db)
+		c.do("SET", "k", db)
+		c.do("RPUSH", "l", db)
+	}
+	runSteps(c, []step{
+		{"FLUSHDB", "+OK"},
+		{"DBSIZE", "0"},
+		{"SELECT 0", "+OK"},
+		{"DBSIZE", "2"},
+		{"FLUSHALL ASYNC", "+OK"},
+		{"DBSIZE", "0"},
+		{"SELECT 1", "+OK"},
+		{"DBSIZE", "0"},
+		{"FLUSHDB SYNC", "+OK"},
+		{"FLUSHDB LAZY", "-ERR syntax error"},
+		{"FLUSHALL SYNC ASYNC", "-ERR syntax error"},
+	})
+}
+
+// TestDatabaseCommandsReplicate checks that a replica ends up with the
+// same databases as its master after MOVE, SWAPDB and the flushes.
+func TestDatabaseCommandsReplicate(t *testing.T) {
+	master := newTestStore(t)
+	replica := attachReplica(t, master)
+	c := connect(t, master)
+	c.do("SET", "a", "1", "EX", "1000")
+	c.do("HSET", "h", "f", "v")
+	c.do("MOVE", "a", "1")
+	c.do("SWAPDB", "0", "1")
+	c.do("SELECT", "1")
+	c.do("FLUSHDB")
+	c.do("SELECT", "0")
+	c.do("SET", "done", "1")
+	waitFor(t, replica, "the writes to reach the replica", func() bool { return replica.dbs[0].keys.len() == 2 })
+
+	rc := connect(t, replica)
+	if got, want := dumpAll(rc), dumpAll(c); len(got) != len(want) {
+		t.Fatalf("the replica holds %v, the master %v", got, want)
+	} else {
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%s differs between the master and the replica", k)
+			}
+		}
+	}
+	rc.do("SELECT", "0")
+	if ttl, _ := rc.do("TTL", "a").(int); ttl <= 0 {
+		t.Errorf("TTL a on the replica = %d, want the deadline moved with it", ttl)
+	}
+}
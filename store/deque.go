@@ -0,0 +1,121 @@
+package store
+
+// dequeMinCap is the smallest buffer a non-empty deque keeps.
+const dequeMinCap = 8
+
+// deque is the value of a list key: a ring buffer whose capacity is always
+// a power of two. Pushes and pops at either end and access by index are
+// O(1); the buffer doubles when full and halves when a quarter full.
+type deque struct {
+	buf  []string
+	head int
+	n    int
+}
+
+func (d *deque) len() int {
+	return d.n
+}
+
+// slot maps the i-th element to its position in buf.
+func (d *deque) slot(i int) int {
+	return (d.head + i) & (len(d.buf) - 1)
+}
+
+func (d *deque) at(i int) string {
+	return d.buf[d.slot(i)]
+}
+
+func (d *deque) set(i int, v string) {
+	d.buf[d.slot(i)] = v
+}
+
+// resize moves the elements into a fresh buffer of the given capacity.
+func (d *deque) resize(capacity int) {
+	buf := make([]string, capacity)
+	for i := 0; i < d.n; i++ {
+		buf[i] = d.at(i)
+	}
+	d.buf = buf
+	d.head = 0
+}
+
+func (d *deque) grow() {
+	if d.n == len(d.buf) {
+		d.resize(max(dequeMinCap, 2*len(d.buf)))
+	}
+}
+
+func (d *deque) shrink() {
+	if len(d.buf) > dequeMinCap && d.n <= len(d.buf)/4 {
+		d.resize(len(d.buf) / 2)
+	}
+}
+
+func (d *deque) pushFront(v string) {
+	d.grow()
+	d.head = (d.head - 1) & (len(d.buf) - 1)
+	d.buf[d.head] = v
+	d.n++
+}
+
+func (d *deque) pushBack(v string) {
+	d.grow()
+	d.buf[d.slot(d.n)] = v
+	d.n++
+}
+
+// popFront removes and returns the first element. The deque must not be
+// empty.
+func (d *deque) popFront() string {
+	v := d.buf[d.head]
+	d.buf[d.head] = ""
+	d.head = d.slot(1)
+	d.n--
+	d.shrink()
+	return v
+}
+
+// popBack removes and returns the last element. The deque must not be
+// empty.
+func (d *deque) popBack() string {
+	i := d.slot(d.n - 1)
+	v := d.buf[i]
+	d.buf[i] = ""
+	d.n--
+	d.shrink()
+	return v
+}
+
+// insert places v at index i, shifting the elements after it back.
+func (d *deque) insert(i int, v string) {
+	d.pushBack(v)
+	for j := d.n - 1; j > i; j-- {
+		d.set(j, d.at(j-1))
+	}
+	d.set(i, v)
+}
+
+// retain keeps the elements for which keep returns true, in order.
+func (d *deque) retain(keep func(i int, v string) bool) {
+	kept := 0
+	for i := 0; i < d.n; i++ {
+		if v := d.at(i); keep(i, v) {
+			d.set(kept, v)
+			kept++
+		}
+	}
+	for i := kept; i < d.n; i++ {
+		d.set(i, "")
+	}
+	d.n = kept
+	d.shrink()
+}
+
+// slice returns a copy of the elements from start to end inclusive.
+func (d *deque) slice(start, end int) []string {
+	out := make([]string, 0, end-start+1)
+	for i := start; i <= end; i++ {
+		out = append(out, d.at(i))
+	}
+	return out
+}
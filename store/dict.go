@@ -0,0 +1,147 @@
+package store
+
+import "math/rand/v2"
+
+type dictEntry[V any] struct {
+	key   string
+	value V
+}
+
+// dict maps strings to values like a Go map, but also keeps its entries
+// packed in a slice. That makes picking a uniformly random entry O(1) and
+// lets SCAN-style cursors walk the dict while it is being modified.
+type dict[V any] struct {
+	index   map[string]int
+	entries []dictEntry[V]
+}
+
+func newDict[V any]() *dict[V] {
+	return &dict[V]{index: make(map[string]int)}
+}
+
+func (d *dict[V]) len() int {
+	return len(d.entries)
+}
+
+func (d *dict[V]) get(key string) (V, bool) {
+	i, ok := d.index[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return d.entries[i].value, true
+}
+
+// set stores value under key and reports whether key is new.
+func (d *dict[V]) set(key string, value V) bool {
+	if i, ok := d.index[key]; ok {
+		d.entries[i].value = value
+		return false
+	}
+	d.index[key] = len(d.entries)
+	d.entries = append(d.entries, dictEntry[V]{key, value})
+	return true
+}
+
+// delete removes key and reports whether it was present. The last entry
+// takes the removed one's slot, which is what scan relies on.
+func (d *dict[V]) delete(key string) bool {
+	i, ok := d.index[key]
+	if !ok {
+		return false
+	}
+	last := len(d.entries) - 1
+	if i != last {
+		d.entries[i] = d.entries[last]
+		d.index[d.entries[i].key] = i
+	}
+	d.entries[last] = dictEntry[V]{}
+	d.entries = d.entries[:last]
+	delete(d.index, key)
+	return true
+}
+
+// random returns a uniformly chosen entry. The dict must not be empty.
+func (d *dict[V]) random() (string, V) {
+	e := d.entries[rand.IntN(len(d.entries))]
+	return e.key, e.value
+}
+
+// sample calls fn for count randomly picked entries, the way HRANDFIELD
+// and its set and sorted set counterparts pick them: a positive count
+// yields distinct entries, at most all of them, while a negative count
+// yields exactly -count entries that may repeat.
+func (d *dict[V]) sample(count int64, fn func(key string, value V)) {
+	switch {
+	case count < 0:
+		for i := int64(0); i < -count; i++ {
+			fn(d.random())
+		}
+	case count >= int64(d.len()):
+		for _, e := range d.entries {
+			fn(e.key, e.value)
+		}
+	case count*3 > int64(d.len()):
+		// asking for most of the dict: copy it and drop random entries
+		picked := newDict[V]()
+		for _, e := range d.entries {
+			picked.set(e.key, e.value)
+		}
+		for int64(picked.len()) > count {
+			key, _ := picked.random()
+			picked.delete(key)
+		}
+		for _, e := range picked.entries {
+			fn(e.key, e.value)
+		}
+	default:
+		seen := make(map[string]struct{}, count)
+		for int64(len(seen)) < count {
+			key, value := d.random()
+			if _, dup := seen[key]; dup {
+				continue
+			}
+			seen[key] = struct{}{}
+			fn(key, value)
+		}
+	}
+}
+
+// each calls fn for every entry until fn returns false. fn must not modify
+// the dict.
+func (d *dict[V]) each(fn func(key string, value V) bool) {
+	for _, e := range d.entries {
+		if !fn(e.key, e.value) {
+			return
+		}
+	}
+}
+
+func (d *dict[V]) keys() []string {
+	keys := make([]string, len(d.entries))
+	for i, e := range d.entries {
+		keys[i] = e.key
+	}
+	return keys
+}
+
+// scan visits up to count entries starting at cursor and returns the cursor
+// to continue from, which is 0 once every entry has been visited. A scan
+// starts with cursor 0.
+//
+// Entries are walked from the end of the slice towards the front. Deleting
+// an entry only ever moves the last entry, which is either already visited
+// or still ahead of the cursor, so every entry that is present for the
+// whole scan is returned at least once. Entries added mid-scan may or may
+// not be seen.
+func (d *dict[V]) scan(cursor uint64, count int, fn func(key string, value V)) uint64 {
+	i := len(d.entries)
+	if cursor != 0 && cursor < uint64(i) {
+		i = int(cursor)
+	}
+	for ; i > 0 && count > 0; count-- {
+		i--
+		fn(d.entries[i].key, d.entries[i].value)
+	}
+	return uint64(i)
+}
@@ -0,0 +1,334 @@
+package store
+
+import (
+	"container/heap"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+const (
+	// activeExpireHz is how many times per second the active expire cycle runs.
+	activeExpireHz = 10
+	// activeExpireSample is how many due-soonest keys one pass of the cycle
+	// looks at before deciding whether another pass is worthwhile.
+	activeExpireSample = 20
+	// activeExpireBudget caps the time a single cycle may hold the lock.
+	activeExpireBudget = time.Second / activeExpireHz / 4
+)
+
+// expiryEntry is one key with a deadline, in unix milliseconds.
+type expiryEntry struct {
+	key   string
+	at    int64
+	index int
+}
+
+// expiryHeap is a min-heap of entries ordered by deadline.
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	e := x.(*expiryEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+// expiryIndex holds the deadline of every volatile key. Lookups by key go
+// through entries; deadlines is ordered so the earliest one is always at
+// hand. Each key costs one map entry plus one heap slot.
+type expiryIndex struct {
+	entries   map[string]*expiryEntry
+	deadlines expiryHeap
+}
+
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{entries: make(map[string]*expiryEntry)}
+}
+
+func (x *expiryIndex) get(key string) (int64, bool) {
+	e, ok := x.entries[key]
+	if !ok {
+		return 0, false
+	}
+	return e.at, true
+}
+
+func (x *expiryIndex) set(key string, at int64) {
+	if e, ok := x.entries[key]; ok {
+		e.at = at
+		heap.Fix(&x.deadlines, e.index)
+		return
+	}
+	e := &expiryEntry{key: key, at: at}
+	x.entries[key] = e
+	heap.Push(&x.deadlines, e)
+}
+
+func (x *expiryIndex) remove(key string) bool {
+	e, ok := x.entries[key]
+	if !ok {
+		return false
+	}
+	heap.Remove(&x.deadlines, e.index)
+	delete(x.entries, key)
+	return true
+}
+
+// earliest returns the key with the nearest deadline.
+func (x *expiryIndex) earliest() (*expiryEntry, bool) {
+	if len(x.deadlines) == 0 {
+		return nil, false
+	}
+	return x.deadlines[0], true
+}
+
+func (x *expiryIndex) len() int {
+	return len(x.entries)
+}
+
+// setExpiry gives key an absolute deadline in unix milliseconds. The caller
+// must hold kv.mu.
+func (kv *KVStore) setExpiry(key string, at int64) {
+	kv.expires.set(key, at)
+}
+
+// removeExpiry makes key persistent again. The caller must hold kv.mu.
+func (kv *KVStore) removeExpiry(key string) bool {
+	return kv.expires.remove(key)
+}
+
+// keyIsExpired reports whether key has a deadline that has passed. The
+// caller must hold kv.mu.
+func (kv *KVStore) keyIsExpired(key string) bool {
+	at, ok := kv.expires.get(key)
+	return ok && at <= time.Now().UnixMilli()
+}
+
+// expireIfNeeded deletes key if its deadline has passed and reports whether
+// it did. Every command calls this on the keys it touches before looking
+// them up, so an expired key is never observed even if the active cycle has
+// not reached it yet. A replica leaves expiring keys to its master, as in
+// Redis: it reports an expired key as gone, and lookups treat it as
+// missing, but it is only deleted by the DEL the master sends, and
+// commands from the master still see it. The caller must hold kv.mu.
+func (kv *KVStore) expireIfNeeded(key string) bool {
+	if !kv.keyIsExpired(key) {
+		return false
+	}
+	if kv.Info.Role == "slave" {
+		return !kv.fromMaster
+	}
+	kv.deleteExpiredKey(key)
+	return true
+}
+
+// deleteExpiredKey deletes key, whose deadline has passed, and propagates
+// the deletion as DEL, so that the replicas and the AOF drop the key at
+// the same point in the stream. The caller must hold kv.mu.
+func (kv *KVStore) deleteExpiredKey(key string) {
+	kv.removeKey(key)
+	kv.dirty++
+	kv.expiredKeys++
+	kv.queuePropagation([]string{"DEL", key})
+}
+
+// activeExpireLoop runs the active expire cycle activeExpireHz times a second
+// for the lifetime of the process.
+func (kv *KVStore) activeExpireLoop() {
+	ticker := time.NewTicker(time.Second / activeExpireHz)
+	defer ticker.Stop()
+	for range ticker.C {
+		kv.mu.Lock()
+		kv.activeExpireCycle()
+		kv.propagatePending()
+		kv.mu.Unlock()
+	}
+}
+
+// activeExpireCycle reclaims keys that nobody is accessing. Like Redis it
+// works in passes over a small sample of keys, here the ones due soonest,
+// and keeps going only while whole samples turn out to be expired and the
+// time budget allows. The budget is shared by all databases. A replica
+// waits for its master to delete keys instead. The caller must hold kv.mu.
+func (kv *KVStore) activeExpireCycle() {
+	if kv.Info.Role == "slave" {
+		return
+	}
+	start := time.Now()
+	for _, db := range kv.dbs {
+		if time.Since(start) >= activeExpireBudget {
+			return
+		}
+		kv.withDB(db, func() { kv.activeExpireDB(start) })
+	}
+}
+
+// activeExpireDB runs the active expire cycle begun at start on the
+// selected database. The caller must hold kv.mu.
+func (kv *KVStore) activeExpireDB(start time.Time) {
+	kv.expireHashFields()
+	for time.Since(start) < activeExpireBudget {
+		now := time.Now().UnixMilli()
+		expired := 0
+		for expired < activeExpireSample {
+			e, ok := kv.expires.earliest()
+			if !ok || e.at > now {
+				break
+			}
+			kv.deleteExpiredKey(e.key)
+			expired++
+		}
+		if expired < activeExpireSample {
+			return
+		}
+	}
+}
+
+// resolveDeadline turns a time argument of n units of unit milliseconds
+// into an absolute unix-ms deadline. Relative times are counted from now.
+// It reports false if the result does not fit in an int64.
+func resolveDeadline(n, unit int64, absolute bool) (int64, bool) {
+	if n > math.MaxInt64/unit || n < math.MinInt64/unit {
+		return 0, false
+	}
+	n *= unit
+	if !absolute {
+		now := time.Now().UnixMilli()
+		if n > math.MaxInt64-now {
+			return 0, false
+		}
+		n += now
+	}
+	return n, true
+}
+
+// expireCommand implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT. unit is
+// the size of one unit of the time argument in milliseconds; absolute says
+// whether the argument is a unix timestamp rather than a relative TTL.
+func (kv *KVStore) expireCommand(args []string, unit int64, absolute bool) []byte {
+	name := strings.ToLower(args[0])
+	if len(args) < 3 {
+		return wrongArgs(name)
+	}
+	key := args[1]
+	when, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+
+	var nx, xx, gt, lt bool
+	for _, opt := range args[3:] {
+		switch strings.ToUpper(opt) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return respgo.EncodeError("ERR Unsupported option " + opt)
+		}
+	}
+	if nx && (xx || gt || lt) {
+		return respgo.EncodeError("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if gt && lt {
+		return respgo.EncodeError("ERR GT and LT options at the same time are not compatible")
+	}
+
+	when, ok := resolveDeadline(when, unit, absolute)
+	if !ok {
+		return respgo.EncodeError("ERR invalid expire time in '" + name + "' command")
+	}
+
+	if !kv.keyExists(key) {
+		return respgo.EncodeInteger(0)
+	}
+	current, volatile := kv.expires.get(key)
+	switch {
+	case nx && volatile,
+		xx && !volatile,
+		gt && (!volatile || when <= current),
+		lt && volatile && when >= current:
+		return respgo.EncodeInteger(0)
+	}
+
+	kv.dirty++
+	if when <= time.Now().UnixMilli() {
+		kv.removeKey(key)
+		kv.rewriteCommand("DEL", key)
+		return respgo.EncodeInteger(1)
+	}
+	kv.setExpiry(key, when)
+	kv.rewriteCommand("PEXPIREAT", key, strconv.FormatInt(when, 10))
+	return respgo.EncodeInteger(1)
+}
+
+// ttlCommand implements TTL and PTTL, which report the remaining time to
+// live in units of unit milliseconds.
+func (kv *KVStore) ttlCommand(args []string, unit int64) []byte {
+	if len(args) != 2 {
+		return wrongArgs(strings.ToLower(args[0]))
+	}
+	key := args[1]
+	if !kv.keyExists(key) {
+		return respgo.EncodeInteger(-2)
+	}
+	at, ok := kv.expires.get(key)
+	if !ok {
+		return respgo.EncodeInteger(-1)
+	}
+	ttl := max(at-time.Now().UnixMilli(), 0)
+	return respgo.EncodeInteger(int((ttl + unit/2) / unit))
+}
+
+// expireTimeCommand implements EXPIRETIME and PEXPIRETIME, which report the
+// absolute deadline of a key as a unix timestamp in units of unit
+// milliseconds.
+func (kv *KVStore) expireTimeCommand(args []string, unit int64) []byte {
+	if len(args) != 2 {
+		return wrongArgs(strings.ToLower(args[0]))
+	}
+	key := args[1]
+	if !kv.keyExists(key) {
+		return respgo.EncodeInteger(-2)
+	}
+	at, ok := kv.expires.get(key)
+	if !ok {
+		return respgo.EncodeInteger(-1)
+	}
+	return respgo.EncodeInteger(int(at / unit))
+}
+
+func (kv *KVStore) persistCommand(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs("persist")
+	}
+	if !kv.keyExists(args[1]) || !kv.removeExpiry(args[1]) {
+		return respgo.EncodeInteger(0)
+	}
+	kv.dirty++
+	return respgo.EncodeInteger(1)
+}
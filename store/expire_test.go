@@ -0,0 +1,314 @@
+package store
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiryIndex(t *testing.T) {
+	x := newExpiryIndex()
+	for _, e := range []struct {
+		key string
+		at  int64
+	}{{"c", 30}, {"a", 10}, {"b", 20}, {"d", 5}, {"e", 25}} {
+		x.set(e.key, e.at)
+	}
+	x.set("d", 40) // moves d from the front to the back
+	x.set("e", 1)  // and e to the front
+	if !x.remove("b") || x.remove("b") || x.remove("missing") {
+		t.Error("remove did not report what it removed")
+	}
+	if at, ok := x.get("c"); !ok || at != 30 {
+		t.Errorf("get(c) = %d, %v, want 30, true", at, ok)
+	}
+	if _, ok := x.get("b"); ok {
+		t.Error("get(b) found a removed key")
+	}
+	if n := x.len(); n != 4 {
+		t.Errorf("len = %d, want 4", n)
+	}
+
+	var order []string
+	for {
+		e, ok := x.earliest()
+		if !ok {
+			break
+		}
+		order = append(order, e.key+"@"+strconv.FormatInt(e.at, 10))
+		x.remove(e.key)
+	}
+	if got, want := strings.Join(order, " "), "e@1 a@10 c@30 d@40"; got != want {
+		t.Errorf("deadlines in order = %s, want %s", got, want)
+	}
+}
+
+func TestLazyExpiry(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	for _, k := range []string{"str", "list", "kept"} {
+		c.do("SET", k, "v")
+	}
+	c.do("DEL", "list")
+	c.do("RPUSH", "list", "a")
+	kv.mu.Lock()
+	past := time.Now().UnixMilli() - 1
+	kv.setExpiry("str", past)
+	kv.setExpiry("list", past)
+	kv.mu.Unlock()
+
+	runSteps(c, []step{
+		{"GET str", "(nil)"},
+		{"TTL str", "-2"},
+		{"LLEN list", "0"},
+		{"EXISTS list", "0"},
+		{"GET kept", "v"},
+		{"TTL kept", "-1"},
+		{"SET str fresh", "+OK"},
+		{"TTL str", "-1"},
+	})
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if _, ok := kv.keys.get("list"); ok {
+		t.Error("an expired key was left in the key index after being accessed")
+	}
+	if n := kv.expires.len(); n != 0 {
+		t.Errorf("%d deadlines left, want 0", n)
+	}
+}
+
+func TestActiveExpireCycle(t *testing.T) {
+	kv := newTestStore(t)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	now := time.Now().UnixMilli()
+	// several samples' worth of expired keys in two databases, along with
+	// keys that are not due yet and keys with no deadline
+	for _, db := range kv.dbs[:2] {
+		kv.withDB(db, func() {
+			for i := range 5 * activeExpireSample {
+				kv.setKey("expired"+strconv.Itoa(i), "v", now-int64(i)-1, false)
+			}
+			for i := range 10 {
+				kv.setKey("due"+strconv.Itoa(i), "v", now+time.Hour.Milliseconds(), false)
+				kv.setKey("kept"+strconv.Itoa(i), "v", 0, false)
+			}
+		})
+	}
+
+	kv.activeExpireCycle()
+
+	for _, db := range kv.dbs[:2] {
+		if n := db.size(); n != 20 {
+			t.Errorf("database %d has %d keys after the cycle, want 20", db.id, n)
+		}
+		if n := db.expires.len(); n != 10 {
+			t.Errorf("database %d has %d deadlines after the cycle, want 10", db.id, n)
+		}
+		if _, ok := db.keys.get("expired0"); ok {
+			t.Errorf("database %d still holds expired0", db.id)
+		}
+	}
+}
+
+func TestExpireCommands(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	for _, k := range []string{"a", "b", "c"} {
+		c.do("SET", k, "v")
+	}
+	runSteps(c, []step{
+		{"TTL a", "-1"},
+		{"PTTL a", "-1"},
+		{"EXPIRETIME a", "-1"},
+		{"TTL missing", "-2"},
+		{"PEXPIRETIME missing", "-2"},
+		{"EXPIRE missing 100", "0"},
+
+		{"EXPIRE a 100 XX", "0"},
+		{"EXPIRE a 100 GT", "0"},
+		{"EXPIRE a 100 NX", "1"},
+		{"EXPIRE a 200 NX", "0"},
+		{"TTL a", "100"},
+		{"EXPIRE a 50 GT", "0"},
+		{"EXPIRE a 500 GT", "1"},
+		{"EXPIRE a 1000 LT", "0"},
+		{"EXPIRE a 300 LT", "1"},
+		{"EXPIRE a 400 XX", "1"},
+		{"TTL a", "400"},
+		{"PERSIST a", "1"},
+		{"PERSIST a", "0"},
+		{"TTL a", "-1"},
+		// LT counts a key with no deadline as having an infinite one
+		{"EXPIRE a 300 LT", "1"},
+
+		{"PEXPIRE b 100000", "1"},
+		{"TTL b", "100"},
+		{"EXPIREAT c 4102444800", "1"},
+		{"EXPIRETIME c", "4102444800"},
+		{"PEXPIRETIME c", "4102444800000"},
+		{"PEXPIREAT c 4102444800123", "1"},
+		{"EXPIRETIME c", "4102444800"},
+
+		// a deadline in the past deletes the key
+		{"EXPIRE b -1", "1"},
+		{"EXISTS b", "0"},
+		{"EXPIREAT c 1", "1"},
+		{"GET c", "(nil)"},
+
+		{"EXPIRE a 10 NX XX", "-ERR NX and XX, GT or LT options at the same time are not compatible"},
+		{"EXPIRE a 10 GT LT", "-ERR GT and LT options at the same time are not compatible"},
+		{"EXPIRE a 10 SOON", "-ERR Unsupported option SOON"},
+		{"EXPIRE a ten", "-ERR value is not an integer or out of range"},
+		{"EXPIRE a 9223372036854775807", "-ERR invalid expire time in 'expire' command"},
+		{"PEXPIRE a 9223372036854775807", "-ERR invalid expire time in 'pexpire' command"},
+		{"TTL", "-ERR wrong number of arguments for 'ttl' command"},
+		{"PERSIST", "-ERR wrong number of arguments for 'persist' command"},
+	})
+}
+
+func TestExpirePropagatesDeadlines(t *testing.T) {
+	master := newTestStore(t)
+	replica := attachReplica(t, master)
+	c := connect(t, master)
+	c.do("SET", "k", "v")
+	c.do("SET", "gone", "v")
+	c.do("EXPIRE", "k", "100")
+	c.do("EXPIRE", "gone", "-1")
+	if got := c.do("WAIT", "1", "5000"); got != 1 {
+		t.Fatalf("WAIT = %v, want 1", got)
+	}
+	// a relative TTL reaches the replica as the master's absolute deadline
+	want := c.do("PEXPIRETIME", "k")
+	rc := connect(t, replica)
+	if got := rc.do("PEXPIRETIME", "k"); got != want {
+		t.Errorf("PEXPIRETIME k on the replica = %v, want %v", got, want)
+	}
+	if got := rc.do("EXISTS", "gone"); got != 0 {
+		t.Errorf("EXISTS gone on the replica = %v, want 0", got)
+	}
+}
+
+// TestExpiryPropagatesDEL checks that the master propagates the keys it
+// expires, lazily or in the active cycle, as DEL, and only that: a read
+// that comes across an expired key is not propagated itself.
+func TestExpiryPropagatesDEL(t *testing.T) {
+	master := newTestStore(t)
+	c := connect(t, master)
+	runSteps(c, []step{{"CONFIG SET appendonly yes", "+OK"}})
+	waitFor(t, master, "the AOF to be turned on", func() bool {
+		return !master.aof.rewriteInProgress && master.aof.file != nil && !master.aof.waitRewrite
+	})
+	replica := attachReplica(t, master)
+	for _, k := range []string{"lazy", "active"} {
+		c.do("SET", k, "v", "EX", "1000")
+	}
+	if got := c.do("WAIT", "1", "5000"); got != 1 {
+		t.Fatalf("WAIT = %v, want 1", got)
+	}
+
+	// the deadlines pass on the master alone, so the replica only drops
+	// the keys when told to
+	master.mu.Lock()
+	past := time.Now().UnixMilli() - 1
+	master.setExpiry("lazy", past)
+	master.setExpiry("active", past)
+	dirty := master.dirty
+	master.mu.Unlock()
+	runSteps(c, []step{{"GET lazy", "(nil)"}})
+	master.mu.Lock()
+	master.activeExpireCycle()
+	master.propagatePending()
+	if master.dirty != dirty+2 {
+		t.Errorf("dirty went from %d to %d, want %d", dirty, master.dirty, dirty+2)
+	}
+	path := master.aof.file.Name()
+	master.mu.Unlock()
+
+	if got := c.do("WAIT", "1", "5000"); got != 1 {
+		t.Fatalf("WAIT = %v, want 1", got)
+	}
+	replica.mu.Lock()
+	for _, k := range []string{"lazy", "active"} {
+		if _, ok := replica.dbs[0].keys.get(k); ok {
+			t.Errorf("the replica still holds %s", k)
+		}
+	}
+	replica.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof := string(data)
+	for _, want := range []string{"DEL\r\n$4\r\nlazy", "DEL\r\n$6\r\nactive"} {
+		if !strings.Contains(aof, want) {
+			t.Errorf("the AOF does not hold %q", want)
+		}
+	}
+	if strings.Contains(aof, "GET") {
+		t.Error("the GET that expired a key was appended to the AOF")
+	}
+}
+
+// TestReplicaLeavesExpiryToMaster checks that a replica treats a key whose
+// deadline has passed as missing, but keeps it, for the master to see,
+// until the master deletes it.
+func TestReplicaLeavesExpiryToMaster(t *testing.T) {
+	master := newTestStore(t)
+	replica := attachReplica(t, master)
+	c := connect(t, master)
+	c.do("SET", "k", "v", "EX", "1000")
+	if got := c.do("WAIT", "1", "5000"); got != 1 {
+		t.Fatalf("WAIT = %v, want 1", got)
+	}
+	// the deadline passes on the replica first, as when its clock is ahead
+	replica.mu.Lock()
+	replica.dbs[0].expires.set("k", time.Now().UnixMilli()-1)
+	replica.mu.Unlock()
+	held := func(want string) {
+		t.Helper()
+		replica.mu.Lock()
+		defer replica.mu.Unlock()
+		o, ok := replica.dbs[0].keys.get("k")
+		switch {
+		case want == "" && ok:
+			t.Errorf("the replica holds k = %q, want it deleted", o.str.String())
+		case want != "" && !ok:
+			t.Errorf("the replica deleted k, want it to hold %q", want)
+		case want != "" && o.str.String() != want:
+			t.Errorf("the replica holds k = %q, want %q", o.str.String(), want)
+		}
+	}
+
+	rc := connect(t, replica)
+	runSteps(rc, []step{
+		{"GET k", "(nil)"},
+		{"EXISTS k", "0"},
+		{"TTL k", "-2"},
+		{"TYPE k", "+none"},
+		{"KEYS *", "[]"},
+		{"SCAN 0", "[0 []]"},
+		// with nothing but expired keys, RANDOMKEY returns one in the end
+		{"RANDOMKEY", "k"},
+	})
+	replica.mu.Lock()
+	replica.activeExpireCycle()
+	replica.mu.Unlock()
+	held("v")
+
+	// the master still sees the key, and is the one to delete it
+	c.do("APPEND", "k", "x")
+	if got := c.do("WAIT", "1", "5000"); got != 1 {
+		t.Fatalf("WAIT = %v, want 1", got)
+	}
+	held("vx")
+	runSteps(rc, []step{{"GET k", "(nil)"}})
+	c.do("DEL", "k")
+	if got := c.do("WAIT", "1", "5000"); got != 1 {
+		t.Fatalf("WAIT = %v, want 1", got)
+	}
+	held("")
+}
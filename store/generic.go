@@ -0,0 +1,407 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddarthpai/wardrobe/rdb"
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// Size limits under which Redis keeps small values in a compact encoding,
+// with its default configuration. OBJECT ENCODING reports the encoding
+// Redis would use for the same value.
+const (
+	embstrSizeLimit     = 44
+	listMaxListpackSize = 8192
+	maxListpackEntries  = 128
+	maxListpackValue    = 64
+)
+
+// sharedRefcount is the reference count Redis reports for shared integers.
+const sharedRefcount = 2147483647
+
+func (kv *KVStore) delCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs(strings.ToLower(args[0]))
+	}
+	deleted := 0
+	for _, key := range args[1:] {
+		if kv.removeKey(key) {
+			deleted++
+		}
+	}
+	kv.dirty += deleted
+	return respgo.EncodeInteger(deleted)
+}
+
+// existsCommand implements EXISTS and TOUCH, which count the given keys
+// that exist, a key given twice counting twice.
+func (kv *KVStore) existsCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs(strings.ToLower(args[0]))
+	}
+	n := 0
+	for _, key := range args[1:] {
+		if kv.lookupValue(key) != nil {
+			n++
+		}
+	}
+	return respgo.EncodeInteger(n)
+}
+
+func (kv *KVStore) typeCommand(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs("type")
+	}
+	typ := "none"
+	if v := kv.lookupValue(args[1]); v != nil {
+		typ = kv.keyType(args[1])
+	}
+	return respgo.EncodeSimpleString(typ)
+}
+
+func (kv *KVStore) randomkeyCommand(args []string) []byte {
+	if len(args) != 1 {
+		return wrongArgs("randomkey")
+	}
+	// a replica does not delete the expired keys it comes across, so if
+	// every key may have expired, it gives up after a while and returns
+	// one of them, as Redis does
+	allVolatile := kv.expires.len() == kv.keys.len()
+	for tries := 100; kv.keys.len() > 0; tries-- {
+		key, _ := kv.keys.random()
+		if !kv.expireIfNeeded(key) || allVolatile && kv.Info.Role == "slave" && tries == 0 {
+			return respgo.EncodeBulkString(key)
+		}
+	}
+	return nilBulk
+}
+
+// renameCommand implements RENAME and, with nx set, RENAMENX, which leaves
+// an existing destination alone. The key keeps its deadline.
+func (kv *KVStore) renameCommand(args []string, nx bool) []byte {
+	if len(args) != 3 {
+		return wrongArgs(strings.ToLower(args[0]))
+	}
+	src, dst := args[1], args[2]
+	v := kv.lookupValue(src)
+	if v == nil {
+		return respgo.EncodeError("ERR no such key")
+	}
+	if src == dst {
+		if nx {
+			return respgo.EncodeInteger(0)
+		}
+		return respgo.EncodeSimpleString("OK")
+	}
+	if nx && kv.lookupValue(dst) != nil {
+		return respgo.EncodeInteger(0)
+	}
+	at, volatile := kv.expires.get(src)
+	kv.removeKey(src)
+	kv.removeKey(dst)
+	kv.storeValue(dst, v)
+	if volatile {
+		kv.setExpiry(dst, at)
+	}
+	kv.signalKeyAsReady(dst)
+	kv.dirty++
+	if nx {
+		return respgo.EncodeInteger(1)
+	}
+	return respgo.EncodeSimpleString("OK")
+}
+
+// copyCommand implements COPY source destination [DB db] [REPLACE], which
+// stores a copy of source and its deadline at destination, in the selected
+// database unless DB says otherwise.
+func (kv *KVStore) copyCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("copy")
+	}
+	src, dst := args[1], args[2]
+	target := kv.database
+	replace := false
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "REPLACE":
+			replace = true
+		case opt == "DB" && i+1 < len(args):
+			i++
+			id, err := strconv.Atoi(args[i])
+			if err != nil || id < -1<<31 || id >= 1<<31 {
+				return errNotInteger
+			}
+			if id < 0 || id >= len(kv.dbs) {
+				return errDBIndex
+			}
+			target = kv.dbs[id]
+		default:
+			return errSyntax
+		}
+	}
+	if target == kv.database && src == dst {
+		return respgo.EncodeError("ERR source and destination objects are the same")
+	}
+	v := kv.lookupValue(src)
+	if v == nil {
+		return respgo.EncodeInteger(0)
+	}
+	at, volatile := kv.expires.get(src)
+
+	copied := false
+	kv.withDB(target, func() {
+		kv.expireIfNeeded(dst)
+		if kv.lookupValue(dst) != nil {
+			if !replace {
+				return
+			}
+			kv.removeKey(dst)
+		}
+		kv.storeValue(dst, copyValue(v))
+		if volatile {
+			kv.setExpiry(dst, at)
+		}
+		kv.signalKeyAsReady(dst)
+		copied = true
+	})
+	if !copied {
+		return respgo.EncodeInteger(0)
+	}
+	kv.dirty++
+	return respgo.EncodeInteger(1)
+}
+
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"ENCODING <key>",
+	"    Return the kind of internal representation used in order to store the value",
+	"    associated with a <key>.",
+	"FREQ <key>",
+	"    Return the access frequency index of the <key>. The returned integer is",
+	"    proportional to the logarithm of the recent access frequency of the key.",
+	"IDLETIME <key>",
+	"    Return the idle time of the <key>, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+	"REFCOUNT <key>",
+	"    Return the number of references of the value associated with the specified",
+	"    <key>.",
+	"HELP",
+	"    Print this help.",
+}
+
+// objectCommand implements OBJECT, which inspects a key without counting
+// as an access to it.
+func (kv *KVStore) objectCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs("object")
+	}
+	sub := strings.ToUpper(args[1])
+	if sub == "HELP" && len(args) == 2 {
+		lines := make([][]byte, len(objectHelp))
+		for i, line := range objectHelp {
+			lines[i] = respgo.EncodeSimpleString(line)
+		}
+		return respgo.EncodeRawArray(lines...)
+	}
+	switch sub {
+	case "ENCODING", "REFCOUNT", "IDLETIME", "FREQ":
+		if len(args) == 3 {
+			break
+		}
+		fallthrough
+	default:
+		return respgo.EncodeError("ERR unknown subcommand or wrong number of arguments for '" + args[1] + "'. Try OBJECT HELP.")
+	}
+
+	key := args[2]
+	kv.expireIfNeeded(key)
+	v := kv.lookupValue(key)
+	if v == nil {
+		return nilBulk
+	}
+	switch sub {
+	case "ENCODING":
+		return respgo.EncodeBulkString(objectEncoding(v))
+	case "REFCOUNT":
+		if n, ok := v.(int64); ok && n >= 0 && n < sharedIntegersCount {
+			return respgo.EncodeInteger(sharedRefcount)
+		}
+		return respgo.EncodeInteger(1)
+	case "IDLETIME":
+		return respgo.EncodeInteger(int(max(time.Now().UnixMilli()-kv.lookupObject(key).lru, 0) / 1000))
+	}
+	return respgo.EncodeError("ERR An LFU maxmemory policy is not selected, access frequency not tracked. " +
+		"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+}
+
+// objectEncoding names the encoding Redis would store v in.
+func objectEncoding(v any) string {
+	switch v := v.(type) {
+	case int64:
+		return "int"
+	case string:
+		if len(v) <= embstrSizeLimit {
+			return "embstr"
+		}
+		return "raw"
+	case *deque:
+		size := 0
+		for i := 0; i < v.len(); i++ {
+			size += len(v.at(i)) + 2
+		}
+		if size <= listMaxListpackSize {
+			return "listpack"
+		}
+		return "quicklist"
+	case *set:
+		if v.dict == nil {
+			return "intset"
+		}
+		if v.len() <= maxListpackEntries && fitsListpack(v.members()) {
+			return "listpack"
+		}
+		return "hashtable"
+	case *hash:
+		small := v.len() <= maxListpackEntries
+		if small {
+			v.fields.each(func(field, value string) bool {
+				small = fitsListpack([]string{field, value})
+				return small
+			})
+		}
+		switch {
+		case !small:
+			return "hashtable"
+		case v.ttls != nil:
+			return "listpackex"
+		}
+		return "listpack"
+	case *zset:
+		small := v.len() <= maxListpackEntries
+		for n := v.zsl.header.level[0].forward; small && n != nil; n = n.level[0].forward {
+			small = len(n.member) <= maxListpackValue
+		}
+		if small {
+			return "listpack"
+		}
+		return "skiplist"
+	}
+	return "stream"
+}
+
+func fitsListpack(items []string) bool {
+	for _, s := range items {
+		if len(s) > maxListpackValue {
+			return false
+		}
+	}
+	return true
+}
+
+func (kv *KVStore) dumpCommand(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs("dump")
+	}
+	v := kv.lookupValue(args[1])
+	if v == nil {
+		return nilBulk
+	}
+	return respgo.EncodeBulkString(string(rdb.Dump(toRDB(v))))
+}
+
+// restoreCommand implements RESTORE key ttl payload [REPLACE] [ABSTTL]
+// [IDLETIME seconds] [FREQ frequency], which creates key from a DUMP
+// payload. A relative TTL is propagated as an absolute deadline.
+func (kv *KVStore) restoreCommand(args []string) []byte {
+	if len(args) < 4 {
+		return wrongArgs("restore")
+	}
+	key, payload := args[1], args[3]
+	ttl, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	if ttl < 0 {
+		return respgo.EncodeError("ERR Invalid TTL value, must be >= 0")
+	}
+	var replace, absttl bool
+	idletime := int64(-1)
+	freq := int64(-1)
+	for i := 4; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "REPLACE":
+			replace = true
+		case opt == "ABSTTL":
+			absttl = true
+		case opt == "IDLETIME" && i+1 < len(args) && freq == -1:
+			i++
+			if idletime, err = strconv.ParseInt(args[i], 10, 64); err != nil {
+				return errNotInteger
+			}
+			if idletime < 0 {
+				return respgo.EncodeError("ERR Invalid IDLETIME value, must be >= 0")
+			}
+		case opt == "FREQ" && i+1 < len(args) && idletime == -1:
+			i++
+			if freq, err = strconv.ParseInt(args[i], 10, 64); err != nil {
+				return errNotInteger
+			}
+			if freq < 0 || freq > 255 {
+				return respgo.EncodeError("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+		default:
+			return errSyntax
+		}
+	}
+
+	if !replace && kv.lookupValue(key) != nil {
+		return respgo.EncodeError("BUSYKEY Target key name already exists.")
+	}
+	decoded, err := rdb.Restore([]byte(payload))
+	if errors.Is(err, rdb.ErrDumpChecksum) {
+		return respgo.EncodeError("ERR " + err.Error())
+	}
+	var v any
+	if err == nil {
+		v, err = fromRDB(decoded)
+	}
+	if err != nil {
+		return respgo.EncodeError("ERR Bad data format")
+	}
+
+	now := time.Now().UnixMilli()
+	at := ttl
+	if ttl > 0 && !absttl {
+		at += now
+	}
+	deleted := replace && kv.removeKey(key)
+	if ttl > 0 && at <= now {
+		// already expired: the key is just gone
+		if deleted {
+			kv.dirty++
+			kv.rewriteCommand("DEL", key)
+		} else {
+			kv.preventPropagation()
+		}
+		return respgo.EncodeSimpleString("OK")
+	}
+	kv.storeValue(key, v)
+	if ttl > 0 {
+		kv.setExpiry(key, at)
+		rewritten := []string{"RESTORE", key, strconv.FormatInt(at, 10), payload, "ABSTTL"}
+		if replace {
+			rewritten = append(rewritten, "REPLACE")
+		}
+		kv.rewriteCommand(rewritten...)
+	}
+	if idletime >= 0 {
+		kv.lookupObject(key).lru = now - idletime*1000
+	}
+	kv.signalKeyAsReady(key)
+	kv.dirty++
+	return respgo.EncodeSimpleString("OK")
+}
@@ -0,0 +1,308 @@
+package store
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siddarthpai/wardrobe/rdb"
+)
+
+// fillTypes creates one key of every type.
+func fillTypes(c *testClient) {
+	c.t.Helper()
+	c.do("SET", "str", "v")
+	c.do("SET", "int", "12")
+	c.do("SET", "empty", "")
+	c.do("RPUSH", "list", "a", "b")
+	c.do("SADD", "set", "x", "y")
+	c.do("HSET", "hash", "f", "v")
+	c.do("ZADD", "zset", "1", "m")
+	c.do("XADD", "stream", "1-1", "f", "v")
+}
+
+func TestGenericCommands(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	fillTypes(c)
+	runSteps(c, []step{
+		{"TYPE str", "+string"},
+		{"TYPE int", "+string"},
+		{"TYPE empty", "+string"},
+		{"TYPE list", "+list"},
+		{"TYPE set", "+set"},
+		{"TYPE hash", "+hash"},
+		{"TYPE zset", "+zset"},
+		{"TYPE stream", "+stream"},
+		{"TYPE nokey", "+none"},
+		{"EXISTS str str nokey list", "3"},
+		{"TOUCH str nokey", "1"},
+		{"DEL list set nokey", "2"},
+		{"UNLINK hash zset stream", "3"},
+		{"EXISTS list set hash zset stream", "0"},
+		{"DBSIZE", "3"},
+		{"DEL", "-ERR wrong number of arguments for 'del' command"},
+		{"TYPE a b", "-ERR wrong number of arguments for 'type' command"},
+
+		{"FLUSHDB", "+OK"},
+		{"RANDOMKEY", "(nil)"},
+		{"SET only v", "+OK"},
+		{"RANDOMKEY", "only"},
+	})
+}
+
+func TestRenameAndCopy(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	runSteps(c, []step{
+		{"RPUSH l a b", "2"},
+		{"PEXPIRE l 100000", "1"},
+		{"SET dst v", "+OK"},
+		{"RENAME l dst", "+OK"},
+		{"EXISTS l", "0"},
+		{"LRANGE dst 0 -1", "[a b]"},
+		{"RENAME dst dst", "+OK"},
+		{"RENAMENX dst dst", "0"},
+		{"RENAME nokey x", "-ERR no such key"},
+		{"RENAMENX nokey x", "-ERR no such key"},
+		{"SET other v EX 100", "+OK"},
+		{"RENAMENX dst other", "0"},
+		{"RENAMENX dst fresh", "1"},
+		// the source's deadline replaces the destination's
+		{"SET s v", "+OK"},
+		{"RENAME s other", "+OK"},
+		{"TTL other", "-1"},
+		{"RENAME a", "-ERR wrong number of arguments for 'rename' command"},
+
+		{"COPY fresh c", "1"},
+		{"COPY fresh c", "0"},
+		{"RPUSH fresh c", "3"},
+		{"COPY fresh c REPLACE", "1"},
+		{"LRANGE c 0 -1", "[a b c]"},
+		// a copy is a copy
+		{"RPUSH c d", "4"},
+		{"LLEN fresh", "3"},
+		{"COPY fresh fresh", "-ERR source and destination objects are the same"},
+		{"COPY fresh fresh DB 1", "1"},
+		{"COPY nokey c", "0"},
+		{"COPY fresh c DB 16", "-ERR DB index is out of range"},
+		{"COPY fresh c DB x", "-ERR value is not an integer or out of range"},
+		{"COPY fresh c DB", "-ERR syntax error"},
+		{"COPY fresh c NX", "-ERR syntax error"},
+		{"SELECT 1", "+OK"},
+		{"LRANGE fresh 0 -1", "[a b c]"},
+	})
+	for _, key := range []string{"fresh", "c"} {
+		c.do("SELECT", "0")
+		if ttl, _ := c.do("PTTL", key).(int); ttl <= 0 || ttl > 100000 {
+			t.Errorf("PTTL %s = %d, want the deadline of l", key, ttl)
+		}
+	}
+
+	// every type copies deeply
+	fillTypes(c)
+	for _, tc := range []struct {
+		key    string
+		change string
+	}{
+		{"set", "SADD set z"},
+		{"hash", "HSET hash g w"},
+		{"zset", "ZADD zset 2 n"},
+		{"stream", "XADD stream 2-1 f v"},
+	} {
+		c.do("COPY", tc.key, "copy:"+tc.key)
+		before := c.do("DUMP", tc.key)
+		c.do(strings.Fields(strings.Replace(tc.change, tc.key, "copy:"+tc.key, 1))...)
+		if c.do("DUMP", tc.key) != before {
+			t.Errorf("changing a copy of %s changed the original", tc.key)
+		}
+	}
+}
+
+func TestObject(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("SET", "long", strings.Repeat("x", embstrSizeLimit+1))
+	runSteps(c, []step{
+		{"SET n 100", "+OK"},
+		{"OBJECT ENCODING n", "int"},
+		{"OBJECT REFCOUNT n", strconv.Itoa(sharedRefcount)},
+		{"SET n 10000", "+OK"},
+		{"OBJECT REFCOUNT n", "1"},
+		{"SET s abc", "+OK"},
+		{"OBJECT ENCODING s", "embstr"},
+		{"OBJECT ENCODING long", "raw"},
+		{"OBJECT REFCOUNT s", "1"},
+		{"RPUSH l a", "1"},
+		{"OBJECT ENCODING l", "listpack"},
+		{"HSET h f v", "1"},
+		{"OBJECT ENCODING h", "listpack"},
+		{"HEXPIRE h 100 FIELDS 1 f", "[1]"},
+		{"OBJECT ENCODING h", "listpackex"},
+		{"ZADD z 1 m", "1"},
+		{"OBJECT ENCODING z", "listpack"},
+		{"XADD x 1-1 f v", "1-1"},
+		{"OBJECT ENCODING x", "stream"},
+		{"OBJECT ENCODING nokey", "(nil)"},
+		{"OBJECT IDLETIME s", "0"},
+		{"OBJECT FREQ s", "-ERR An LFU maxmemory policy is not selected, access frequency not tracked. " +
+			"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."},
+		{"OBJECT NOPE s", "-ERR unknown subcommand or wrong number of arguments for 'NOPE'. Try OBJECT HELP."},
+		{"OBJECT ENCODING", "-ERR unknown subcommand or wrong number of arguments for 'ENCODING'. Try OBJECT HELP."},
+	})
+	if help, _ := c.do("OBJECT", "HELP").([]any); len(help) != len(objectHelp) {
+		t.Errorf("OBJECT HELP = %v", help)
+	}
+
+	// big values leave the compact encodings
+	args := []string{"RPUSH", "biglist"}
+	for range listMaxListpackSize / 64 {
+		args = append(args, strings.Repeat("v", 64))
+	}
+	c.do(args...)
+	c.do("ZADD", "bigz", "1", strings.Repeat("m", maxListpackValue+1))
+	c.do("HSET", "bigh", strings.Repeat("f", maxListpackValue+1), "v")
+	runSteps(c, []step{
+		{"OBJECT ENCODING biglist", "quicklist"},
+		{"OBJECT ENCODING bigz", "skiplist"},
+		{"OBJECT ENCODING bigh", "hashtable"},
+	})
+
+	// OBJECT does not count as an access, but other commands do
+	c.do("RESTORE", "idle", "0", c.do("DUMP", "s").(string), "IDLETIME", "1000")
+	if got := c.do("OBJECT", "IDLETIME", "idle"); got != 1000 {
+		t.Errorf("OBJECT IDLETIME after RESTORE IDLETIME 1000 = %v", got)
+	}
+	if got := c.do("OBJECT", "IDLETIME", "idle"); got != 1000 {
+		t.Errorf("a second OBJECT IDLETIME = %v, want 1000 still", got)
+	}
+	c.do("GET", "idle")
+	if got := c.do("OBJECT", "IDLETIME", "idle"); got != 0 {
+		t.Errorf("OBJECT IDLETIME after GET = %v, want 0", got)
+	}
+}
+
+func TestDumpAndRestore(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	fillTypes(c)
+	c.do("HEXPIRE", "hash", "1000", "FIELDS", "1", "f")
+	c.do("XGROUP", "CREATE", "stream", "g", "0")
+	c.do("XREADGROUP", "GROUP", "g", "alice", "STREAMS", "stream", ">")
+	for _, key := range []string{"str", "int", "empty", "list", "set", "hash", "zset", "stream"} {
+		dump, ok := c.do("DUMP", key).(string)
+		if !ok {
+			t.Fatalf("DUMP %s returned no payload", key)
+		}
+		if got := c.do("RESTORE", "copy:"+key, "0", dump); got != "+OK" {
+			t.Fatalf("RESTORE of %s = %v", key, got)
+		}
+		if got := c.do("DUMP", "copy:"+key); got != dump {
+			t.Errorf("the restored copy of %s dumps differently", key)
+		}
+	}
+	runSteps(c, []step{
+		{"XPENDING copy:stream g", "[1 1-1 1-1 [[alice 1]]]"},
+		{"HTTL copy:hash FIELDS 1 f", "[1000]"},
+		{"DUMP nokey", "(nil)"},
+		{"RESTORE str 0 x", "-BUSYKEY Target key name already exists."},
+		{"RESTORE new 0 x", "-ERR DUMP payload version or checksum are wrong"},
+		{"RESTORE new -1 x", "-ERR Invalid TTL value, must be >= 0"},
+		{"RESTORE new x x", "-ERR value is not an integer or out of range"},
+		{"RESTORE new 0 x IDLETIME -1", "-ERR Invalid IDLETIME value, must be >= 0"},
+		{"RESTORE new 0 x FREQ 256", "-ERR Invalid FREQ value, must be >= 0 and <= 255"},
+		{"RESTORE new 0 x IDLETIME 1 FREQ 1", "-ERR syntax error"},
+		{"RESTORE new 0 x KEEPTTL", "-ERR syntax error"},
+		{"RESTORE new 0", "-ERR wrong number of arguments for 'restore' command"},
+	})
+
+	dump := c.do("DUMP", "list").(string)
+	// payloads are binary, so these go through do rather than runSteps
+	if got := c.do("RESTORE", "str", "0", dump, "REPLACE"); got != "+OK" {
+		t.Fatalf("RESTORE REPLACE = %v", got)
+	}
+	if got := c.do("TYPE", "str"); got != "+list" {
+		t.Errorf("TYPE after RESTORE REPLACE = %v, want +list", got)
+	}
+	c.do("RESTORE", "ttl", "100000", dump)
+	if ttl, _ := c.do("PTTL", "ttl").(int); ttl <= 0 || ttl > 100000 {
+		t.Errorf("PTTL after RESTORE with a TTL = %d", ttl)
+	}
+	at := time.Now().Add(time.Hour).UnixMilli()
+	c.do("RESTORE", "abs", strconv.FormatInt(at, 10), dump, "ABSTTL")
+	if got := c.do("PEXPIRETIME", "abs"); got != int(at) {
+		t.Errorf("PEXPIRETIME after RESTORE ABSTTL = %v, want %d", got, at)
+	}
+	// a deadline already past leaves no key, and deletes a replaced one
+	if got := c.do("RESTORE", "past", "1", dump, "ABSTTL"); got != "+OK" {
+		t.Errorf("RESTORE with a past deadline = %v", got)
+	}
+	if got := c.do("RESTORE", "abs", "1", dump, "ABSTTL", "REPLACE"); got != "+OK" {
+		t.Errorf("RESTORE REPLACE with a past deadline = %v", got)
+	}
+	if got := c.do("EXISTS", "past", "abs"); got != 0 {
+		t.Errorf("EXISTS after restoring with past deadlines = %v, want 0", got)
+	}
+	// a payload whose checksum does not match is refused
+	bad := []byte(dump)
+	bad[len(bad)-1] ^= 1
+	if got := formatReply(c.do("RESTORE", "bad", "0", string(bad))); got != "-ERR DUMP payload version or checksum are wrong" {
+		t.Errorf("RESTORE of a corrupt payload = %s", got)
+	}
+}
+
+// TestRestoreRedisPayloads restores payloads produced by Redis's DUMP.
+func TestRestoreRedisPayloads(t *testing.T) {
+	const (
+		// the integer 10 from an RDB version 6 and a version 9 server
+		int10v6 = "\x00\xc0\n\x06\x00\xf8r?\xc5\xfb\xfb_("
+		int10v9 = "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n"
+		// the list 1, 2, 3 as a ziplist, from the RESTORE documentation
+		list123 = "\n\x17\x17\x00\x00\x00\x12\x00\x00\x00\x03\x00\x00\xc0\x01\x00\x04\xc0\x02\x00\x04\xc0\x03\x00\xff\x04\x00u#<\xc0;.\xe9\xdd"
+	)
+	// the payload of version 9 with its version raised past the newest
+	// this server reads, and a checksum to match
+	newer := binary.LittleEndian.AppendUint16([]byte(int10v9[:3]), 13)
+	newer = binary.LittleEndian.AppendUint64(newer, rdb.CRC64(0, newer))
+	corrupt := []byte(int10v9)
+	corrupt[len(corrupt)-1] ^= 1
+	at := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"RESTORE", "n", "0", int10v6}, "+OK"},
+		{[]string{"GET", "n"}, "10"},
+		{[]string{"OBJECT", "ENCODING", "n"}, "int"},
+		{[]string{"RESTORE", "n", "0", int10v9}, "-BUSYKEY Target key name already exists."},
+		{[]string{"RESTORE", "n", "0", list123, "REPLACE"}, "+OK"},
+		{[]string{"LRANGE", "n", "0", "-1"}, "[1 2 3]"},
+		{[]string{"OBJECT", "ENCODING", "n"}, "listpack"},
+		{[]string{"RESTORE", "abs", at, int10v9, "ABSTTL"}, "+OK"},
+		{[]string{"PEXPIRETIME", "abs"}, at},
+		{[]string{"RESTORE", "idle", "0", int10v9, "IDLETIME", "100"}, "+OK"},
+		{[]string{"OBJECT", "IDLETIME", "idle"}, "100"},
+		{[]string{"RESTORE", "new", "0", string(newer)}, "-ERR DUMP payload version or checksum are wrong"},
+		{[]string{"RESTORE", "new", "0", string(corrupt)}, "-ERR DUMP payload version or checksum are wrong"},
+		{[]string{"RESTORE", "new", "0", int10v9[:9]}, "-ERR DUMP payload version or checksum are wrong"},
+		{[]string{"EXISTS", "new"}, "0"},
+	} {
+		if got := formatReply(c.do(tc.args...)); got != tc.want {
+			t.Errorf("%q = %s, want %s", tc.args, got, tc.want)
+		}
+	}
+
+	// DUMP writes the value the way Redis does, with this server's RDB
+	// version and the checksum of the rest
+	dump := c.do("DUMP", "abs").(string)
+	body, version, crc := dump[:len(dump)-10], dump[len(dump)-10:len(dump)-8], dump[len(dump)-8:]
+	if body != int10v9[:3] || binary.LittleEndian.Uint16([]byte(version)) != rdb.Version ||
+		binary.LittleEndian.Uint64([]byte(crc)) != rdb.CRC64(0, []byte(dump[:len(dump)-8])) {
+		t.Errorf("DUMP abs = %q", dump)
+	}
+}
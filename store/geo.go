@@ -0,0 +1,463 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// GEO sets are sorted sets whose scores are the 52-bit geohashes of their
+// members' positions (see geohash.go), so any sorted set command works on
+// them too.
+
+var errGeoUnit = respgo.EncodeError("ERR unsupported unit provided. please use M, KM, FT, MI")
+
+// parseLongLat parses a longitude and latitude argument pair.
+func parseLongLat(longArg, latArg string) (long, lat float64, errReply []byte) {
+	long, ok1 := parseDouble(longArg)
+	lat, ok2 := parseDouble(latArg)
+	if !ok1 || !ok2 {
+		return 0, 0, errNotFloat
+	}
+	if long < geoLongMin || long > geoLongMax || lat < geoLatMin || lat > geoLatMax {
+		return 0, 0, respgo.EncodeError(fmt.Sprintf("ERR invalid longitude,latitude pair %f,%f", long, lat))
+	}
+	return long, lat, nil
+}
+
+// parseGeoUnit returns how many meters a distance unit is.
+func parseGeoUnit(arg string) (float64, bool) {
+	switch strings.ToLower(arg) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	}
+	return 0, false
+}
+
+// formatGeoCoord formats a coordinate the way Redis replies with it: with
+// 17 decimals, less any trailing zeros.
+func formatGeoCoord(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 17, 64)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		s = "0"
+	}
+	return s
+}
+
+func formatGeoDistance(d float64) string {
+	return strconv.FormatFloat(d, 'f', 4, 64)
+}
+
+func encodeGeoCoords(long, lat float64) []byte {
+	return respgo.EncodeRawArray(
+		respgo.EncodeBulkString(formatGeoCoord(long)),
+		respgo.EncodeBulkString(formatGeoCoord(lat)),
+	)
+}
+
+// geoaddCommand implements GEOADD key [NX | XX] [CH] longitude latitude
+// member [...] as the ZADD it propagates as.
+func (kv *KVStore) geoaddCommand(args []string) []byte {
+	if len(args) < 5 {
+		return wrongArgs("geoadd")
+	}
+	i := 2
+	var nx, xx bool
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+		default:
+			break flags
+		}
+	}
+	if (len(args)-i)%3 != 0 || (nx && xx) {
+		return errSyntax
+	}
+	zaddArgs := make([]string, 0, i+(len(args)-i)/3*2)
+	zaddArgs = append(zaddArgs, "ZADD")
+	zaddArgs = append(zaddArgs, args[1:i]...)
+	for ; i < len(args); i += 3 {
+		long, lat, errReply := parseLongLat(args[i], args[i+1])
+		if errReply != nil {
+			return errReply
+		}
+		score, _ := geoScore(long, lat)
+		zaddArgs = append(zaddArgs, strconv.FormatUint(uint64(score), 10), args[i+2])
+	}
+	dirty := kv.dirty
+	reply := kv.zaddCommand(zaddArgs)
+	if kv.dirty != dirty {
+		kv.rewriteCommand(zaddArgs...)
+	}
+	return reply
+}
+
+func (kv *KVStore) geoposCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs("geopos")
+	}
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	out := make([][]byte, 0, len(args)-2)
+	for _, member := range args[2:] {
+		var score float64
+		found := false
+		if z != nil {
+			score, found = z.score(member)
+		}
+		if !found {
+			out = append(out, nilArray)
+			continue
+		}
+		out = append(out, encodeGeoCoords(decodeGeoScore(score)))
+	}
+	return respgo.EncodeRawArray(out...)
+}
+
+// geohashAlphabet is the base32 alphabet of standard geohash strings.
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohashCommand implements GEOHASH, replying with standard 11 character
+// geohashes. Those span latitudes -90 to 90 rather than the Mercator
+// range scores use, so each position is hashed again.
+func (kv *KVStore) geohashCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs("geohash")
+	}
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	out := make([][]byte, 0, len(args)-2)
+	for _, member := range args[2:] {
+		var score float64
+		found := false
+		if z != nil {
+			score, found = z.score(member)
+		}
+		if !found {
+			out = append(out, nilBulk)
+			continue
+		}
+		long, lat := decodeGeoScore(score)
+		hash, _ := geohashEncode(geoRange{-180, 180}, geoRange{-90, 90}, long, lat, geoStepMax)
+		var buf [11]byte
+		for i := range buf {
+			idx := 0
+			// 52 bits make ten characters; the eleventh is always 0
+			if i < 10 {
+				idx = int(hash.bits>>(52-(i+1)*5)) & 0x1f
+			}
+			buf[i] = geohashAlphabet[idx]
+		}
+		out = append(out, respgo.EncodeBulkString(string(buf[:])))
+	}
+	return respgo.EncodeRawArray(out...)
+}
+
+// geodistCommand implements GEODIST key member1 member2 [M | KM | FT | MI].
+func (kv *KVStore) geodistCommand(args []string) []byte {
+	if len(args) < 4 {
+		return wrongArgs("geodist")
+	}
+	conversion := 1.0
+	switch len(args) {
+	case 4:
+	case 5:
+		var ok bool
+		if conversion, ok = parseGeoUnit(args[4]); !ok {
+			return errGeoUnit
+		}
+	default:
+		return errSyntax
+	}
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if z == nil {
+		return nilBulk
+	}
+	score1, ok1 := z.score(args[2])
+	score2, ok2 := z.score(args[3])
+	if !ok1 || !ok2 {
+		return nilBulk
+	}
+	long1, lat1 := decodeGeoScore(score1)
+	long2, lat2 := decodeGeoScore(score2)
+	return respgo.EncodeBulkString(formatGeoDistance(geoDistance(long1, lat1, long2, lat2) / conversion))
+}
+
+// geoPoint is a GEOSEARCH match.
+type geoPoint struct {
+	member    string
+	score     float64
+	long, lat float64
+	dist      float64
+}
+
+// geoPointsInBox appends the members within the shape whose scores fall
+// in the geohash box, stopping once there are limit points if limit is
+// not 0.
+func geoPointsInBox(z *zset, hash geoHash, shape *geoShape, points []geoPoint, limit int) []geoPoint {
+	lo := hash.align52()
+	hash.bits++
+	r := scoreRange{min: float64(lo), max: float64(hash.align52()), maxex: true}
+	for n := z.zsl.firstInScoreRange(r); n != nil && r.lteMax(n.score); n = n.level[0].forward {
+		long, lat := decodeGeoScore(n.score)
+		dist, ok := shape.contains(long, lat)
+		if !ok {
+			continue
+		}
+		points = append(points, geoPoint{member: n.member, score: n.score, long: long, lat: lat, dist: dist})
+		if limit != 0 && len(points) >= limit {
+			break
+		}
+	}
+	return points
+}
+
+// geoSearch returns the members within the shape, scanning the boxes of
+// searchAreas in turn.
+func geoSearch(z *zset, shape *geoShape, limit int) []geoPoint {
+	var points []geoPoint
+	areas := shape.searchAreas()
+	last := 0
+	for i, hash := range areas {
+		if hash.isZero() {
+			continue
+		}
+		// with huge radiuses neighbors can coincide; Redis only compares
+		// with the last box scanned, and never with the center one
+		if last != 0 && hash == areas[last] {
+			continue
+		}
+		if limit != 0 && len(points) >= limit {
+			break
+		}
+		points = geoPointsInBox(z, hash, shape, points, limit)
+		last = i
+	}
+	return points
+}
+
+// geosearchCommand implements GEOSEARCH and, with store set,
+// GEOSEARCHSTORE:
+//
+//	GEOSEARCH key FROMMEMBER member | FROMLONLAT longitude latitude
+//	    BYRADIUS radius unit | BYBOX width height unit
+//	    [ASC | DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+//	GEOSEARCHSTORE destination source ... [STOREDIST]
+func (kv *KVStore) geosearchCommand(args []string, store bool) []byte {
+	name := args[0]
+	base := 2
+	if store {
+		base = 3
+	}
+	if len(args) < base+5 {
+		return wrongArgs(strings.ToLower(name))
+	}
+	src := args[base-1]
+	z, ok := kv.lookupZSet(src)
+	if !ok {
+		return errWrongType
+	}
+
+	var withDist, withHash, withCoord, any, storeDist bool
+	var fromMember, fromLonLat, byRadius, byBox bool
+	sortDir := 0 // 1 for ASC, -1 for DESC
+	count := int64(0)
+	shape := geoShape{}
+	for j := base; j < len(args); j++ {
+		remaining := len(args) - j - 1
+		switch opt := strings.ToUpper(args[j]); {
+		case opt == "WITHDIST":
+			withDist = true
+		case opt == "WITHHASH":
+			withHash = true
+		case opt == "WITHCOORD":
+			withCoord = true
+		case opt == "ANY":
+			any = true
+		case opt == "ASC":
+			sortDir = 1
+		case opt == "DESC":
+			sortDir = -1
+		case opt == "COUNT" && remaining >= 1:
+			n, ok := parseInt(args[j+1])
+			if !ok {
+				return errNotInteger
+			}
+			if n <= 0 {
+				return respgo.EncodeError("ERR COUNT must be > 0")
+			}
+			count = n
+			j++
+		case opt == "FROMMEMBER" && remaining >= 1 && !fromLonLat:
+			fromMember = true
+			j++
+			if z == nil {
+				// keep parsing; a missing key replies empty afterwards
+				continue
+			}
+			score, found := z.score(args[j])
+			if !found {
+				return respgo.EncodeError("ERR could not decode requested zset member")
+			}
+			shape.long, shape.lat = decodeGeoScore(score)
+		case opt == "FROMLONLAT" && remaining >= 2 && !fromMember:
+			long, lat, errReply := parseLongLat(args[j+1], args[j+2])
+			if errReply != nil {
+				return errReply
+			}
+			shape.long, shape.lat = long, lat
+			fromLonLat = true
+			j += 2
+		case opt == "BYRADIUS" && remaining >= 2 && !byBox:
+			radius, ok := parseDouble(args[j+1])
+			if !ok {
+				return respgo.EncodeError("ERR need numeric radius")
+			}
+			if radius < 0 {
+				return respgo.EncodeError("ERR radius cannot be negative")
+			}
+			if shape.conversion, ok = parseGeoUnit(args[j+2]); !ok {
+				return errGeoUnit
+			}
+			shape.radius = radius
+			byRadius = true
+			j += 2
+		case opt == "BYBOX" && remaining >= 3 && !byRadius:
+			width, ok := parseDouble(args[j+1])
+			if !ok {
+				return respgo.EncodeError("ERR need numeric width")
+			}
+			height, ok := parseDouble(args[j+2])
+			if !ok {
+				return respgo.EncodeError("ERR need numeric height")
+			}
+			if width < 0 || height < 0 {
+				return respgo.EncodeError("ERR height or width cannot be negative")
+			}
+			if shape.conversion, ok = parseGeoUnit(args[j+3]); !ok {
+				return errGeoUnit
+			}
+			shape.box, shape.width, shape.height = true, width, height
+			byBox = true
+			j += 3
+		case opt == "STOREDIST" && store:
+			storeDist = true
+		default:
+			return errSyntax
+		}
+	}
+	if store && (withDist || withHash || withCoord) {
+		return respgo.EncodeError("ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+	}
+	if !fromMember && !fromLonLat {
+		return respgo.EncodeError("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for " + name)
+	}
+	if !byRadius && !byBox {
+		return respgo.EncodeError("ERR exactly one of BYRADIUS and BYBOX can be specified for " + name)
+	}
+	if any && count == 0 {
+		return respgo.EncodeError("ERR the ANY argument requires COUNT argument")
+	}
+
+	dst := args[1]
+	if z == nil {
+		if store {
+			if kv.removeKey(dst) {
+				kv.dirty++
+			}
+			return respgo.EncodeInteger(0)
+		}
+		return respgo.EncodeRawArray()
+	}
+	// the closest N is the only sensible reading of COUNT without ANY
+	if count != 0 && sortDir == 0 && !any {
+		sortDir = 1
+	}
+
+	limit := 0
+	if any {
+		limit = int(count)
+	}
+	points := geoSearch(z, &shape, limit)
+	if sortDir != 0 {
+		slices.SortStableFunc(points, func(a, b geoPoint) int {
+			if sortDir < 0 {
+				a, b = b, a
+			}
+			switch {
+			case a.dist < b.dist:
+				return -1
+			case a.dist > b.dist:
+				return 1
+			}
+			return 0
+		})
+	}
+	if count != 0 && int64(len(points)) > count {
+		points = points[:count]
+	}
+
+	if store {
+		if len(points) == 0 {
+			if kv.removeKey(dst) {
+				kv.dirty++
+			}
+			return respgo.EncodeInteger(0)
+		}
+		result := newZSet()
+		for _, p := range points {
+			score := p.score
+			if storeDist {
+				score = p.dist / shape.conversion
+			}
+			result.set(p.member, score)
+		}
+		kv.removeKey(dst)
+		kv.storeValue(dst, result)
+		kv.dirty += len(points)
+		return respgo.EncodeInteger(len(points))
+	}
+
+	out := make([][]byte, 0, len(points))
+	for _, p := range points {
+		if !withDist && !withHash && !withCoord {
+			out = append(out, respgo.EncodeBulkString(p.member))
+			continue
+		}
+		item := [][]byte{respgo.EncodeBulkString(p.member)}
+		if withDist {
+			item = append(item, respgo.EncodeBulkString(formatGeoDistance(p.dist/shape.conversion)))
+		}
+		if withHash {
+			item = append(item, respgo.EncodeInteger(int(p.score)))
+		}
+		if withCoord {
+			item = append(item, encodeGeoCoords(p.long, p.lat))
+		}
+		out = append(out, respgo.EncodeRawArray(item...))
+	}
+	return respgo.EncodeRawArray(out...)
+}
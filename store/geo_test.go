@@ -0,0 +1,149 @@
+package store
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestGeoCommands(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("SET", "str", "v")
+	runSteps(c, []step{
+		// the examples from the GEO command documentation
+		{"GEOADD Sicily 13.361389 38.115556 Palermo 15.087269 37.502669 Catania", "2"},
+		{"GEODIST Sicily Palermo Catania", "166274.1516"},
+		{"GEODIST Sicily Palermo Catania km", "166.2742"},
+		{"GEODIST Sicily Palermo Catania mi", "103.3182"},
+		{"GEODIST Sicily Foo Bar", "(nil)"},
+		{"GEOHASH Sicily Palermo Catania Foo", "[sqc8b49rny0 sqdtr74hyu0 (nil)]"},
+		{"GEOPOS Sicily Palermo Catania NonExisting", "[[13.36138933897018433 38.11555639549629859] [15.08726745843887329 37.50266842333162032] (nil)]"},
+		{"GEOADD Sicily 12.758489 38.788135 edge1 17.241510 38.788135 edge2", "2"},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km ASC", "[Catania Palermo]"},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYBOX 400 400 km ASC WITHCOORD WITHDIST", "[" +
+			"[Catania 56.4413 [15.08726745843887329 37.50266842333162032]] " +
+			"[Palermo 190.4424 [13.36138933897018433 38.11555639549629859]] " +
+			"[edge2 279.7403 [17.24151045083999634 38.78813451624225195]] " +
+			"[edge1 279.7405 [12.7584877610206604 38.78813451624225195]]]"},
+		{"GEOSEARCHSTORE key1 Sicily FROMLONLAT 15 37 BYBOX 400 400 km ASC COUNT 3", "3"},
+		{"GEOSEARCH key1 FROMLONLAT 15 37 BYBOX 400 400 km ASC WITHDIST WITHHASH", "[" +
+			"[Catania 56.4413 3479447370796909] [Palermo 190.4424 3479099956230698] [edge2 279.7403 3481342659049484]]"},
+		{"GEOSEARCHSTORE key2 Sicily FROMLONLAT 15 37 BYBOX 400 400 km ASC COUNT 3 STOREDIST", "3"},
+		{"ZRANGE key2 0 -1", "[Catania Palermo edge2]"},
+
+		{"GEOSEARCH Sicily FROMMEMBER Palermo BYRADIUS 170 km DESC", "[Catania edge1 Palermo]"},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km COUNT 1", "[Catania]"},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 1 km", "[]"},
+		{"GEOSEARCH nokey FROMMEMBER x BYRADIUS 1 km", "[]"},
+		{"GEOSEARCHSTORE key1 Sicily FROMLONLAT 15 37 BYRADIUS 1 km", "0"},
+		{"EXISTS key1", "0"},
+
+		// GEOADD is ZADD underneath
+		{"GEOADD Sicily NX 13.361389 38.115556 Palermo", "0"},
+		{"GEOADD Sicily XX CH 13 38 Palermo", "1"},
+		{"GEOADD Sicily XX 13 38 Nowhere", "0"},
+		{"ZCARD Sicily", "4"},
+		{"GEOADD Sicily XX NX 13 38 Palermo", "-ERR syntax error"},
+		{"GEOADD Sicily 13 38", "-ERR wrong number of arguments for 'geoadd' command"},
+		{"GEOADD Sicily 200 100 x", "-ERR invalid longitude,latitude pair 200.000000,100.000000"},
+		{"GEOADD Sicily 13 86 x", "-ERR invalid longitude,latitude pair 13.000000,86.000000"},
+		{"GEOADD str 13 38 x", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+
+		{"GEODIST Sicily Palermo Catania yd", "-ERR unsupported unit provided. please use M, KM, FT, MI"},
+		{"GEOSEARCH Sicily FROMMEMBER Foo BYRADIUS 1 km", "-ERR could not decode requested zset member"},
+		{"GEOSEARCH Sicily BYRADIUS 1 km ASC WITHDIST", "-ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH"},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 ASC WITHDIST", "-ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH"},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 1 km BYBOX 1 1 km", "-ERR syntax error"},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS -1 km", "-ERR radius cannot be negative"},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 1 km ANY", "-ERR the ANY argument requires COUNT argument"},
+		{"GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 1 km COUNT 0", "-ERR COUNT must be > 0"},
+		{"GEOSEARCHSTORE d Sicily FROMLONLAT 15 37 BYRADIUS 1 km WITHDIST", "-ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options"},
+		{"GEOSEARCH str FROMLONLAT 15 37 BYRADIUS 1 km", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+}
+
+func TestGeoSmallDistances(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	runSteps(c, []step{
+		{"GEOADD points -122.407107 37.794300 1 -122.227336 37.794300 2", "2"},
+		{"GEOSEARCH points FROMLONLAT -122.407107 37.794300 BYRADIUS 30 mi ASC WITHDIST", "[[1 0.0001] [2 9.8182]]"},
+		// a zero radius still finds a point on the center
+		{"GEOADD zero 10 20 p", "1"},
+		{"GEOSEARCH zero FROMMEMBER p BYRADIUS 0 m", "[p]"},
+	})
+}
+
+// TestGeoSearchAgainstScan checks that the geohash boxes a search scans
+// never miss a point that is within the shape, near the poles and the
+// antimeridian too.
+func TestGeoSearchAgainstScan(t *testing.T) {
+	rng := rand.New(rand.NewPCG(15, 16))
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	for round := range 60 {
+		c.do("DEL", "points")
+		long := rng.Float64()*360 - 180
+		lat := rng.Float64()*170 - 85
+		switch round % 4 {
+		case 0:
+			lat = 80 + rng.Float64()*5
+		case 1:
+			long = 179.9 - rng.Float64()*0.2
+		}
+		// radiuses from meters to thousands of kilometers
+		radius := 1 + rng.Float64()*float64(int(1)<<(3*(round%8)))
+		var shapeArgs []string
+		shape := geoShape{long: long, lat: lat, conversion: 1}
+		if rng.IntN(2) == 0 {
+			shape.radius = radius
+			shapeArgs = []string{"BYRADIUS", strconv.FormatFloat(radius, 'f', -1, 64), "m"}
+		} else {
+			shape.box, shape.width, shape.height = true, radius*2, radius
+			shapeArgs = []string{"BYBOX", strconv.FormatFloat(radius*2, 'f', -1, 64), strconv.FormatFloat(radius, 'f', -1, 64), "m"}
+		}
+
+		args := []string{"GEOADD", "points"}
+		for i := range 400 {
+			// points spread around the center at up to twice the radius
+			pLong := long + (rng.Float64()*4-2)*radius/111000/max(0.05, math.Cos(degRad(lat)))
+			pLat := lat + (rng.Float64()*4-2)*radius/111000
+			// past the antimeridian, wrap around
+			if pLong >= geoLongMax {
+				pLong -= 360
+			} else if pLong < geoLongMin {
+				pLong += 360
+			}
+			if pLat >= geoLatMax || pLat <= geoLatMin {
+				continue
+			}
+			args = append(args, strconv.FormatFloat(pLong, 'f', -1, 64), strconv.FormatFloat(pLat, 'f', -1, 64), strconv.Itoa(i))
+		}
+		c.do(args...)
+
+		var want []string
+		kv.mu.Lock()
+		z := kv.lookupObject("points").ptr.(*zset)
+		for n := z.zsl.header.level[0].forward; n != nil; n = n.level[0].forward {
+			pLong, pLat := decodeGeoScore(n.score)
+			if _, ok := shape.contains(pLong, pLat); ok {
+				want = append(want, n.member)
+			}
+		}
+		kv.mu.Unlock()
+		search := append([]string{"GEOSEARCH", "points", "FROMLONLAT",
+			strconv.FormatFloat(long, 'f', -1, 64), strconv.FormatFloat(lat, 'f', -1, 64)}, shapeArgs...)
+		var got []string
+		for _, m := range c.do(search...).([]any) {
+			got = append(got, m.(string))
+		}
+		slices.Sort(want)
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Fatalf("%v found %d points, a scan %d", search, len(got), len(want))
+		}
+	}
+}
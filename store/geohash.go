@@ -0,0 +1,327 @@
+package store
+
+import "math"
+
+// Geohashes as Redis computes them: latitude and longitude are each scaled
+// to step bits over their range and interleaved, latitude in the even bits
+// and longitude in the odd ones. GEO sets store the 52-bit (step 26) hash
+// of each member as its score. Latitudes stop short of the poles at the
+// limits of Web Mercator.
+
+const (
+	geoStepMax = 26
+	geoLatMin  = -85.05112878
+	geoLatMax  = 85.05112878
+	geoLongMin = -180.0
+	geoLongMax = 180.0
+
+	earthRadiusMeters = 6372797.560856
+	mercatorMax       = 20037726.37
+)
+
+type geoRange struct {
+	min, max float64
+}
+
+var (
+	geoLongRange = geoRange{geoLongMin, geoLongMax}
+	geoLatRange  = geoRange{geoLatMin, geoLatMax}
+)
+
+type geoHash struct {
+	bits uint64
+	step uint
+}
+
+func (h geoHash) isZero() bool {
+	return h.bits == 0 && h.step == 0
+}
+
+// align52 returns the hash scaled to 52 bits, as used for scores.
+func (h geoHash) align52() uint64 {
+	return h.bits << (52 - h.step*2)
+}
+
+// geoArea is the box a geohash covers.
+type geoArea struct {
+	long, lat geoRange
+}
+
+// interleave64 spreads the bits of x over the even bits of the result and
+// those of y over the odd bits.
+func interleave64(x, y uint32) uint64 {
+	spread := func(v uint32) uint64 {
+		b := uint64(v)
+		b = (b | b<<16) & 0x0000FFFF0000FFFF
+		b = (b | b<<8) & 0x00FF00FF00FF00FF
+		b = (b | b<<4) & 0x0F0F0F0F0F0F0F0F
+		b = (b | b<<2) & 0x3333333333333333
+		b = (b | b<<1) & 0x5555555555555555
+		return b
+	}
+	return spread(x) | spread(y)<<1
+}
+
+// deinterleave64 undoes interleave64.
+func deinterleave64(v uint64) (x, y uint32) {
+	squash := func(b uint64) uint32 {
+		b &= 0x5555555555555555
+		b = (b | b>>1) & 0x3333333333333333
+		b = (b | b>>2) & 0x0F0F0F0F0F0F0F0F
+		b = (b | b>>4) & 0x00FF00FF00FF00FF
+		b = (b | b>>8) & 0x0000FFFF0000FFFF
+		b = (b | b>>16) & 0x00000000FFFFFFFF
+		return uint32(b)
+	}
+	return squash(v), squash(v >> 1)
+}
+
+// geohashEncode hashes a point to step bits per coordinate within the
+// given ranges. It reports false for a point outside them.
+func geohashEncode(longRange, latRange geoRange, long, lat float64, step uint) (geoHash, bool) {
+	if long > geoLongMax || long < geoLongMin || lat > geoLatMax || lat < geoLatMin {
+		return geoHash{}, false
+	}
+	if lat < latRange.min || lat > latRange.max || long < longRange.min || long > longRange.max {
+		return geoHash{}, false
+	}
+	latOffset := (lat - latRange.min) / (latRange.max - latRange.min)
+	longOffset := (long - longRange.min) / (longRange.max - longRange.min)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return geoHash{bits: interleave64(uint32(latOffset), uint32(longOffset)), step: step}, true
+}
+
+// geohashDecode returns the box covered by hash.
+func geohashDecode(longRange, latRange geoRange, hash geoHash) geoArea {
+	ilat, ilong := deinterleave64(hash.bits)
+	latScale := latRange.max - latRange.min
+	longScale := longRange.max - longRange.min
+	cells := float64(uint64(1) << hash.step)
+	return geoArea{
+		lat: geoRange{
+			latRange.min + (float64(ilat)/cells)*latScale,
+			latRange.min + (float64(uint64(ilat)+1)/cells)*latScale,
+		},
+		long: geoRange{
+			longRange.min + (float64(ilong)/cells)*longScale,
+			longRange.min + (float64(uint64(ilong)+1)/cells)*longScale,
+		},
+	}
+}
+
+// center returns the middle of the box, clamped to the valid coordinates.
+func (a geoArea) center() (long, lat float64) {
+	long = (a.long.min + a.long.max) / 2
+	lat = (a.lat.min + a.lat.max) / 2
+	long = min(max(long, geoLongMin), geoLongMax)
+	lat = min(max(lat, geoLatMin), geoLatMax)
+	return long, lat
+}
+
+// geoScore returns the score a point is stored with.
+func geoScore(long, lat float64) (float64, bool) {
+	hash, ok := geohashEncode(geoLongRange, geoLatRange, long, lat, geoStepMax)
+	return float64(hash.align52()), ok
+}
+
+// decodeGeoScore returns the point a score stands for: the center of its
+// 52-bit box.
+func decodeGeoScore(score float64) (long, lat float64) {
+	hash := geoHash{bits: uint64(score), step: geoStepMax}
+	return geohashDecode(geoLongRange, geoLatRange, hash).center()
+}
+
+// geohashMoveX moves hash d cells east (d > 0) or west.
+func geohashMoveX(hash *geoHash, d int) {
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - hash.step*2)
+	if d > 0 {
+		x += zz + 1
+	} else {
+		x |= zz
+		x -= zz + 1
+	}
+	x &= 0xaaaaaaaaaaaaaaaa >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+// geohashMoveY moves hash d cells north (d > 0) or south.
+func geohashMoveY(hash *geoHash, d int) {
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	if d > 0 {
+		y += zz + 1
+	} else {
+		y |= zz
+		y -= zz + 1
+	}
+	y &= 0x5555555555555555 >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+// geoNeighbors are the eight boxes around a geohash box.
+type geoNeighbors struct {
+	north, south, east, west                   geoHash
+	northEast, northWest, southEast, southWest geoHash
+}
+
+func geohashNeighbors(hash geoHash) geoNeighbors {
+	moved := func(dx, dy int) geoHash {
+		h := hash
+		if dx != 0 {
+			geohashMoveX(&h, dx)
+		}
+		if dy != 0 {
+			geohashMoveY(&h, dy)
+		}
+		return h
+	}
+	return geoNeighbors{
+		north: moved(0, 1), south: moved(0, -1), east: moved(1, 0), west: moved(-1, 0),
+		northEast: moved(1, 1), northWest: moved(-1, 1), southEast: moved(1, -1), southWest: moved(-1, -1),
+	}
+}
+
+func degRad(ang float64) float64 { return ang * (math.Pi / 180) }
+func radDeg(ang float64) float64 { return ang / (math.Pi / 180) }
+
+// geoLatDistance is the distance between two latitudes along a meridian.
+func geoLatDistance(lat1, lat2 float64) float64 {
+	return earthRadiusMeters * math.Abs(degRad(lat2)-degRad(lat1))
+}
+
+// geoDistance is the haversine distance in meters between two points.
+func geoDistance(long1, lat1, long2, lat2 float64) float64 {
+	v := math.Sin((degRad(long2) - degRad(long1)) / 2)
+	if v == 0 {
+		// same meridian: skip the expensive part
+		return geoLatDistance(lat1, lat2)
+	}
+	lat1r, lat2r := degRad(lat1), degRad(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+// geoShape is the area a GEOSEARCH covers: a circle of radius, or a box
+// of width by height, around a center, with sizes in units of conversion
+// meters.
+type geoShape struct {
+	long, lat     float64
+	box           bool
+	radius        float64
+	width, height float64
+	conversion    float64
+}
+
+// contains reports whether a point is within the shape and its distance
+// from the center in meters.
+func (s *geoShape) contains(long, lat float64) (float64, bool) {
+	if !s.box {
+		d := geoDistance(s.long, s.lat, long, lat)
+		return d, d <= s.radius*s.conversion
+	}
+	// the latitude test is the cheaper one, so it goes first
+	if geoLatDistance(lat, s.lat) > s.height*s.conversion/2 {
+		return 0, false
+	}
+	if geoDistance(long, lat, s.long, lat) > s.width*s.conversion/2 {
+		return 0, false
+	}
+	return geoDistance(s.long, s.lat, long, lat), true
+}
+
+// boundingBox returns the min and max longitude and latitude of a box
+// around the shape.
+func (s *geoShape) boundingBox() (minLong, minLat, maxLong, maxLat float64) {
+	height, width := s.radius, s.radius
+	if s.box {
+		height, width = s.height/2, s.width/2
+	}
+	height *= s.conversion
+	width *= s.conversion
+	latDelta := radDeg(height / earthRadiusMeters)
+	longDeltaTop := radDeg(width / earthRadiusMeters / math.Cos(degRad(s.lat+latDelta)))
+	longDeltaBottom := radDeg(width / earthRadiusMeters / math.Cos(degRad(s.lat-latDelta)))
+	// the hemispheres widen in opposite directions
+	if s.lat < 0 {
+		return s.long - longDeltaBottom, s.lat - latDelta, s.long + longDeltaBottom, s.lat + latDelta
+	}
+	return s.long - longDeltaTop, s.lat - latDelta, s.long + longDeltaTop, s.lat + latDelta
+}
+
+// geoEstimateSteps picks the geohash precision whose boxes are about the
+// size of a search radius.
+func geoEstimateSteps(rangeMeters, lat float64) uint {
+	if rangeMeters == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2 // make sure the range is included in most base cases
+	// boxes get narrower towards the poles
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	return uint(min(max(step, 1), geoStepMax))
+}
+
+// searchAreas returns the geohash boxes to scan for the shape: the box of
+// its center and the neighbors that the shape may reach into, in the order
+// Redis scans them. Boxes not worth scanning are zero.
+func (s *geoShape) searchAreas() [9]geoHash {
+	minLong, minLat, maxLong, maxLat := s.boundingBox()
+	radius := s.radius
+	if s.box {
+		radius = math.Sqrt((s.width/2)*(s.width/2) + (s.height/2)*(s.height/2))
+	}
+	steps := geoEstimateSteps(radius*s.conversion, s.lat)
+
+	hash, _ := geohashEncode(geoLongRange, geoLatRange, s.long, s.lat, steps)
+	neighbors := geohashNeighbors(hash)
+	area := geohashDecode(geoLongRange, geoLatRange, hash)
+
+	// near the edge of its box the shape can reach past the neighbors, in
+	// which case bigger boxes are needed
+	north := geohashDecode(geoLongRange, geoLatRange, neighbors.north)
+	south := geohashDecode(geoLongRange, geoLatRange, neighbors.south)
+	east := geohashDecode(geoLongRange, geoLatRange, neighbors.east)
+	west := geohashDecode(geoLongRange, geoLatRange, neighbors.west)
+	if steps > 1 && (north.lat.max < maxLat || south.lat.min > minLat ||
+		east.long.max < maxLong || west.long.min > minLong) {
+		steps--
+		hash, _ = geohashEncode(geoLongRange, geoLatRange, s.long, s.lat, steps)
+		neighbors = geohashNeighbors(hash)
+		area = geohashDecode(geoLongRange, geoLatRange, hash)
+	}
+
+	// skip the neighbors the shape does not reach
+	if steps >= 2 {
+		if area.lat.min < minLat {
+			neighbors.south, neighbors.southWest, neighbors.southEast = geoHash{}, geoHash{}, geoHash{}
+		}
+		if area.lat.max > maxLat {
+			neighbors.north, neighbors.northEast, neighbors.northWest = geoHash{}, geoHash{}, geoHash{}
+		}
+		if area.long.min < minLong {
+			neighbors.west, neighbors.southWest, neighbors.northWest = geoHash{}, geoHash{}, geoHash{}
+		}
+		if area.long.max > maxLong {
+			neighbors.east, neighbors.southEast, neighbors.northEast = geoHash{}, geoHash{}, geoHash{}
+		}
+	}
+	return [9]geoHash{
+		hash,
+		neighbors.north, neighbors.south, neighbors.east, neighbors.west,
+		neighbors.northEast, neighbors.northWest, neighbors.southEast, neighbors.southWest,
+	}
+}
@@ -0,0 +1,103 @@
+package store
+
+// globMatch reports whether str matches the Redis glob pattern p, as used
+// by KEYS and the MATCH option of the SCAN family. It supports *, ?, [...]
+// character classes with ranges and ^ negation, and \ escapes.
+func globMatch(p, str string, nocase bool) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '*':
+			for len(p) > 1 && p[1] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if globMatch(p[1:], str[i:], nocase) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			p = p[1:]
+			not := len(p) > 0 && p[0] == '^'
+			if not {
+				p = p[1:]
+			}
+			match := false
+			for len(p) > 0 && p[0] != ']' {
+				switch {
+				case p[0] == '\\' && len(p) >= 2:
+					p = p[1:]
+					if equalFold(p[0], str[0], nocase) {
+						match = true
+					}
+				case len(p) >= 3 && p[1] == '-':
+					lo, hi := p[0], p[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					c := str[0]
+					if nocase {
+						lo, hi, c = lower(lo), lower(hi), lower(c)
+					}
+					if c >= lo && c <= hi {
+						match = true
+					}
+					p = p[2:]
+				default:
+					if equalFold(p[0], str[0], nocase) {
+						match = true
+					}
+				}
+				p = p[1:]
+			}
+			if len(p) == 0 {
+				// unterminated class: treat the end of the pattern as ']'
+				p = "]"
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(p) >= 2 {
+				p = p[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || !equalFold(p[0], str[0], nocase) {
+				return false
+			}
+			str = str[1:]
+		}
+		p = p[1:]
+	}
+	return len(str) == 0
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func equalFold(a, b byte, nocase bool) bool {
+	if nocase {
+		return lower(a) == lower(b)
+	}
+	return a == b
+}
@@ -0,0 +1,604 @@
+package store
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// hash is the value of a hash key. Fields may carry their own deadlines,
+// kept in ttls, which stays nil until a field first gets one.
+type hash struct {
+	fields *dict[string]
+	ttls   *expiryIndex
+}
+
+func newHash() *hash {
+	return &hash{fields: newDict[string]()}
+}
+
+func (h *hash) len() int {
+	return h.fields.len()
+}
+
+// set stores a field, dropping any deadline it had, and reports whether the
+// field is new.
+func (h *hash) set(field, value string) bool {
+	if h.ttls != nil {
+		h.ttls.remove(field)
+	}
+	return h.fields.set(field, value)
+}
+
+func (h *hash) del(field string) bool {
+	if h.ttls != nil {
+		h.ttls.remove(field)
+	}
+	return h.fields.delete(field)
+}
+
+// expireFields drops the fields whose deadline is not after now.
+func (h *hash) expireFields(now int64) {
+	for h.ttls != nil {
+		e, ok := h.ttls.earliest()
+		if !ok || e.at > now {
+			break
+		}
+		h.del(e.key)
+	}
+	if h.ttls != nil && h.ttls.len() == 0 {
+		h.ttls = nil
+	}
+}
+
+// lookupHash returns the hash stored at key with its expired fields
+// dropped, or nil if there is none. ok is false if key holds another type.
+// The caller must hold kv.mu.
+func (kv *KVStore) lookupHash(key string) (h *hash, ok bool) {
+	h, ok = lookupTyped[*hash](kv, key, objHash)
+	if h != nil && h.ttls != nil {
+		h.expireFields(time.Now().UnixMilli())
+		kv.hashChanged(key, h)
+		if h.len() == 0 {
+			return nil, true
+		}
+	}
+	return h, ok
+}
+
+// hashForWrite is lookupHash for commands that add fields: a missing hash
+// is created. The caller must hold kv.mu.
+func (kv *KVStore) hashForWrite(key string) (h *hash, ok bool) {
+	h, ok = kv.lookupHash(key)
+	if ok && h == nil {
+		h = newHash()
+		kv.storeValue(key, h)
+	}
+	return h, ok
+}
+
+// hashChanged keeps the keyspace in step with a hash that just lost fields
+// or had field deadlines changed: an empty hash is deleted, and only hashes
+// with field deadlines are left for the active expire cycle to visit. The
+// caller must hold kv.mu.
+func (kv *KVStore) hashChanged(key string, h *hash) {
+	switch {
+	case h.len() == 0:
+		kv.removeKey(key)
+	case h.ttls == nil:
+		delete(kv.volatileHashes, key)
+	default:
+		kv.volatileHashes[key] = struct{}{}
+	}
+}
+
+// expireHashFields is the part of the active expire cycle that reclaims
+// expired hash fields nobody is reading. The caller must hold kv.mu.
+func (kv *KVStore) expireHashFields() {
+	now := time.Now().UnixMilli()
+	visited := 0
+	for key := range kv.volatileHashes {
+		if visited == activeExpireSample {
+			return
+		}
+		kv.preserve(key)
+		h := kv.lookupObject(key).ptr.(*hash)
+		h.expireFields(now)
+		kv.hashChanged(key, h)
+		visited++
+	}
+}
+
+func (kv *KVStore) hsetCommand(args []string) []byte {
+	name := strings.ToLower(args[0])
+	if len(args) < 4 || len(args)%2 != 0 {
+		return wrongArgs(name)
+	}
+	h, ok := kv.hashForWrite(args[1])
+	if !ok {
+		return errWrongType
+	}
+	created := 0
+	for i := 2; i < len(args); i += 2 {
+		if h.set(args[i], args[i+1]) {
+			created++
+		}
+	}
+	kv.dirty += (len(args) - 2) / 2
+	if name == "hmset" {
+		return respgo.EncodeSimpleString("OK")
+	}
+	return respgo.EncodeInteger(created)
+}
+
+func (kv *KVStore) hsetnxCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs("hsetnx")
+	}
+	h, ok := kv.hashForWrite(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if _, exists := h.fields.get(args[2]); exists {
+		return respgo.EncodeInteger(0)
+	}
+	h.set(args[2], args[3])
+	kv.dirty++
+	return respgo.EncodeInteger(1)
+}
+
+func (kv *KVStore) hgetCommand(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs("hget")
+	}
+	h, ok := kv.lookupHash(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if h == nil {
+		return nilBulk
+	}
+	v, found := h.fields.get(args[2])
+	if !found {
+		return nilBulk
+	}
+	return respgo.EncodeBulkString(v)
+}
+
+func (kv *KVStore) hmgetCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("hmget")
+	}
+	h, ok := kv.lookupHash(args[1])
+	if !ok {
+		return errWrongType
+	}
+	frames := make([][]byte, 0, len(args)-2)
+	for _, field := range args[2:] {
+		var v string
+		found := false
+		if h != nil {
+			v, found = h.fields.get(field)
+		}
+		if found {
+			frames = append(frames, respgo.EncodeBulkString(v))
+		} else {
+			frames = append(frames, nilBulk)
+		}
+	}
+	return respgo.EncodeRawArray(frames...)
+}
+
+func (kv *KVStore) hdelCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("hdel")
+	}
+	h, ok := kv.lookupHash(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if h == nil {
+		return respgo.EncodeInteger(0)
+	}
+	deleted := 0
+	for _, field := range args[2:] {
+		if h.del(field) {
+			deleted++
+		}
+	}
+	kv.hashChanged(args[1], h)
+	kv.dirty += deleted
+	return respgo.EncodeInteger(deleted)
+}
+
+func (kv *KVStore) hlenCommand(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs("hlen")
+	}
+	h, ok := kv.lookupHash(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if h == nil {
+		return respgo.EncodeInteger(0)
+	}
+	return respgo.EncodeInteger(h.len())
+}
+
+func (kv *KVStore) hstrlenCommand(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs("hstrlen")
+	}
+	h, ok := kv.lookupHash(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if h == nil {
+		return respgo.EncodeInteger(0)
+	}
+	v, _ := h.fields.get(args[2])
+	return respgo.EncodeInteger(len(v))
+}
+
+func (kv *KVStore) hexistsCommand(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs("hexists")
+	}
+	h, ok := kv.lookupHash(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if h == nil {
+		return respgo.EncodeInteger(0)
+	}
+	if _, found := h.fields.get(args[2]); found {
+		return respgo.EncodeInteger(1)
+	}
+	return respgo.EncodeInteger(0)
+}
+
+// hgetallCommand implements HGETALL, HKEYS and HVALS.
+func (kv *KVStore) hgetallCommand(args []string) []byte {
+	name := strings.ToLower(args[0])
+	if len(args) != 2 {
+		return wrongArgs(name)
+	}
+	h, ok := kv.lookupHash(args[1])
+	if !ok {
+		return errWrongType
+	}
+	var out []string
+	if h != nil {
+		h.fields.each(func(field, value string) bool {
+			switch name {
+			case "hkeys":
+				out = append(out, field)
+			case "hvals":
+				out = append(out, value)
+			default:
+				out = append(out, field, value)
+			}
+			return true
+		})
+	}
+	return respgo.EncodeArray(out)
+}
+
+func (kv *KVStore) hincrbyCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs("hincrby")
+	}
+	incr, ok := parseInt(args[3])
+	if !ok {
+		return errNotInteger
+	}
+	h, ok := kv.hashForWrite(args[1])
+	if !ok {
+		return errWrongType
+	}
+	var cur int64
+	if v, found := h.fields.get(args[2]); found {
+		if cur, ok = parseInt(v); !ok {
+			return respgo.EncodeError("ERR hash value is not an integer")
+		}
+	}
+	if (incr < 0 && cur < 0 && incr < math.MinInt64-cur) ||
+		(incr > 0 && cur > 0 && incr > math.MaxInt64-cur) {
+		return respgo.EncodeError("ERR increment or decrement would overflow")
+	}
+	cur += incr
+	// a field keeps its deadline when incremented
+	h.fields.set(args[2], strconv.FormatInt(cur, 10))
+	kv.dirty++
+	return respgo.EncodeInteger(int(cur))
+}
+
+func (kv *KVStore) hincrbyfloatCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs("hincrbyfloat")
+	}
+	incr, ok := parseLongDouble(args[3])
+	if !ok {
+		return respgo.EncodeError("ERR value is not a valid float")
+	}
+	h, ok := kv.hashForWrite(args[1])
+	if !ok {
+		return errWrongType
+	}
+	cur, _ := parseLongDouble("0")
+	if v, found := h.fields.get(args[2]); found {
+		if cur, ok = parseLongDouble(v); !ok {
+			return respgo.EncodeError("ERR hash value is not a float")
+		}
+	}
+	out, ok := incrFloat(cur, incr)
+	if !ok {
+		kv.hashChanged(args[1], h)
+		return respgo.EncodeError("ERR increment would produce NaN or Infinity")
+	}
+	h.fields.set(args[2], out)
+	kv.dirty++
+	// replicas must not redo float arithmetic that may round differently
+	kv.rewriteCommand("HSET", args[1], args[2], out)
+	return respgo.EncodeBulkString(out)
+}
+
+func (kv *KVStore) hrandfieldCommand(args []string) []byte {
+	if len(args) < 2 || len(args) > 4 {
+		return wrongArgs("hrandfield")
+	}
+	h, ok := kv.lookupHash(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if len(args) == 2 {
+		if h == nil {
+			return nilBulk
+		}
+		field, _ := h.fields.random()
+		return respgo.EncodeBulkString(field)
+	}
+
+	count, ok := parseInt(args[2])
+	if !ok {
+		return errNotInteger
+	}
+	withValues := false
+	if len(args) == 4 {
+		if strings.ToUpper(args[3]) != "WITHVALUES" {
+			return errSyntax
+		}
+		withValues = true
+	}
+	if count == math.MinInt64 || (withValues && count < -math.MaxInt64/2) {
+		return respgo.EncodeError("ERR value is out of range")
+	}
+	if h == nil || count == 0 {
+		return respgo.EncodeArray(nil)
+	}
+
+	var out []string
+	h.fields.sample(count, func(field, value string) {
+		out = append(out, field)
+		if withValues {
+			out = append(out, value)
+		}
+	})
+	return respgo.EncodeArray(out)
+}
+
+func (kv *KVStore) hscanCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("hscan")
+	}
+	cursor, opts, errReply := parseScanArgs(args[2:], false, true)
+	if errReply != nil {
+		return errReply
+	}
+	h, ok := kv.lookupHash(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if h == nil {
+		return scanReply(0, nil)
+	}
+	var out []string
+	cursor = h.fields.scan(cursor, opts.count, func(field, value string) {
+		if opts.matches(field) {
+			out = append(out, field)
+			if !opts.noValues {
+				out = append(out, value)
+			}
+		}
+	})
+	return scanReply(cursor, out)
+}
+
+// maxFieldDeadline is the latest deadline, in unix milliseconds, a hash
+// field may be given. Redis stores field deadlines in 48 bits.
+const maxFieldDeadline = 1<<48 - 1
+
+// hashFieldArgs parses the FIELDS numfields field [field ...] tail shared by
+// the hash field expiry commands.
+func hashFieldArgs(args []string) ([]string, []byte) {
+	if len(args) < 3 || strings.ToUpper(args[0]) != "FIELDS" {
+		return nil, respgo.EncodeError("ERR Mandatory argument FIELDS is missing or not at the right position")
+	}
+	n, ok := parseInt(args[1])
+	if !ok {
+		return nil, errNotInteger
+	}
+	if n <= 0 {
+		return nil, respgo.EncodeError("ERR Parameter `numFields` should be greater than 0")
+	}
+	if n != int64(len(args)-2) {
+		return nil, respgo.EncodeError("ERR The `numfields` parameter must match the number of arguments")
+	}
+	return args[2:], nil
+}
+
+// hexpireCommand implements HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT.
+// unit and absolute mean the same as for expireCommand.
+func (kv *KVStore) hexpireCommand(args []string, unit int64, absolute bool) []byte {
+	name := strings.ToLower(args[0])
+	if len(args) < 6 {
+		return wrongArgs(name)
+	}
+	key := args[1]
+	when, ok := parseInt(args[2])
+	if !ok {
+		return errNotInteger
+	}
+	rest := args[3:]
+	cond := ""
+	switch strings.ToUpper(rest[0]) {
+	case "NX", "XX", "GT", "LT":
+		cond = strings.ToUpper(rest[0])
+		rest = rest[1:]
+	}
+	fields, errReply := hashFieldArgs(rest)
+	if errReply != nil {
+		return errReply
+	}
+	when, ok = resolveDeadline(when, unit, absolute)
+	if !ok || when < 0 || when > maxFieldDeadline {
+		return respgo.EncodeError("ERR invalid expire time, must be >= 0 and <= " + strconv.FormatInt(maxFieldDeadline, 10))
+	}
+
+	h, ok := kv.lookupHash(key)
+	if !ok {
+		return errWrongType
+	}
+	results := make([][]byte, len(fields))
+	changed := false
+	now := time.Now().UnixMilli()
+	for i, field := range fields {
+		if h == nil {
+			results[i] = respgo.EncodeInteger(-2)
+			continue
+		}
+		if _, found := h.fields.get(field); !found {
+			results[i] = respgo.EncodeInteger(-2)
+			continue
+		}
+		var current int64
+		volatile := false
+		if h.ttls != nil {
+			current, volatile = h.ttls.get(field)
+		}
+		if (cond == "NX" && volatile) ||
+			(cond == "XX" && !volatile) ||
+			(cond == "GT" && (!volatile || when <= current)) ||
+			(cond == "LT" && volatile && when >= current) {
+			results[i] = respgo.EncodeInteger(0)
+			continue
+		}
+		changed = true
+		if when <= now {
+			h.del(field)
+			results[i] = respgo.EncodeInteger(2)
+			continue
+		}
+		if h.ttls == nil {
+			h.ttls = newExpiryIndex()
+		}
+		h.ttls.set(field, when)
+		results[i] = respgo.EncodeInteger(1)
+	}
+	if changed {
+		kv.hashChanged(key, h)
+		kv.dirty++
+		propagated := []string{"HPEXPIREAT", key, strconv.FormatInt(when, 10)}
+		if cond != "" {
+			propagated = append(propagated, cond)
+		}
+		propagated = append(propagated, "FIELDS", strconv.Itoa(len(fields)))
+		kv.rewriteCommand(append(propagated, fields...)...)
+	}
+	return respgo.EncodeRawArray(results...)
+}
+
+// httlCommand implements HTTL, HPTTL, HEXPIRETIME and HPEXPIRETIME. unit is
+// the reporting unit in milliseconds; absolute reports deadlines rather
+// than the time left.
+func (kv *KVStore) httlCommand(args []string, unit int64, absolute bool) []byte {
+	if len(args) < 5 {
+		return wrongArgs(strings.ToLower(args[0]))
+	}
+	fields, errReply := hashFieldArgs(args[2:])
+	if errReply != nil {
+		return errReply
+	}
+	h, ok := kv.lookupHash(args[1])
+	if !ok {
+		return errWrongType
+	}
+	results := make([][]byte, len(fields))
+	now := time.Now().UnixMilli()
+	for i, field := range fields {
+		if h == nil {
+			results[i] = respgo.EncodeInteger(-2)
+			continue
+		}
+		if _, found := h.fields.get(field); !found {
+			results[i] = respgo.EncodeInteger(-2)
+			continue
+		}
+		var at int64
+		volatile := false
+		if h.ttls != nil {
+			at, volatile = h.ttls.get(field)
+		}
+		switch {
+		case !volatile:
+			results[i] = respgo.EncodeInteger(-1)
+		case absolute:
+			results[i] = respgo.EncodeInteger(int(at / unit))
+		default:
+			ttl := max(at-now, 0)
+			results[i] = respgo.EncodeInteger(int((ttl + unit/2) / unit))
+		}
+	}
+	return respgo.EncodeRawArray(results...)
+}
+
+func (kv *KVStore) hpersistCommand(args []string) []byte {
+	if len(args) < 5 {
+		return wrongArgs("hpersist")
+	}
+	fields, errReply := hashFieldArgs(args[2:])
+	if errReply != nil {
+		return errReply
+	}
+	h, ok := kv.lookupHash(args[1])
+	if !ok {
+		return errWrongType
+	}
+	results := make([][]byte, len(fields))
+	for i, field := range fields {
+		if h == nil {
+			results[i] = respgo.EncodeInteger(-2)
+			continue
+		}
+		if _, found := h.fields.get(field); !found {
+			results[i] = respgo.EncodeInteger(-2)
+			continue
+		}
+		if h.ttls == nil || !h.ttls.remove(field) {
+			results[i] = respgo.EncodeInteger(-1)
+			continue
+		}
+		results[i] = respgo.EncodeInteger(1)
+		kv.dirty++
+	}
+	if h != nil {
+		if h.ttls != nil && h.ttls.len() == 0 {
+			h.ttls = nil
+		}
+		kv.hashChanged(args[1], h)
+	}
+	return respgo.EncodeRawArray(results...)
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHashCommands(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("SET", "str", "v")
+	runSteps(c, []step{
+		{"HSET h a 1 b 2", "2"},
+		{"HSET h b 3 c 4", "1"},
+		{"HMSET h d 5", "+OK"},
+		{"HSETNX h a 9", "0"},
+		{"HSETNX h e 6", "1"},
+		{"HGET h b", "3"},
+		{"HGET h missing", "(nil)"},
+		{"HGET nohash a", "(nil)"},
+		{"HMGET h a missing e", "[1 (nil) 6]"},
+		{"HMGET nohash a", "[(nil)]"},
+		{"HLEN h", "5"},
+		{"HLEN nohash", "0"},
+		{"HSTRLEN h a", "1"},
+		{"HSTRLEN h missing", "0"},
+		{"HEXISTS h c", "1"},
+		{"HEXISTS h missing", "0"},
+		{"HGETALL h", "[a 1 b 3 c 4 d 5 e 6]"},
+		{"HKEYS h", "[a b c d e]"},
+		{"HVALS h", "[1 3 4 5 6]"},
+		{"HGETALL nohash", "[]"},
+		{"HDEL h a missing", "1"},
+		{"HKEYS h", "[e b c d]"},
+
+		{"HINCRBY h b 10", "13"},
+		{"HINCRBY h new -5", "-5"},
+		{"HINCRBY h b x", "-ERR value is not an integer or out of range"},
+		{"HSET h big 9223372036854775807 word abc", "2"},
+		{"HINCRBY h big 1", "-ERR increment or decrement would overflow"},
+		{"HINCRBY h word 1", "-ERR hash value is not an integer"},
+		{"HINCRBYFLOAT h f 10.5", "10.5"},
+		{"HINCRBYFLOAT h f 0.1", "10.6"},
+		{"HINCRBYFLOAT h b 1.5e3", "1513"},
+		{"HINCRBYFLOAT h word 1", "-ERR hash value is not a float"},
+		{"HINCRBYFLOAT h f x", "-ERR value is not a valid float"},
+		{"HINCRBYFLOAT h f inf", "-ERR increment would produce NaN or Infinity"},
+
+		{"HDEL h e b c d new big word f", "8"},
+		{"EXISTS h", "0"},
+		{"HDEL h a", "0"},
+
+		{"HSET str a 1", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"HGET str a", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"HGETALL str", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"HSET h a", "-ERR wrong number of arguments for 'hset' command"},
+		{"HMSET h a 1 b", "-ERR wrong number of arguments for 'hmset' command"},
+		{"HGET h", "-ERR wrong number of arguments for 'hget' command"},
+	})
+}
+
+func TestHashRandomFieldsAndScan(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("HSET", "h", "a", "1", "b", "2", "c", "3")
+	runSteps(c, []step{
+		{"HRANDFIELD nohash", "(nil)"},
+		{"HRANDFIELD nohash 3", "[]"},
+		{"HRANDFIELD h 0", "[]"},
+		{"HRANDFIELD h 3 WITHSCORES", "-ERR syntax error"},
+		{"HRANDFIELD h x", "-ERR value is not an integer or out of range"},
+		{"HRANDFIELD h -9223372036854775808", "-ERR value is out of range"},
+		{"HSCAN h 0", "[0 [c 3 b 2 a 1]]"},
+		{"HSCAN h 0 MATCH [ab] NOVALUES", "[0 [b a]]"},
+		{"HSCAN nohash 0", "[0 []]"},
+	})
+
+	for _, tc := range []struct {
+		count    string
+		n        int
+		distinct bool
+	}{
+		{"2", 2, true},
+		{"10", 3, true},
+		{"-10", 10, false},
+	} {
+		reply, ok := c.do("HRANDFIELD", "h", tc.count, "WITHVALUES").([]any)
+		if !ok || len(reply) != 2*tc.n {
+			t.Errorf("HRANDFIELD h %s WITHVALUES = %v, want %d fields with values", tc.count, reply, tc.n)
+			continue
+		}
+		seen := make(map[any]bool)
+		for i := 0; i < len(reply); i += 2 {
+			field, value := reply[i].(string), reply[i+1]
+			if want := strconv.Itoa(int(field[0]-'a') + 1); value != want {
+				t.Errorf("HRANDFIELD h %s WITHVALUES paired %s with %v", tc.count, field, value)
+			}
+			if tc.distinct && seen[field] {
+				t.Errorf("HRANDFIELD h %s repeated %s", tc.count, field)
+			}
+			seen[field] = true
+		}
+	}
+	if got, _ := c.do("HRANDFIELD", "h").(string); got != "a" && got != "b" && got != "c" {
+		t.Errorf("HRANDFIELD h = %q, want one of its fields", got)
+	}
+}
+
+func TestHashFieldExpiry(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("HSET", "h", "a", "1", "b", "2", "c", "3", "n", "10")
+	runSteps(c, []step{
+		{"HTTL h FIELDS 2 a missing", "[-1 -2]"},
+		{"HTTL nohash FIELDS 1 a", "[-2]"},
+		{"HEXPIRE h 100 FIELDS 2 a missing", "[1 -2]"},
+		{"HTTL h FIELDS 1 a", "[100]"},
+		{"HEXPIRE h 200 NX FIELDS 2 a b", "[0 1]"},
+		{"HEXPIRE h 50 GT FIELDS 2 a c", "[0 0]"},
+		{"HEXPIRE h 300 GT FIELDS 1 a", "[1]"},
+		{"HEXPIRE h 150 LT FIELDS 2 a c", "[1 1]"},
+		{"HEXPIRE h 400 XX FIELDS 2 a n", "[1 0]"},
+		{"HPEXPIRE h 100000 FIELDS 1 b", "[1]"},
+		{"HPTTL h FIELDS 1 b", "[100000]"},
+		{"HEXPIREAT h 4102444800 FIELDS 1 c", "[1]"},
+		{"HEXPIRETIME h FIELDS 1 c", "[4102444800]"},
+		{"HPEXPIRETIME h FIELDS 1 c", "[4102444800000]"},
+		{"HPEXPIREAT h 4102444800123 FIELDS 1 c", "[1]"},
+		{"HEXPIRETIME h FIELDS 1 c", "[4102444800]"},
+
+		// HINCRBY keeps a deadline, HSET drops it
+		{"HEXPIRE h 100 FIELDS 1 n", "[1]"},
+		{"HINCRBY h n 1", "11"},
+		{"HTTL h FIELDS 1 n", "[100]"},
+		{"HSET h n 0", "0"},
+		{"HTTL h FIELDS 1 n", "[-1]"},
+
+		{"HPERSIST h FIELDS 3 a n missing", "[1 -1 -2]"},
+		{"HTTL h FIELDS 1 a", "[-1]"},
+
+		// a deadline that has passed deletes the field at once
+		{"HEXPIRE h 0 FIELDS 1 a", "[2]"},
+		{"HEXPIREAT h 1 FIELDS 1 n", "[2]"},
+		{"HKEYS h", "[c b]"},
+
+		{"HEXPIRE h 10 FIELDS 2 a", "-ERR The `numfields` parameter must match the number of arguments"},
+		{"HEXPIRE h 10 FIELDS 0 a", "-ERR Parameter `numFields` should be greater than 0"},
+		{"HEXPIRE h 10 a b c", "-ERR Mandatory argument FIELDS is missing or not at the right position"},
+		{"HPEXPIREAT h -1 FIELDS 1 c", "-ERR invalid expire time, must be >= 0 and <= 281474976710655"},
+		{"HPEXPIREAT h 281474976710656 FIELDS 1 a", "-ERR invalid expire time, must be >= 0 and <= 281474976710655"},
+		{"HTTL h FIELDS 1", "-ERR wrong number of arguments for 'httl' command"},
+	})
+
+	// fields whose deadline passes read as missing, and the hash goes
+	// once the last one does
+	kv.mu.Lock()
+	past := time.Now().UnixMilli() - 1
+	kv.lookupObject("h").ptr.(*hash).ttls.set("b", past)
+	kv.mu.Unlock()
+	runSteps(c, []step{
+		{"HGET h b", "(nil)"},
+		{"HLEN h", "1"},
+		{"HGETALL h", "[c 3]"},
+	})
+	kv.mu.Lock()
+	kv.lookupObject("h").ptr.(*hash).ttls.set("c", past)
+	kv.mu.Unlock()
+	runSteps(c, []step{
+		{"HLEN h", "0"},
+		{"EXISTS h", "0"},
+	})
+}
+
+func TestActiveExpireOfHashFields(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("HSET", "gone", "a", "1")
+	c.do("HSET", "kept", "a", "1", "b", "2")
+	c.do("HPEXPIRE", "gone", "100000", "FIELDS", "1", "a")
+	c.do("HPEXPIRE", "kept", "100000", "FIELDS", "1", "a")
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	past := time.Now().UnixMilli() - 1
+	kv.lookupObject("gone").ptr.(*hash).ttls.set("a", past)
+	kv.lookupObject("kept").ptr.(*hash).ttls.set("a", past)
+	kv.expireHashFields()
+	if kv.keyExists("gone") {
+		t.Error("a hash whose only field expired was not deleted")
+	}
+	h := kv.lookupObject("kept").ptr.(*hash)
+	if _, ok := h.fields.get("a"); ok || h.len() != 1 {
+		t.Errorf("kept has %d fields after its field a expired, want just b", h.len())
+	}
+	if _, ok := kv.volatileHashes["kept"]; ok {
+		t.Error("a hash with no field deadlines left is still visited by the active expire cycle")
+	}
+}
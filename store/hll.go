@@ -0,0 +1,432 @@
+package store
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// HyperLogLogs are strings in Redis's own format, so they can be dumped to
+// and loaded from a real Redis. A value is a 16 byte header
+//
+//	"HYLL" | encoding | 3 unused bytes | cached cardinality
+//
+// followed by 16384 6-bit registers. The cardinality is 8 bytes little
+// endian, with the top bit of the last byte set when it is stale. The
+// dense encoding packs the registers into 12288 bytes, least significant
+// bits first. The sparse encoding run-length codes them with three opcodes:
+//
+//	00xxxxxx          ZERO:  xxxxxx+1 registers set to 0
+//	01xxxxxx yyyyyyyy XZERO: xxxxxxyyyyyyyy+1 registers set to 0
+//	1vvvvvxx          VAL:   xx+1 registers set to vvvvv+1
+//
+// A new HyperLogLog starts sparse and turns dense for good once a register
+// goes above 32 or the sparse form grows past hllSparseMaxBytes.
+
+const (
+	hllP              = 14
+	hllQ              = 64 - hllP
+	hllRegisters      = 1 << hllP
+	hllBits           = 6
+	hllRegisterMax    = 1<<hllBits - 1
+	hllHeaderSize     = 16
+	hllDenseSize      = hllHeaderSize + (hllRegisters*hllBits+7)/8
+	hllSparseMaxBytes = 3000
+	hllSparseValMax   = 32
+	hllXZeroMaxLen    = 16384
+	hllZeroMaxLen     = 64
+	hllValMaxLen      = 4
+
+	hllEncDense  = 0
+	hllEncSparse = 1
+)
+
+var (
+	errNotHLL     = respgo.EncodeError("WRONGTYPE Key is not a valid HyperLogLog string value.")
+	errCorruptHLL = respgo.EncodeError("INVALIDOBJ Corrupted HLL object detected")
+)
+
+// hll is a HyperLogLog decoded for reading or updating.
+type hll struct {
+	dense bool
+	reg   [hllRegisters]uint8
+	// card is the cached cardinality, meaningful when cached is set.
+	card   uint64
+	cached bool
+}
+
+// newHLL returns an empty sparse HyperLogLog with a cached count of 0.
+func newHLL() *hll {
+	return &hll{cached: true}
+}
+
+// murmurHash64A is the hash Redis uses for HyperLogLog elements.
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ uint64(len(key))*m
+	for len(key) >= 8 {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		key = key[8:]
+	}
+	if len(key) > 0 {
+		for i := len(key) - 1; i >= 0; i-- {
+			h ^= uint64(key[i]) << (8 * i)
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatLen returns the register an element falls in and the run length
+// of the 0 bits that follow the index bits in its hash, plus one.
+func hllPatLen(ele string) (int, uint8) {
+	hash := murmurHash64A([]byte(ele), 0xadc83b19)
+	index := int(hash & (hllRegisters - 1))
+	hash >>= hllP
+	hash |= 1 << hllQ
+	return index, uint8(bits.TrailingZeros64(hash) + 1)
+}
+
+// add counts ele and reports whether a register changed.
+func (h *hll) add(ele string) bool {
+	index, count := hllPatLen(ele)
+	if count <= h.reg[index] {
+		return false
+	}
+	h.reg[index] = count
+	return true
+}
+
+// parseHLL decodes a HyperLogLog string, replying with the Redis error
+// for a value that is not one.
+func parseHLL(v string) (*hll, []byte) {
+	if len(v) < hllHeaderSize || v[:4] != "HYLL" || v[4] > hllEncSparse {
+		return nil, errNotHLL
+	}
+	if v[4] == hllEncDense && len(v) != hllDenseSize {
+		return nil, errNotHLL
+	}
+	h := &hll{dense: v[4] == hllEncDense}
+	h.card = binary.LittleEndian.Uint64([]byte(v[8:16]))
+	h.cached = v[15]&0x80 == 0
+	p := v[hllHeaderSize:]
+	if h.dense {
+		for i := range h.reg {
+			h.reg[i] = denseRegister(p, i)
+		}
+		return h, nil
+	}
+	i := 0
+	for j := 0; j < len(p); j++ {
+		b := p[j]
+		var run int
+		var val uint8
+		switch {
+		case b&0xc0 == 0x00:
+			run = int(b&0x3f) + 1
+		case b&0xc0 == 0x40:
+			if j+1 == len(p) {
+				return nil, errCorruptHLL
+			}
+			j++
+			run = (int(b&0x3f)<<8 | int(p[j])) + 1
+		default:
+			val = (b>>2)&0x1f + 1
+			run = int(b&3) + 1
+		}
+		if i+run > hllRegisters {
+			return nil, errCorruptHLL
+		}
+		for end := i + run; i < end; i++ {
+			h.reg[i] = val
+		}
+	}
+	if i != hllRegisters {
+		return nil, errCorruptHLL
+	}
+	return h, nil
+}
+
+// denseRegister reads register i of packed dense registers.
+func denseRegister[T string | []byte](p T, i int) uint8 {
+	byteIdx := i * hllBits / 8
+	fb := uint(i * hllBits & 7)
+	b0 := uint(p[byteIdx])
+	b1 := uint(0)
+	if byteIdx+1 < len(p) {
+		b1 = uint(p[byteIdx+1])
+	}
+	return uint8((b0>>fb | b1<<(8-fb)) & hllRegisterMax)
+}
+
+// setDenseRegister sets register i of packed dense registers.
+func setDenseRegister(p []byte, i int, v uint8) {
+	byteIdx := i * hllBits / 8
+	fb := uint(i * hllBits & 7)
+	p[byteIdx] &^= hllRegisterMax << fb
+	p[byteIdx] |= v << fb
+	if byteIdx+1 < len(p) {
+		p[byteIdx+1] &^= hllRegisterMax >> (8 - fb)
+		p[byteIdx+1] |= v >> (8 - fb)
+	}
+}
+
+// encodeSparse appends the sparse form of the registers to buf, reporting
+// false if a register is too large for it.
+func (h *hll) encodeSparse(buf []byte) ([]byte, bool) {
+	for i := 0; i < hllRegisters; {
+		val := h.reg[i]
+		if val > hllSparseValMax {
+			return nil, false
+		}
+		run := 1
+		for i+run < hllRegisters && h.reg[i+run] == val {
+			run++
+		}
+		i += run
+		for run > 0 {
+			switch {
+			case val != 0:
+				n := min(run, hllValMaxLen)
+				buf = append(buf, 0x80|(val-1)<<2|byte(n-1))
+				run -= n
+			case run > hllZeroMaxLen:
+				n := min(run, hllXZeroMaxLen) - 1
+				buf = append(buf, 0x40|byte(n>>8), byte(n))
+				run -= n + 1
+			default:
+				buf = append(buf, byte(run-1))
+				run = 0
+			}
+		}
+	}
+	return buf, true
+}
+
+// String encodes h, switching it to dense if the sparse form would not do.
+func (h *hll) String() string {
+	buf := make([]byte, hllHeaderSize, hllDenseSize)
+	copy(buf, "HYLL")
+	card := h.card
+	if !h.cached {
+		card |= 1 << 63
+	}
+	binary.LittleEndian.PutUint64(buf[8:], card)
+	if !h.dense {
+		buf[4] = hllEncSparse
+		if out, ok := h.encodeSparse(buf); ok && len(out) <= hllSparseMaxBytes {
+			return string(out)
+		}
+		h.dense = true
+	}
+	buf[4] = hllEncDense
+	buf = buf[:hllDenseSize]
+	p := buf[hllHeaderSize:]
+	clear(p) // a failed sparse attempt may have written here
+	for i, v := range h.reg {
+		setDenseRegister(p, i, v)
+	}
+	return string(buf)
+}
+
+// hllSigma and hllTau are the corrections of Otmar Ertl's improved raw
+// estimator, which Redis uses for every cardinality.
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+// hllCount estimates the cardinality from the registers.
+func hllCount(reg *[hllRegisters]uint8) uint64 {
+	const m = float64(hllRegisters)
+	const alphaInf = 0.721347520444481703680 // 0.5/ln(2)
+	var histo [64]int
+	for _, v := range reg {
+		histo[v]++
+	}
+	z := m * hllTau((m-float64(histo[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histo[0])/m)
+	return uint64(math.Round(alphaInf * m * m / z))
+}
+
+// lookupHLL returns the HyperLogLog at key, or nil if there is none. The
+// caller must hold kv.mu.
+func (kv *KVStore) lookupHLL(key string) (*hll, []byte) {
+	v, found, ok := kv.lookupString(key)
+	if !ok {
+		return nil, errWrongType
+	}
+	if !found {
+		return nil, nil
+	}
+	return parseHLL(v)
+}
+
+// pfaddCommand implements PFADD key [element ...]. It replies 1 if the
+// key was created or an estimate may have changed.
+func (kv *KVStore) pfaddCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs("pfadd")
+	}
+	if v, _, _ := kv.lookupString(args[1]); len(v) == hllDenseSize && v[:4] == "HYLL" && v[4] == hllEncDense {
+		return kv.pfaddDense(args[1], v, args[2:])
+	}
+	h, errReply := kv.lookupHLL(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	updated := false
+	if h == nil {
+		h = newHLL()
+		updated = true
+	}
+	for _, ele := range args[2:] {
+		if h.add(ele) {
+			updated = true
+		}
+	}
+	if !updated {
+		return respgo.EncodeInteger(0)
+	}
+	if len(args) > 2 {
+		h.cached = false
+	}
+	kv.updateString(args[1], h.String())
+	kv.dirty++
+	return respgo.EncodeInteger(1)
+}
+
+// pfaddDense is PFADD on a dense HyperLogLog, updating its registers in
+// place rather than decoding them all.
+func (kv *KVStore) pfaddDense(key, v string, elements []string) []byte {
+	p := []byte(v)
+	reg := p[hllHeaderSize:]
+	updated := false
+	for _, ele := range elements {
+		index, count := hllPatLen(ele)
+		if count > denseRegister(reg, index) {
+			setDenseRegister(reg, index, count)
+			updated = true
+		}
+	}
+	if !updated {
+		return respgo.EncodeInteger(0)
+	}
+	p[15] |= 0x80
+	kv.updateString(key, string(p))
+	kv.dirty++
+	return respgo.EncodeInteger(1)
+}
+
+// pfcountCommand implements PFCOUNT key [key ...]. A single key's estimate
+// is cached in its header; several keys are merged into a temporary
+// HyperLogLog and counted together.
+func (kv *KVStore) pfcountCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs("pfcount")
+	}
+	if len(args) == 2 {
+		key := args[1]
+		h, errReply := kv.lookupHLL(key)
+		if errReply != nil {
+			return errReply
+		}
+		if h == nil {
+			return respgo.EncodeInteger(0)
+		}
+		if !h.cached {
+			h.card = hllCount(&h.reg)
+			// patch the header alone, leaving the registers' encoding be
+			v := []byte(kv.lookupObject(key).str.s)
+			binary.LittleEndian.PutUint64(v[8:16], h.card)
+			kv.updateString(key, string(v))
+			kv.dirty++
+		}
+		return respgo.EncodeInteger(int(h.card))
+	}
+
+	var merged [hllRegisters]uint8
+	for _, key := range args[1:] {
+		h, errReply := kv.lookupHLL(key)
+		if errReply != nil {
+			return errReply
+		}
+		if h == nil {
+			continue
+		}
+		for i, v := range h.reg {
+			merged[i] = max(merged[i], v)
+		}
+	}
+	return respgo.EncodeInteger(int(hllCount(&merged)))
+}
+
+// pfmergeCommand implements PFMERGE destkey [sourcekey ...], storing the
+// union of the sources and destkey itself. The result is dense if any
+// input was.
+func (kv *KVStore) pfmergeCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs("pfmerge")
+	}
+	var merged [hllRegisters]uint8
+	dense := false
+	for _, key := range args[1:] {
+		h, errReply := kv.lookupHLL(key)
+		if errReply != nil {
+			return errReply
+		}
+		if h == nil {
+			continue
+		}
+		dense = dense || h.dense
+		for i, v := range h.reg {
+			merged[i] = max(merged[i], v)
+		}
+	}
+	dest := &hll{dense: dense, reg: merged}
+	kv.updateString(args[1], dest.String())
+	kv.dirty++
+	return respgo.EncodeSimpleString("OK")
+}
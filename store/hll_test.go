@@ -0,0 +1,217 @@
+package store
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHLLCommands(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("SET", "str", "not an hll")
+	c.do("RPUSH", "list", "a")
+	runSteps(c, []step{
+		// the examples from the PFADD, PFCOUNT and PFMERGE documentation
+		{"PFADD hll a b c d e f g", "1"},
+		{"PFCOUNT hll", "7"},
+		{"PFADD h2 foo bar zap", "1"},
+		{"PFADD h2 zap zap zap", "0"},
+		{"PFADD h2 foo bar", "0"},
+		{"PFCOUNT h2", "3"},
+		{"PFADD other 1 2 3", "1"},
+		{"PFCOUNT h2 other", "6"},
+		{"PFADD m1 foo bar zap a", "1"},
+		{"PFADD m2 a b c foo", "1"},
+		{"PFMERGE m3 m1 m2", "+OK"},
+		{"PFCOUNT m3", "6"},
+
+		// PFADD with no elements only creates the key
+		{"PFADD empty", "1"},
+		{"PFADD empty", "0"},
+		{"PFCOUNT empty", "0"},
+		{"PFCOUNT nokey", "0"},
+		{"PFMERGE dest", "+OK"},
+		{"PFCOUNT dest", "0"},
+		{"PFMERGE m1 m2", "+OK"},
+		{"PFCOUNT m1", "6"},
+
+		{"PFADD str a", "-WRONGTYPE Key is not a valid HyperLogLog string value."},
+		{"PFCOUNT hll str", "-WRONGTYPE Key is not a valid HyperLogLog string value."},
+		{"PFMERGE hll str", "-WRONGTYPE Key is not a valid HyperLogLog string value."},
+		{"PFADD list a", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"PFCOUNT", "-ERR wrong number of arguments for 'pfcount' command"},
+	})
+}
+
+func TestHLLCachedCardinality(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	header := func() (card uint64, stale bool) {
+		t.Helper()
+		v, _ := c.do("GET", "hll").(string)
+		if len(v) < hllHeaderSize {
+			t.Fatalf("GET hll = %q", v)
+		}
+		return binary.LittleEndian.Uint64([]byte(v[8:16])) &^ (1 << 63), v[15]&0x80 != 0
+	}
+	c.do("PFADD", "hll", "a", "b", "c")
+	if _, stale := header(); !stale {
+		t.Error("PFADD left the cached cardinality marked valid")
+	}
+	c.do("PFCOUNT", "hll")
+	if card, stale := header(); stale || card != 3 {
+		t.Errorf("after PFCOUNT the header holds %d, stale %v, want 3 and valid", card, stale)
+	}
+	// adding an element that changes no register keeps the cache
+	c.do("PFADD", "hll", "a")
+	if card, stale := header(); stale || card != 3 {
+		t.Errorf("a PFADD that changed nothing left %d, stale %v in the header", card, stale)
+	}
+}
+
+func TestHLLSparseEncoding(t *testing.T) {
+	// one element sets one register; the rest are runs of zeros
+	index, count := hllPatLen("wardrobe")
+	h := newHLL()
+	h.add("wardrobe")
+	v := h.String()
+	var want []byte
+	if index > 0 {
+		want = append(want, 0x40|byte((index-1)>>8), byte(index-1))
+	}
+	want = append(want, 0x80|(count-1)<<2)
+	rest := hllRegisters - index - 1
+	want = append(want, 0x40|byte((rest-1)>>8), byte(rest-1))
+	if v[4] != hllEncSparse || v[hllHeaderSize:] != string(want) {
+		t.Fatalf("sparse form = % x, want % x", v[hllHeaderSize:], want)
+	}
+
+	// registers of every sparse-sized value survive a round trip
+	rng := rand.New(rand.NewPCG(13, 14))
+	for range 50 {
+		h := newHLL()
+		for range rng.IntN(400) {
+			h.reg[rng.IntN(hllRegisters)] = uint8(1 + rng.IntN(hllSparseValMax))
+		}
+		// and some long runs of one value
+		at := rng.IntN(hllRegisters - 100)
+		for i := at; i < at+100; i++ {
+			h.reg[i] = 7
+		}
+		back, errReply := parseHLL(h.String())
+		if errReply != nil || back.reg != h.reg || back.dense != h.dense {
+			t.Fatalf("round trip of a %v HyperLogLog failed: %s", h.dense, errReply)
+		}
+	}
+}
+
+func TestHLLTurnsDense(t *testing.T) {
+	// a register above 32 does not fit the sparse encoding
+	h := newHLL()
+	h.reg[100] = hllSparseValMax + 1
+	if v := h.String(); v[4] != hllEncDense || len(v) != hllDenseSize {
+		t.Errorf("a register of %d left the encoding at %d, %d bytes", h.reg[100], v[4], len(v))
+	}
+
+	// nor does a sparse form longer than hllSparseMaxBytes
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	n := 0
+	for ; n < 5000; n += 100 {
+		args := []string{"PFADD", "hll"}
+		for i := n; i < n+100; i++ {
+			args = append(args, "e"+strconv.Itoa(i))
+		}
+		c.do(args...)
+		v, _ := c.do("GET", "hll").(string)
+		if v[4] == hllEncDense {
+			break
+		}
+		if len(v) > hllHeaderSize+hllSparseMaxBytes {
+			t.Fatalf("the sparse form grew to %d bytes", len(v)-hllHeaderSize)
+		}
+	}
+	v, _ := c.do("GET", "hll").(string)
+	if v[4] != hllEncDense || len(v) != hllDenseSize {
+		t.Fatalf("%d elements left the encoding at %d, %d bytes", n, v[4], len(v))
+	}
+	// the dense form counts the same as the sparse one did
+	sparse := newHLL()
+	for i := range n + 100 {
+		sparse.add("e" + strconv.Itoa(i))
+	}
+	dense, _ := parseHLL(v)
+	if dense.reg != sparse.reg {
+		t.Error("the dense registers differ from the elements added")
+	}
+	if got, want := c.do("PFCOUNT", "hll"), int(hllCount(&sparse.reg)); got != want {
+		t.Errorf("PFCOUNT = %v, want %d", got, want)
+	}
+	// and stays dense when merged into a sparse one
+	c.do("PFADD", "small", "x")
+	c.do("PFMERGE", "small", "hll")
+	if v, _ := c.do("GET", "small").(string); v[4] != hllEncDense {
+		t.Error("merging a dense HyperLogLog produced a sparse one")
+	}
+}
+
+func TestHLLAccuracy(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	const n = 100000
+	for i := 0; i < n; i += 1000 {
+		a := []string{"PFADD", "a"}
+		b := []string{"PFADD", "b"}
+		for j := i; j < i+1000; j++ {
+			a = append(a, strconv.Itoa(j))
+			// b overlaps a by half
+			b = append(b, strconv.Itoa(j+n/2))
+		}
+		c.do(a...)
+		c.do(b...)
+	}
+	// the standard error is 0.81%; allow four times that
+	for _, tc := range []struct {
+		keys []string
+		want float64
+	}{
+		{[]string{"a"}, n},
+		{[]string{"b"}, n},
+		{[]string{"a", "b"}, 1.5 * n},
+	} {
+		got, _ := c.do(append([]string{"PFCOUNT"}, tc.keys...)...).(int)
+		if e := math.Abs(float64(got)-tc.want) / tc.want; e > 4*0.0081 {
+			t.Errorf("PFCOUNT %s = %d, want about %.0f", strings.Join(tc.keys, " "), got, tc.want)
+		}
+	}
+}
+
+func TestHLLCorruption(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	header := "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+	for _, tc := range []struct {
+		name, v, want string
+	}{
+		{"too few registers", header + "\x7f\xfe", "-INVALIDOBJ Corrupted HLL object detected"},
+		{"too many registers", header + "\x7f\xff\x00", "-INVALIDOBJ Corrupted HLL object detected"},
+		{"a cut XZERO", header + "\x7f", "-INVALIDOBJ Corrupted HLL object detected"},
+		{"a short dense form", "HYLL\x00" + header[5:] + "\x00", "-WRONGTYPE Key is not a valid HyperLogLog string value."},
+		{"an unknown encoding", "HYLL\x02" + header[5:], "-WRONGTYPE Key is not a valid HyperLogLog string value."},
+		{"a short header", "HYLL\x01", "-WRONGTYPE Key is not a valid HyperLogLog string value."},
+	} {
+		c.do("SET", "h", tc.v)
+		if got := formatReply(c.do("PFCOUNT", "h")); got != tc.want {
+			t.Errorf("PFCOUNT on %s = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+	// a well-formed sparse value: one XZERO covering every register
+	c.do("SET", "h", header+"\x7f\xff")
+	if got := c.do("PFCOUNT", "h"); got != 0 {
+		t.Errorf("PFCOUNT of an empty sparse value = %v, want 0", got)
+	}
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand/v2"
+	"sort"
+)
+
+// intset is Redis's compact encoding for small sets of integers: the
+// values sorted in a byte slice, each as wide as the widest one needs (2, 4
+// or 8 bytes, little endian). Adding a value too wide for the current
+// encoding upgrades every element.
+type intset struct {
+	enc      int
+	contents []byte
+}
+
+func newIntset() *intset {
+	return &intset{enc: 2}
+}
+
+// intsetEncoding returns the width in bytes v needs.
+func intsetEncoding(v int64) int {
+	switch {
+	case v < math.MinInt32 || v > math.MaxInt32:
+		return 8
+	case v < math.MinInt16 || v > math.MaxInt16:
+		return 4
+	}
+	return 2
+}
+
+func (is *intset) len() int {
+	return len(is.contents) / is.enc
+}
+
+func (is *intset) get(i int) int64 {
+	b := is.contents[i*is.enc:]
+	switch is.enc {
+	case 2:
+		return int64(int16(binary.LittleEndian.Uint16(b)))
+	case 4:
+		return int64(int32(binary.LittleEndian.Uint32(b)))
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (is *intset) put(i int, v int64) {
+	b := is.contents[i*is.enc:]
+	switch is.enc {
+	case 2:
+		binary.LittleEndian.PutUint16(b, uint16(v))
+	case 4:
+		binary.LittleEndian.PutUint32(b, uint32(v))
+	default:
+		binary.LittleEndian.PutUint64(b, uint64(v))
+	}
+}
+
+// search returns the position of v, or where it would be inserted.
+func (is *intset) search(v int64) (int, bool) {
+	n := is.len()
+	i := sort.Search(n, func(i int) bool { return is.get(i) >= v })
+	return i, i < n && is.get(i) == v
+}
+
+func (is *intset) contains(v int64) bool {
+	if intsetEncoding(v) > is.enc {
+		return false
+	}
+	_, ok := is.search(v)
+	return ok
+}
+
+// upgrade re-encodes the elements with a wider encoding.
+func (is *intset) upgrade(enc int) {
+	old := &intset{enc: is.enc, contents: is.contents}
+	is.enc = enc
+	is.contents = make([]byte, old.len()*enc)
+	for i := 0; i < old.len(); i++ {
+		is.put(i, old.get(i))
+	}
+}
+
+// add inserts v and reports whether it was new.
+func (is *intset) add(v int64) bool {
+	if enc := intsetEncoding(v); enc > is.enc {
+		// v is beyond every current element, so it goes at one end
+		is.upgrade(enc)
+		is.contents = append(is.contents, make([]byte, enc)...)
+		if v < 0 {
+			copy(is.contents[enc:], is.contents)
+			is.put(0, v)
+		} else {
+			is.put(is.len()-1, v)
+		}
+		return true
+	}
+	i, found := is.search(v)
+	if found {
+		return false
+	}
+	is.contents = append(is.contents, make([]byte, is.enc)...)
+	copy(is.contents[(i+1)*is.enc:], is.contents[i*is.enc:])
+	is.put(i, v)
+	return true
+}
+
+// remove deletes v and reports whether it was there.
+func (is *intset) remove(v int64) bool {
+	if intsetEncoding(v) > is.enc {
+		return false
+	}
+	i, found := is.search(v)
+	if !found {
+		return false
+	}
+	copy(is.contents[i*is.enc:], is.contents[(i+1)*is.enc:])
+	is.contents = is.contents[:len(is.contents)-is.enc]
+	return true
+}
+
+// random returns a uniformly chosen element. The intset must not be empty.
+func (is *intset) random() int64 {
+	return is.get(rand.IntN(is.len()))
+}
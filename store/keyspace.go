@@ -0,0 +1,386 @@
+package store
+
+import (
+	"strings"
+	"time"
+)
+
+// objType is the type of the value stored at a key.
+type objType uint8
+
+const (
+	objString objType = iota
+	objList
+	objSet
+	objHash
+	objZSet
+	objStream
+)
+
+// objTypeNames are the type names TYPE reports.
+var objTypeNames = [...]string{
+	objString: "string",
+	objList:   "list",
+	objSet:    "set",
+	objHash:   "hash",
+	objZSet:   "zset",
+	objStream: "stream",
+}
+
+// object is the value stored at a key, like Redis's robj. typ says which
+// type it is: a string is held in str, and a value of any other type in
+// ptr, as a *deque, *set, *hash, *zset or *stream. lru is when the key was
+// last accessed, in unix ms.
+type object struct {
+	typ objType
+	lru int64
+	str strValue
+	ptr any
+}
+
+// lookupObject returns the object stored at key, or nil if there is none.
+// On a replica, a key whose deadline has passed is missing to everyone but
+// the master, which has yet to delete it. The caller must hold kv.mu.
+func (kv *KVStore) lookupObject(key string) *object {
+	o, _ := kv.keys.get(key)
+	if o != nil && kv.Info.Role == "slave" && !kv.fromMaster && kv.keyIsExpired(key) {
+		return nil
+	}
+	return o
+}
+
+// lookupTyped returns the value stored at key if it is of type typ, or the
+// zero T if there is none. ok is false if key holds another type. The
+// caller must hold kv.mu.
+func lookupTyped[T any](kv *KVStore, key string, typ objType) (v T, ok bool) {
+	o := kv.lookupObject(key)
+	if o == nil {
+		return v, true
+	}
+	if o.typ != typ {
+		return v, false
+	}
+	return o.ptr.(T), true
+}
+
+// touchKey records that key, if it exists, was just accessed. The caller
+// must hold kv.mu.
+func (kv *KVStore) touchKey(key string) {
+	if o := kv.lookupObject(key); o != nil {
+		o.lru = time.Now().UnixMilli()
+	}
+}
+
+// removeKey deletes key along with its deadline, and reports whether
+// anything was removed. The caller must hold kv.mu.
+func (kv *KVStore) removeKey(key string) bool {
+	kv.preserve(key)
+	// an expired key a replica is keeping for its master goes too, but
+	// was not there to remove
+	visible := kv.lookupObject(key) != nil
+	o, ok := kv.keys.get(key)
+	if !ok {
+		return false
+	}
+	if o.typ == objHash {
+		delete(kv.volatileHashes, key)
+	}
+	kv.keys.delete(key)
+	kv.removeExpiry(key)
+	return visible
+}
+
+// keyType returns the type name of the value stored at key, as reported by
+// TYPE, or "none" if the key does not exist. The caller must hold kv.mu.
+func (kv *KVStore) keyType(key string) string {
+	if o := kv.lookupObject(key); o != nil {
+		return objTypeNames[o.typ]
+	}
+	return "none"
+}
+
+// keyExists reports whether key holds a value of any type. The caller must
+// hold kv.mu.
+func (kv *KVStore) keyExists(key string) bool {
+	return kv.lookupObject(key) != nil
+}
+
+// lookupValue returns the value stored at key, as a string, an int64 for
+// an integer-encoded string, a *deque, *set, *hash, *zset or *stream, or nil
+// if there is none. The caller must hold kv.mu.
+func (kv *KVStore) lookupValue(key string) any {
+	o := kv.lookupObject(key)
+	switch {
+	case o == nil:
+		return nil
+	case o.typ == objString && o.str.isInt:
+		return o.str.n
+	case o.typ == objString:
+		return o.str.s
+	case o.typ == objHash:
+		if h, _ := kv.lookupHash(key); h != nil {
+			return h
+		}
+		return nil
+	}
+	return o.ptr
+}
+
+// storeValue stores v, one of the types lookupValue returns, at key, which
+// must not hold anything. On a replica it may still hold an expired value
+// the master has yet to delete, which goes along with its deadline. The
+// caller must hold kv.mu.
+func (kv *KVStore) storeValue(key string, v any) {
+	if kv.keyIsExpired(key) {
+		kv.removeKey(key)
+	}
+	o := &object{ptr: v}
+	switch v := v.(type) {
+	case string:
+		o.typ, o.ptr, o.str = objString, nil, newStrValue(v)
+	case int64:
+		o.typ, o.ptr, o.str = objString, nil, strValue{n: v, isInt: true}
+	case *deque:
+		o.typ = objList
+	case *set:
+		o.typ = objSet
+	case *hash:
+		o.typ = objHash
+		if v.ttls != nil {
+			kv.volatileHashes[key] = struct{}{}
+		}
+	case *zset:
+		o.typ = objZSet
+	case *stream:
+		o.typ = objStream
+	}
+	o.lru = time.Now().UnixMilli()
+	kv.keys.set(key, o)
+}
+
+// keySpec says where a command's key arguments are: args[first] through
+// args[last] stepping by step. A negative last counts from the end of args.
+type keySpec struct {
+	first, last, step int
+}
+
+var commandKeySpecs = map[string]keySpec{
+	"SET":            {1, 1, 1},
+	"GET":            {1, 1, 1},
+	"DEL":            {1, -1, 1},
+	"TYPE":           {1, 1, 1},
+	"MOVE":           {1, 1, 1},
+	"EXISTS":         {1, -1, 1},
+	"TOUCH":          {1, -1, 1},
+	"UNLINK":         {1, -1, 1},
+	"RENAME":         {1, 2, 1},
+	"RENAMENX":       {1, 2, 1},
+	"COPY":           {1, 2, 1},
+	"DUMP":           {1, 1, 1},
+	"RESTORE":        {1, 1, 1},
+	"GETDEL":         {1, 1, 1},
+	"GETEX":          {1, 1, 1},
+	"GETSET":         {1, 1, 1},
+	"SETNX":          {1, 1, 1},
+	"SETEX":          {1, 1, 1},
+	"PSETEX":         {1, 1, 1},
+	"MGET":           {1, -1, 1},
+	"MSET":           {1, -1, 2},
+	"MSETNX":         {1, -1, 2},
+	"APPEND":         {1, 1, 1},
+	"STRLEN":         {1, 1, 1},
+	"GETRANGE":       {1, 1, 1},
+	"SUBSTR":         {1, 1, 1},
+	"SETRANGE":       {1, 1, 1},
+	"LCS":            {1, 2, 1},
+	"INCR":           {1, 1, 1},
+	"DECR":           {1, 1, 1},
+	"INCRBY":         {1, 1, 1},
+	"DECRBY":         {1, 1, 1},
+	"INCRBYFLOAT":    {1, 1, 1},
+	"SETBIT":         {1, 1, 1},
+	"GETBIT":         {1, 1, 1},
+	"BITCOUNT":       {1, 1, 1},
+	"BITPOS":         {1, 1, 1},
+	"BITOP":          {2, -1, 1},
+	"BITFIELD":       {1, 1, 1},
+	"BITFIELD_RO":    {1, 1, 1},
+	"PFADD":          {1, 1, 1},
+	"PFCOUNT":        {1, -1, 1},
+	"PFMERGE":        {1, -1, 1},
+	"GEOADD":         {1, 1, 1},
+	"GEOPOS":         {1, 1, 1},
+	"GEOHASH":        {1, 1, 1},
+	"GEODIST":        {1, 1, 1},
+	"GEOSEARCH":      {1, 1, 1},
+	"GEOSEARCHSTORE": {1, 2, 1},
+	"SADD":           {1, 1, 1},
+	"SMEMBERS":       {1, 1, 1},
+	"SREM":           {1, 1, 1},
+	"SISMEMBER":      {1, 1, 1},
+	"SMISMEMBER":     {1, 1, 1},
+	"SCARD":          {1, 1, 1},
+	"SPOP":           {1, 1, 1},
+	"SRANDMEMBER":    {1, 1, 1},
+	"SSCAN":          {1, 1, 1},
+	"SMOVE":          {1, 2, 1},
+	"SINTER":         {1, -1, 1},
+	"SUNION":         {1, -1, 1},
+	"SDIFF":          {1, -1, 1},
+	"SINTERSTORE":    {1, -1, 1},
+	"SUNIONSTORE":    {1, -1, 1},
+	"SDIFFSTORE":     {1, -1, 1},
+	"XADD":           {1, 1, 1},
+	"XRANGE":         {1, 1, 1},
+	"XREVRANGE":      {1, 1, 1},
+	"XLEN":           {1, 1, 1},
+	"XDEL":           {1, 1, 1},
+	"XTRIM":          {1, 1, 1},
+	"XINFO":          {2, 2, 1},
+	"XGROUP":         {2, 2, 1},
+	"XACK":           {1, 1, 1},
+	"XPENDING":       {1, 1, 1},
+	"XCLAIM":         {1, 1, 1},
+	"XAUTOCLAIM":     {1, 1, 1},
+
+	"EXPIRE":      {1, 1, 1},
+	"PEXPIRE":     {1, 1, 1},
+	"EXPIREAT":    {1, 1, 1},
+	"PEXPIREAT":   {1, 1, 1},
+	"TTL":         {1, 1, 1},
+	"PTTL":        {1, 1, 1},
+	"EXPIRETIME":  {1, 1, 1},
+	"PEXPIRETIME": {1, 1, 1},
+	"PERSIST":     {1, 1, 1},
+
+	"LPUSH":      {1, 1, 1},
+	"RPUSH":      {1, 1, 1},
+	"LPUSHX":     {1, 1, 1},
+	"RPUSHX":     {1, 1, 1},
+	"LPOP":       {1, 1, 1},
+	"RPOP":       {1, 1, 1},
+	"LLEN":       {1, 1, 1},
+	"LINDEX":     {1, 1, 1},
+	"LSET":       {1, 1, 1},
+	"LRANGE":     {1, 1, 1},
+	"LINSERT":    {1, 1, 1},
+	"LREM":       {1, 1, 1},
+	"LTRIM":      {1, 1, 1},
+	"LPOS":       {1, 1, 1},
+	"LMOVE":      {1, 2, 1},
+	"RPOPLPUSH":  {1, 2, 1},
+	"BLPOP":      {1, -2, 1},
+	"BRPOP":      {1, -2, 1},
+	"BLMOVE":     {1, 2, 1},
+	"BRPOPLPUSH": {1, 2, 1},
+
+	"HSET":         {1, 1, 1},
+	"HMSET":        {1, 1, 1},
+	"HSETNX":       {1, 1, 1},
+	"HGET":         {1, 1, 1},
+	"HMGET":        {1, 1, 1},
+	"HDEL":         {1, 1, 1},
+	"HLEN":         {1, 1, 1},
+	"HSTRLEN":      {1, 1, 1},
+	"HEXISTS":      {1, 1, 1},
+	"HGETALL":      {1, 1, 1},
+	"HKEYS":        {1, 1, 1},
+	"HVALS":        {1, 1, 1},
+	"HINCRBY":      {1, 1, 1},
+	"HINCRBYFLOAT": {1, 1, 1},
+	"HRANDFIELD":   {1, 1, 1},
+	"HSCAN":        {1, 1, 1},
+	"HEXPIRE":      {1, 1, 1},
+	"HPEXPIRE":     {1, 1, 1},
+	"HEXPIREAT":    {1, 1, 1},
+	"HPEXPIREAT":   {1, 1, 1},
+	"HTTL":         {1, 1, 1},
+	"HPTTL":        {1, 1, 1},
+	"HEXPIRETIME":  {1, 1, 1},
+	"HPEXPIRETIME": {1, 1, 1},
+	"HPERSIST":     {1, 1, 1},
+
+	"ZADD":             {1, 1, 1},
+	"ZINCRBY":          {1, 1, 1},
+	"ZREM":             {1, 1, 1},
+	"ZCARD":            {1, 1, 1},
+	"ZSCORE":           {1, 1, 1},
+	"ZMSCORE":          {1, 1, 1},
+	"ZRANK":            {1, 1, 1},
+	"ZREVRANK":         {1, 1, 1},
+	"ZCOUNT":           {1, 1, 1},
+	"ZLEXCOUNT":        {1, 1, 1},
+	"ZRANGE":           {1, 1, 1},
+	"ZRANGESTORE":      {1, 2, 1},
+	"ZREVRANGE":        {1, 1, 1},
+	"ZRANGEBYSCORE":    {1, 1, 1},
+	"ZREVRANGEBYSCORE": {1, 1, 1},
+	"ZRANGEBYLEX":      {1, 1, 1},
+	"ZREVRANGEBYLEX":   {1, 1, 1},
+	"ZREMRANGEBYRANK":  {1, 1, 1},
+	"ZREMRANGEBYSCORE": {1, 1, 1},
+	"ZREMRANGEBYLEX":   {1, 1, 1},
+	"ZPOPMIN":          {1, 1, 1},
+	"ZPOPMAX":          {1, 1, 1},
+	"ZRANDMEMBER":      {1, 1, 1},
+	"ZSCAN":            {1, 1, 1},
+	"ZUNIONSTORE":      {1, 1, 1},
+	"ZINTERSTORE":      {1, 1, 1},
+	"ZDIFFSTORE":       {1, 1, 1},
+}
+
+// commandNumkeys gives the position of the key count of commands that take
+// one, like ZUNIONSTORE; that many keys follow it. They may have fixed key
+// arguments in commandKeySpecs as well.
+var commandNumkeys = map[string]int{
+	"LMPOP":       1,
+	"BLMPOP":      2,
+	"ZMPOP":       1,
+	"ZUNION":      1,
+	"ZINTER":      1,
+	"ZDIFF":       1,
+	"ZINTERCARD":  1,
+	"ZUNIONSTORE": 2,
+	"ZINTERSTORE": 2,
+	"ZDIFFSTORE":  2,
+	"SINTERCARD":  1,
+}
+
+// commandKeys returns the key arguments of a command, based on
+// commandKeySpecs and commandNumkeys. Commands whose keys cannot be
+// described by a fixed position are handled individually.
+func commandKeys(args []string) []string {
+	cmd := strings.ToUpper(args[0])
+	if cmd == "XREAD" || cmd == "XREADGROUP" {
+		return streamsKeys(args)
+	}
+	var keys []string
+	if spec, ok := commandKeySpecs[cmd]; ok {
+		last := spec.last
+		if last < 0 {
+			last = len(args) + last
+		}
+		for i := spec.first; i <= last && i < len(args); i += spec.step {
+			keys = append(keys, args[i])
+		}
+	}
+	if at, ok := commandNumkeys[cmd]; ok && at < len(args) {
+		n, _ := parseInt(args[at])
+		for i := at + 1; i <= at+int(n) && i < len(args); i++ {
+			keys = append(keys, args[i])
+		}
+	}
+	return keys
+}
+
+// streamsKeys returns the keys following the STREAMS token of XREAD and
+// XREADGROUP, which is followed by an equal number of keys and IDs.
+func streamsKeys(args []string) []string {
+	for i, a := range args {
+		if strings.ToUpper(a) == "STREAMS" {
+			rest := args[i+1:]
+			return rest[:len(rest)/2]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,557 @@
+package store
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// lookupList returns the list stored at key, or nil if there is none. ok is
+// false if key holds another type. The caller must hold kv.mu.
+func (kv *KVStore) lookupList(key string) (l *deque, ok bool) {
+	return lookupTyped[*deque](kv, key, objList)
+}
+
+// listForWrite is lookupList for commands that add elements: a missing list
+// is created. The caller must hold kv.mu.
+func (kv *KVStore) listForWrite(key string) (l *deque, ok bool) {
+	l, ok = kv.lookupList(key)
+	if ok && l == nil {
+		l = &deque{}
+		kv.storeValue(key, l)
+		kv.signalKeyAsReady(key)
+	}
+	return l, ok
+}
+
+// listChanged deletes a list that just lost its last element, as Redis
+// never keeps empty lists around. The caller must hold kv.mu.
+func (kv *KVStore) listChanged(key string, l *deque) {
+	if l.len() == 0 {
+		kv.removeKey(key)
+	}
+}
+
+// listIndex resolves a possibly negative list index, reporting false if it
+// is out of range.
+func listIndex(l *deque, index int64) (int, bool) {
+	if index < 0 {
+		index += int64(l.len())
+	}
+	if index < 0 || index >= int64(l.len()) {
+		return 0, false
+	}
+	return int(index), true
+}
+
+// listPop removes up to count elements from the head of l, or the tail if
+// right is set.
+func listPop(l *deque, count int64, right bool) []string {
+	count = min(count, int64(l.len()))
+	out := make([]string, 0, count)
+	for ; count > 0; count-- {
+		if right {
+			out = append(out, l.popBack())
+		} else {
+			out = append(out, l.popFront())
+		}
+	}
+	return out
+}
+
+// parseWhere parses the LEFT or RIGHT argument of LMOVE and LMPOP,
+// returning true for RIGHT.
+func parseWhere(s string) (right, ok bool) {
+	switch strings.ToUpper(s) {
+	case "LEFT":
+		return false, true
+	case "RIGHT":
+		return true, true
+	}
+	return false, false
+}
+
+func whereName(right bool) string {
+	if right {
+		return "RIGHT"
+	}
+	return "LEFT"
+}
+
+// pushCommand implements LPUSH, RPUSH, LPUSHX and RPUSHX. The X variants
+// only push onto an existing list.
+func (kv *KVStore) pushCommand(args []string, right, existing bool) []byte {
+	if len(args) < 3 {
+		return wrongArgs(strings.ToLower(args[0]))
+	}
+	key := args[1]
+	l, ok := kv.lookupList(key)
+	if !ok {
+		return errWrongType
+	}
+	if l == nil {
+		if existing {
+			return respgo.EncodeInteger(0)
+		}
+		l, _ = kv.listForWrite(key)
+	}
+	for _, v := range args[2:] {
+		if right {
+			l.pushBack(v)
+		} else {
+			l.pushFront(v)
+		}
+	}
+	kv.dirty += len(args) - 2
+	return respgo.EncodeInteger(l.len())
+}
+
+// popCommand implements LPOP and RPOP.
+func (kv *KVStore) popCommand(args []string, right bool) []byte {
+	name := strings.ToLower(args[0])
+	if len(args) < 2 {
+		return wrongArgs(name)
+	}
+	if len(args) > 3 {
+		return errSyntax
+	}
+	count := int64(-1)
+	if len(args) == 3 {
+		var ok bool
+		if count, ok = parseInt(args[2]); !ok {
+			return errNotInteger
+		}
+		if count < 0 {
+			return errNotPositive
+		}
+	}
+	l, ok := kv.lookupList(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if l == nil {
+		if count < 0 {
+			return nilBulk
+		}
+		return nilArray
+	}
+	if count < 0 {
+		v := listPop(l, 1, right)[0]
+		kv.listChanged(args[1], l)
+		kv.dirty++
+		return respgo.EncodeBulkString(v)
+	}
+	popped := listPop(l, count, right)
+	kv.listChanged(args[1], l)
+	kv.dirty += len(popped)
+	return respgo.EncodeArray(popped)
+}
+
+func (kv *KVStore) llenCommand(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs("llen")
+	}
+	l, ok := kv.lookupList(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if l == nil {
+		return respgo.EncodeInteger(0)
+	}
+	return respgo.EncodeInteger(l.len())
+}
+
+func (kv *KVStore) lindexCommand(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs("lindex")
+	}
+	index, ok := parseInt(args[2])
+	if !ok {
+		return errNotInteger
+	}
+	l, ok := kv.lookupList(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if l == nil {
+		return nilBulk
+	}
+	i, ok := listIndex(l, index)
+	if !ok {
+		return nilBulk
+	}
+	return respgo.EncodeBulkString(l.at(i))
+}
+
+func (kv *KVStore) lsetCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs("lset")
+	}
+	index, ok := parseInt(args[2])
+	if !ok {
+		return errNotInteger
+	}
+	l, ok := kv.lookupList(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if l == nil {
+		return respgo.EncodeError("ERR no such key")
+	}
+	i, ok := listIndex(l, index)
+	if !ok {
+		return respgo.EncodeError("ERR index out of range")
+	}
+	l.set(i, args[3])
+	kv.dirty++
+	return respgo.EncodeSimpleString("OK")
+}
+
+func (kv *KVStore) lrangeCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs("lrange")
+	}
+	start, ok1 := parseInt(args[2])
+	stop, ok2 := parseInt(args[3])
+	if !ok1 || !ok2 {
+		return errNotInteger
+	}
+	l, ok := kv.lookupList(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if l == nil {
+		return respgo.EncodeArray(nil)
+	}
+	n := int64(l.len())
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	start = max(start, 0)
+	stop = min(stop, n-1)
+	if start > stop {
+		return respgo.EncodeArray(nil)
+	}
+	return respgo.EncodeArray(l.slice(int(start), int(stop)))
+}
+
+func (kv *KVStore) linsertCommand(args []string) []byte {
+	if len(args) != 5 {
+		return wrongArgs("linsert")
+	}
+	var after bool
+	switch strings.ToUpper(args[2]) {
+	case "BEFORE":
+	case "AFTER":
+		after = true
+	default:
+		return errSyntax
+	}
+	l, ok := kv.lookupList(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if l == nil {
+		return respgo.EncodeInteger(0)
+	}
+	for i := 0; i < l.len(); i++ {
+		if l.at(i) != args[3] {
+			continue
+		}
+		if after {
+			i++
+		}
+		l.insert(i, args[4])
+		kv.dirty++
+		return respgo.EncodeInteger(l.len())
+	}
+	return respgo.EncodeInteger(-1)
+}
+
+func (kv *KVStore) lremCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs("lrem")
+	}
+	count, ok := parseInt(args[2])
+	if !ok {
+		return errNotInteger
+	}
+	l, ok := kv.lookupList(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if l == nil {
+		return respgo.EncodeInteger(0)
+	}
+	// pick the matches to drop first: the first count from the head, the
+	// last -count from the tail, or all of them for a zero count
+	drop := make(map[int]struct{})
+	if count < 0 {
+		for i := l.len() - 1; i >= 0 && int64(len(drop)) < -count; i-- {
+			if l.at(i) == args[3] {
+				drop[i] = struct{}{}
+			}
+		}
+	} else {
+		for i := 0; i < l.len() && (count == 0 || int64(len(drop)) < count); i++ {
+			if l.at(i) == args[3] {
+				drop[i] = struct{}{}
+			}
+		}
+	}
+	l.retain(func(i int, _ string) bool {
+		_, found := drop[i]
+		return !found
+	})
+	kv.listChanged(args[1], l)
+	kv.dirty += len(drop)
+	return respgo.EncodeInteger(len(drop))
+}
+
+func (kv *KVStore) ltrimCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs("ltrim")
+	}
+	start, ok1 := parseInt(args[2])
+	stop, ok2 := parseInt(args[3])
+	if !ok1 || !ok2 {
+		return errNotInteger
+	}
+	l, ok := kv.lookupList(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if l == nil {
+		return respgo.EncodeSimpleString("OK")
+	}
+	n := int64(l.len())
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	start = max(start, 0)
+	var ltrim, rtrim int64
+	if start > stop || start >= n {
+		// out of range: everything goes
+		ltrim, rtrim = n, 0
+	} else {
+		stop = min(stop, n-1)
+		ltrim, rtrim = start, n-stop-1
+	}
+	listPop(l, ltrim, false)
+	listPop(l, rtrim, true)
+	kv.listChanged(args[1], l)
+	kv.dirty += int(ltrim + rtrim)
+	return respgo.EncodeSimpleString("OK")
+}
+
+func (kv *KVStore) lposCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("lpos")
+	}
+	rank, count, maxlen := int64(1), int64(-1), int64(0)
+	for i := 3; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errSyntax
+		}
+		n, ok := parseInt(args[i+1])
+		if !ok {
+			return errNotInteger
+		}
+		switch strings.ToUpper(args[i]) {
+		case "RANK":
+			if n == 0 {
+				return respgo.EncodeError("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			if n == math.MinInt64 {
+				return respgo.EncodeError("ERR value is out of range, value must between -9223372036854775807 and 9223372036854775807")
+			}
+			rank = n
+		case "COUNT":
+			if n < 0 {
+				return respgo.EncodeError("ERR COUNT can't be negative")
+			}
+			count = n
+		case "MAXLEN":
+			if n < 0 {
+				return respgo.EncodeError("ERR MAXLEN can't be negative")
+			}
+			maxlen = n
+		default:
+			return errSyntax
+		}
+	}
+
+	l, ok := kv.lookupList(args[1])
+	if !ok {
+		return errWrongType
+	}
+	var matches []int
+	if l != nil {
+		// a negative rank searches from the tail
+		skip := rank - 1
+		step, i := 1, 0
+		if rank < 0 {
+			skip = -rank - 1
+			step, i = -1, l.len()-1
+		}
+		for compared := int64(0); i >= 0 && i < l.len() && (maxlen == 0 || compared < maxlen); i += step {
+			compared++
+			if l.at(i) != args[2] {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			matches = append(matches, i)
+			// without COUNT only the first match is wanted; COUNT 0 wants
+			// all of them
+			if count < 0 || int64(len(matches)) == count {
+				break
+			}
+		}
+	}
+	if count < 0 {
+		if len(matches) == 0 {
+			return nilBulk
+		}
+		return respgo.EncodeInteger(matches[0])
+	}
+	frames := make([][]byte, len(matches))
+	for i, m := range matches {
+		frames[i] = respgo.EncodeInteger(m)
+	}
+	return respgo.EncodeRawArray(frames...)
+}
+
+// lmove pops from one end of src and pushes onto one end of dst. It
+// reports false, changing nothing, if src is empty. The caller must hold
+// kv.mu.
+func (kv *KVStore) lmove(src, dst string, fromRight, toRight bool) ([]byte, bool) {
+	l, ok := kv.lookupList(src)
+	if !ok {
+		return errWrongType, true
+	}
+	if l == nil {
+		return nil, false
+	}
+	d, ok := kv.listForWrite(dst)
+	if !ok {
+		return errWrongType, true
+	}
+	v := listPop(l, 1, fromRight)[0]
+	if toRight {
+		d.pushBack(v)
+	} else {
+		d.pushFront(v)
+	}
+	kv.listChanged(src, l)
+	kv.dirty++
+	return respgo.EncodeBulkString(v), true
+}
+
+// lmoveCommand implements LMOVE and RPOPLPUSH, which is LMOVE with RIGHT
+// and LEFT.
+func (kv *KVStore) lmoveCommand(args []string) []byte {
+	name := strings.ToLower(args[0])
+	from, to := true, false
+	switch {
+	case name == "rpoplpush" && len(args) == 3:
+	case name == "lmove" && len(args) == 5:
+		var ok1, ok2 bool
+		from, ok1 = parseWhere(args[3])
+		to, ok2 = parseWhere(args[4])
+		if !ok1 || !ok2 {
+			return errSyntax
+		}
+	default:
+		return wrongArgs(name)
+	}
+	if reply, ok := kv.lmove(args[1], args[2], from, to); ok {
+		return reply
+	}
+	return nilBulk
+}
+
+// parseMpopArgs parses "numkeys key [key ...] LEFT|RIGHT [COUNT count]", the
+// tail shared by LMPOP and BLMPOP.
+func parseMpopArgs(args []string) (keys []string, right bool, count int64, errReply []byte) {
+	numkeys, ok := parseInt(args[0])
+	if !ok {
+		return nil, false, 0, errNotInteger
+	}
+	if numkeys <= 0 {
+		return nil, false, 0, errNumkeysZero
+	}
+	if numkeys > int64(len(args)-1) {
+		return nil, false, 0, errNumkeysTooBig
+	}
+	keys = args[1 : 1+numkeys]
+	rest := args[1+numkeys:]
+	if len(rest) == 0 {
+		return nil, false, 0, errSyntax
+	}
+	if right, ok = parseWhere(rest[0]); !ok {
+		return nil, false, 0, errSyntax
+	}
+	count = 1
+	switch {
+	case len(rest) == 1:
+	case len(rest) == 3 && strings.ToUpper(rest[1]) == "COUNT":
+		if count, ok = parseInt(rest[2]); !ok {
+			return nil, false, 0, errNotInteger
+		}
+		if count <= 0 {
+			return nil, false, 0, respgo.EncodeError("ERR count should be greater than 0")
+		}
+	default:
+		return nil, false, 0, errSyntax
+	}
+	return keys, right, count, nil
+}
+
+// lmpop pops up to count elements from the first non-empty list among
+// keys. It reports false if they are all empty. The caller must hold kv.mu.
+func (kv *KVStore) lmpop(keys []string, right bool, count int64) ([]byte, bool) {
+	for _, key := range keys {
+		l, ok := kv.lookupList(key)
+		if !ok {
+			return errWrongType, true
+		}
+		if l == nil {
+			continue
+		}
+		popped := listPop(l, count, right)
+		kv.listChanged(key, l)
+		kv.dirty += len(popped)
+		cmd := "LPOP"
+		if right {
+			cmd = "RPOP"
+		}
+		kv.rewriteCommand(cmd, key, strconv.Itoa(len(popped)))
+		return respgo.EncodeRawArray(respgo.EncodeBulkString(key), respgo.EncodeArray(popped)), true
+	}
+	return nil, false
+}
+
+func (kv *KVStore) lmpopCommand(args []string) []byte {
+	if len(args) < 4 {
+		return wrongArgs("lmpop")
+	}
+	keys, right, count, errReply := parseMpopArgs(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	if reply, ok := kv.lmpop(keys, right, count); ok {
+		return reply
+	}
+	return nilArray
+}
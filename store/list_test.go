@@ -0,0 +1,198 @@
+package store
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// checkDeque checks d against want, the elements it should hold, and
+// that its buffer stays a power of two no more than four times too big.
+func checkDeque(t *testing.T, d *deque, want []string) {
+	t.Helper()
+	if d.len() != len(want) {
+		t.Fatalf("len = %d, want %d", d.len(), len(want))
+	}
+	if len(want) > 0 && !slices.Equal(d.slice(0, d.len()-1), want) {
+		t.Fatalf("elements = %v, want %v", d.slice(0, d.len()-1), want)
+	}
+	c := len(d.buf)
+	if c&(c-1) != 0 {
+		t.Fatalf("capacity %d is not a power of two", c)
+	}
+	if c > dequeMinCap && d.n < c/4 {
+		t.Fatalf("capacity %d was not shrunk for %d elements", c, d.n)
+	}
+}
+
+func TestDeque(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	var d deque
+	var model []string
+	for i := range 5000 {
+		v := strconv.Itoa(i)
+		// lean towards growth for the first half and shrinking after, so
+		// the buffer wraps, doubles and halves along the way
+		grow := i < 2500
+		switch op := rng.IntN(6); {
+		case op == 0 && (grow || len(model) == 0):
+			d.pushFront(v)
+			model = append([]string{v}, model...)
+		case op == 1 && (grow || len(model) == 0):
+			d.pushBack(v)
+			model = append(model, v)
+		case op == 2 && len(model) > 0:
+			if got := d.popFront(); got != model[0] {
+				t.Fatalf("popFront = %s, want %s", got, model[0])
+			}
+			model = model[1:]
+		case op == 3 && len(model) > 0:
+			if got := d.popBack(); got != model[len(model)-1] {
+				t.Fatalf("popBack = %s, want %s", got, model[len(model)-1])
+			}
+			model = model[:len(model)-1]
+		case op == 4 && grow:
+			at := rng.IntN(len(model) + 1)
+			d.insert(at, v)
+			model = slices.Insert(model, at, v)
+		case op == 5 && len(model) > 0:
+			at := rng.IntN(len(model))
+			d.set(at, v)
+			model[at] = v
+		case len(model) > 0 && !grow:
+			// drop every third element
+			d.retain(func(i int, _ string) bool { return i%3 != 0 })
+			var kept []string
+			for i, v := range model {
+				if i%3 != 0 {
+					kept = append(kept, v)
+				}
+			}
+			model = kept
+		}
+		checkDeque(t, &d, model)
+	}
+}
+
+func TestListCommands(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("SET", "str", "v")
+	runSteps(c, []step{
+		{"RPUSH l b c", "2"},
+		{"LPUSH l a z", "4"},
+		{"LRANGE l 0 -1", "[z a b c]"},
+		{"LPUSHX nolist a", "0"},
+		{"RPUSHX l d", "5"},
+		{"EXISTS nolist", "0"},
+		{"LLEN l", "5"},
+		{"LLEN nolist", "0"},
+		{"LINDEX l 0", "z"},
+		{"LINDEX l -1", "d"},
+		{"LINDEX l 5", "(nil)"},
+		{"LINDEX l x", "-ERR value is not an integer or out of range"},
+		{"LSET l -2 C", "+OK"},
+		{"LSET l 5 x", "-ERR index out of range"},
+		{"LSET nolist 0 x", "-ERR no such key"},
+		{"LRANGE l 1 2", "[a b]"},
+		{"LRANGE l -100 100", "[z a b C d]"},
+		{"LRANGE l 3 1", "[]"},
+		{"LRANGE nolist 0 -1", "[]"},
+
+		{"LINSERT l BEFORE a y", "6"},
+		{"LINSERT l AFTER d e", "7"},
+		{"LINSERT l AFTER missing x", "-1"},
+		{"LINSERT nolist AFTER a x", "0"},
+		{"LINSERT l SIDEWAYS a x", "-ERR syntax error"},
+		{"LRANGE l 0 -1", "[z y a b C d e]"},
+
+		{"LPOP l", "z"},
+		{"RPOP l 2", "[e d]"},
+		{"LPOP l 0", "[]"},
+		{"LPOP nolist", "(nil)"},
+		{"LPOP nolist 2", "(nil)"},
+		{"LPOP l -1", "-ERR value is out of range, must be positive"},
+		{"LPOP l 1 2", "-ERR syntax error"},
+		{"RPOP l 100", "[C b a y]"},
+		{"EXISTS l", "0"},
+
+		{"RPUSH r a b a c a b a", "7"},
+		{"LREM r 2 a", "2"},
+		{"LRANGE r 0 -1", "[b c a b a]"},
+		{"LREM r -1 b", "1"},
+		{"LRANGE r 0 -1", "[b c a a]"},
+		{"LREM r 0 a", "2"},
+		{"LREM r 0 missing", "0"},
+		{"LRANGE r 0 -1", "[b c]"},
+		{"LREM r 0 b", "1"},
+		{"LREM r 0 c", "1"},
+		{"EXISTS r", "0"},
+
+		{"RPUSH t 0 1 2 3 4 5", "6"},
+		{"LTRIM t 1 -2", "+OK"},
+		{"LRANGE t 0 -1", "[1 2 3 4]"},
+		{"LTRIM t -3 100", "+OK"},
+		{"LRANGE t 0 -1", "[2 3 4]"},
+		{"LTRIM nolist 0 1", "+OK"},
+		{"LTRIM t 5 10", "+OK"},
+		{"EXISTS t", "0"},
+
+		{"RPUSH p a b c a b c a", "7"},
+		{"LPOS p a", "0"},
+		{"LPOS p a RANK 2", "3"},
+		{"LPOS p a RANK -1", "6"},
+		{"LPOS p a RANK -2 COUNT 2", "[3 0]"},
+		{"LPOS p a COUNT 0", "[0 3 6]"},
+		{"LPOS p b COUNT 0 MAXLEN 4", "[1]"},
+		{"LPOS p x", "(nil)"},
+		{"LPOS p x COUNT 2", "[]"},
+		{"LPOS nolist a", "(nil)"},
+		{"LPOS p a RANK 0", "-ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list"},
+		{"LPOS p a RANK -9223372036854775808", "-ERR value is out of range, value must between -9223372036854775807 and 9223372036854775807"},
+		{"LPOS p a COUNT -1", "-ERR COUNT can't be negative"},
+		{"LPOS p a MAXLEN -1", "-ERR MAXLEN can't be negative"},
+		{"LPOS p a RANK", "-ERR syntax error"},
+		{"LPOS p a SOON 1", "-ERR syntax error"},
+
+		{"RPUSH str a", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"LRANGE str 0 -1", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"LPOP str", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"RPUSH l", "-ERR wrong number of arguments for 'rpush' command"},
+		{"LLEN", "-ERR wrong number of arguments for 'llen' command"},
+	})
+}
+
+func TestListMoves(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("SET", "str", "v")
+	c.do("RPUSH", "src", "a", "b", "c")
+	runSteps(c, []step{
+		{"LMOVE src dst LEFT RIGHT", "a"},
+		{"LMOVE src dst RIGHT LEFT", "c"},
+		{"RPOPLPUSH src dst", "b"},
+		{"EXISTS src", "0"},
+		{"LRANGE dst 0 -1", "[b c a]"},
+		{"LMOVE src dst LEFT LEFT", "(nil)"},
+		// a rotation when source and destination are the same list
+		{"LMOVE dst dst LEFT RIGHT", "b"},
+		{"LRANGE dst 0 -1", "[c a b]"},
+		{"LMOVE dst str LEFT LEFT", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"LRANGE dst 0 -1", "[c a b]"},
+		{"LMOVE dst x UP DOWN", "-ERR syntax error"},
+		{"RPOPLPUSH dst", "-ERR wrong number of arguments for 'rpoplpush' command"},
+
+		{"RPUSH other 1 2", "2"},
+		{"LMPOP 3 nolist dst other LEFT", "[dst [c]]"},
+		{"LMPOP 2 dst other RIGHT COUNT 5", "[dst [b a]]"},
+		{"LMPOP 2 dst other RIGHT COUNT 5", "[other [2 1]]"},
+		{"LMPOP 1 dst LEFT", "(nil)"},
+		{"LMPOP 2 str dst LEFT", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"LMPOP 0 dst LEFT", "-ERR numkeys should be greater than 0"},
+		{"LMPOP 3 dst LEFT", "-ERR Number of keys can't be greater than number of args"},
+		{"LMPOP 1 dst UP", "-ERR syntax error"},
+		{"LMPOP 1 dst LEFT COUNT 0", "-ERR count should be greater than 0"},
+		{"LMPOP 1 dst LEFT LIMIT 1", "-ERR syntax error"},
+	})
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+)
+
+// replica is a replica connected to this server. What it is sent is added to
+// its output buffer, which a goroutine of its own writes out, so that a slow
+// replica holds up nobody but itself: commands reach it in the order they
+// were buffered, which is the order they ran in, as they are buffered with
+// kv.mu held.
+type replica struct {
+	conn net.Conn
+	// acked is the replication offset the replica last acknowledged with
+	// REPLCONF ACK. It is guarded by kv.mu.
+	acked int
+	// sync sends the replica the reply to its PSYNC, with the dataset,
+	// before anything in the output buffer.
+	sync func(w io.Writer) error
+
+	mu  sync.Mutex
+	buf []byte
+	// closed says the replica has gone away, after which its output is
+	// dropped.
+	closed bool
+	// wake signals the writer that there is output, or that the replica
+	// was closed.
+	wake chan struct{}
+}
+
+// newReplica returns a replica for conn, with its writer running. offset is
+// the replication offset its dataset is synced to.
+func newReplica(conn net.Conn, offset int, sync func(w io.Writer) error) *replica {
+	r := &replica{conn: conn, acked: offset, sync: sync, wake: make(chan struct{}, 1)}
+	go r.writeLoop()
+	return r
+}
+
+// write adds b to the output buffer. It never waits on the replica.
+func (r *replica) write(b []byte) {
+	r.mu.Lock()
+	if !r.closed {
+		r.buf = append(r.buf, b...)
+	}
+	r.mu.Unlock()
+	r.signal()
+}
+
+func (r *replica) signal() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close stops the writer. Output not written yet is dropped.
+func (r *replica) close() {
+	r.mu.Lock()
+	r.closed = true
+	r.buf = nil
+	r.mu.Unlock()
+	r.signal()
+}
+
+// writeLoop syncs the replica, then writes out the output buffer as it
+// fills, until the replica is closed or a write fails. If the replica cannot
+// be synced, its link is closed, for it to sync again.
+func (r *replica) writeLoop() {
+	if err := r.sync(r.conn); err != nil {
+		log.Printf("error syncing the replica at %s: %v", r.conn.RemoteAddr(), err)
+		r.close()
+		r.conn.Close()
+		return
+	}
+	for range r.wake {
+		r.mu.Lock()
+		buf, closed := r.buf, r.closed
+		r.buf = nil
+		r.mu.Unlock()
+		if closed {
+			return
+		}
+		if len(buf) == 0 {
+			continue
+		}
+		if _, err := r.conn.Write(buf); err != nil {
+			// the replica is dropped once its link is seen to be closed
+			r.close()
+			r.conn.Close()
+			return
+		}
+	}
+}
+
+// feedReplicas adds b to the replication stream, writing it to every
+// replica and advancing the master's replication offset by its size, which
+// is what the replicas count in theirs. The caller must hold kv.mu.
+func (kv *KVStore) feedReplicas(b []byte) {
+	for _, slave := range kv.Info.slaves {
+		slave.write(b)
+	}
+	kv.Info.MasterReplOffSet += len(b)
+}
+
+// ackedReplicas counts the replicas that have acknowledged the
+// replication stream up to offset. The caller must hold kv.mu.
+func (kv *KVStore) ackedReplicas(offset int) int {
+	n := 0
+	for _, slave := range kv.Info.slaves {
+		if slave.acked >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+// replicaAcked records that r has acknowledged the replication stream up
+// to offset, and wakes the clients waiting in WAIT to count their replicas
+// again. The caller must hold kv.mu.
+func (kv *KVStore) replicaAcked(r *replica, offset int) {
+	r.acked = offset
+	close(kv.acks)
+	kv.acks = make(chan struct{})
+}
+
+// removeReplica forgets r once it has disconnected. The caller must hold
+// kv.mu.
+func (kv *KVStore) removeReplica(r *replica) {
+	kv.Info.slaves = slices.DeleteFunc(kv.Info.slaves, func(other *replica) bool {
+		return other == r
+	})
+	r.close()
+}
@@ -0,0 +1,459 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siddarthpai/wardrobe/rdb"
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// redisVersion is the Redis version dumps claim to come from, which tells
+// tools reading them what to expect.
+const redisVersion = "7.2.0"
+
+// bgsaveRetryDelay is how long after a failed background save the save
+// points wait before trying again.
+const bgsaveRetryDelay = 5 * time.Second
+
+// saveParam is a save point: a snapshot is taken once changes writes have
+// happened and seconds have passed since the last one.
+type saveParam struct {
+	seconds int64
+	changes int
+}
+
+// defaultSaveParams are Redis's default save points.
+var defaultSaveParams = []saveParam{{3600, 1}, {300, 100}, {60, 10000}}
+
+// parseSaveParams parses save points in the form of the save setting,
+// "seconds changes" pairs separated by spaces. An empty string means none.
+func parseSaveParams(s string) ([]saveParam, bool) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, false
+	}
+	params := make([]saveParam, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.Atoi(fields[i+1])
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, false
+		}
+		params = append(params, saveParam{seconds, changes})
+	}
+	return params, true
+}
+
+func formatSaveParams(params []saveParam) string {
+	parts := make([]string, 0, 2*len(params))
+	for _, p := range params {
+		parts = append(parts, strconv.FormatInt(p.seconds, 10), strconv.Itoa(p.changes))
+	}
+	return strings.Join(parts, " ")
+}
+
+// snapshotBatch is how many keys a snapshot copies at a time.
+const snapshotBatch = 1024
+
+// snapshot is the dataset as it was when the snapshot was taken, written out
+// while commands keep running. Rather than copying everything up front, the
+// writer copies keys a batch at a time, holding kv.mu for one batch only, and
+// a key about to change before its turn has come is copied first by preserve.
+// Either way each key is copied as it was when the snapshot was taken.
+type snapshot struct {
+	ctime int64
+	// now is when the snapshot was taken in unix ms; keys that had expired
+	// by then are left out.
+	now int64
+	dbs []*snapshotDB
+	// aofBase marks a snapshot taken as the base of the AOF.
+	aofBase bool
+}
+
+// snapshotDB is the part of a snapshot for one database that had keys when
+// the snapshot was taken.
+type snapshotDB struct {
+	db *database
+	// size and expires are the number of keys, and of keys with a
+	// deadline, when the snapshot was taken.
+	size, expires int
+	// cursor is how far the scan of the keys has got. seen holds the keys
+	// copied so far, or found to have had no value to copy, and copied the
+	// keys copied but not written out yet. done says every key has been
+	// copied.
+	cursor uint64
+	seen   map[string]struct{}
+	copied []snapshotEntry
+	done   bool
+}
+
+type snapshotEntry struct {
+	key      string
+	value    any
+	expireAt int64
+}
+
+// takeSnapshot takes a snapshot of every non-empty database, which is
+// copied as it is written out. Until it is released, it is kept in
+// kv.snapshots so that keys are preserved for it. The caller must hold
+// kv.mu.
+func (kv *KVStore) takeSnapshot() *snapshot {
+	now := time.Now()
+	snap := &snapshot{ctime: now.Unix(), now: now.UnixMilli()}
+	for _, db := range kv.dbs {
+		if db.size() == 0 {
+			continue
+		}
+		snap.dbs = append(snap.dbs, &snapshotDB{
+			db:      db,
+			size:    db.size(),
+			expires: db.expires.len(),
+			seen:    make(map[string]struct{}),
+		})
+	}
+	kv.snapshots = append(kv.snapshots, snap)
+	return snap
+}
+
+// releaseSnapshot stops keeping keys for snap once it has been written out,
+// or given up on. mu is kv.mu, or heldLock if the caller holds that.
+func (kv *KVStore) releaseSnapshot(snap *snapshot, mu sync.Locker) {
+	mu.Lock()
+	defer mu.Unlock()
+	kv.snapshots = slices.DeleteFunc(kv.snapshots, func(other *snapshot) bool {
+		return other == snap
+	})
+}
+
+// heldLock stands in for kv.mu when the caller holds it throughout, as
+// SAVE does.
+type heldLock struct{}
+
+func (heldLock) Lock()   {}
+func (heldLock) Unlock() {}
+
+// copyKey copies key, in the selected database, into sdb unless that has
+// been done already. A key that has no value, or had expired when the
+// snapshot was taken, counts as copied too, so that a key created since is
+// left out. The caller must hold kv.mu.
+func (kv *KVStore) copyKey(snap *snapshot, sdb *snapshotDB, key string) {
+	if _, ok := sdb.seen[key]; ok {
+		return
+	}
+	sdb.seen[key] = struct{}{}
+	at, volatile := kv.expires.get(key)
+	if volatile && at <= snap.now {
+		return
+	}
+	v := kv.lookupValue(key)
+	if v == nil {
+		return
+	}
+	if !volatile {
+		at = 0
+	}
+	sdb.copied = append(sdb.copied, snapshotEntry{key, toRDB(v), at})
+}
+
+// copyBatch copies the next batch of keys of sdb, and returns the keys
+// copied since it was last called, along with whether there are more to
+// come. The caller must hold kv.mu.
+func (kv *KVStore) copyBatch(snap *snapshot, sdb *snapshotDB) ([]snapshotEntry, bool) {
+	if !sdb.done {
+		kv.withDB(sdb.db, func() {
+			sdb.cursor = kv.keys.scan(sdb.cursor, snapshotBatch, func(key string, _ *object) {
+				kv.copyKey(snap, sdb, key)
+			})
+		})
+		if sdb.cursor == 0 {
+			sdb.done, sdb.seen = true, nil
+		}
+	}
+	entries := sdb.copied
+	sdb.copied = nil
+	return entries, !sdb.done
+}
+
+// preserve copies keys, in the selected database, into the snapshots being
+// written out that have yet to copy them, before they are changed. The
+// caller must hold kv.mu.
+func (kv *KVStore) preserve(keys ...string) {
+	for _, snap := range kv.snapshots {
+		for _, sdb := range snap.dbs {
+			if sdb.db != kv.database || sdb.done {
+				continue
+			}
+			for _, key := range keys {
+				kv.copyKey(snap, sdb, key)
+			}
+		}
+	}
+}
+
+// snapshotBarriers are the commands that change more than the keys they
+// name, such as FLUSHALL, or keys of another database, such as MOVE.
+var snapshotBarriers = map[string]bool{
+	"FLUSHALL": true,
+	"FLUSHDB":  true,
+	"SWAPDB":   true,
+	"MOVE":     true,
+	"COPY":     true,
+}
+
+// preserveForCommand gets the snapshots being written out ready for args to
+// run: the keys it names are preserved, or if it may change others,
+// everything the snapshots have yet to copy is copied. The caller must hold
+// kv.mu.
+func (kv *KVStore) preserveForCommand(args []string) {
+	if snapshotBarriers[strings.ToUpper(args[0])] {
+		kv.completeSnapshots()
+		return
+	}
+	kv.preserve(commandKeys(args)...)
+}
+
+// completeSnapshots copies everything the snapshots being written out have
+// yet to copy, ahead of a change to the dataset preserve cannot follow key
+// by key. The caller must hold kv.mu.
+func (kv *KVStore) completeSnapshots() {
+	for _, snap := range kv.snapshots {
+		for _, sdb := range snap.dbs {
+			if sdb.done {
+				continue
+			}
+			kv.withDB(sdb.db, func() {
+				for _, key := range kv.keys.keys() {
+					kv.copyKey(snap, sdb, key)
+				}
+			})
+			sdb.done, sdb.seen = true, nil
+		}
+	}
+}
+
+// writeSnapshot writes snap to w as a dump file, copying its keys as it
+// goes. mu is held while copying a batch of keys, but not while they are
+// encoded and written; it is kv.mu, or heldLock if the caller holds that.
+func (kv *KVStore) writeSnapshot(snap *snapshot, w io.Writer, mu sync.Locker) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	wr := rdb.NewWriter(w)
+	wr.WriteAux("redis-ver", redisVersion)
+	wr.WriteAux("redis-bits", strconv.Itoa(strconv.IntSize))
+	wr.WriteAux("ctime", strconv.FormatInt(snap.ctime, 10))
+	wr.WriteAux("used-mem", strconv.FormatUint(mem.Alloc, 10))
+	aofBase := "0"
+	if snap.aofBase {
+		aofBase = "1"
+	}
+	wr.WriteAux("aof-base", aofBase)
+	for _, sdb := range snap.dbs {
+		if err := wr.SelectDB(sdb.db.id, sdb.size, sdb.expires); err != nil {
+			return err
+		}
+		for more := true; more; {
+			var entries []snapshotEntry
+			mu.Lock()
+			entries, more = kv.copyBatch(snap, sdb)
+			mu.Unlock()
+			for _, e := range entries {
+				if err := wr.WriteEntry(e.key, e.value, e.expireAt); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return wr.Close()
+}
+
+// saveSnapshot writes snap to path, then releases it. It goes to a
+// temporary file in the same directory first, which is renamed over path
+// once it is complete and synced, so a crash midway never leaves a
+// truncated dump behind. mu is as for writeSnapshot.
+func (kv *KVStore) saveSnapshot(snap *snapshot, path string, mu sync.Locker) error {
+	defer kv.releaseSnapshot(snap, mu)
+	f, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf("temp-%d-*.rdb", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := kv.writeSnapshot(snap, f, mu); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// rdbPath returns where the dump file goes. The caller must hold kv.mu.
+func (kv *KVStore) rdbPath() string {
+	return filepath.Join(kv.dir, kv.dbfilename)
+}
+
+// rdbSave saves the dataset in the foreground. The caller must hold kv.mu.
+func (kv *KVStore) rdbSave() error {
+	dirty := kv.dirty
+	if err := kv.saveSnapshot(kv.takeSnapshot(), kv.rdbPath(), heldLock{}); err != nil {
+		log.Println("error saving RDB:", err)
+		return err
+	}
+	kv.dirtyAtSave = dirty
+	kv.lastSave = time.Now().Unix()
+	return nil
+}
+
+// rdbSaveBackground starts saving the dataset while commands keep running,
+// and reports false if a background save is already under way. The
+// snapshot is copied and written out a batch of keys at a time, so kv.mu
+// is never held for long. The caller must hold kv.mu.
+func (kv *KVStore) rdbSaveBackground() bool {
+	if kv.bgsaveInProgress {
+		return false
+	}
+	snap := kv.takeSnapshot()
+	dirty := kv.dirty
+	path := kv.rdbPath()
+	kv.bgsaveInProgress = true
+	kv.lastBgsaveTry = time.Now().Unix()
+	go func() {
+		err := kv.saveSnapshot(snap, path, &kv.mu)
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		kv.bgsaveInProgress = false
+		kv.lastBgsaveOK = err == nil
+		if err != nil {
+			log.Println("error saving RDB in the background:", err)
+		} else {
+			kv.dirtyAtSave = dirty
+			kv.lastSave = time.Now().Unix()
+		}
+		if kv.bgsaveScheduled {
+			kv.bgsaveScheduled = false
+			kv.rdbSaveBackground()
+		}
+	}()
+	return true
+}
+
+// serverCron checks the save points and looks after the AOF once a second
+// for the lifetime of the process.
+func (kv *KVStore) serverCron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		kv.mu.Lock()
+		kv.checkSavePoints()
+		kv.appendOnlyCron()
+		kv.mu.Unlock()
+	}
+}
+
+// checkSavePoints starts a background save if any save point is due. After
+// a failed save it waits bgsaveRetryDelay before trying again, whatever the
+// save points say. The caller must hold kv.mu.
+func (kv *KVStore) checkSavePoints() {
+	if kv.bgsaveInProgress {
+		return
+	}
+	now := time.Now().Unix()
+	changes := kv.dirty - kv.dirtyAtSave
+	for _, p := range kv.saveParams {
+		if changes >= p.changes && now-kv.lastSave >= p.seconds &&
+			(kv.lastBgsaveOK || now-kv.lastBgsaveTry >= int64(bgsaveRetryDelay/time.Second)) {
+			log.Printf("%d changes in %d seconds. Saving...", p.changes, p.seconds)
+			kv.rdbSaveBackground()
+			return
+		}
+	}
+}
+
+var errBgsaveInProgress = respgo.EncodeError("ERR Background save already in progress")
+
+func (kv *KVStore) saveCommand(args []string) []byte {
+	if len(args) != 1 {
+		return wrongArgs("save")
+	}
+	if kv.bgsaveInProgress {
+		return errBgsaveInProgress
+	}
+	if kv.rdbSave() != nil {
+		return respgo.EncodeError("ERR")
+	}
+	return respgo.EncodeSimpleString("OK")
+}
+
+// bgsaveCommand implements BGSAVE [SCHEDULE]. With SCHEDULE, a save asked
+// for while one is running starts as soon as that one is done.
+func (kv *KVStore) bgsaveCommand(args []string) []byte {
+	schedule := false
+	switch {
+	case len(args) == 2 && strings.EqualFold(args[1], "SCHEDULE"):
+		schedule = true
+	case len(args) != 1:
+		return errSyntax
+	}
+	if kv.rdbSaveBackground() {
+		return respgo.EncodeSimpleString("Background saving started")
+	}
+	if schedule {
+		kv.bgsaveScheduled = true
+		return respgo.EncodeSimpleString("Background saving scheduled")
+	}
+	return errBgsaveInProgress
+}
+
+func (kv *KVStore) lastsaveCommand(args []string) []byte {
+	if len(args) != 1 {
+		return wrongArgs("lastsave")
+	}
+	return respgo.EncodeInteger(int(kv.lastSave))
+}
+
+// sendSnapshot sends a replica header, the reply to its PSYNC, followed by
+// snap as the payload of the full resynchronization, and releases snap.
+// The payload, a bulk string, has to be preceded by its length, so like
+// Redis with repl-diskless-sync off it is written to a temporary file in
+// dir first, then copied out from there.
+func (kv *KVStore) sendSnapshot(snap *snapshot, header []byte, dir string, w io.Writer) error {
+	defer kv.releaseSnapshot(snap, &kv.mu)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, fmt.Sprintf("temp-sync-%d-*.rdb", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := kv.writeSnapshot(snap, f, &kv.mu); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "$%d\r\n", size); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
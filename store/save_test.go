@@ -0,0 +1,120 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// gatedWriter holds up the first write until gate is closed, so that the
+// test can change the dataset while a snapshot is half written.
+type gatedWriter struct {
+	f       *os.File
+	started chan struct{}
+	gate    chan struct{}
+	waited  bool
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	if !w.waited {
+		w.waited = true
+		close(w.started)
+		<-w.gate
+	}
+	return w.f.Write(p)
+}
+
+func TestSnapshotIsPointInTime(t *testing.T) {
+	const keys = 5000
+	for _, tc := range []struct {
+		name   string
+		change func(c *testClient)
+	}{
+		{"writes", func(c *testClient) {
+			for i := range keys {
+				k := strconv.Itoa(i)
+				switch i % 3 {
+				case 0:
+					c.do("SET", "k"+k, "changed")
+				case 1:
+					c.do("DEL", "k"+k)
+				case 2:
+					c.do("APPEND", "k"+k, "!")
+				}
+				c.do("SET", "new"+k, "x")
+			}
+			c.do("RPUSH", "list", "d")
+			c.do("LPOP", "list")
+		}},
+		{"flushall", func(c *testClient) {
+			c.do("SET", "k1", "changed")
+			c.do("FLUSHALL")
+			c.do("SET", "new", "x")
+		}},
+		{"swapdb", func(c *testClient) {
+			c.do("SWAPDB", "0", "1")
+			c.do("SET", "k2", "changed")
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kv := newTestStore(t)
+			c := connect(t, kv)
+			for i := range keys {
+				k := strconv.Itoa(i)
+				c.do("SET", "k"+k, "v"+k)
+			}
+			c.do("RPUSH", "list", "a", "b", "c")
+
+			path := filepath.Join(t.TempDir(), "dump.rdb")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			w := &gatedWriter{f: f, started: make(chan struct{}), gate: make(chan struct{})}
+			kv.mu.Lock()
+			snap := kv.takeSnapshot()
+			kv.mu.Unlock()
+			done := make(chan error)
+			go func() {
+				defer kv.releaseSnapshot(snap, &kv.mu)
+				done <- kv.writeSnapshot(snap, w, &kv.mu)
+			}()
+			<-w.started
+			tc.change(c)
+			close(w.gate)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			kv.mu.Lock()
+			left := len(kv.snapshots)
+			kv.mu.Unlock()
+			if left != 0 {
+				t.Errorf("%d snapshots still kept after writing", left)
+			}
+
+			loaded := newTestStore(t)
+			if err := loaded.LoadRDBFile(path); err != nil {
+				t.Fatal(err)
+			}
+			lc := connect(t, loaded)
+			if got := lc.do("DBSIZE"); got != keys+1 {
+				t.Errorf("DBSIZE = %v, want %d", got, keys+1)
+			}
+			for i := range keys {
+				k := strconv.Itoa(i)
+				if got := lc.do("GET", "k"+k); got != "v"+k {
+					t.Fatalf("GET k%s = %q, want %q", k, got, "v"+k)
+				}
+			}
+			if got := formatReply(lc.do("LRANGE", "list", "0", "-1")); got != "[a b c]" {
+				t.Errorf("LRANGE list = %v, want [a b c]", got)
+			}
+			lc.do("SELECT", "1")
+			if got := lc.do("DBSIZE"); got != 0 {
+				t.Errorf("DBSIZE of database 1 = %v, want 0", got)
+			}
+		})
+	}
+}
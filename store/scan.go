@@ -0,0 +1,116 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// scanOptions holds the options shared by the SCAN family of commands.
+type scanOptions struct {
+	pattern  string
+	count    int
+	typ      string
+	noValues bool
+}
+
+func (o scanOptions) matches(s string) bool {
+	return o.pattern == "" || globMatch(o.pattern, s, false)
+}
+
+// parseScanArgs parses "cursor [MATCH pattern] [COUNT count]" followed by
+// TYPE when allowType is set (SCAN) or NOVALUES when allowNoValues is set
+// (HSCAN).
+func parseScanArgs(args []string, allowType, allowNoValues bool) (uint64, scanOptions, []byte) {
+	opts := scanOptions{count: 10}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, opts, respgo.EncodeError("ERR invalid cursor")
+	}
+	for i := 1; i < len(args); i++ {
+		hasNext := i+1 < len(args)
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "COUNT" && hasNext:
+			n, ok := parseInt(args[i+1])
+			if !ok {
+				return 0, opts, errNotInteger
+			}
+			if n < 1 {
+				return 0, opts, errSyntax
+			}
+			opts.count = int(n)
+			i++
+		case opt == "MATCH" && hasNext:
+			opts.pattern = args[i+1]
+			if opts.pattern == "*" {
+				opts.pattern = ""
+			}
+			i++
+		case opt == "TYPE" && hasNext && allowType:
+			opts.typ = strings.ToLower(args[i+1])
+			i++
+		case opt == "NOVALUES" && allowNoValues:
+			opts.noValues = true
+		default:
+			return 0, opts, errSyntax
+		}
+	}
+	return cursor, opts, nil
+}
+
+// scanReply encodes the two-element reply of the SCAN family: the next
+// cursor followed by the elements found.
+func scanReply(cursor uint64, items []string) []byte {
+	return respgo.EncodeRawArray(
+		respgo.EncodeBulkString(strconv.FormatUint(cursor, 10)),
+		respgo.EncodeArray(items),
+	)
+}
+
+// scanCommand implements SCAN over the keys of the selected database. Keys
+// are filtered after the walk, so a call may return fewer than COUNT keys,
+// or none, without the scan being over.
+func (kv *KVStore) scanCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs("scan")
+	}
+	cursor, opts, errReply := parseScanArgs(args[1:], true, false)
+	if errReply != nil {
+		return errReply
+	}
+	var keys []string
+	cursor = kv.keys.scan(cursor, opts.count, func(key string, _ *object) {
+		keys = append(keys, key)
+	})
+	// expired keys are only reclaimed once the walk is done, as it must not
+	// modify the index
+	out := keys[:0]
+	for _, key := range keys {
+		if !opts.matches(key) || kv.expireIfNeeded(key) {
+			continue
+		}
+		if opts.typ != "" && kv.keyType(key) != opts.typ {
+			continue
+		}
+		out = append(out, key)
+	}
+	return scanReply(cursor, out)
+}
+
+func (kv *KVStore) keysCommand(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs("keys")
+	}
+	opts := scanOptions{pattern: args[1]}
+	if opts.pattern == "*" {
+		opts.pattern = ""
+	}
+	var out []string
+	for _, key := range kv.keys.keys() {
+		if opts.matches(key) && !kv.expireIfNeeded(key) {
+			out = append(out, key)
+		}
+	}
+	return respgo.EncodeArray(out)
+}
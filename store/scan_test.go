@@ -0,0 +1,195 @@
+package store
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestDictScan checks the SCAN guarantee against random changes between
+// calls: every entry present for the whole scan is returned, and the scan
+// ends.
+func TestDictScan(t *testing.T) {
+	rng := rand.New(rand.NewPCG(17, 18))
+	for round := range 200 {
+		d := newDict[int]()
+		next := 0
+		for range rng.IntN(300) {
+			d.set("k"+strconv.Itoa(next), next)
+			next++
+		}
+		// the entries that are never deleted must all be seen
+		stay := make(map[string]bool)
+		for _, k := range d.keys() {
+			if rng.IntN(2) == 0 {
+				stay[k] = true
+			}
+		}
+		seen := make(map[string]bool)
+		cursor, calls := uint64(0), 0
+		for {
+			cursor = d.scan(cursor, 1+rng.IntN(20), func(key string, _ int) { seen[key] = true })
+			calls++
+			if cursor == 0 {
+				break
+			}
+			if calls > 10000 {
+				t.Fatalf("round %d: the scan did not end", round)
+			}
+			for range rng.IntN(30) {
+				if rng.IntN(3) == 0 {
+					d.set("k"+strconv.Itoa(next), next)
+					next++
+				} else if d.len() > 0 {
+					if k, _ := d.random(); !stay[k] {
+						d.delete(k)
+					}
+				}
+			}
+		}
+		for k := range stay {
+			if !seen[k] {
+				t.Fatalf("round %d: the scan missed %s", round, k)
+			}
+		}
+	}
+}
+
+// TestScanUnderMutation runs SCAN, SSCAN, HSCAN and ZSCAN while another
+// client adds and deletes other keys and members.
+func TestScanUnderMutation(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	const n = 2000
+	var stay []string
+	for i := range n {
+		k := "stay:" + strconv.Itoa(i)
+		stay = append(stay, k)
+		c.do("SET", k, "v")
+		c.do("SADD", "set", k)
+		c.do("HSET", "hash", k, "v")
+		c.do("ZADD", "zset", strconv.Itoa(i), k)
+	}
+
+	m := connect(t, kv)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			k := "churn:" + strconv.Itoa(i%500)
+			if i%1000 < 500 {
+				m.do("SET", k, "v")
+				m.do("SADD", "set", k)
+				m.do("HSET", "hash", k, "v")
+				m.do("ZADD", "zset", "0", k)
+			} else {
+				m.do("DEL", k)
+				m.do("SREM", "set", k)
+				m.do("HDEL", "hash", k)
+				m.do("ZREM", "zset", k)
+			}
+		}
+	}()
+
+	for _, tc := range []struct {
+		cmd    []string
+		stride int
+	}{
+		{[]string{"SCAN"}, 1},
+		{[]string{"SSCAN", "set"}, 1},
+		{[]string{"HSCAN", "hash"}, 2},
+		{[]string{"ZSCAN", "zset"}, 2},
+	} {
+		seen := make(map[string]bool)
+		cursor := "0"
+		for calls := 0; ; calls++ {
+			args := append(append([]string{}, tc.cmd...), cursor, "COUNT", "7")
+			reply := c.do(args...).([]any)
+			items := reply[1].([]any)
+			for i := 0; i < len(items); i += tc.stride {
+				seen[items[i].(string)] = true
+			}
+			if cursor = reply[0].(string); cursor == "0" {
+				break
+			}
+			if calls > 100*n {
+				t.Fatalf("%v did not end", tc.cmd)
+			}
+			time.Sleep(10 * time.Microsecond)
+		}
+		for _, k := range stay {
+			if !seen[k] {
+				t.Fatalf("%v missed %s", tc.cmd, k)
+			}
+		}
+	}
+	close(done)
+	<-stopped
+}
+
+func TestScanCommand(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("SET", "s1", "v")
+	c.do("SET", "s2", "1")
+	c.do("RPUSH", "l1", "a")
+	c.do("SADD", "set1", "a")
+	c.do("SET", "gone", "v", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+
+	scanAll := func(args ...string) []string {
+		t.Helper()
+		var keys []string
+		cursor := "0"
+		for {
+			reply := c.do(append([]string{"SCAN", cursor}, args...)...).([]any)
+			for _, k := range reply[1].([]any) {
+				keys = append(keys, k.(string))
+			}
+			if cursor = reply[0].(string); cursor == "0" {
+				break
+			}
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"l1", "s1", "s2", "set1"}},
+		{[]string{"COUNT", "1"}, []string{"l1", "s1", "s2", "set1"}},
+		{[]string{"MATCH", "s?"}, []string{"s1", "s2"}},
+		{[]string{"MATCH", "s*", "COUNT", "1"}, []string{"s1", "s2", "set1"}},
+		{[]string{"TYPE", "string"}, []string{"s1", "s2"}},
+		{[]string{"TYPE", "LIST"}, []string{"l1"}},
+		{[]string{"TYPE", "zset"}, nil},
+		{[]string{"MATCH", "*1", "TYPE", "set"}, []string{"set1"}},
+	} {
+		if got := scanAll(tc.args...); !slices.Equal(got, tc.want) {
+			t.Errorf("SCAN %v = %v, want %v", tc.args, got, tc.want)
+		}
+	}
+	if got := c.do("KEYS", "*"); len(got.([]any)) != 4 {
+		t.Errorf("KEYS * = %v, want the expired key left out", got)
+	}
+	runSteps(c, []step{
+		{"KEYS s[0-9]", "[s1 s2]"},
+		{"SCAN x", "-ERR invalid cursor"},
+		{"SCAN -1", "-ERR invalid cursor"},
+		{"SCAN 0 COUNT 0", "-ERR syntax error"},
+		{"SCAN 0 COUNT x", "-ERR value is not an integer or out of range"},
+		{"SCAN 0 MATCH", "-ERR syntax error"},
+		{"SCAN 0 NOVALUES", "-ERR syntax error"},
+		{"SSCAN set1 0 TYPE set", "-ERR syntax error"},
+		{"SCAN", "-ERR wrong number of arguments for 'scan' command"},
+	})
+}
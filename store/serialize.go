@@ -0,0 +1,223 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+
+	"github.com/siddarthpai/wardrobe/rdb"
+)
+
+// errBadData is returned by fromRDB for values no command could have built,
+// such as empty collections or sets with repeated members.
+var errBadData = errors.New("bad data format")
+
+// toRDB converts a value returned by lookupValue to its rdb counterpart.
+func toRDB(v any) any {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case *deque:
+		return rdb.List(v.slice(0, v.len()-1))
+	case *set:
+		return rdb.Set(v.members())
+	case *hash:
+		out := make(rdb.Hash, 0, v.len())
+		v.fields.each(func(field, value string) bool {
+			f := rdb.HashField{Field: field, Value: value}
+			if v.ttls != nil {
+				f.ExpireAt, _ = v.ttls.get(field)
+			}
+			out = append(out, f)
+			return true
+		})
+		return out
+	case *zset:
+		out := make(rdb.SortedSet, 0, v.len())
+		for n := v.zsl.header.level[0].forward; n != nil; n = n.level[0].forward {
+			out = append(out, rdb.ScoredMember{Member: n.member, Score: n.score})
+		}
+		return out
+	case *stream:
+		return streamToRDB(v)
+	}
+	return nil
+}
+
+func toRDBStreamID(id streamID) rdb.StreamID {
+	return rdb.StreamID{Ms: id.ms, Seq: id.seq}
+}
+
+func fromRDBStreamID(id rdb.StreamID) streamID {
+	return streamID{id.Ms, id.Seq}
+}
+
+func streamToRDB(s *stream) *rdb.Stream {
+	out := &rdb.Stream{
+		Length:       uint64(s.length),
+		LastID:       toRDBStreamID(s.lastID),
+		FirstID:      toRDBStreamID(s.firstID),
+		MaxDeletedID: toRDBStreamID(s.maxDeletedID),
+		EntriesAdded: uint64(s.entriesAdded),
+	}
+	for _, e := range s.rangeEntries(streamID{}, maxStreamID, 0, false) {
+		out.Entries = append(out.Entries, rdb.StreamEntry{ID: toRDBStreamID(e.ID), Fields: e.Fields})
+	}
+	names := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		g := s.groups[name]
+		rg := rdb.StreamGroup{
+			Name:        name,
+			LastID:      toRDBStreamID(g.lastDelivered),
+			EntriesRead: g.entriesRead,
+		}
+		for _, e := range g.pending {
+			rg.Pending = append(rg.Pending, rdb.StreamPending{
+				ID:            toRDBStreamID(e.id),
+				DeliveryTime:  e.deliveryTime,
+				DeliveryCount: uint64(e.deliveryCount),
+			})
+		}
+		for _, c := range g.sortedConsumers() {
+			rc := rdb.StreamConsumer{Name: c.name, SeenTime: c.seenTime, ActiveTime: c.activeTime}
+			for _, e := range c.pending {
+				rc.Pending = append(rc.Pending, toRDBStreamID(e.id))
+			}
+			rg.Consumers = append(rg.Consumers, rc)
+		}
+		out.Groups = append(out.Groups, rg)
+	}
+	return out
+}
+
+// fromRDB converts a value read from a dump to the type storeValue takes.
+// Like Redis, it rejects values that would not survive being loaded, such
+// as empty collections other than streams.
+func fromRDB(v any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case rdb.List:
+		if len(v) == 0 {
+			return nil, errBadData
+		}
+		d := &deque{}
+		for _, item := range v {
+			d.pushBack(item)
+		}
+		return d, nil
+	case rdb.Set:
+		if len(v) == 0 {
+			return nil, errBadData
+		}
+		s := newSet()
+		for _, member := range v {
+			if !s.add(member) {
+				return nil, errBadData
+			}
+		}
+		return s, nil
+	case rdb.Hash:
+		if len(v) == 0 {
+			return nil, errBadData
+		}
+		h := newHash()
+		for _, f := range v {
+			if !h.set(f.Field, f.Value) {
+				return nil, errBadData
+			}
+			if f.ExpireAt != 0 {
+				if h.ttls == nil {
+					h.ttls = newExpiryIndex()
+				}
+				h.ttls.set(f.Field, f.ExpireAt)
+			}
+		}
+		return h, nil
+	case rdb.SortedSet:
+		if len(v) == 0 {
+			return nil, errBadData
+		}
+		z := newZSet()
+		for _, m := range v {
+			if math.IsNaN(m.Score) || !z.set(m.Member, m.Score) {
+				return nil, errBadData
+			}
+		}
+		return z, nil
+	case *rdb.Stream:
+		return streamFromRDB(v)
+	}
+	return nil, errBadData
+}
+
+func streamFromRDB(v *rdb.Stream) (*stream, error) {
+	s := &stream{}
+	for _, e := range v.Entries {
+		id := fromRDBStreamID(e.ID)
+		if s.length > 0 && !s.lastID.less(id) || len(e.Fields) == 0 || len(e.Fields)%2 != 0 {
+			return nil, errBadData
+		}
+		s.add(id, e.Fields)
+	}
+	lastID := fromRDBStreamID(v.LastID)
+	if lastID.less(s.lastID) {
+		return nil, errBadData
+	}
+	s.lastID = lastID
+	s.maxDeletedID = fromRDBStreamID(v.MaxDeletedID)
+	s.entriesAdded = max(int64(v.EntriesAdded), int64(s.length))
+
+	for _, rg := range v.Groups {
+		if s.groups == nil {
+			s.groups = make(map[string]*consumerGroup)
+		}
+		if _, ok := s.groups[rg.Name]; ok {
+			return nil, errBadData
+		}
+		g := newConsumerGroup(fromRDBStreamID(rg.LastID), rg.EntriesRead)
+		for _, p := range rg.Pending {
+			id := fromRDBStreamID(p.ID)
+			if _, ok := g.pending.get(id); ok {
+				return nil, errBadData
+			}
+			g.pending.add(&pendingEntry{id: id, deliveryTime: p.DeliveryTime, deliveryCount: int64(p.DeliveryCount)})
+		}
+		for _, rc := range rg.Consumers {
+			if _, ok := g.consumers[rc.Name]; ok {
+				return nil, errBadData
+			}
+			c := &consumer{name: rc.Name, seenTime: rc.SeenTime, activeTime: rc.ActiveTime}
+			for _, rid := range rc.Pending {
+				e, ok := g.pending.get(fromRDBStreamID(rid))
+				if !ok || e.consumer != nil {
+					return nil, errBadData
+				}
+				e.consumer = c
+				c.pending.add(e)
+			}
+			g.consumers[rc.Name] = c
+		}
+		// every pending entry must belong to a consumer
+		for _, e := range g.pending {
+			if e.consumer == nil {
+				return nil, errBadData
+			}
+		}
+		s.groups[rg.Name] = g
+	}
+	return s, nil
+}
+
+// copyValue returns a deep copy of a value returned by lookupValue.
+func copyValue(v any) any {
+	out, _ := fromRDB(toRDB(v))
+	return out
+}
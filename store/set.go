@@ -0,0 +1,543 @@
+package store
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// setMaxIntsetEntries is the most members a set keeps in the intset
+// encoding, like Redis's set-max-intset-entries.
+const setMaxIntsetEntries = 512
+
+// set is the value of a set key. It starts out as an intset and converts
+// to a dict for good once it gets a member that is not an integer or grows
+// past setMaxIntsetEntries.
+type set struct {
+	ints *intset
+	dict *dict[struct{}]
+}
+
+func newSet() *set {
+	return &set{ints: newIntset()}
+}
+
+func (s *set) len() int {
+	if s.dict != nil {
+		return s.dict.len()
+	}
+	return s.ints.len()
+}
+
+func (s *set) contains(member string) bool {
+	if s.dict != nil {
+		_, ok := s.dict.get(member)
+		return ok
+	}
+	v, ok := parseInt(member)
+	return ok && s.ints.contains(v)
+}
+
+// convert moves the members from the intset to a dict.
+func (s *set) convert() {
+	d := newDict[struct{}]()
+	for i := 0; i < s.ints.len(); i++ {
+		d.set(strconv.FormatInt(s.ints.get(i), 10), struct{}{})
+	}
+	s.dict, s.ints = d, nil
+}
+
+// add inserts member and reports whether it was new.
+func (s *set) add(member string) bool {
+	if s.dict == nil {
+		if v, ok := parseInt(member); ok {
+			if !s.ints.add(v) {
+				return false
+			}
+			if s.ints.len() > setMaxIntsetEntries {
+				s.convert()
+			}
+			return true
+		}
+		s.convert()
+	}
+	return s.dict.set(member, struct{}{})
+}
+
+func (s *set) remove(member string) bool {
+	if s.dict != nil {
+		return s.dict.delete(member)
+	}
+	v, ok := parseInt(member)
+	return ok && s.ints.remove(v)
+}
+
+// random returns a uniformly chosen member. The set must not be empty.
+func (s *set) random() string {
+	if s.dict != nil {
+		member, _ := s.dict.random()
+		return member
+	}
+	return strconv.FormatInt(s.ints.random(), 10)
+}
+
+// each calls fn for every member until fn returns false. fn must not modify
+// the set.
+func (s *set) each(fn func(member string) bool) {
+	if s.dict != nil {
+		s.dict.each(func(member string, _ struct{}) bool { return fn(member) })
+		return
+	}
+	for i := 0; i < s.ints.len(); i++ {
+		if !fn(strconv.FormatInt(s.ints.get(i), 10)) {
+			return
+		}
+	}
+}
+
+func (s *set) members() []string {
+	out := make([]string, 0, s.len())
+	s.each(func(member string) bool {
+		out = append(out, member)
+		return true
+	})
+	return out
+}
+
+// sample picks count members the way SRANDMEMBER does; see dict.sample.
+func (s *set) sample(count int64, fn func(member string)) {
+	d := s.dict
+	if d == nil {
+		d = newDict[struct{}]()
+		s.each(func(member string) bool {
+			d.set(member, struct{}{})
+			return true
+		})
+	}
+	d.sample(count, func(member string, _ struct{}) { fn(member) })
+}
+
+// lookupSet returns the set stored at key, or nil if there is none. ok is
+// false if key holds another type. The caller must hold kv.mu.
+func (kv *KVStore) lookupSet(key string) (s *set, ok bool) {
+	return lookupTyped[*set](kv, key, objSet)
+}
+
+// setForWrite is lookupSet for commands that add members: a missing set is
+// created. The caller must hold kv.mu.
+func (kv *KVStore) setForWrite(key string) (s *set, ok bool) {
+	s, ok = kv.lookupSet(key)
+	if ok && s == nil {
+		s = newSet()
+		kv.storeValue(key, s)
+	}
+	return s, ok
+}
+
+// setChanged deletes a set that just lost its last member. The caller must
+// hold kv.mu.
+func (kv *KVStore) setChanged(key string, s *set) {
+	if s.len() == 0 {
+		kv.removeKey(key)
+	}
+}
+
+// storeSet replaces dst with s, or deletes it if s is empty, for the STORE
+// variants of the set algebra commands. The caller must hold kv.mu.
+func (kv *KVStore) storeSet(dst string, s *set) {
+	if kv.removeKey(dst) {
+		kv.dirty++
+	}
+	if s.len() > 0 {
+		kv.storeValue(dst, s)
+		kv.dirty++
+	}
+}
+
+func (kv *KVStore) saddCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("sadd")
+	}
+	s, ok := kv.setForWrite(args[1])
+	if !ok {
+		return errWrongType
+	}
+	added := 0
+	for _, member := range args[2:] {
+		if s.add(member) {
+			added++
+		}
+	}
+	kv.setChanged(args[1], s)
+	kv.dirty += added
+	return respgo.EncodeInteger(added)
+}
+
+func (kv *KVStore) sremCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("srem")
+	}
+	s, ok := kv.lookupSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		return respgo.EncodeInteger(0)
+	}
+	removed := 0
+	for _, member := range args[2:] {
+		if s.remove(member) {
+			removed++
+		}
+	}
+	kv.setChanged(args[1], s)
+	kv.dirty += removed
+	return respgo.EncodeInteger(removed)
+}
+
+func (kv *KVStore) smembersCommand(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs("smembers")
+	}
+	s, ok := kv.lookupSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		return respgo.EncodeArray(nil)
+	}
+	return respgo.EncodeArray(s.members())
+}
+
+func (kv *KVStore) sismemberCommand(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs("sismember")
+	}
+	s, ok := kv.lookupSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if s != nil && s.contains(args[2]) {
+		return respgo.EncodeInteger(1)
+	}
+	return respgo.EncodeInteger(0)
+}
+
+func (kv *KVStore) smismemberCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("smismember")
+	}
+	s, ok := kv.lookupSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	out := make([][]byte, 0, len(args)-2)
+	for _, member := range args[2:] {
+		if s != nil && s.contains(member) {
+			out = append(out, respgo.EncodeInteger(1))
+		} else {
+			out = append(out, respgo.EncodeInteger(0))
+		}
+	}
+	return respgo.EncodeRawArray(out...)
+}
+
+func (kv *KVStore) scardCommand(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs("scard")
+	}
+	s, ok := kv.lookupSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		return respgo.EncodeInteger(0)
+	}
+	return respgo.EncodeInteger(s.len())
+}
+
+func (kv *KVStore) spopCommand(args []string) []byte {
+	if len(args) < 2 || len(args) > 3 {
+		return wrongArgs("spop")
+	}
+	key := args[1]
+	count := int64(-1)
+	if len(args) == 3 {
+		n, ok := parseInt(args[2])
+		if !ok || n < 0 {
+			return errNotPositive
+		}
+		count = n
+	}
+	s, ok := kv.lookupSet(key)
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		if count < 0 {
+			return nilBulk
+		}
+		return respgo.EncodeArray(nil)
+	}
+	if count < 0 {
+		member := s.random()
+		s.remove(member)
+		kv.setChanged(key, s)
+		kv.dirty++
+		kv.rewriteCommand("SREM", key, member)
+		return respgo.EncodeBulkString(member)
+	}
+	if count == 0 {
+		return respgo.EncodeArray(nil)
+	}
+	if count >= int64(s.len()) {
+		members := s.members()
+		kv.removeKey(key)
+		kv.dirty++
+		kv.rewriteCommand("DEL", key)
+		return respgo.EncodeArray(members)
+	}
+	var popped []string
+	s.sample(count, func(member string) {
+		popped = append(popped, member)
+	})
+	for _, member := range popped {
+		s.remove(member)
+	}
+	kv.dirty++
+	// replicas must remove the same members we picked
+	kv.rewriteCommand(append([]string{"SREM", key}, popped...)...)
+	return respgo.EncodeArray(popped)
+}
+
+func (kv *KVStore) srandmemberCommand(args []string) []byte {
+	if len(args) < 2 || len(args) > 3 {
+		return wrongArgs("srandmember")
+	}
+	s, ok := kv.lookupSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if len(args) == 2 {
+		if s == nil {
+			return nilBulk
+		}
+		return respgo.EncodeBulkString(s.random())
+	}
+	count, ok := parseInt(args[2])
+	if !ok {
+		return errNotInteger
+	}
+	if count == math.MinInt64 {
+		return respgo.EncodeError("ERR value is out of range")
+	}
+	if s == nil || count == 0 {
+		return respgo.EncodeArray(nil)
+	}
+	var out []string
+	s.sample(count, func(member string) {
+		out = append(out, member)
+	})
+	return respgo.EncodeArray(out)
+}
+
+func (kv *KVStore) smoveCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs("smove")
+	}
+	srcKey, dstKey, member := args[1], args[2], args[3]
+	src, ok := kv.lookupSet(srcKey)
+	if !ok {
+		return errWrongType
+	}
+	dst, ok := kv.lookupSet(dstKey)
+	if !ok {
+		return errWrongType
+	}
+	if src == nil || !src.contains(member) {
+		return respgo.EncodeInteger(0)
+	}
+	if srcKey == dstKey {
+		return respgo.EncodeInteger(1)
+	}
+	src.remove(member)
+	kv.setChanged(srcKey, src)
+	if dst == nil {
+		dst = newSet()
+		kv.storeValue(dstKey, dst)
+	}
+	dst.add(member)
+	kv.dirty++
+	return respgo.EncodeInteger(1)
+}
+
+// lookupSets returns the sets at keys, with nil for missing ones, or false
+// if any key holds another type. The caller must hold kv.mu.
+func (kv *KVStore) lookupSets(keys []string) ([]*set, bool) {
+	sets := make([]*set, len(keys))
+	for i, key := range keys {
+		s, ok := kv.lookupSet(key)
+		if !ok {
+			return nil, false
+		}
+		sets[i] = s
+	}
+	return sets, true
+}
+
+// setInter returns the members common to all sets, stopping once it has
+// limit of them unless limit is 0. A missing set makes it empty.
+func setInter(sets []*set, limit int) *set {
+	out := newSet()
+	if slices.Contains(sets, nil) {
+		return out
+	}
+	sets = slices.Clone(sets)
+	slices.SortStableFunc(sets, func(a, b *set) int { return a.len() - b.len() })
+	sets[0].each(func(member string) bool {
+		for _, other := range sets[1:] {
+			if !other.contains(member) {
+				return true
+			}
+		}
+		out.add(member)
+		return limit == 0 || out.len() < limit
+	})
+	return out
+}
+
+func setUnion(sets []*set) *set {
+	out := newSet()
+	for _, s := range sets {
+		if s == nil {
+			continue
+		}
+		s.each(func(member string) bool {
+			out.add(member)
+			return true
+		})
+	}
+	return out
+}
+
+// setDiff returns the members of the first set that are in none of the
+// others.
+func setDiff(sets []*set) *set {
+	out := newSet()
+	if sets[0] == nil {
+		return out
+	}
+	sets[0].each(func(member string) bool {
+		for _, other := range sets[1:] {
+			if other != nil && other.contains(member) {
+				return true
+			}
+		}
+		out.add(member)
+		return true
+	})
+	return out
+}
+
+// setOpCommand implements SINTER, SUNION and SDIFF along with their STORE
+// variants. op is "inter", "union" or "diff".
+func (kv *KVStore) setOpCommand(args []string, op string, store bool) []byte {
+	name := strings.ToLower(args[0])
+	first := 1
+	if store {
+		first = 2
+	}
+	if len(args) < first+1 {
+		return wrongArgs(name)
+	}
+	sets, ok := kv.lookupSets(args[first:])
+	if !ok {
+		return errWrongType
+	}
+	var result *set
+	switch op {
+	case "inter":
+		result = setInter(sets, 0)
+	case "union":
+		result = setUnion(sets)
+	default:
+		result = setDiff(sets)
+	}
+	if store {
+		kv.storeSet(args[1], result)
+		return respgo.EncodeInteger(result.len())
+	}
+	return respgo.EncodeArray(result.members())
+}
+
+func (kv *KVStore) sintercardCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("sintercard")
+	}
+	numkeys, ok := parseInt(args[1])
+	if !ok {
+		return errNotInteger
+	}
+	if numkeys <= 0 {
+		return errNumkeysZero
+	}
+	if numkeys > int64(len(args)-2) {
+		return errNumkeysTooBig
+	}
+	keys := args[2 : 2+numkeys]
+	limit := int64(0)
+	switch rest := args[2+numkeys:]; {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.ToUpper(rest[0]) == "LIMIT":
+		if limit, ok = parseInt(rest[1]); !ok {
+			return errNotInteger
+		}
+		if limit < 0 {
+			return respgo.EncodeError("ERR LIMIT can't be negative")
+		}
+	default:
+		return errSyntax
+	}
+	sets, ok := kv.lookupSets(keys)
+	if !ok {
+		return errWrongType
+	}
+	return respgo.EncodeInteger(setInter(sets, int(min(limit, math.MaxInt32))).len())
+}
+
+func (kv *KVStore) sscanCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("sscan")
+	}
+	cursor, opts, errReply := parseScanArgs(args[2:], false, false)
+	if errReply != nil {
+		return errReply
+	}
+	s, ok := kv.lookupSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	var out []string
+	switch {
+	case s == nil:
+		cursor = 0
+	case s.dict == nil:
+		// a small set is returned whole, as Redis does for compact encodings
+		for _, member := range s.members() {
+			if opts.matches(member) {
+				out = append(out, member)
+			}
+		}
+		cursor = 0
+	default:
+		cursor = s.dict.scan(cursor, opts.count, func(member string, _ struct{}) {
+			if opts.matches(member) {
+				out = append(out, member)
+			}
+		})
+	}
+	return scanReply(cursor, out)
+}
@@ -0,0 +1,244 @@
+package store
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestIntset(t *testing.T) {
+	rng := rand.New(rand.NewPCG(7, 8))
+	is := newIntset()
+	model := make(map[int64]bool)
+	// values drawn from ever wider ranges, so the encoding is upgraded with
+	// both negative and positive values along the way
+	ranges := []int64{100, math.MaxInt16 + 10, math.MaxInt32 + 10, math.MaxInt64}
+	for i := range 3000 {
+		span := ranges[min(i/500, len(ranges)-1)]
+		v := rng.Int64N(span)
+		if rng.IntN(2) == 0 {
+			v = -v - 1
+		}
+		if rng.IntN(3) == 0 && len(model) > 0 {
+			// remove something that is there, or something that is not
+			for k := range model {
+				v = k
+				break
+			}
+		}
+		if is.contains(v) != model[v] {
+			t.Fatalf("contains(%d) = %v, want %v", v, !model[v], model[v])
+		}
+		if model[v] {
+			if !is.remove(v) {
+				t.Fatalf("remove(%d) found nothing", v)
+			}
+			delete(model, v)
+		} else {
+			if !is.add(v) {
+				t.Fatalf("add(%d) found it already there", v)
+			}
+			model[v] = true
+		}
+	}
+	if is.enc != 8 {
+		t.Errorf("encoding = %d bytes, want 8 once 64-bit values were added", is.enc)
+	}
+	want := make([]int64, 0, len(model))
+	for v := range model {
+		want = append(want, v)
+	}
+	slices.Sort(want)
+	got := make([]int64, is.len())
+	for i := range got {
+		got[i] = is.get(i)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("the intset holds %d values out of order or wrong, want %d", len(got), len(want))
+	}
+	if is.add(want[0]) {
+		t.Errorf("add(%d) reported adding a value already there", want[0])
+	}
+}
+
+func TestIntsetUpgrade(t *testing.T) {
+	for _, tc := range []struct {
+		v    int64
+		enc  int
+		want []int64
+	}{
+		{math.MaxInt16 + 1, 4, []int64{-5, 7, math.MaxInt16 + 1}},
+		{math.MinInt32, 4, []int64{math.MinInt32, -5, 7}},
+		{math.MaxInt32 + 1, 8, []int64{-5, 7, math.MaxInt32 + 1}},
+		{math.MinInt64, 8, []int64{math.MinInt64, -5, 7}},
+	} {
+		is := newIntset()
+		is.add(7)
+		is.add(-5)
+		is.add(tc.v)
+		got := make([]int64, is.len())
+		for i := range got {
+			got[i] = is.get(i)
+		}
+		if is.enc != tc.enc || !slices.Equal(got, tc.want) {
+			t.Errorf("adding %d: encoding %d with %v, want %d with %v", tc.v, is.enc, got, tc.enc, tc.want)
+		}
+	}
+}
+
+func TestSetEncoding(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	runSteps(c, []step{
+		{"SADD ints 3 -1 2", "3"},
+		{"OBJECT ENCODING ints", "intset"},
+		{"SMEMBERS ints", "[-1 2 3]"},
+		// only canonical integers go in an intset
+		{"SADD ints 04", "1"},
+		{"OBJECT ENCODING ints", "listpack"},
+		{"SISMEMBER ints 04", "1"},
+		{"SISMEMBER ints 4", "0"},
+		{"SREM ints 04", "1"},
+		// and a set stays converted
+		{"OBJECT ENCODING ints", "listpack"},
+		{"SADD big 1", "1"},
+	})
+	args := []string{"SADD", "big"}
+	for i := 2; i <= setMaxIntsetEntries; i++ {
+		args = append(args, strconv.Itoa(i))
+	}
+	c.do(args...)
+	runSteps(c, []step{
+		{"OBJECT ENCODING big", "intset"},
+		{"SADD big 0", "1"},
+		{"OBJECT ENCODING big", "hashtable"},
+		{"SCARD big", "513"},
+		{"SISMEMBER big 512", "1"},
+	})
+}
+
+func TestSetCommands(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("SET", "str", "v")
+	runSteps(c, []step{
+		{"SADD s a b c", "3"},
+		{"SADD s c d", "1"},
+		{"SCARD s", "4"},
+		{"SCARD noset", "0"},
+		{"SMEMBERS s", "[a b c d]"},
+		{"SMEMBERS noset", "[]"},
+		{"SISMEMBER s a", "1"},
+		{"SISMEMBER s z", "0"},
+		{"SISMEMBER noset a", "0"},
+		{"SMISMEMBER s a z d", "[1 0 1]"},
+		{"SREM s a z", "1"},
+		{"SMOVE s t b", "1"},
+		{"SMOVE s t z", "0"},
+		{"SMOVE s s c", "1"},
+		{"SMOVE noset t a", "0"},
+		{"SMEMBERS t", "[b]"},
+		{"SMOVE s str c", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"SREM s c d", "2"},
+		{"EXISTS s", "0"},
+
+		{"SPOP noset", "(nil)"},
+		{"SPOP noset 2", "[]"},
+		{"SPOP t 0", "[]"},
+		{"SPOP t -1", "-ERR value is out of range, must be positive"},
+		{"SPOP t", "b"},
+		{"EXISTS t", "0"},
+		{"SADD t 1 2 3", "3"},
+		{"SPOP t 5", "[1 2 3]"},
+		{"EXISTS t", "0"},
+
+		{"SRANDMEMBER noset", "(nil)"},
+		{"SRANDMEMBER noset 3", "[]"},
+		{"SRANDMEMBER str", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"SRANDMEMBER t x", "-ERR value is not an integer or out of range"},
+		{"SRANDMEMBER t -9223372036854775808", "-ERR value is out of range"},
+		{"SADD str a", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"SADD s", "-ERR wrong number of arguments for 'sadd' command"},
+	})
+
+	c.do("SADD", "r", "1", "2", "3", "4", "5")
+	seen := make(map[any]bool)
+	for _, m := range c.do("SPOP", "r", "3").([]any) {
+		seen[m] = true
+	}
+	left := c.do("SMEMBERS", "r").([]any)
+	for _, m := range left {
+		seen[m] = true
+	}
+	if len(seen) != 5 || len(left) != 2 {
+		t.Errorf("SPOP r 3 left %v, and %d distinct members between them", left, len(seen))
+	}
+	for _, tc := range []struct {
+		count    string
+		n        int
+		distinct bool
+	}{{"2", 2, true}, {"9", 2, true}, {"-9", 9, false}} {
+		reply := c.do("SRANDMEMBER", "r", tc.count).([]any)
+		distinct := make(map[any]bool)
+		for _, m := range reply {
+			if !slices.Contains(left, m) {
+				t.Errorf("SRANDMEMBER r %s returned %v, which is not a member", tc.count, m)
+			}
+			distinct[m] = true
+		}
+		if len(reply) != tc.n || tc.distinct && len(distinct) != len(reply) {
+			t.Errorf("SRANDMEMBER r %s = %v, want %d members", tc.count, reply, tc.n)
+		}
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("SET", "str", "v")
+	c.do("SADD", "a", "1", "2", "3", "4")
+	c.do("SADD", "b", "3", "4", "5")
+	c.do("SADD", "c", "4", "x")
+	runSteps(c, []step{
+		{"SINTER a b", "[3 4]"},
+		{"SINTER a b c", "[4]"},
+		{"SINTER a noset", "[]"},
+		{"SUNION a b", "[1 2 3 4 5]"},
+		{"SUNION b c", "[3 4 5 x]"},
+		{"SDIFF a b", "[1 2]"},
+		{"SDIFF a b c", "[1 2]"},
+		{"SDIFF noset a", "[]"},
+		{"SDIFF a noset", "[1 2 3 4]"},
+		{"SINTER a str", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+
+		{"SINTERSTORE dst a b", "2"},
+		{"SMEMBERS dst", "[3 4]"},
+		{"OBJECT ENCODING dst", "intset"},
+		{"SUNIONSTORE dst b c", "4"},
+		{"OBJECT ENCODING dst", "listpack"},
+		{"SDIFFSTORE dst a b", "2"},
+		{"SMEMBERS dst", "[1 2]"},
+		// an empty result deletes the destination, whatever it held
+		{"SINTERSTORE str a noset", "0"},
+		{"EXISTS str", "0"},
+		{"SDIFFSTORE a a", "4"},
+		{"SMEMBERS a", "[1 2 3 4]"},
+
+		{"SINTERCARD 2 a b", "2"},
+		{"SINTERCARD 3 a b c", "1"},
+		{"SINTERCARD 2 a b LIMIT 1", "1"},
+		{"SINTERCARD 2 a b LIMIT 0", "2"},
+		{"SINTERCARD 2 a noset", "0"},
+		{"SINTERCARD 0 a", "-ERR numkeys should be greater than 0"},
+		{"SINTERCARD 3 a b", "-ERR Number of keys can't be greater than number of args"},
+		{"SINTERCARD 2 a b LIMIT -1", "-ERR LIMIT can't be negative"},
+		{"SINTERCARD 2 a b COUNT 1", "-ERR syntax error"},
+
+		{"SSCAN a 0", "[0 [1 2 3 4]]"},
+		{"SSCAN a 0 MATCH [13]", "[0 [1 3]]"},
+		{"SSCAN noset 0", "[0 []]"},
+		{"SSCAN a x", "-ERR invalid cursor"},
+	})
+}
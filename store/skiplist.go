@@ -0,0 +1,418 @@
+package store
+
+import "math/rand/v2"
+
+const (
+	zslMaxLevel = 32
+	zslP        = 0.25
+)
+
+type zslLevel struct {
+	forward *zslNode
+	// span is the number of nodes the forward link skips over, which is
+	// what makes rank lookups O(log n).
+	span int
+}
+
+type zslNode struct {
+	member   string
+	score    float64
+	backward *zslNode
+	level    []zslLevel
+}
+
+// skiplist keeps sorted set members ordered by (score, member), as Redis's
+// zskiplist does. Ranks are 1-based, matching the Redis implementation.
+type skiplist struct {
+	header *zslNode
+	tail   *zslNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &zslNode{level: make([]zslLevel, zslMaxLevel)},
+		level:  1,
+	}
+}
+
+func zslRandomLevel() int {
+	level := 1
+	for level < zslMaxLevel && rand.Float64() < zslP {
+		level++
+	}
+	return level
+}
+
+// zslBefore reports whether node n sorts before (score, member).
+func zslBefore(n *zslNode, score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+// insert adds a member that must not already be present.
+func (zsl *skiplist) insert(score float64, member string) *zslNode {
+	var update [zslMaxLevel]*zslNode
+	var rank [zslMaxLevel]int
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && zslBefore(x.level[i].forward, score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &zslNode{member: member, score: score, level: make([]zslLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+// unlink removes x given the rightmost node before it on every level.
+func (zsl *skiplist) unlink(x *zslNode, update []*zslNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+// find returns the node for (score, member), if present, along with the
+// rightmost node before that position on every level.
+func (zsl *skiplist) find(score float64, member string) (*zslNode, []*zslNode) {
+	update := make([]*zslNode, zslMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslBefore(x.level[i].forward, score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x != nil && x.score == score && x.member == member {
+		return x, update
+	}
+	return nil, update
+}
+
+func (zsl *skiplist) delete(score float64, member string) bool {
+	x, update := zsl.find(score, member)
+	if x == nil {
+		return false
+	}
+	zsl.unlink(x, update)
+	return true
+}
+
+// updateScore moves member from curScore to newScore. When the node would
+// stay in place it is updated without relinking.
+func (zsl *skiplist) updateScore(curScore float64, member string, newScore float64) *zslNode {
+	x, update := zsl.find(curScore, member)
+	if (x.backward == nil || x.backward.score < newScore) &&
+		(x.level[0].forward == nil || x.level[0].forward.score > newScore) {
+		x.score = newScore
+		return x
+	}
+	zsl.unlink(x, update)
+	return zsl.insert(newScore, member)
+}
+
+// rank returns the 1-based rank of (score, member), or 0 if absent.
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.score < score ||
+				(x.level[i].forward.score == score && x.level[i].forward.member <= member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node with the given 1-based rank.
+func (zsl *skiplist) byRank(rank int) *zslNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// scoreRange is a score interval as given to ZRANGEBYSCORE and friends.
+type scoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func (r scoreRange) gteMin(v float64) bool {
+	if r.minex {
+		return v > r.min
+	}
+	return v >= r.min
+}
+
+func (r scoreRange) lteMax(v float64) bool {
+	if r.maxex {
+		return v < r.max
+	}
+	return v <= r.max
+}
+
+func (r scoreRange) empty() bool {
+	return r.min > r.max || (r.min == r.max && (r.minex || r.maxex))
+}
+
+func (zsl *skiplist) inScoreRange(r scoreRange) bool {
+	if r.empty() || zsl.tail == nil || !r.gteMin(zsl.tail.score) {
+		return false
+	}
+	return r.lteMax(zsl.header.level[0].forward.score)
+}
+
+// firstInScoreRange returns the lowest node within r, if any.
+func (zsl *skiplist) firstInScoreRange(r scoreRange) *zslNode {
+	if !zsl.inScoreRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if !r.lteMax(x.score) {
+		return nil
+	}
+	return x
+}
+
+// lastInScoreRange returns the highest node within r, if any.
+func (zsl *skiplist) lastInScoreRange(r scoreRange) *zslNode {
+	if !zsl.inScoreRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	if !r.gteMin(x.score) {
+		return nil
+	}
+	return x
+}
+
+// lexBound is one end of a lexicographic range. inf is -1 for "-", 1 for
+// "+" and 0 for an actual string, which is exclusive when ex is set.
+type lexBound struct {
+	value string
+	inf   int
+	ex    bool
+}
+
+// compare orders two bounds, treating equal strings as equal regardless of
+// exclusivity.
+func (b lexBound) compare(o lexBound) int {
+	switch {
+	case b.inf != 0 || o.inf != 0:
+		return b.inf - o.inf
+	case b.value < o.value:
+		return -1
+	case b.value > o.value:
+		return 1
+	}
+	return 0
+}
+
+// lexRange is a member interval as given to ZRANGEBYLEX and friends.
+type lexRange struct {
+	min, max lexBound
+}
+
+func (r lexRange) gteMin(v string) bool {
+	switch {
+	case r.min.inf != 0:
+		return r.min.inf < 0
+	case r.min.ex:
+		return v > r.min.value
+	}
+	return v >= r.min.value
+}
+
+func (r lexRange) lteMax(v string) bool {
+	switch {
+	case r.max.inf != 0:
+		return r.max.inf > 0
+	case r.max.ex:
+		return v < r.max.value
+	}
+	return v <= r.max.value
+}
+
+func (r lexRange) empty() bool {
+	c := r.min.compare(r.max)
+	return c > 0 || (c == 0 && (r.min.ex || r.max.ex || r.min.inf != 0))
+}
+
+func (zsl *skiplist) inLexRange(r lexRange) bool {
+	if r.empty() || zsl.tail == nil || !r.gteMin(zsl.tail.member) {
+		return false
+	}
+	return r.lteMax(zsl.header.level[0].forward.member)
+}
+
+// firstInLexRange returns the lowest node within r, if any. Like Redis, lex
+// ranges assume all members have the same score.
+func (zsl *skiplist) firstInLexRange(r lexRange) *zslNode {
+	if !zsl.inLexRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if !r.lteMax(x.member) {
+		return nil
+	}
+	return x
+}
+
+// lastInLexRange returns the highest node within r, if any.
+func (zsl *skiplist) lastInLexRange(r lexRange) *zslNode {
+	if !zsl.inLexRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+	if !r.gteMin(x.member) {
+		return nil
+	}
+	return x
+}
+
+// deleteRange removes the nodes from first onwards for as long as keep
+// accepts them, given the rightmost nodes before first on every level, and
+// returns the removed members.
+func (zsl *skiplist) deleteRange(first *zslNode, update []*zslNode, keep func(*zslNode) bool) []string {
+	var removed []string
+	for x := first; x != nil && keep(x); {
+		next := x.level[0].forward
+		zsl.unlink(x, update)
+		removed = append(removed, x.member)
+		x = next
+	}
+	return removed
+}
+
+func (zsl *skiplist) deleteRangeByScore(r scoreRange) []string {
+	update := make([]*zslNode, zslMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	return zsl.deleteRange(x.level[0].forward, update, func(n *zslNode) bool {
+		return r.lteMax(n.score)
+	})
+}
+
+func (zsl *skiplist) deleteRangeByLex(r lexRange) []string {
+	update := make([]*zslNode, zslMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	return zsl.deleteRange(x.level[0].forward, update, func(n *zslNode) bool {
+		return r.lteMax(n.member)
+	})
+}
+
+// deleteRangeByRank removes the nodes with 1-based ranks start to end
+// inclusive.
+func (zsl *skiplist) deleteRangeByRank(start, end int) []string {
+	update := make([]*zslNode, zslMaxLevel)
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span < start {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	rank := traversed
+	return zsl.deleteRange(x.level[0].forward, update, func(*zslNode) bool {
+		rank++
+		return rank <= end
+	})
+}
@@ -0,0 +1,282 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseCommandLine configures the server from its arguments, as
+// redis-server does: an optional config file, then any number of
+// "--directive arg..." options, which take precedence over the file. A
+// config file has a directive a line, with its arguments separated by
+// spaces and quoted if need be; lines starting with # are comments. It is
+// meant to be called once at startup, before anything is loaded.
+func (kv *KVStore) ParseCommandLine(args []string) error {
+	var directives [][]string
+	var sources []string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return fmt.Errorf("can't open config file: %w", err)
+		}
+		for n, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			words, err := splitArgs(line)
+			if err != nil {
+				return fmt.Errorf("%s, line %d: %v", args[0], n+1, err)
+			}
+			directives = append(directives, words)
+			sources = append(sources, fmt.Sprintf("%s, line %d", args[0], n+1))
+		}
+		args = args[1:]
+	}
+	// the arguments of an option follow it, but never add to the last
+	// directive of the file
+	fromFile := len(directives)
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			directives = append(directives, []string{strings.TrimPrefix(arg, "--")})
+			sources = append(sources, "option "+arg)
+		case len(directives) == fromFile:
+			return fmt.Errorf("invalid argument %q: options start with --", arg)
+		default:
+			last := len(directives) - 1
+			directives[last] = append(directives[last], arg)
+		}
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	flags := make(map[string]string)
+	saveSeen := false
+	for i, d := range directives {
+		name, params := strings.ToLower(d[0]), d[1:]
+		var err error
+		if name == "save" && saveSeen && strings.TrimSpace(strings.Join(params, " ")) != "" {
+			// further save points add to the first ones, rather than
+			// replacing them, but save "" still clears them
+			err = kv.setConfig(name, formatSaveParams(kv.saveParams)+" "+strings.Join(params, " "))
+		} else {
+			err = kv.applyDirective(name, params)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: '%s': %v", sources[i], strings.Join(d, " "), err)
+		}
+		saveSeen = saveSeen || name == "save"
+		flags[name] = strings.Join(params, " ")
+	}
+	kv.Info.flags = flags
+	return nil
+}
+
+var errDirective = errors.New("bad directive or wrong number of arguments")
+
+// applyDirective applies one configuration directive. The caller must hold
+// kv.mu.
+func (kv *KVStore) applyDirective(name string, params []string) error {
+	switch name {
+	case "port":
+		if len(params) != 1 {
+			return errDirective
+		}
+		if n, err := strconv.Atoi(params[0]); err != nil || n < 0 || n > 65535 {
+			return errors.New("invalid port")
+		}
+		kv.Info.Port = params[0]
+	case "databases":
+		if len(params) != 1 {
+			return errDirective
+		}
+		n, err := strconv.Atoi(params[0])
+		if err != nil || n < 1 {
+			return errors.New("invalid number of databases")
+		}
+		kv.setDatabases(n)
+	case "replicaof", "slaveof":
+		// the master may also be given as one argument, "host port" or
+		// "host:port"
+		if len(params) == 1 {
+			params = strings.Fields(params[0])
+			if len(params) == 1 {
+				if host, port, ok := strings.Cut(params[0], ":"); ok {
+					params = []string{host, port}
+				}
+			}
+		}
+		if len(params) != 2 {
+			return errDirective
+		}
+		if strings.EqualFold(params[0], "no") && strings.EqualFold(params[1], "one") {
+			kv.Info.Role = "master"
+			return nil
+		}
+		if n, err := strconv.Atoi(params[1]); err != nil || n < 0 || n > 65535 {
+			return errors.New("invalid master port")
+		}
+		kv.Info.Role = "slave"
+		kv.Info.MasterIP, kv.Info.MasterPort = params[0], params[1]
+	case "save":
+		return kv.setConfig(name, strings.Join(params, " "))
+	default:
+		if len(params) != 1 {
+			return errDirective
+		}
+		if err := kv.setConfig(name, params[0]); err != nil {
+			if errors.Is(err, errUnknownConfig) {
+				return errDirective
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// splitArgs splits a config file line into words the way Redis does.
+// Words are separated by spaces, and may be quoted: in double quotes,
+// backslash escapes such as \n and \x41 are understood, and in single
+// quotes only \'.
+func splitArgs(line string) ([]string, error) {
+	var words []string
+	for i := 0; ; {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
+			return words, nil
+		}
+		var word []byte
+		switch line[i] {
+		case '"', '\'':
+			quote := line[i]
+			i++
+			for ; ; i++ {
+				if i == len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				c := line[i]
+				if c == quote {
+					i++
+					break
+				}
+				switch {
+				case c == '\\' && quote == '"' && i+1 < len(line):
+					c, i = unescape(line, i)
+				case c == '\\' && quote == '\'' && i+1 < len(line) && line[i+1] == '\'':
+					c, i = '\'', i+1
+				}
+				word = append(word, c)
+			}
+			if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				return nil, errors.New("closing quote must be followed by a space")
+			}
+		default:
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				word = append(word, line[i])
+				i++
+			}
+		}
+		words = append(words, string(word))
+	}
+}
+
+// unescape decodes the backslash escape at line[i], returning the byte it
+// stands for and the index of its last character.
+func unescape(line string, i int) (byte, int) {
+	next := line[i+1]
+	if next == 'x' && i+3 < len(line) {
+		if b, err := strconv.ParseUint(line[i+2:i+4], 16, 8); err == nil {
+			return byte(b), i + 3
+		}
+	}
+	switch next {
+	case 'n':
+		return '\n', i + 1
+	case 'r':
+		return '\r', i + 1
+	case 't':
+		return '\t', i + 1
+	case 'b':
+		return '\b', i + 1
+	case 'a':
+		return '\a', i + 1
+	}
+	return next, i + 1
+}
+
+// LoadDataFromDisk loads the dataset at startup. With appendonly on, the
+// AOF has the latest writes, so it is loaded if there is one; otherwise
+// the dump file is, if there is one, and the AOF starts out from what it
+// held. If loading fails, the error says what failed to load, unless
+// start-empty-on-load-error is on: then the server starts with no data,
+// and leaves the AOF off so as not to replace the one that failed to load.
+func (kv *KVStore) LoadDataFromDisk() error {
+	kv.mu.Lock()
+	useAOF := kv.aof.enabled && kv.appendOnlyFileExists()
+	rdbPath, aofDir := kv.rdbPath(), kv.aofDir()
+	kv.mu.Unlock()
+
+	start := time.Now()
+	var err error
+	if useAOF {
+		if err = kv.LoadAppendOnlyFile(); err == nil {
+			log.Printf("DB loaded from append only file: %.3f seconds", time.Since(start).Seconds())
+			return nil
+		}
+		err = fmt.Errorf("loading the append only file in %s: %w", aofDir, err)
+	} else {
+		err = kv.LoadRDBFile(rdbPath)
+		switch {
+		case err == nil:
+			log.Printf("DB loaded from disk: %.3f seconds", time.Since(start).Seconds())
+		case errors.Is(err, fs.ErrNotExist):
+			err = nil
+		default:
+			err = fmt.Errorf("loading %s: %w", rdbPath, err)
+		}
+		if err == nil {
+			if err = kv.LoadAppendOnlyFile(); err == nil {
+				return nil
+			}
+			err = fmt.Errorf("starting the append only file in %s: %w", aofDir, err)
+		}
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if !kv.startEmpty {
+		return err
+	}
+	log.Println(err)
+	log.Println("start-empty-on-load-error is on: starting with an empty dataset")
+	for _, db := range kv.dbs {
+		db.clear()
+	}
+	if kv.aof.enabled {
+		log.Println("appendonly is turned off, so that the append only file on disk is left as it is")
+		kv.stopAppendOnly()
+		kv.aof.enabled = false
+	}
+	return nil
+}
+
+// appendOnlyFileExists reports whether there is an AOF to load, in the
+// Redis 7 layout or as a single file. The caller must hold kv.mu.
+func (kv *KVStore) appendOnlyFileExists() bool {
+	for _, p := range []string{kv.aofManifestPath(), filepath.Join(kv.dir, kv.aof.filename)} {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want []string
+		err  string
+	}{
+		{"port 6380", []string{"port", "6380"}, ""},
+		{"  save\t900 1  ", []string{"save", "900", "1"}, ""},
+		{`dir "/tmp/with space"`, []string{"dir", "/tmp/with space"}, ""},
+		{`dbfilename "a\tb\x41\n\\\"c"`, []string{"dbfilename", "a\tbA\n\\\"c"}, ""},
+		// an escape that is not one is the character itself
+		{`x "\q\x4"`, []string{"x", "qx4"}, ""},
+		{`x 'it\'s' '\n'`, []string{"x", "it's", `\n`}, ""},
+		{`save ""`, []string{"save", ""}, ""},
+		{"", nil, ""},
+		{`dir "/tmp`, nil, "unbalanced quotes"},
+		{`dir 'a\'`, nil, "unbalanced quotes"},
+		{`dir "a"b`, nil, "closing quote must be followed by a space"},
+	} {
+		got, err := splitArgs(tc.line)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("splitArgs(%q) returned %v, want %q", tc.line, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tc.want) {
+			t.Errorf("splitArgs(%q) = %q, %v, want %q", tc.line, got, err, tc.want)
+		}
+	}
+}
+
+func TestParseCommandLine(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "redis.conf")
+	if err := os.WriteFile(conf, []byte(`# a comment
+port 7000
+dbfilename "from file.rdb"
+save 900 1
+save 300 10
+appendonly yes
+   # an indented comment
+
+start-empty-on-load-error yes
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		args []string
+		// want maps settings to what CONFIG GET returns for them
+		want map[string]string
+		err  string
+	}{
+		{"no arguments", nil, map[string]string{"port": "", "save": "3600 1 300 100 60 10000"}, ""},
+		{"the config file", []string{conf}, map[string]string{
+			"port": "7000", "dbfilename": "from file.rdb", "save": "900 1 300 10", "appendonly": "yes",
+			"start-empty-on-load-error": "yes",
+		}, ""},
+		// options come after the file, and override it
+		{"options after the file", []string{conf, "--port", "7001", "--appendonly", "no", "--save", "60", "5"},
+			map[string]string{"port": "7001", "appendonly": "no", "save": "900 1 300 10 60 5", "dbfilename": "from file.rdb"}, ""},
+		{"save \"\" clears the save points", []string{conf, "--save", ""}, map[string]string{"save": ""}, ""},
+		{"options alone", []string{"--replicaof", "127.0.0.1 6379", "--databases", "4"},
+			map[string]string{"replicaof": "127.0.0.1 6379"}, ""},
+		{"a missing config file", []string{filepath.Join(dir, "nope.conf")}, nil, "can't open config file"},
+		{"a bare argument", []string{conf, "7000"}, nil, `invalid argument "7000": options start with --`},
+		{"a bare argument alone", []string{"--port", "1", "2"}, nil, "option --port: 'port 1 2'"},
+		{"a bad value", []string{"--port", "x"}, nil, "option --port: 'port x': invalid port"},
+		{"an unknown option", []string{"--nope", "1"}, nil,
+			"option --nope: 'nope 1': bad directive or wrong number of arguments"},
+		{"too many values", []string{"--dir", "a", "b"}, nil,
+			"option --dir: 'dir a b': bad directive or wrong number of arguments"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kv := newTestStore(t)
+			err := kv.ParseCommandLine(tc.args)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("ParseCommandLine returned %v, want an error with %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			kv.mu.Lock()
+			defer kv.mu.Unlock()
+			for name, want := range tc.want {
+				if got, _ := kv.configGet(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+
+	// errors in the file say where they are
+	bad := filepath.Join(dir, "bad.conf")
+	os.WriteFile(bad, []byte("port 7000\n\ndir \"/tmp\n"), 0644)
+	if err := newTestStore(t).ParseCommandLine([]string{bad}); err == nil || err.Error() != bad+", line 3: unbalanced quotes" {
+		t.Errorf("ParseCommandLine of a bad file returned %v", err)
+	}
+	os.WriteFile(bad, []byte("port 7000\ndatabases 0\n"), 0644)
+	if err := newTestStore(t).ParseCommandLine([]string{bad}); err == nil ||
+		err.Error() != bad+", line 2: 'databases 0': invalid number of databases" {
+		t.Errorf("ParseCommandLine of a bad file returned %v", err)
+	}
+}
+
+// TestLoadDataFromDisk checks which of the dump file and the AOF is loaded
+// at startup, and what happens when loading fails.
+func TestLoadDataFromDisk(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// rdb and aof are what is on disk: a value for key k, "corrupt"
+		// for a file that does not load, or "" for none
+		rdb, aof string
+		options  []string
+		// want is the value of k after loading, "" if it is missing; err
+		// is part of the error expected
+		want, err string
+		// aofOn says whether the AOF is on after loading
+		aofOn bool
+	}{
+		{name: "nothing on disk"},
+		{name: "the dump file", rdb: "from rdb", want: "from rdb"},
+		{name: "the AOF off", rdb: "from rdb", aof: "from aof", want: "from rdb"},
+		{name: "the AOF on", rdb: "from rdb", aof: "from aof", options: []string{"--appendonly", "yes"},
+			want: "from aof", aofOn: true},
+		// the AOF starts out from the dump
+		{name: "the AOF on with no AOF on disk", rdb: "from rdb", options: []string{"--appendonly", "yes"},
+			want: "from rdb", aofOn: true},
+		{name: "a corrupt dump file", rdb: "corrupt", err: "loading "},
+		{name: "a corrupt dump file starting empty", rdb: "corrupt",
+			options: []string{"--start-empty-on-load-error", "yes"}},
+		{name: "a corrupt AOF", rdb: "from rdb", aof: "corrupt", options: []string{"--appendonly", "yes"},
+			err: "loading the append only file in "},
+		{name: "a corrupt AOF starting empty", rdb: "from rdb", aof: "corrupt",
+			options: []string{"--appendonly", "yes", "--start-empty-on-load-error", "yes"}},
+		// the dump loads, but the AOF cannot be started where it should be
+		{name: "an AOF that cannot start", rdb: "from rdb", aof: "blocked", options: []string{"--appendonly", "yes"},
+			err: "starting the append only file in "},
+		{name: "an AOF that cannot start starting empty", rdb: "from rdb", aof: "blocked",
+			options: []string{"--appendonly", "yes", "--start-empty-on-load-error", "yes"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			switch tc.rdb {
+			case "":
+			case "corrupt":
+				os.WriteFile(filepath.Join(dir, "dump.rdb"), []byte("REDIS0011\xff"), 0644)
+			default:
+				os.WriteFile(filepath.Join(dir, "dump.rdb"), rdbPreamble(t, map[string]string{"k": tc.rdb}), 0644)
+			}
+			switch tc.aof {
+			case "":
+			case "blocked":
+				// a file where the AOF directory should be
+				os.WriteFile(filepath.Join(dir, "appendonlydir"), nil, 0644)
+			case "corrupt":
+				writeAOF(t, dir, "file appendonly.aof.1.incr.aof seq 1 type i\n",
+					map[string][]byte{"appendonly.aof.1.incr.aof": []byte("+OK\r\n")})
+			default:
+				writeAOF(t, dir, "file appendonly.aof.1.incr.aof seq 1 type i\n",
+					map[string][]byte{"appendonly.aof.1.incr.aof": respgo.EncodeArray([]string{"SET", "k", tc.aof})})
+			}
+
+			kv := newTestStore(t)
+			if err := kv.ParseCommandLine(append([]string{"--dir", dir}, tc.options...)); err != nil {
+				t.Fatal(err)
+			}
+			err := kv.LoadDataFromDisk()
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("LoadDataFromDisk returned %v, want an error with %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := connect(t, kv)
+			if got, _ := c.do("GET", "k").(string); got != tc.want {
+				t.Errorf("GET k = %q, want %q", got, tc.want)
+			}
+			kv.mu.Lock()
+			on := kv.aof.on()
+			kv.mu.Unlock()
+			if on != tc.aofOn {
+				t.Errorf("the AOF is on: %v, want %v", on, tc.aofOn)
+			}
+			waitFor(t, kv, "the AOF rewrite to finish", func() bool { return !kv.aof.rewriteInProgress })
+		})
+	}
+}
@@ -1,16 +1,14 @@
 package store
 
 import (
-	"encoding/hex"
 	"fmt"
 	"io"
-	"math"
+	"log"
 	"net"
-	"os"
-	"path"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/siddarthpai/wardrobe/rdb"
@@ -21,6 +19,16 @@ type Connection struct {
 	Conn       net.Conn
 	TxnStarted bool
 	TxnQueue   [][]string
+
+	// db is the database selected with SELECT.
+	db int
+	// blocked is the blocking command the client is waiting in, if any,
+	// and disconnected says the client has gone away. The connection is
+	// read while its commands run, so both are guarded by kv.mu.
+	blocked      *blockedClient
+	disconnected bool
+	// replica is set once the client has turned into a replica with PSYNC.
+	replica *replica
 }
 
 type Info struct {
@@ -30,193 +38,525 @@ type Info struct {
 	MasterReplId     string
 	MasterReplOffSet int
 	MasterConn       net.Conn
-	slaves           []net.Conn
+	slaves           []*replica
 	Port             string
 	flags            map[string]string
 }
 
+// StreamEntry is one entry of a stream. Fields alternates field names and
+// values, in the order they were added.
 type StreamEntry struct {
-	Id   string
-	Pair map[string]string
+	ID     streamID
+	Fields []string
 }
 
+// KVStore is shared by every client connection. All databases, the expiry
+// bookkeeping and the replication state are guarded by mu; a command runs
+// start to finish while holding it, so clients observe commands atomically.
 type KVStore struct {
+	mu sync.Mutex
+	// database is the database the running command operates on; call
+	// selects the one chosen by the client before running each command.
+	*database
+	dbs            []*database
 	Info           Info
-	store          map[string]string
-	expiryMap      map[string]chan int
-	lists          map[string][]string
-	sets           map[string]map[string]struct{}
-	AckCh          chan int
 	ProcessedWrite bool
-	StreamXCh      chan []byte
-	Stream         map[string][]StreamEntry
+	// acks is closed, and replaced, whenever a replica acknowledges the
+	// replication stream, to wake the clients waiting in WAIT.
+	acks chan struct{}
+
+	// dirty counts changes to the dataset. A command that modifies data
+	// bumps it, which is how call knows to propagate the command.
+	// expiredKeys counts the keys deleted for having expired, which bump
+	// dirty too but are propagated as DEL of their own.
+	dirty       int
+	expiredKeys int
+	// fromMaster says the running command came from the master, which
+	// still sees the keys that have expired on this replica.
+	fromMaster bool
+	// rewritten, when set by a command, is propagated instead of the
+	// command's own arguments.
+	rewritten []string
+	// pending holds the commands waiting to be sent to replicas and
+	// the AOF, and replDB is the database the replicas were last told to
+	// SELECT, or -1.
+	pending []propagatedCommand
+	replDB  int
+	// readyKeys lists the keys that may be able to serve some of the
+	// clients blocked on them.
+	readyKeys []readyKey
+
+	// dir and dbfilename say where the dump file goes, and saveParams
+	// when it is saved automatically.
+	dir        string
+	dbfilename string
+	saveParams []saveParam
+	// startEmpty says to start with no data if what is on disk fails to
+	// load.
+	startEmpty bool
+	// dirtyAtSave is dirty as of the last successful save, which lastSave
+	// says the time of, in unix seconds. lastBgsaveTry is when the last
+	// background save started.
+	dirtyAtSave      int
+	lastSave         int64
+	lastBgsaveTry    int64
+	lastBgsaveOK     bool
+	bgsaveInProgress bool
+	bgsaveScheduled  bool
+	// snapshots lists the snapshots being written out, which keys are
+	// preserved for before they change.
+	snapshots []*snapshot
+
+	aof appendOnly
 }
 
-func (kv *KVStore) Set(key, value string, expiry int) {
-
-	if expiry >= 0 {
-		timeout := time.After(time.Duration(expiry) * time.Millisecond)
-		go kv.handleExpiry(timeout, key)
-	}
-
-	kv.store[key] = value
+// propagatedCommand is a command queued for the replicas and the AOF,
+// along with the database it ran against.
+type propagatedCommand struct {
+	db   int
+	args []string
 }
 
 func New() *KVStore {
 
-	return &KVStore{
+	kv := &KVStore{
 		Info: Info{
 			Role:             "master",
 			MasterReplId:     "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb",
 			MasterReplOffSet: 0,
 			Port:             "8000",
 		},
-		store:     make(map[string]string),
-		expiryMap: make(map[string]chan int),
-		lists:     make(map[string][]string),
-		sets:      make(map[string]map[string]struct{}),
-		AckCh:     make(chan int),
-		Stream:    make(map[string][]StreamEntry),
-		StreamXCh: make(chan []byte),
+		acks:         make(chan struct{}),
+		replDB:       -1,
+		dir:          ".",
+		dbfilename:   "dump.rdb",
+		saveParams:   defaultSaveParams,
+		lastSave:     time.Now().Unix(),
+		lastBgsaveOK: true,
+		aof:          newAppendOnly(),
 	}
+	kv.SetDatabases(defaultDatabases)
+	go kv.activeExpireLoop()
+	go kv.serverCron()
+	return kv
 }
 
-func (kv *KVStore) LoadFromRDB(dump *rdb.DumpParser) {
-	if len(dump.Databases) < 1 {
-		return
-	}
-	kv.store = dump.Databases[0].KeyValues
-	for _, rec := range dump.Databases[0].TTLRecords {
-		kv.store[rec.Key] = rec.Value
-		delay := time.Duration(int64(rec.ExpireAt)-time.Now().UnixMilli()) * time.Millisecond
-		go kv.handleExpiry(time.After(delay), rec.Key)
+// LoadRDBFile loads the dump file at path into the databases, a key at a
+// time as it is parsed.
+func (kv *KVStore) LoadRDBFile(path string) error {
+	dump, err := rdb.NewParser(path)
+	if err != nil {
+		return err
 	}
+	defer dump.Close()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.readDump(dump)
 }
 
-func (kv *KVStore) handleExpiry(timeout <-chan time.Time, key string) {
-	stop := make(chan int)
-	kv.expiryMap[key] = stop
-	select {
-	case <-timeout:
-		delete(kv.store, key)
-	case <-stop:
-	}
+// readDump parses dump, loading each key into its database as soon as it
+// has been read, so that loading takes no more memory than the keys do.
+// Keys of databases this server does not have are skipped. The caller
+// must hold kv.mu.
+func (kv *KVStore) readDump(dump *rdb.DumpParser) error {
+	skipped := make(map[int]bool)
+	return dump.ParseEach(func(id int, e rdb.Entry) error {
+		if id < 0 || id >= len(kv.dbs) {
+			if !skipped[id] {
+				log.Printf("skipping RDB keys for DB %d: only %d databases", id, len(kv.dbs))
+				skipped[id] = true
+			}
+			return nil
+		}
+		kv.withDB(kv.dbs[id], func() { kv.loadEntry(e) })
+		return nil
+	})
 }
 
-func (kv *KVStore) LoadRDB(master net.Conn) {
-	fmt.Println("started loading rdb from master... ")
-	parser := respgo.NewParser(master)
-
-	msg, err := parser.ParseMessage()
-	if err != nil {
-		fmt.Println("error reading RDB payload:", err)
+// loadEntry loads a key read from a dump into the selected database. Keys
+// that expired while the server was down are not loaded, and neither are
+// values no command could have built. The caller must hold kv.mu.
+func (kv *KVStore) loadEntry(e rdb.Entry) {
+	if e.ExpireAt != 0 && e.ExpireAt <= time.Now().UnixMilli() {
 		return
 	}
-	data, ok := msg.([]byte)
-	if !ok {
-		fmt.Printf("expected bulk string, got %T\n", msg)
+	v, err := fromRDB(e.Value)
+	if err != nil {
+		log.Printf("skipping key %q of DB %d: %v", e.Key, kv.database.id, err)
 		return
 	}
-
-	dump, err := rdb.NewParserFromBytes(data)
-	if err != nil {
-		panic(err)
+	kv.removeKey(e.Key)
+	kv.storeValue(e.Key, v)
+	if e.ExpireAt != 0 {
+		kv.setExpiry(e.Key, e.ExpireAt)
 	}
-	kv.LoadFromRDB(dump)
-	fmt.Println("finished loading rdb from master...")
 }
 
-func (kv *KVStore) HandleConnection(conn Connection, parser *respgo.RespParser) {
-	defer conn.Conn.Close()
-	for {
-		msg, err := parser.ParseMessage()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			panic("parse error: " + err.Error())
+// LoadRDB replaces the dataset with the dump a master sends after
+// FULLRESYNC, loading it straight off the link as it arrives. If loading
+// fails, the dataset is left empty rather than half loaded.
+func (kv *KVStore) LoadRDB(parser *respgo.RespParser) error {
+	log.Println("started loading rdb from master...")
+	body, err := parser.ParseBulkStream()
+	if err != nil {
+		return fmt.Errorf("reading the RDB payload: %w", err)
+	}
+	// the link carries on after the payload, so it is read to the end
+	// even if the dump turns out to be bad
+	defer io.Copy(io.Discard, body)
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.completeSnapshots()
+	for _, db := range kv.dbs {
+		db.clear()
+	}
+	if err := kv.readDump(rdb.NewParserFromReader(body)); err != nil {
+		for _, db := range kv.dbs {
+			db.clear()
 		}
+		return fmt.Errorf("loading the RDB payload: %w", err)
+	}
+	log.Println("finished loading rdb from master...")
 
-		args, ok := msg.([]string)
-		if !ok || len(args) == 0 {
-			continue
+	// what the AOF holds has just been replaced, so it starts over
+	if kv.aof.on() {
+		kv.stopAppendOnly()
+		if err := kv.startAppendOnly(); err != nil {
+			log.Println("error restarting the AOF after syncing with the master:", err)
 		}
+	}
+	return nil
+}
 
+func (kv *KVStore) HandleConnection(conn Connection, parser *respgo.RespParser) {
+	defer conn.Conn.Close()
+	// the next command is read while the current one runs, so that a
+	// client that disconnects while blocked is noticed at once
+	commands := make(chan []string)
+	go kv.readCommands(&conn, parser, commands)
+	for args := range commands {
 		// transaction queuing
 		cmd := strings.ToUpper(args[0])
 
 		txnCmds := []string{"EXEC", "DISCARD"}
 		if conn.TxnStarted && !slices.Contains(txnCmds, cmd) {
 			conn.TxnQueue = append(conn.TxnQueue, args)
-			conn.Conn.Write([]byte("+QUEUED\r\n"))
+			kv.mu.Lock()
+			fromMaster := conn.Conn == kv.Info.MasterConn
+			if fromMaster {
+				// what the master sends inside MULTI counts towards the
+				// offset as soon as it is queued, like anything else it
+				// sends
+				kv.Info.MasterReplOffSet += len(respgo.EncodeArray(args))
+			}
+			kv.mu.Unlock()
+			if !fromMaster {
+				conn.Conn.Write(respgo.EncodeSimpleString("QUEUED"))
+			}
 			continue
 		}
 
-		reply := kv.processCommand(args, &conn)
+		kv.mu.Lock()
+		reply := kv.call(args, &conn)
+		kv.handleClientsBlockedOnKeys()
 
-		if kv.Info.Role == "slave" {
-			if conn.Conn == kv.Info.MasterConn && cmd == "REPLCONF" && strings.ToUpper(args[1]) == "GETACK" {
+		if kv.Info.Role == "slave" && conn.Conn == kv.Info.MasterConn {
+			// the master is only answered when it asks for an
+			// acknowledgement
+			if cmd == "REPLCONF" && len(args) > 1 && strings.ToUpper(args[1]) == "GETACK" {
 				conn.Conn.Write(reply)
 			}
 			kv.Info.MasterReplOffSet += len(respgo.EncodeArray(args))
+			kv.propagatePending()
+			kv.mu.Unlock()
 		} else {
-			conn.Conn.Write(reply)
-			if cmd == "SET" {
-				for _, slave := range kv.Info.slaves {
-					slave.Write(respgo.EncodeArray(args))
-				}
+			// propagate while still holding the lock so replicas see writes
+			// in the same order they were applied here
+			kv.propagatePending()
+			kv.mu.Unlock()
+			// a replica is only sent what goes through its output buffer,
+			// and is not replied to past PSYNC, like in Redis
+			if conn.replica == nil {
+				conn.Conn.Write(reply)
 			}
 		}
 	}
 }
 
+// readCommands parses the commands a client sends and hands them over on
+// commands, which it closes once the client disconnects.
+func (kv *KVStore) readCommands(conn *Connection, parser *respgo.RespParser, commands chan<- []string) {
+	defer close(commands)
+	defer kv.clientDisconnected(conn)
+	for {
+		msg, err := parser.ParseMessage()
+		if err != nil {
+			// a protocol error or a broken link only ends this client
+			if err != io.EOF {
+				log.Printf("closing the connection from %s: %v", conn.Conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		args, ok := msg.([]string)
+		if !ok || len(args) == 0 {
+			continue
+		}
+		commands <- args
+	}
+}
+
+// clientDisconnected notes that the client of connection has gone away. If
+// it is blocked, it is taken off the queues of its keys at once, so that
+// nothing is handed to a client that is no longer there to receive it, and
+// if it is a replica, it is sent nothing more.
+func (kv *KVStore) clientDisconnected(connection *Connection) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	connection.disconnected = true
+	if b := connection.blocked; b != nil {
+		kv.unblock(b)
+		close(b.gone)
+	}
+	if connection.replica != nil {
+		kv.removeReplica(connection.replica)
+	}
+}
+
+// call executes one command and, if it changed the dataset, queues it for
+// the replicas. The caller must hold kv.mu.
+func (kv *KVStore) call(args []string, connection *Connection) []byte {
+	kv.selectDB(connection.db)
+	if len(kv.snapshots) > 0 {
+		kv.preserveForCommand(args)
+	}
+	dirty := kv.changes()
+	kv.rewritten = nil
+	kv.fromMaster = connection.Conn != nil && connection.Conn == kv.Info.MasterConn
+	reply := kv.processCommand(args, connection)
+	kv.propagate(args, dirty)
+	return reply
+}
+
+// propagate queues a command that has just run for the replicas: its
+// rewritten form if it set one, otherwise args if it changed the dataset
+// since dirty was sampled with changes. The caller must hold kv.mu.
+func (kv *KVStore) propagate(args []string, dirty int) {
+	switch {
+	case kv.rewritten != nil:
+		if len(kv.rewritten) > 0 {
+			kv.queuePropagation(kv.rewritten)
+		}
+	case kv.changes() != dirty && args != nil:
+		kv.queuePropagation(args)
+	}
+	kv.rewritten = nil
+}
+
+// changes returns dirty less the keys deleted for having expired, so that
+// a command that only came across expired keys is not propagated itself.
+// The caller must hold kv.mu.
+func (kv *KVStore) changes() int {
+	return kv.dirty - kv.expiredKeys
+}
+
+// queuePropagation queues args, run against the selected database, for the
+// replicas and the AOF. The caller must hold kv.mu.
+func (kv *KVStore) queuePropagation(args []string) {
+	kv.pending = append(kv.pending, propagatedCommand{kv.database.id, args})
+}
+
+// propagatePending sends the queued commands to the AOF and the replicas,
+// each of which is told to SELECT a database whenever it last heard of a
+// different one. A replica has no replicas of its own, so there they only
+// go to the AOF. Replicas are only written to by their own goroutines, so
+// this never waits on one. The caller must hold kv.mu.
+func (kv *KVStore) propagatePending() {
+	for _, p := range kv.pending {
+		kv.feedAppendOnlyFile(p.db, p.args)
+		if kv.Info.Role == "slave" || len(kv.Info.slaves) == 0 {
+			continue
+		}
+		if kv.replDB != p.db {
+			kv.feedReplicas(respgo.EncodeArray([]string{"SELECT", strconv.Itoa(p.db)}))
+			kv.replDB = p.db
+		}
+		kv.feedReplicas(respgo.EncodeArray(p.args))
+	}
+	kv.pending = kv.pending[:0]
+	kv.flushAppendOnlyFile()
+}
+
+// rewriteCommand makes call propagate args in place of the command being
+// executed, e.g. to replace a relative TTL with an absolute deadline. The
+// caller must hold kv.mu.
+func (kv *KVStore) rewriteCommand(args ...string) {
+	kv.rewritten = args
+}
+
+// preventPropagation keeps call from propagating the command being
+// executed, for commands that queue their own propagation. The caller must
+// hold kv.mu.
+func (kv *KVStore) preventPropagation() {
+	kv.rewritten = []string{}
+}
+
+// alsoPropagate queues args for the replicas right away, for commands whose
+// effects are replicated as several other commands. Such commands call
+// preventPropagation too. The caller must hold kv.mu.
+func (kv *KVStore) alsoPropagate(args ...string) {
+	kv.queuePropagation(args)
+}
+
+// waitUnlocked releases kv.mu for the duration of fn so that other clients
+// can make progress while a blocking command waits. Their writes move
+// kv.dirty in the meantime, so the waiting command is kept from being
+// propagated; anything it needs replicated is propagated by whoever served
+// it. Other clients may select other databases too, so the caller's one is
+// selected again afterwards.
+func (kv *KVStore) waitUnlocked(fn func()) {
+	db := kv.database
+	kv.mu.Unlock()
+	fn()
+	kv.mu.Lock()
+	kv.database = db
+	kv.preventPropagation()
+}
+
 func (kv *KVStore) processCommand(args []string, connection *Connection) []byte {
 
 	cmd := strings.ToUpper(args[0])
+	for _, key := range commandKeys(args) {
+		if !kv.expireIfNeeded(key) {
+			kv.touchKey(key)
+		}
+	}
 	switch cmd {
 	case "PING":
-		return []byte("+Ping-a-Ding-Dong\r\n")
+		return respgo.EncodeSimpleString("Ping-a-Ding-Dong")
 	case "ECHO":
 		return respgo.EncodeBulkString(args[1])
 	case "SET":
-		key, val := args[1], args[2]
-		ex := -1
-		if len(args) > 4 {
-			if n, err := strconv.Atoi(args[4]); err == nil {
-				ex = n
-			}
-		}
-		kv.Set(key, val, ex)
-		return []byte("+SET DONE\r\n")
+		return kv.setCommand(args)
 	case "GET":
-		key := args[1]
-		if v, ok := kv.store[key]; ok {
-			return respgo.EncodeBulkString(v)
-		}
-		return []byte("$-1\r\n")
-	case "DEL":
-		key := args[1]
-		if _, found := kv.store[key]; !found {
-			return respgo.EncodeInteger(0)
-		}
-		delete(kv.store, key)
-		if stop, ok := kv.expiryMap[key]; ok {
-			stop <- 1
-		}
-		return respgo.EncodeInteger(1)
+		return kv.getCommand(args)
+	case "GETDEL":
+		return kv.getdelCommand(args)
+	case "GETEX":
+		return kv.getexCommand(args)
+	case "GETSET":
+		return kv.getsetCommand(args)
+	case "SETNX":
+		return kv.setnxCommand(args)
+	case "SETEX":
+		return kv.setexCommand(args, 1000)
+	case "PSETEX":
+		return kv.setexCommand(args, 1)
+	case "MGET":
+		return kv.mgetCommand(args)
+	case "MSET":
+		return kv.msetCommand(args, false)
+	case "MSETNX":
+		return kv.msetCommand(args, true)
+	case "APPEND":
+		return kv.appendCommand(args)
+	case "STRLEN":
+		return kv.strlenCommand(args)
+	case "GETRANGE", "SUBSTR":
+		return kv.getrangeCommand(args)
+	case "SETRANGE":
+		return kv.setrangeCommand(args)
+	case "LCS":
+		return kv.lcsCommand(args)
+	case "SETBIT":
+		return kv.setbitCommand(args)
+	case "GETBIT":
+		return kv.getbitCommand(args)
+	case "BITCOUNT":
+		return kv.bitcountCommand(args)
+	case "BITPOS":
+		return kv.bitposCommand(args)
+	case "BITOP":
+		return kv.bitopCommand(args)
+	case "BITFIELD":
+		return kv.bitfieldCommand(args, false)
+	case "BITFIELD_RO":
+		return kv.bitfieldCommand(args, true)
+	case "PFADD":
+		return kv.pfaddCommand(args)
+	case "PFCOUNT":
+		return kv.pfcountCommand(args)
+	case "PFMERGE":
+		return kv.pfmergeCommand(args)
+	case "DEL", "UNLINK":
+		return kv.delCommand(args)
+	case "EXISTS", "TOUCH":
+		return kv.existsCommand(args)
+	case "TYPE":
+		return kv.typeCommand(args)
+	case "RANDOMKEY":
+		return kv.randomkeyCommand(args)
+	case "RENAME":
+		return kv.renameCommand(args, false)
+	case "RENAMENX":
+		return kv.renameCommand(args, true)
+	case "COPY":
+		return kv.copyCommand(args)
+	case "OBJECT":
+		return kv.objectCommand(args)
+	case "DUMP":
+		return kv.dumpCommand(args)
+	case "RESTORE":
+		return kv.restoreCommand(args)
+
+	case "SAVE":
+		return kv.saveCommand(args)
+	case "BGSAVE":
+		return kv.bgsaveCommand(args)
+	case "LASTSAVE":
+		return kv.lastsaveCommand(args)
+	case "BGREWRITEAOF":
+		return kv.bgrewriteaofCommand(args)
+
+	case "SELECT":
+		return kv.selectCommand(args, connection)
+	case "MOVE":
+		return kv.moveCommand(args)
+	case "SWAPDB":
+		return kv.swapdbCommand(args)
+	case "FLUSHDB":
+		return kv.flushCommand(args, false)
+	case "FLUSHALL":
+		return kv.flushCommand(args, true)
+	case "DBSIZE":
+		return kv.dbsizeCommand(args)
+
+	case "EXPIRE":
+		return kv.expireCommand(args, 1000, false)
+	case "PEXPIRE":
+		return kv.expireCommand(args, 1, false)
+	case "EXPIREAT":
+		return kv.expireCommand(args, 1000, true)
+	case "PEXPIREAT":
+		return kv.expireCommand(args, 1, true)
+	case "TTL":
+		return kv.ttlCommand(args, 1000)
+	case "PTTL":
+		return kv.ttlCommand(args, 1)
+	case "EXPIRETIME":
+		return kv.expireTimeCommand(args, 1000)
+	case "PEXPIRETIME":
+		return kv.expireTimeCommand(args, 1)
+	case "PERSIST":
+		return kv.persistCommand(args)
 
 	case "CONFIG":
-		if len(args) >= 3 && strings.ToUpper(args[1]) == "GET" {
-			if v, ok := kv.Info.flags[args[2]]; ok {
-				return respgo.EncodeArray([]string{args[2], v})
-			}
-		}
-		return []byte("+OK\r\n")
+		return kv.configCommand(args)
 	case "KEYS":
-		var all []string
-		for k := range kv.store {
-			all = append(all, k)
-		}
-		return respgo.EncodeArray(all)
+		return kv.keysCommand(args)
+	case "SCAN":
+		return kv.scanCommand(args)
 	case "INFO":
 
 		var sb strings.Builder
@@ -225,6 +565,20 @@ func (kv *KVStore) processCommand(args []string, connection *Connection) []byte
 		sb.WriteString(fmt.Sprintf("master_replid:%s\r\n", kv.Info.MasterReplId))
 		sb.WriteString(fmt.Sprintf("master_repl_offset:%d\r\n", kv.Info.MasterReplOffSet))
 		sb.WriteString("\r\n")
+		sb.WriteString("# Persistence\r\n")
+		sb.WriteString(fmt.Sprintf("rdb_changes_since_last_save:%d\r\n", kv.dirty-kv.dirtyAtSave))
+		inProgress, status := 0, "ok"
+		if kv.bgsaveInProgress {
+			inProgress = 1
+		}
+		if !kv.lastBgsaveOK {
+			status = "err"
+		}
+		sb.WriteString(fmt.Sprintf("rdb_bgsave_in_progress:%d\r\n", inProgress))
+		sb.WriteString(fmt.Sprintf("rdb_last_save_time:%d\r\n", kv.lastSave))
+		sb.WriteString(fmt.Sprintf("rdb_last_bgsave_status:%s\r\n", status))
+		kv.aofInfo(&sb)
+		sb.WriteString("\r\n")
 
 		return respgo.EncodeBulkString(sb.String())
 	case "REPLCONF":
@@ -233,344 +587,361 @@ func (kv *KVStore) processCommand(args []string, connection *Connection) []byte
 		case "GETACK":
 			return respgo.EncodeArray([]string{"REPLCONF", "ACK", strconv.Itoa(kv.Info.MasterReplOffSet)})
 		case "ACK":
-			kv.AckCh <- 1
-			return []byte("+OK\r\n")
+			if connection.replica != nil && len(args) > 2 {
+				if offset, err := strconv.Atoi(args[2]); err == nil {
+					kv.replicaAcked(connection.replica, offset)
+				}
+			}
+			return respgo.EncodeSimpleString("OK")
 		default:
-			return []byte("+OK\r\n")
+			return respgo.EncodeSimpleString("OK")
 		}
 	case "PSYNC":
-		header := fmt.Sprintf("+FULLRESYNC %s %d\r\n", kv.Info.MasterReplId, kv.Info.MasterReplOffSet)
-		rdbBlob, _ := hex.DecodeString("524544495330303131fa0972656469732d76657205372e322e30fa0a72656469732d62697473c040fa056374696d65c26d08bc65fa08757365642d6d656dc2b0c41000fa08616f662d62617365c000fff06e3bfec0ff5aa2")
-		payload := append([]byte(fmt.Sprintf("$%d\r\n", len(rdbBlob))), rdbBlob...)
-		kv.Info.slaves = append(kv.Info.slaves, connection.Conn)
-		return append([]byte(header), payload...)
+		header := respgo.EncodeSimpleString(fmt.Sprintf("FULLRESYNC %s %d", kv.Info.MasterReplId, kv.Info.MasterReplOffSet))
+		// the replica is sent the dataset as it is now, then whatever is
+		// propagated to it from now on, once it is registered
+		snap, dir := kv.takeSnapshot(), kv.dir
+		r := newReplica(connection.Conn, kv.Info.MasterReplOffSet, func(w io.Writer) error {
+			return kv.sendSnapshot(snap, header, dir, w)
+		})
+		connection.replica = r
+		kv.Info.slaves = append(kv.Info.slaves, r)
+		// the new replica starts out in database 0
+		kv.replDB = -1
+		return nil
 	case "WAIT":
-		req, _ := strconv.Atoi(args[1])
-		to, _ := strconv.Atoi(args[2])
-		if len(kv.store) == 0 {
-			return respgo.EncodeInteger(len(kv.Info.slaves))
+		if len(args) != 3 {
+			return wrongArgs("wait")
 		}
-		for _, s := range kv.Info.slaves {
-			go s.Write(respgo.EncodeArray([]string{"REPLCONF", "GETACK", "*"}))
+		req, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errNotInteger
 		}
-		acks := 0
-		timer := time.After(time.Duration(to) * time.Millisecond)
-	WAIT_LOOP:
-		for acks < req {
-
-			select {
-			case <-kv.AckCh:
-				acks++
-			case <-timer:
-				break WAIT_LOOP
-			}
+		to, err := strconv.Atoi(args[2])
+		if err != nil || to < 0 {
+			return respgo.EncodeError("ERR timeout is negative")
 		}
-		return respgo.EncodeInteger(acks)
-
-	case "TYPE":
-		key := args[1]
-		switch {
-		case kv.store[key] != "":
-			return []byte("+string\r\n")
-		case kv.lists[key] != nil:
-			return []byte("+list\r\n")
-		case kv.sets[key] != nil:
-			return []byte("+set\r\n")
-		default:
-			return []byte("+none\r\n")
+		// the replicas have to acknowledge everything they were sent
+		// before WAIT was called
+		offset := kv.Info.MasterReplOffSet
+		acked := kv.ackedReplicas(offset)
+		if acked >= req {
+			return respgo.EncodeInteger(acked)
 		}
-	case "XADD":
-		// generate an ID if the user passed "*"
-		if args[2] == "*" {
-			args[2] = fmt.Sprintf("%d-0", time.Now().UnixMilli())
+		kv.feedReplicas(respgo.EncodeArray([]string{"REPLCONF", "GETACK", "*"}))
+		// a timeout of 0 waits for as long as it takes, as in Redis
+		var timeout <-chan time.Time
+		if to > 0 {
+			timeout = time.After(time.Duration(to) * time.Millisecond)
 		}
-
-		streamKey := args[1]
-		lastEntries := kv.Stream[streamKey]
-		if len(lastEntries) > 0 {
-			last := lastEntries[len(lastEntries)-1]
-			lastParts := strings.Split(last.Id, "-")
-			currParts := strings.Split(args[2], "-")
-
-			lastTime, _ := strconv.Atoi(lastParts[0])
-			currTime, _ := strconv.Atoi(currParts[0])
-			lastSeq, _ := strconv.Atoi(lastParts[1])
-
-			// if user specified "*", bump sequence or reset
-			if currParts[1] == "*" {
-				if currTime == lastTime {
-					args[2] = fmt.Sprintf("%d-%d", lastTime, lastSeq+1)
-				} else if currTime == 0 {
-					args[2] = fmt.Sprintf("0-1")
-				} else {
-					args[2] = fmt.Sprintf("%d-0", currTime)
+		kv.waitUnlocked(func() {
+			for {
+				kv.mu.Lock()
+				acked = kv.ackedReplicas(offset)
+				acks := kv.acks
+				kv.mu.Unlock()
+				if acked >= req {
+					return
+				}
+				select {
+				case <-acks:
+				case <-timeout:
+					return
 				}
-				currParts = strings.Split(args[2], "-")
-				currTime, _ = strconv.Atoi(currParts[0])
-			}
-
-			currSeq, _ := strconv.Atoi(currParts[1])
-			// error checks
-			if currTime < 1 && currSeq < 1 {
-				return []byte("-ERR The ID specified in XADD must be greater than 0-0\r\n")
-			}
-			if lastTime > currTime ||
-				(lastTime == currTime && lastSeq >= currSeq) {
-				return []byte("-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n")
-			}
-		} else {
-			// empty stream, turn "*,*" into "0-1"
-			parts := strings.Split(args[2], "-")
-			if parts[1] == "*" {
-				args[2] = "0-1"
 			}
-		}
-
-		// build the StreamEntry
-		se := StreamEntry{
-			Id:   args[2],
-			Pair: make(map[string]string, (len(args)-3)/2),
-		}
-		for i := 3; i < len(args); i += 2 {
-			se.Pair[args[i]] = args[i+1]
-		}
-
-		// append into the store
-		kv.Stream[streamKey] = append(kv.Stream[streamKey], se)
-
-		// reply with the entry ID
-		reply := respgo.EncodeBulkString(args[2])
-		select {
-		case kv.StreamXCh <- reply:
-		default:
-		}
-		return reply
+		})
+		return respgo.EncodeInteger(acked)
 
+	case "XADD":
+		return kv.xaddCommand(args)
+	case "XTRIM":
+		return kv.xtrimCommand(args)
+	case "XDEL":
+		return kv.xdelCommand(args)
+	case "XLEN":
+		return kv.xlenCommand(args)
+	case "XINFO":
+		return kv.xinfoCommand(args)
 	case "LPUSH":
-		key := args[1]
-		if _, exists := kv.sets[key]; exists {
-			return []byte("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
-		}
-		for _, v := range args[2:] {
-			kv.lists[key] = append([]string{v}, kv.lists[key]...)
-		}
-		return respgo.EncodeInteger(len(kv.lists[key]))
-
+		return kv.pushCommand(args, false, false)
+	case "RPUSH":
+		return kv.pushCommand(args, true, false)
+	case "LPUSHX":
+		return kv.pushCommand(args, false, true)
+	case "RPUSHX":
+		return kv.pushCommand(args, true, true)
+	case "LPOP":
+		return kv.popCommand(args, false)
+	case "RPOP":
+		return kv.popCommand(args, true)
+	case "LLEN":
+		return kv.llenCommand(args)
+	case "LINDEX":
+		return kv.lindexCommand(args)
+	case "LSET":
+		return kv.lsetCommand(args)
 	case "LRANGE":
-		key := args[1]
-		start, _ := strconv.Atoi(args[2])
-		stop, _ := strconv.Atoi(args[3])
-		list, ok := kv.lists[key]
-		if !ok {
-			return respgo.EncodeArray([]string{})
-		}
-		if start < 0 {
-			start = len(list) + start
-		}
-		if stop < 0 {
-			stop = len(list) + stop
-		}
-		if start < 0 {
-			start = 0
-		}
-		if stop >= len(list) {
-			stop = len(list) - 1
-		}
-		if start > stop {
-			return respgo.EncodeArray([]string{})
-		}
-		return respgo.EncodeArray(list[start : stop+1])
+		return kv.lrangeCommand(args)
+	case "LINSERT":
+		return kv.linsertCommand(args)
+	case "LREM":
+		return kv.lremCommand(args)
+	case "LTRIM":
+		return kv.ltrimCommand(args)
+	case "LPOS":
+		return kv.lposCommand(args)
+	case "LMOVE", "RPOPLPUSH":
+		return kv.lmoveCommand(args)
+	case "LMPOP":
+		return kv.lmpopCommand(args)
+	case "BLPOP":
+		return kv.bpopCommand(args, connection, false)
+	case "BRPOP":
+		return kv.bpopCommand(args, connection, true)
+	case "BLMOVE", "BRPOPLPUSH":
+		return kv.blmoveCommand(args, connection)
+	case "BLMPOP":
+		return kv.blmpopCommand(args, connection)
 
 	case "SADD":
-		key := args[1]
-		if _, exists := kv.lists[key]; exists {
-			return []byte("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
-		}
-		if kv.sets[key] == nil {
-			kv.sets[key] = make(map[string]struct{})
-		}
-		added := 0
-		for _, m := range args[2:] {
-			if _, ok := kv.sets[key][m]; !ok {
-				kv.sets[key][m] = struct{}{}
-				added++
-			}
-		}
-		return respgo.EncodeInteger(added)
-
+		return kv.saddCommand(args)
+	case "SREM":
+		return kv.sremCommand(args)
 	case "SMEMBERS":
-		key := args[1]
-		set, ok := kv.sets[key]
-		if !ok {
-			return respgo.EncodeArray([]string{})
-		}
-		var mems []string
-		for m := range set {
-			mems = append(mems, m)
-		}
-		return respgo.EncodeArray(mems)
+		return kv.smembersCommand(args)
+	case "SISMEMBER":
+		return kv.sismemberCommand(args)
+	case "SMISMEMBER":
+		return kv.smismemberCommand(args)
+	case "SCARD":
+		return kv.scardCommand(args)
+	case "SPOP":
+		return kv.spopCommand(args)
+	case "SRANDMEMBER":
+		return kv.srandmemberCommand(args)
+	case "SMOVE":
+		return kv.smoveCommand(args)
+	case "SINTER":
+		return kv.setOpCommand(args, "inter", false)
+	case "SINTERSTORE":
+		return kv.setOpCommand(args, "inter", true)
+	case "SUNION":
+		return kv.setOpCommand(args, "union", false)
+	case "SUNIONSTORE":
+		return kv.setOpCommand(args, "union", true)
+	case "SDIFF":
+		return kv.setOpCommand(args, "diff", false)
+	case "SDIFFSTORE":
+		return kv.setOpCommand(args, "diff", true)
+	case "SINTERCARD":
+		return kv.sintercardCommand(args)
+	case "SSCAN":
+		return kv.sscanCommand(args)
 
 	case "XRANGE":
-		key := args[1]
-
-		endArg := args[3]
-		if endArg == "+" {
-			endArg = fmt.Sprintf("%d-%d", math.MaxInt64, math.MaxInt64)
-		}
-		startParts := strings.Split(args[2], "-")
-		endParts := strings.Split(endArg, "-")
-
-		startTime, _ := strconv.Atoi(startParts[0])
-		startSeq := 0
-		if len(startParts) > 1 {
-			startSeq, _ = strconv.Atoi(startParts[1])
-		}
-		endTime, _ := strconv.Atoi(endParts[0])
-		endSeq := -1
-		if len(endParts) > 1 {
-			endSeq, _ = strconv.Atoi(endParts[1])
-		}
-
-		var nestedEntries [][]byte
-		for _, se := range kv.Stream[key] {
-			parts := strings.Split(se.Id, "-")
-			t, _ := strconv.Atoi(parts[0])
-			s, _ := strconv.Atoi(parts[1])
-			if (t > startTime || (t == startTime && s >= startSeq)) &&
-				(t < endTime || (t == endTime && s <= endSeq)) {
-				// build [ ID, [ field, value, … ] ]
-				idFrame := respgo.EncodeBulkString(se.Id)
-
-				// and one _array_ for the field/value pairs
-				var fv []string
-				for f, v := range se.Pair {
-					fv = append(fv, f, v)
-				}
-				pairFrame := respgo.EncodeArray(fv)
-
-				// now wrap those two raw frames as a nested array
-				nested := respgo.EncodeRawArray(idFrame, pairFrame)
-				nestedEntries = append(nestedEntries, nested)
-			}
-		}
-		return respgo.EncodeRawArray(nestedEntries...)
+		return kv.xrangeCommand(args, false)
+	case "XREVRANGE":
+		return kv.xrangeCommand(args, true)
 	case "XREAD":
+		return kv.xreadCommand(args, connection)
+	case "XREADGROUP":
+		return kv.xreadgroupCommand(args, connection)
+	case "XGROUP":
+		return kv.xgroupCommand(args)
+	case "XACK":
+		return kv.xackCommand(args)
+	case "XPENDING":
+		return kv.xpendingCommand(args)
+	case "XCLAIM":
+		return kv.xclaimCommand(args)
+	case "XAUTOCLAIM":
+		return kv.xautoclaimCommand(args)
+	case "HSET", "HMSET":
+		return kv.hsetCommand(args)
+	case "HSETNX":
+		return kv.hsetnxCommand(args)
+	case "HGET":
+		return kv.hgetCommand(args)
+	case "HMGET":
+		return kv.hmgetCommand(args)
+	case "HDEL":
+		return kv.hdelCommand(args)
+	case "HLEN":
+		return kv.hlenCommand(args)
+	case "HSTRLEN":
+		return kv.hstrlenCommand(args)
+	case "HEXISTS":
+		return kv.hexistsCommand(args)
+	case "HGETALL", "HKEYS", "HVALS":
+		return kv.hgetallCommand(args)
+	case "HINCRBY":
+		return kv.hincrbyCommand(args)
+	case "HINCRBYFLOAT":
+		return kv.hincrbyfloatCommand(args)
+	case "HRANDFIELD":
+		return kv.hrandfieldCommand(args)
+	case "HSCAN":
+		return kv.hscanCommand(args)
+	case "HEXPIRE":
+		return kv.hexpireCommand(args, 1000, false)
+	case "HPEXPIRE":
+		return kv.hexpireCommand(args, 1, false)
+	case "HEXPIREAT":
+		return kv.hexpireCommand(args, 1000, true)
+	case "HPEXPIREAT":
+		return kv.hexpireCommand(args, 1, true)
+	case "HTTL":
+		return kv.httlCommand(args, 1000, false)
+	case "HPTTL":
+		return kv.httlCommand(args, 1, false)
+	case "HEXPIRETIME":
+		return kv.httlCommand(args, 1000, true)
+	case "HPEXPIRETIME":
+		return kv.httlCommand(args, 1, true)
+	case "HPERSIST":
+		return kv.hpersistCommand(args)
+
+	case "GEOADD":
+		return kv.geoaddCommand(args)
+	case "GEOPOS":
+		return kv.geoposCommand(args)
+	case "GEOHASH":
+		return kv.geohashCommand(args)
+	case "GEODIST":
+		return kv.geodistCommand(args)
+	case "GEOSEARCH":
+		return kv.geosearchCommand(args, false)
+	case "GEOSEARCHSTORE":
+		return kv.geosearchCommand(args, true)
+	case "ZADD":
+		return kv.zaddCommand(args)
+	case "ZINCRBY":
+		return kv.zincrbyCommand(args)
+	case "ZREM":
+		return kv.zremCommand(args)
+	case "ZCARD":
+		return kv.zcardCommand(args)
+	case "ZSCORE":
+		return kv.zscoreCommand(args)
+	case "ZMSCORE":
+		return kv.zmscoreCommand(args)
+	case "ZRANK":
+		return kv.zrankCommand(args, false)
+	case "ZREVRANK":
+		return kv.zrankCommand(args, true)
+	case "ZCOUNT":
+		return kv.zcountCommand(args)
+	case "ZLEXCOUNT":
+		return kv.zlexcountCommand(args)
+	case "ZRANGE":
+		return kv.zrangeCommand(args, zrangeByRank, false, false)
+	case "ZRANGESTORE":
+		return kv.zrangeCommand(args, zrangeByRank, false, true)
+	case "ZREVRANGE":
+		return kv.zrangeCommand(args, zrangeByRank, true, false)
+	case "ZRANGEBYSCORE":
+		return kv.zrangeCommand(args, zrangeByScore, false, false)
+	case "ZREVRANGEBYSCORE":
+		return kv.zrangeCommand(args, zrangeByScore, true, false)
+	case "ZRANGEBYLEX":
+		return kv.zrangeCommand(args, zrangeByLex, false, false)
+	case "ZREVRANGEBYLEX":
+		return kv.zrangeCommand(args, zrangeByLex, true, false)
+	case "ZREMRANGEBYRANK":
+		return kv.zremrangeCommand(args, zrangeByRank)
+	case "ZREMRANGEBYSCORE":
+		return kv.zremrangeCommand(args, zrangeByScore)
+	case "ZREMRANGEBYLEX":
+		return kv.zremrangeCommand(args, zrangeByLex)
+	case "ZPOPMIN":
+		return kv.zpopCommand(args, false)
+	case "ZPOPMAX":
+		return kv.zpopCommand(args, true)
+	case "ZMPOP":
+		return kv.zmpopCommand(args)
+	case "ZRANDMEMBER":
+		return kv.zrandmemberCommand(args)
+	case "ZSCAN":
+		return kv.zscanCommand(args)
+	case "ZUNION":
+		return kv.zsetOpCommand(args, "union", false)
+	case "ZINTER":
+		return kv.zsetOpCommand(args, "inter", false)
+	case "ZDIFF":
+		return kv.zsetOpCommand(args, "diff", false)
+	case "ZUNIONSTORE":
+		return kv.zsetOpCommand(args, "union", true)
+	case "ZINTERSTORE":
+		return kv.zsetOpCommand(args, "inter", true)
+	case "ZDIFFSTORE":
+		return kv.zsetOpCommand(args, "diff", true)
+	case "ZINTERCARD":
+		return kv.zintercardCommand(args)
 
-		block := strings.ToLower(args[1]) == "block"
-		waitMs := 0
-		offset := 2
-		if block {
-			waitMs, _ = strconv.Atoi(args[2])
-			offset = 4
-		}
-
-		parts := args[offset:]
-		half := len(parts) / 2
-		keys, ids := parts[:half], parts[half:]
-
-		if block {
-			if waitMs > 0 {
-				select {
-				case <-kv.StreamXCh:
-				case <-time.After(time.Duration(waitMs) * time.Millisecond):
-					return []byte("$-1\r\n")
-				}
-			} else {
-				<-kv.StreamXCh
-			}
-		}
-
-		var outer [][]byte
-		for i, key := range keys {
-			var groupItems [][]byte
-
-			if ids[i] == "$" {
-
-				se := kv.Stream[key][len(kv.Stream[key])-1]
-				idF := respgo.EncodeBulkString(se.Id)
-				var fv []string
-				for f, v := range se.Pair {
-					fv = append(fv, f, v)
-				}
-				pairF := respgo.EncodeArray(fv)
-				groupItems = append(groupItems, respgo.EncodeRawArray(idF, pairF))
-
-			} else {
-
-				thr := strings.Split(ids[i], "-")
-				thrT, _ := strconv.Atoi(thr[0])
-				thrS, _ := strconv.Atoi(thr[1])
-				for _, se := range kv.Stream[key] {
-					parts := strings.Split(se.Id, "-")
-					t, _ := strconv.Atoi(parts[0])
-					s, _ := strconv.Atoi(parts[1])
-					if t > thrT || (t == thrT && s > thrS) {
-						idF := respgo.EncodeBulkString(se.Id)
-						var fv []string
-						for f, v := range se.Pair {
-							fv = append(fv, f, v)
-						}
-						pairF := respgo.EncodeArray(fv)
-						groupItems = append(groupItems, respgo.EncodeRawArray(idF, pairF))
-					}
-				}
-			}
-
-			keyF := respgo.EncodeBulkString(key)
-			inner := respgo.EncodeRawArray(groupItems...)
-			outer = append(outer, respgo.EncodeRawArray(keyF, inner))
-		}
-
-		return respgo.EncodeRawArray(outer...)
 	case "INCR":
-		key := args[1]
-		v, ok := kv.store[key]
-		if !ok {
-			kv.store[key] = "1"
-		} else {
-			n, err := strconv.Atoi(v)
-			if err != nil {
-				return []byte("-ERR value is not an integer or out of range\r\n")
-			}
-			kv.store[key] = strconv.Itoa(n + 1)
-		}
-		n, err := strconv.Atoi(kv.store[key])
-		if err != nil {
-			return []byte("-ERR value is not an integer or out of range\r\n")
-		}
-		return respgo.EncodeInteger(n)
+		return kv.incrCommand(args, 1)
+	case "DECR":
+		return kv.incrCommand(args, -1)
+	case "INCRBY":
+		return kv.incrbyCommand(args, false)
+	case "DECRBY":
+		return kv.incrbyCommand(args, true)
+	case "INCRBYFLOAT":
+		return kv.incrbyfloatCommand(args)
 
 	case "MULTI":
 		connection.TxnStarted = true
-		return []byte("+OK\r\n")
+		return respgo.EncodeSimpleString("OK")
 	case "EXEC":
 		if !connection.TxnStarted {
 			return []byte("-ERR EXEC without MULTI\r\n")
 		}
-		var replies []string
+		var replies [][]byte
+		pending := len(kv.pending)
 		for _, queued := range connection.TxnQueue {
-			b := kv.processCommand(queued, connection)
-			replies = append(replies, string(b))
+			replies = append(replies, kv.call(queued, connection))
 		}
 		connection.TxnStarted = false
 		connection.TxnQueue = nil
-		return respgo.EncodeArray(replies)
+
+		// wrap the writes in MULTI/EXEC so replicas apply them atomically
+		if len(kv.pending) > pending {
+			writes := slices.Clone(kv.pending[pending:])
+			kv.pending = append(kv.pending[:pending], propagatedCommand{writes[0].db, []string{"MULTI"}})
+			kv.pending = append(kv.pending, writes...)
+			kv.pending = append(kv.pending, propagatedCommand{writes[len(writes)-1].db, []string{"EXEC"}})
+		}
+		kv.preventPropagation()
+		return respgo.EncodeRawArray(replies...)
 	case "DISCARD":
 		if !connection.TxnStarted {
 			return []byte("-ERR DISCARD without MULTI\r\n")
 		}
 		connection.TxnStarted = false
 		connection.TxnQueue = nil
-		return []byte("+OK\r\n")
+		return respgo.EncodeSimpleString("OK")
 
 	default:
 		return []byte("-ERR unknown command\r\n")
 	}
 }
 
+var (
+	errWrongType  = []byte("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+	errNotInteger = []byte("-ERR value is not an integer or out of range\r\n")
+	errSyntax     = []byte("-ERR syntax error\r\n")
+
+	nilBulk  = []byte("$-1\r\n")
+	nilArray = []byte("*-1\r\n")
+)
+
+func wrongArgs(cmd string) []byte {
+	return respgo.EncodeError("ERR wrong number of arguments for '" + cmd + "' command")
+}
+
 var OP_CODES = []string{"FF", "FE", "FD", "FC", "FB", "FA"}
 
-func (kv *KVStore) SendHandshake(master net.Conn, parser *respgo.RespParser) {
+func (kv *KVStore) SendHandshake(master net.Conn, parser *respgo.RespParser) error {
 	steps := [][]string{
 		{"PING"},
 		{"REPLCONF", "listening-port", kv.Info.Port},
@@ -578,100 +949,82 @@ func (kv *KVStore) SendHandshake(master net.Conn, parser *respgo.RespParser) {
 		{"PSYNC", "?", "-1"},
 	}
 	for _, cmd := range steps {
-		master.Write(respgo.EncodeArray(cmd))
-		msg, _ := parser.ParseMessage()
-		fmt.Printf("↩ %v\n", msg)
+		if _, err := master.Write(respgo.EncodeArray(cmd)); err != nil {
+			return err
+		}
+		msg, err := parser.ParseMessage()
+		if err != nil {
+			return fmt.Errorf("%s: %w", cmd[0], err)
+		}
+		if s, ok := msg.(string); ok && strings.HasPrefix(s, "-") {
+			return fmt.Errorf("%s: %s", cmd[0], s[1:])
+		}
+		log.Printf("↩ %v", msg)
+		if cmd[0] == "PSYNC" {
+			if err := kv.fullResync(msg); err != nil {
+				return err
+			}
+		}
 	}
+	kv.mu.Lock()
 	kv.Info.MasterConn = master
+	kv.mu.Unlock()
+	return nil
 }
 
-func (kv *KVStore) ExpectRDBFile(parser *respgo.RespParser) {
-	msg, err := parser.ParseMessage()
-	if err != nil {
-		fmt.Println("nothing to read")
-		return
-	}
-	data, ok := msg.([]byte)
-	if !ok {
-		fmt.Printf("expected bulk, got %T\n", msg)
-		return
+// fullResync takes on the replication ID and offset of the master from its
+// reply to PSYNC, +FULLRESYNC <replid> <offset>, so that the offsets this
+// replica acknowledges are the master's.
+func (kv *KVStore) fullResync(reply any) error {
+	s, _ := reply.(string)
+	fields := strings.Fields(s)
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		return fmt.Errorf("PSYNC: unexpected reply %q", s)
 	}
-	fmt.Println(string(data))
-}
-
-func (kv *KVStore) HandleReplication() {
-	master, err := net.Dial("tcp", kv.Info.MasterIP+":"+kv.Info.MasterPort)
+	offset, err := strconv.Atoi(fields[2])
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("PSYNC: bad offset in %q", s)
 	}
-	parser := respgo.NewParser(master)
-	kv.SendHandshake(master, parser)
-	go kv.HandleConnection(Connection{Conn: master}, parser)
+	kv.mu.Lock()
+	kv.Info.MasterReplId, kv.Info.MasterReplOffSet = fields[1], offset
+	kv.mu.Unlock()
+	return nil
 }
 
-func (kv *KVStore) ParseCommandLine() {
-	flags := make(map[string]string)
-	args := os.Args[1:]
+// replicationRetryDelay is how long a replica waits before connecting to
+// its master again after failing to sync with it.
+const replicationRetryDelay = time.Second
 
-	for i := 0; i < len(args); i++ {
-		if !strings.HasPrefix(args[i], "--") {
-			continue
-		}
-		key := strings.TrimPrefix(args[i], "--")
-
-		switch key {
-		case "replicaof":
-			if i+2 < len(args) &&
-				!strings.HasPrefix(args[i+1], "--") &&
-				!strings.HasPrefix(args[i+2], "--") {
-				kv.Info.Role = "slave"
-				kv.Info.MasterIP = args[i+1]
-				kv.Info.MasterPort = args[i+2]
-				i += 2
-				continue
-			}
-			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
-				parts := strings.SplitN(args[i+1], ":", 2)
-				if len(parts) != 2 {
-					fmt.Fprintf(os.Stderr, "invalid replicaof argument: %s\n", args[i+1])
-					os.Exit(1)
-				}
-				kv.Info.Role = "slave"
-				kv.Info.MasterIP = parts[0]
-				kv.Info.MasterPort = parts[1]
-				i++
-				continue
-			}
-			fmt.Fprintf(os.Stderr, "invalid replicaof argument\n")
-			os.Exit(1)
-
-		default:
-			// All other flags are single‐valued: --flag value
-			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
-				flags[key] = args[i+1]
-				i++
+// HandleReplication connects to the master and syncs with it. If that
+// fails, the link is closed and the handshake tried again from the start
+// after replicationRetryDelay, rather than following the master with a
+// dataset that failed to load.
+func (kv *KVStore) HandleReplication() {
+	for {
+		master, err := net.Dial("tcp", net.JoinHostPort(kv.Info.MasterIP, kv.Info.MasterPort))
+		if err == nil {
+			if err = kv.syncWithMaster(master); err == nil {
+				return
 			}
+			master.Close()
 		}
+		log.Println("error syncing with the master:", err)
+		time.Sleep(replicationRetryDelay)
 	}
+}
 
-	if port, ok := flags["port"]; ok {
-		kv.Info.Port = port
+// syncWithMaster does the handshake on the link to the master and loads
+// the dump it sends, then has HandleConnection apply the commands that
+// follow it. On error, nothing has been read off the link past the dump,
+// and the caller closes it.
+func (kv *KVStore) syncWithMaster(master net.Conn) error {
+	parser := respgo.NewParser(master)
+	if err := kv.SendHandshake(master, parser); err != nil {
+		return err
 	}
-
-	if dir, ok := flags["dir"]; ok {
-		if fname, ok2 := flags["dbfilename"]; ok2 {
-			fullPath := path.Join(dir, fname)
-			dump, err := rdb.NewParser(fullPath)
-			if err == nil {
-				if err := dump.Parse(); err != nil {
-					panic(err)
-				}
-				kv.LoadFromRDB(dump)
-			} else {
-				fmt.Println("RDB load error:", err)
-			}
-		}
+	if err := kv.LoadRDB(parser); err != nil {
+		return err
 	}
-
-	kv.Info.flags = flags
+	go kv.HandleConnection(Connection{Conn: master}, parser)
+	return nil
 }
@@ -0,0 +1,471 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// testClient is a client talking to a store over net.Pipe.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newTestStore returns a store that saves, if it ever does, to a
+// temporary directory.
+func newTestStore(t *testing.T) *KVStore {
+	kv := New()
+	kv.dir = t.TempDir()
+	return kv
+}
+
+// connect serves a new client connection to kv.
+func connect(t *testing.T, kv *KVStore) *testClient {
+	server, client := net.Pipe()
+	go kv.HandleConnection(Connection{Conn: server}, respgo.NewParser(server))
+	t.Cleanup(func() { client.Close() })
+	return &testClient{t: t, conn: client, r: bufio.NewReader(client)}
+}
+
+// send sends a command without waiting for its reply.
+func (c *testClient) send(args ...string) {
+	c.t.Helper()
+	if _, err := c.conn.Write(respgo.EncodeArray(args)); err != nil {
+		c.t.Fatalf("%v: %v", args, err)
+	}
+}
+
+// try sends a command and returns its reply, as read by readReply. Unlike
+// do, it may be called from any goroutine.
+func (c *testClient) try(args ...string) (any, error) {
+	if _, err := c.conn.Write(respgo.EncodeArray(args)); err != nil {
+		return nil, fmt.Errorf("%v: %w", args, err)
+	}
+	reply, err := readReply(c.r)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", args, err)
+	}
+	return reply, nil
+}
+
+// do sends a command and returns its reply, failing the test if it cannot.
+func (c *testClient) do(args ...string) any {
+	c.t.Helper()
+	reply, err := c.try(args...)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return reply
+}
+
+// read reads a reply to a command sent earlier.
+func (c *testClient) read() any {
+	c.t.Helper()
+	reply, err := readReply(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return reply
+}
+
+// readReply reads one reply. Simple strings and errors keep their + or -
+// prefix, bulk strings are strings, integers ints, arrays []any and null
+// replies nil.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply line")
+	}
+	switch line[0] {
+	case '+', '-':
+		return line, nil
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]any, n)
+		for i := range out {
+			if out[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// formatReply renders a reply compactly for comparisons: arrays as
+// [a b c], nil as (nil), and anything else as fmt does.
+func formatReply(reply any) string {
+	switch reply := reply.(type) {
+	case nil:
+		return "(nil)"
+	case []any:
+		parts := make([]string, len(reply))
+		for i, v := range reply {
+			parts[i] = formatReply(v)
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+	return fmt.Sprint(reply)
+}
+
+// step is a command of a table-driven test, split on spaces, and its
+// expected reply as formatReply renders it.
+type step struct {
+	cmd  string
+	want string
+}
+
+// runSteps runs steps in order on c, reporting every reply that differs
+// from the expected one.
+func runSteps(c *testClient, steps []step) {
+	c.t.Helper()
+	for _, s := range steps {
+		if got := formatReply(c.do(strings.Fields(s.cmd)...)); got != s.want {
+			c.t.Errorf("%s = %s, want %s", s.cmd, got, s.want)
+		}
+	}
+}
+
+// waitFor waits for cond, which is checked with kv.mu held, to hold.
+func waitFor(t *testing.T, kv *KVStore, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		kv.mu.Lock()
+		ok := cond()
+		kv.mu.Unlock()
+		if ok {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// attachReplica starts a replica of master, linked to it over net.Pipe, and
+// waits for it to load the dump.
+func attachReplica(t *testing.T, master *KVStore) *KVStore {
+	t.Helper()
+	replica := newTestStore(t)
+	replica.Info.Role = "slave"
+	server, client := net.Pipe()
+	go master.HandleConnection(Connection{Conn: server}, respgo.NewParser(server))
+	t.Cleanup(func() { client.Close() })
+	if err := replica.syncWithMaster(client); err != nil {
+		t.Fatal(err)
+	}
+	return replica
+}
+
+// dumpAll returns the serialized value of every key in databases 0 and 1,
+// as DUMP gives it, by database and key.
+func dumpAll(c *testClient) map[string]string {
+	c.t.Helper()
+	values := make(map[string]string)
+	for _, db := range []string{"0", "1"} {
+		c.do("SELECT", db)
+		keys, ok := c.do("KEYS", "*").([]any)
+		if !ok {
+			c.t.Fatalf("KEYS * in database %s did not return an array", db)
+		}
+		for _, key := range keys {
+			values[db+"/"+key.(string)] = c.do("DUMP", key.(string)).(string)
+		}
+	}
+	return values
+}
+
+func TestConcurrentClients(t *testing.T) {
+	const clients, ops = 200, 100
+	master := newTestStore(t)
+
+	var (
+		mu     sync.Mutex
+		popped []string
+		pushed []string
+		xadds  int
+	)
+	var wg sync.WaitGroup
+	started := make(chan struct{}, clients)
+	for i := range clients {
+		c := connect(t, master)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started <- struct{}{}
+			if err := runClient(c, i, ops, &mu, &popped, &pushed, &xadds); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// the replica joins while the clients are busy, so that it has to sync
+	// in the middle of a stream of writes
+	for range clients {
+		<-started
+	}
+	replica := attachReplica(t, master)
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	c := connect(t, master)
+	if got := c.do("LLEN", "queue"); got != 0 {
+		t.Errorf("LLEN queue = %v, want 0", got)
+	}
+	slices.Sort(pushed)
+	slices.Sort(popped)
+	if !slices.Equal(pushed, popped) {
+		t.Errorf("BLPOP got %d elements, %d distinct, of the %d pushed", len(popped), len(slices.Compact(slices.Clone(popped))), len(pushed))
+	}
+	total := 0
+	for s := range 4 {
+		n, _ := c.do("XLEN", "s"+strconv.Itoa(s)).(int)
+		total += n
+	}
+	c.do("SELECT", "1")
+	for s := range 4 {
+		n, _ := c.do("XLEN", "s"+strconv.Itoa(s)).(int)
+		total += n
+	}
+	if total != xadds {
+		t.Errorf("streams hold %d entries, want %d", total, xadds)
+	}
+
+	if got := c.do("WAIT", "1", "5000"); got != 1 {
+		t.Fatalf("WAIT = %v, want 1", got)
+	}
+	want := dumpAll(c)
+	got := dumpAll(connect(t, replica))
+	if len(got) != len(want) {
+		t.Errorf("replica has %d keys, master %d", len(got), len(want))
+	}
+	for key, v := range want {
+		if got[key] != v {
+			t.Errorf("replica's %s differs from the master's", key)
+		}
+	}
+	// once it has taken in everything it was sent, the replica is at the
+	// master's offset, transactions included
+	master.mu.Lock()
+	offset := master.Info.MasterReplOffSet
+	master.mu.Unlock()
+	waitFor(t, replica, "the replica to reach the master's offset", func() bool { return replica.Info.MasterReplOffSet == offset })
+}
+
+// runClient runs ops commands as client i. A quarter of the clients pop the
+// queue with BLPOP while another quarter push to it, the same number of
+// times, and the rest mix SET, GET, LPUSH, XADD and transactions in
+// database 0 or 1.
+func runClient(c *testClient, i, ops int, mu *sync.Mutex, popped, pushed *[]string, xadds *int) error {
+	check := func(args []string, ok func(any) bool) error {
+		reply, err := c.try(args...)
+		if err != nil {
+			return err
+		}
+		if !ok(reply) {
+			return fmt.Errorf("client %d: %v = %v", i, args, reply)
+		}
+		return nil
+	}
+	isInt := func(r any) bool { n, ok := r.(int); return ok && n > 0 }
+	isString := func(r any) bool { _, ok := r.(string); return ok }
+
+	switch i % 4 {
+	case 0:
+		for range ops {
+			reply, err := c.try("BLPOP", "queue", "0")
+			if err != nil {
+				return err
+			}
+			got, ok := reply.([]any)
+			if !ok || len(got) != 2 {
+				return fmt.Errorf("client %d: BLPOP = %v", i, reply)
+			}
+			mu.Lock()
+			*popped = append(*popped, got[1].(string))
+			mu.Unlock()
+		}
+	case 1:
+		for n := range ops {
+			v := fmt.Sprintf("%d:%d", i, n)
+			if err := check([]string{"LPUSH", "queue", v}, isInt); err != nil {
+				return err
+			}
+			mu.Lock()
+			*pushed = append(*pushed, v)
+			mu.Unlock()
+		}
+	default:
+		if err := check([]string{"SELECT", strconv.Itoa(i % 4 / 3)}, isString); err != nil {
+			return err
+		}
+		for n := range ops {
+			v := fmt.Sprintf("%d:%d", i, n)
+			var err error
+			switch n % 5 {
+			case 0:
+				err = check([]string{"SET", "k" + strconv.Itoa(n%16), v}, func(r any) bool { return r == "+OK" })
+			case 1:
+				// the key the previous command set, perhaps overwritten
+				// since by another client
+				err = check([]string{"GET", "k" + strconv.Itoa((n-1)%16)}, isString)
+			case 2:
+				err = check([]string{"LPUSH", "l" + strconv.Itoa(n%8), v}, isInt)
+			case 3:
+				err = check([]string{"XADD", "s" + strconv.Itoa(n%4), "*", "client", v}, isString)
+				mu.Lock()
+				*xadds++
+				mu.Unlock()
+			case 4:
+				// a transaction, which replicas get wrapped in MULTI/EXEC
+				txn := []struct {
+					args []string
+					want string
+				}{
+					{[]string{"MULTI"}, "+OK"},
+					{[]string{"SET", "t" + strconv.Itoa(n%8), v}, "+QUEUED"},
+					{[]string{"INCR", "counter"}, "+QUEUED"},
+				}
+				for _, cmd := range txn {
+					if err = check(cmd.args, func(r any) bool { return r == cmd.want }); err != nil {
+						return err
+					}
+				}
+				err = check([]string{"EXEC"}, func(r any) bool { return strings.HasPrefix(formatReply(r), "[+OK ") })
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestReplicaFailingToLoadTheDump(t *testing.T) {
+	replica := newTestStore(t)
+	replica.Info.Role = "slave"
+	server, client := net.Pipe()
+	defer server.Close()
+	// a master that sends a corrupt dump, followed by a write
+	go func() {
+		parser := respgo.NewParser(server)
+		for _, reply := range []string{"+PONG", "+OK", "+OK", "+FULLRESYNC 8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb 0"} {
+			if _, err := parser.ParseMessage(); err != nil {
+				return
+			}
+			server.Write([]byte(reply + "\r\n"))
+		}
+		server.Write([]byte("$9\r\nREDIS0011"))
+		server.Write(respgo.EncodeArray([]string{"SET", "k", "v"}))
+	}()
+	err := replica.syncWithMaster(client)
+	if err == nil {
+		t.Fatal("syncWithMaster succeeded with a corrupt dump")
+	}
+	client.Close()
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	if n := replica.dbs[0].size(); n != 0 {
+		t.Errorf("replica has %d keys after failing to sync", n)
+	}
+}
+
+func TestWaitCountsAcknowledgedOffsets(t *testing.T) {
+	master := newTestStore(t)
+	// a replica that syncs, then never acknowledges anything
+	silent := connect(t, master)
+	for _, cmd := range [][]string{{"PING"}, {"REPLCONF", "listening-port", "6380"}, {"REPLCONF", "capa", "psync2"}} {
+		silent.do(cmd...)
+	}
+	silent.send("PSYNC", "?", "-1")
+	go io.Copy(io.Discard, silent.conn)
+	waitFor(t, master, "the replica to be registered", func() bool { return len(master.Info.slaves) == 1 })
+
+	c := connect(t, master)
+	if got := c.do("WAIT", "1", "100"); got != 1 {
+		t.Errorf("WAIT with nothing written = %v, want 1", got)
+	}
+	// the dataset ends up empty, but the replica has still been sent
+	// writes it has not acknowledged
+	c.do("SET", "k", "v")
+	c.do("DEL", "k")
+	if got := c.do("WAIT", "1", "100"); got != 0 {
+		t.Errorf("WAIT after unacknowledged writes = %v, want 0", got)
+	}
+
+	replica := attachReplica(t, master)
+	c.do("SET", "k", "v")
+	if got := c.do("WAIT", "2", "100"); got != 1 {
+		t.Errorf("WAIT 2 with one replica acknowledging = %v, want 1", got)
+	}
+	if got := c.do("WAIT", "1", "0"); got != 1 {
+		t.Errorf("WAIT 1 = %v, want 1", got)
+	}
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	if v, _, _ := replica.lookupString("k"); v != "v" {
+		t.Errorf("replica has k = %q, want v", v)
+	}
+}
+
+// infoField returns a field of the INFO reply.
+func infoField(c *testClient, field string) string {
+	c.t.Helper()
+	for _, line := range strings.Split(c.do("INFO").(string), "\r\n") {
+		if v, ok := strings.CutPrefix(line, field+":"); ok {
+			return v
+		}
+	}
+	c.t.Fatalf("INFO has no %s", field)
+	return ""
+}
+
+func TestReplicaOffsetAfterTransaction(t *testing.T) {
+	master := newTestStore(t)
+	replica := attachReplica(t, master)
+	c := connect(t, master)
+	c.do("SET", "before", "1")
+	c.do("MULTI")
+	c.do("SET", "k", "v")
+	c.do("INCR", "n")
+	c.do("EXEC")
+	want := infoField(c, "master_repl_offset")
+	waitFor(t, replica, "the transaction to reach the replica", func() bool { return replica.keyExists("n") })
+
+	reply := connect(t, replica).do("REPLCONF", "GETACK", "*")
+	if got, ok := reply.([]any); !ok || len(got) != 3 || got[2] != want {
+		t.Errorf("REPLCONF GETACK on the replica = %v, want an offset of %s", reply, want)
+	}
+	if got := c.do("WAIT", "1", "5000"); got != 1 {
+		t.Errorf("WAIT after a transaction = %v, want 1", got)
+	}
+}
@@ -0,0 +1,962 @@
+package store
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// streamID is a stream entry ID: a millisecond timestamp and a sequence
+// number within that millisecond.
+type streamID struct {
+	ms, seq uint64
+}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(o streamID) bool {
+	return id.ms < o.ms || (id.ms == o.ms && id.seq < o.seq)
+}
+
+// next returns the smallest ID above id; ok is false if id is the largest.
+func (id streamID) next() (streamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return streamID{id.ms, id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return streamID{id.ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// prev returns the largest ID below id; ok is false if id is 0-0.
+func (id streamID) prev() (streamID, bool) {
+	switch {
+	case id.seq > 0:
+		return streamID{id.ms, id.seq - 1}, true
+	case id.ms > 0:
+		return streamID{id.ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// parseStreamID parses "ms-seq", or a bare "ms" which takes missingSeq as
+// its sequence number.
+func parseStreamID(s string, missingSeq uint64) (streamID, bool) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+	if !hasSeq {
+		return streamID{ms, missingSeq}, true
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+	return streamID{ms, seq}, true
+}
+
+var errInvalidStreamID = respgo.EncodeError("ERR Invalid stream ID specified as stream command argument")
+
+// maxStreamID is the largest possible stream ID.
+var maxStreamID = streamID{math.MaxUint64, math.MaxUint64}
+
+// streamNodeMaxEntries is how many entries a block of a stream holds at
+// most. Approximate trimming only ever drops whole blocks.
+const streamNodeMaxEntries = 100
+
+// stream is the value of a stream key.
+type stream struct {
+	// blocks hold the entries, ordered by ID. XDEL leaves tombstones in a
+	// block, which goes away once all its entries are deleted.
+	blocks []*streamBlock
+	length int
+	// lastID is the greatest ID ever added, which the ID of a new entry
+	// must exceed.
+	lastID streamID
+	// firstID is the ID of the first live entry, or 0-0 when empty.
+	firstID streamID
+	// maxDeletedID is the greatest ID removed by XDEL.
+	maxDeletedID streamID
+	// entriesAdded counts every entry ever added.
+	entriesAdded int64
+	// groups holds the consumer groups; it stays nil until one is created.
+	groups map[string]*consumerGroup
+}
+
+// entry returns the entry with the given ID, if it is still in the stream.
+func (s *stream) entry(id streamID) (StreamEntry, bool) {
+	i := s.searchBlock(id)
+	if i < 0 {
+		return StreamEntry{}, false
+	}
+	b := s.blocks[i]
+	if e, ok := b.find(id); ok && !e.deleted() {
+		return b.decode(e), true
+	}
+	return StreamEntry{}, false
+}
+
+// add appends an entry, whose ID must be above lastID. fields alternates
+// field names and values.
+func (s *stream) add(id streamID, fields []string) {
+	if len(s.blocks) == 0 || s.blocks[len(s.blocks)-1].full() {
+		s.blocks = append(s.blocks, newStreamBlock(id, fields))
+	}
+	s.blocks[len(s.blocks)-1].append(id, fields)
+	if s.length == 0 {
+		s.firstID = id
+	}
+	s.length++
+	s.lastID = id
+	s.entriesAdded++
+}
+
+// delete marks the entry with the given ID deleted and reports whether it
+// was there.
+func (s *stream) delete(id streamID) bool {
+	i := s.searchBlock(id)
+	if i < 0 {
+		return false
+	}
+	b := s.blocks[i]
+	e, ok := b.find(id)
+	if !ok || e.deleted() {
+		return false
+	}
+	b.markDeleted(e)
+	if b.live == 0 {
+		s.blocks = slices.Delete(s.blocks, i, i+1)
+	}
+	s.length--
+	if s.maxDeletedID.less(id) {
+		s.maxDeletedID = id
+	}
+	s.updateFirstID()
+	return true
+}
+
+func (s *stream) updateFirstID() {
+	s.firstID = streamID{}
+	if first := s.rangeEntries(streamID{}, maxStreamID, 1, false); len(first) > 0 {
+		s.firstID = first[0].ID
+	}
+}
+
+// rangeEntries returns the entries with IDs from start to end inclusive,
+// last first if rev is set, stopping after count unless it is 0.
+func (s *stream) rangeEntries(start, end streamID, count int64, rev bool) []StreamEntry {
+	if end.less(start) {
+		return nil
+	}
+	var out []StreamEntry
+	done := func() bool { return count > 0 && int64(len(out)) == count }
+	if !rev {
+		for i := max(s.searchBlock(start), 0); i < len(s.blocks) && !done(); i++ {
+			b := s.blocks[i]
+			for off := 0; off < len(b.data) && !done(); {
+				e := b.at(off)
+				if end.less(e.id) {
+					return out
+				}
+				if !e.deleted() && !e.id.less(start) {
+					out = append(out, b.decode(e))
+				}
+				off = e.next
+			}
+		}
+		return out
+	}
+	for i := s.searchBlock(end); i >= 0 && !done(); i-- {
+		b := s.blocks[i]
+		offsets := b.offsets()
+		for j := len(offsets) - 1; j >= 0 && !done(); j-- {
+			e := b.at(offsets[j])
+			if e.id.less(start) {
+				return out
+			}
+			if !e.deleted() && !end.less(e.id) {
+				out = append(out, b.decode(e))
+			}
+		}
+	}
+	return out
+}
+
+// after returns up to count entries with IDs above id, or all of them if
+// count is 0.
+func (s *stream) after(id streamID, count int64) []StreamEntry {
+	next, ok := id.next()
+	if !ok {
+		return nil
+	}
+	return s.rangeEntries(next, maxStreamID, count, false)
+}
+
+// streamTrim is the MAXLEN or MINID clause of XADD and XTRIM.
+type streamTrim struct {
+	// minID selects MINID, which trims entries below threshold; otherwise
+	// MAXLEN trims the oldest entries beyond maxLen.
+	minID     bool
+	maxLen    int64
+	threshold streamID
+	// approx trims whole nodes only, removing at most limit entries
+	// unless limit is 0.
+	approx bool
+	limit  int64
+}
+
+// trim removes entries from the head of the stream as t says and returns
+// how many it removed.
+func (s *stream) trim(t streamTrim) int64 {
+	removed := int64(0)
+	for len(s.blocks) > 0 {
+		b := s.blocks[0]
+		whole := int64(s.length-b.live) >= t.maxLen
+		if t.minID {
+			whole = b.last.less(t.threshold)
+		}
+		if whole {
+			if t.limit > 0 && removed+int64(b.live) > t.limit {
+				break
+			}
+			s.blocks = s.blocks[1:]
+			s.length -= b.live
+			removed += int64(b.live)
+			continue
+		}
+		if t.approx {
+			break
+		}
+		// the cut falls inside this block: delete entries one at a time
+		for off := 0; off < len(b.data); {
+			e := b.at(off)
+			if t.minID && !e.id.less(t.threshold) || !t.minID && int64(s.length) <= t.maxLen {
+				break
+			}
+			if !e.deleted() {
+				b.markDeleted(e)
+				s.length--
+				removed++
+			}
+			off = e.next
+		}
+		if b.live == 0 {
+			s.blocks = s.blocks[1:]
+		}
+		break
+	}
+	if removed > 0 {
+		s.updateFirstID()
+	}
+	return removed
+}
+
+// nodes returns the number of blocks.
+func (s *stream) nodes() int {
+	return len(s.blocks)
+}
+
+// hasTombstones reports whether an entry deleted by XDEL may lie between
+// start and end.
+func (s *stream) hasTombstones(start, end streamID) bool {
+	if s.length == 0 || s.maxDeletedID == (streamID{}) {
+		return false
+	}
+	return !s.maxDeletedID.less(start) && !end.less(s.maxDeletedID)
+}
+
+// entriesReadAt works out how many entries a group that has read up to id
+// has seen, or returns -1 if deletions make that impossible to tell.
+func (s *stream) entriesReadAt(id streamID) int64 {
+	if s.entriesAdded == 0 {
+		return 0
+	}
+	if s.length == 0 && !s.lastID.less(id) {
+		return s.entriesAdded
+	}
+	if id == s.lastID {
+		return s.entriesAdded
+	}
+	if s.lastID.less(id) {
+		return -1
+	}
+	if s.maxDeletedID == (streamID{}) || s.maxDeletedID.less(s.firstID) {
+		// nothing was deleted past the first entry
+		if id.less(s.firstID) {
+			return s.entriesAdded - int64(s.length)
+		}
+		if id == s.firstID {
+			return s.entriesAdded - int64(s.length) + 1
+		}
+	}
+	return -1
+}
+
+// lag returns how many entries g has yet to read, if it can be told.
+func (s *stream) lag(g *consumerGroup) (int64, bool) {
+	if s.entriesAdded == 0 {
+		return 0, true
+	}
+	if g.entriesRead >= 0 && !s.hasTombstones(g.lastDelivered, maxStreamID) {
+		return s.entriesAdded - g.entriesRead, true
+	}
+	if read := s.entriesReadAt(g.lastDelivered); read >= 0 {
+		return s.entriesAdded - read, true
+	}
+	return 0, false
+}
+
+// markRead advances g past the entry with the given ID.
+func (s *stream) markRead(g *consumerGroup, id streamID) {
+	if !g.lastDelivered.less(id) {
+		return
+	}
+	if g.entriesRead >= 0 && !s.hasTombstones(id, maxStreamID) {
+		g.entriesRead++
+	} else if s.entriesAdded > 0 {
+		g.entriesRead = s.entriesReadAt(id)
+	}
+	g.lastDelivered = id
+}
+
+// lastStreamID returns the last ID added to the stream at key, or 0-0 if
+// there is no such stream. The caller must hold kv.mu.
+func (kv *KVStore) lastStreamID(key string) streamID {
+	if s, _ := kv.lookupStream(key); s != nil {
+		return s.lastID
+	}
+	return streamID{}
+}
+
+// parseRangeID parses one end of an ID range: "-" or "+" for the extremes,
+// or an ID, exclusive when prefixed with "(". A bare timestamp covers the
+// whole millisecond.
+func parseRangeID(arg string, end bool) (streamID, []byte) {
+	switch arg {
+	case "-":
+		return streamID{}, nil
+	case "+":
+		return maxStreamID, nil
+	}
+	exclusive := strings.HasPrefix(arg, "(")
+	missingSeq := uint64(0)
+	if end {
+		missingSeq = math.MaxUint64
+	}
+	id, ok := parseStreamID(strings.TrimPrefix(arg, "("), missingSeq)
+	if !ok {
+		return id, errInvalidStreamID
+	}
+	if !exclusive {
+		return id, nil
+	}
+	if end {
+		if id, ok = id.prev(); !ok {
+			return id, respgo.EncodeError("ERR invalid end ID for the interval")
+		}
+		return id, nil
+	}
+	if id, ok = id.next(); !ok {
+		return id, respgo.EncodeError("ERR invalid start ID for the interval")
+	}
+	return id, nil
+}
+
+// encodeStreamEntry encodes an entry as the [id, [field, value, ...]] pair
+// used by XRANGE and XREAD.
+func encodeStreamEntry(se StreamEntry) []byte {
+	return respgo.EncodeRawArray(respgo.EncodeBulkString(se.ID.String()), respgo.EncodeArray(se.Fields))
+}
+
+func (kv *KVStore) xreadCommand(args []string, connection *Connection) []byte {
+	count := int64(0)
+	block := false
+	var timeout time.Duration
+	streamsAt := -1
+	for i := 1; i < len(args) && streamsAt < 0; i++ {
+		hasNext := i+1 < len(args)
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "COUNT" && hasNext:
+			n, ok := parseInt(args[i+1])
+			if !ok {
+				return errNotInteger
+			}
+			count = max(n, 0)
+			i++
+		case opt == "BLOCK" && hasNext:
+			ms, ok := parseInt(args[i+1])
+			if !ok {
+				return respgo.EncodeError("ERR timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return respgo.EncodeError("ERR timeout is negative")
+			}
+			block = true
+			timeout = time.Duration(min(ms, math.MaxInt64/int64(time.Millisecond))) * time.Millisecond
+			i++
+		case opt == "STREAMS":
+			streamsAt = i
+		default:
+			return errSyntax
+		}
+	}
+	if streamsAt < 0 {
+		return errSyntax
+	}
+	rest := args[streamsAt+1:]
+	if len(rest) == 0 || len(rest)%2 != 0 {
+		return respgo.EncodeError("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+	keys, rawIDs := rest[:len(rest)/2], rest[len(rest)/2:]
+	for _, key := range keys {
+		if t := kv.keyType(key); t != "none" && t != "stream" {
+			return errWrongType
+		}
+	}
+	// "$" means entries added from now on, so it is resolved before blocking
+	ids := make([]streamID, len(keys))
+	for i, raw := range rawIDs {
+		if raw == "$" {
+			ids[i] = kv.lastStreamID(keys[i])
+			continue
+		}
+		id, ok := parseStreamID(raw, 0)
+		if !ok {
+			return errInvalidStreamID
+		}
+		ids[i] = id
+	}
+
+	serve := func() ([]byte, bool) {
+		var streams [][]byte
+		for i, key := range keys {
+			s, _ := kv.lookupStream(key)
+			if s == nil {
+				continue
+			}
+			var items [][]byte
+			for _, se := range s.after(ids[i], count) {
+				items = append(items, encodeStreamEntry(se))
+			}
+			if len(items) > 0 {
+				streams = append(streams, respgo.EncodeRawArray(
+					respgo.EncodeBulkString(key),
+					respgo.EncodeRawArray(items...),
+				))
+			}
+		}
+		if len(streams) == 0 {
+			return nil, false
+		}
+		return respgo.EncodeRawArray(streams...), true
+	}
+	if !block {
+		if reply, ok := serve(); ok {
+			return reply
+		}
+		return nilArray
+	}
+	return kv.blockOrReply(connection, keys, timeout, serve, nilArray)
+}
+
+// streamAddArgs holds the options of XADD, and of XTRIM which shares the
+// trimming ones.
+type streamAddArgs struct {
+	noMkStream bool
+	trim       *streamTrim
+	// limitGiven records an explicit LIMIT, which needs "~".
+	limitGiven bool
+	// idArg is the ID argument of XADD; fields start right after it.
+	idArg int
+}
+
+// parseAddOrTrimArgs parses the options of XADD or XTRIM, which start at
+// args[2].
+func parseAddOrTrimArgs(args []string, xadd bool) (streamAddArgs, []byte) {
+	var a streamAddArgs
+	limit := int64(0)
+	i := 2
+	for ; i < len(args); i++ {
+		hasNext := i+1 < len(args)
+		switch opt := strings.ToUpper(args[i]); {
+		case xadd && opt == "*":
+		case (opt == "MAXLEN" || opt == "MINID") && hasNext:
+			if a.trim != nil {
+				return a, respgo.EncodeError("ERR syntax error, MAXLEN and MINID options at the same time are not compatible")
+			}
+			t := &streamTrim{minID: opt == "MINID"}
+			if next := args[i+1]; (next == "~" || next == "=") && i+2 < len(args) {
+				t.approx = next == "~"
+				i++
+			}
+			i++
+			if t.minID {
+				id, ok := parseStreamID(args[i], 0)
+				if !ok {
+					return a, errInvalidStreamID
+				}
+				t.threshold = id
+			} else {
+				n, ok := parseInt(args[i])
+				if !ok {
+					return a, errNotInteger
+				}
+				if n < 0 {
+					return a, respgo.EncodeError("ERR The MAXLEN argument must be >= 0.")
+				}
+				t.maxLen = n
+			}
+			a.trim = t
+			continue
+		case opt == "LIMIT" && hasNext:
+			n, ok := parseInt(args[i+1])
+			if !ok {
+				return a, errNotInteger
+			}
+			if n < 0 {
+				return a, respgo.EncodeError("ERR The LIMIT argument must be >= 0.")
+			}
+			limit = n
+			a.limitGiven = true
+			i++
+			continue
+		case xadd && opt == "NOMKSTREAM":
+			a.noMkStream = true
+			continue
+		case xadd:
+		default:
+			return a, errSyntax
+		}
+		// anything else is the ID of XADD
+		break
+	}
+	if xadd {
+		a.idArg = i
+		if fields := len(args) - i - 1; fields < 2 || fields%2 != 0 {
+			return a, wrongArgs("xadd")
+		}
+	}
+	switch {
+	case a.limitGiven && a.trim == nil:
+		return a, respgo.EncodeError("ERR syntax error, LIMIT cannot be used without specifying a trimming strategy")
+	case !xadd && a.trim == nil:
+		return a, errSyntax
+	case a.trim == nil:
+	case a.trim.approx:
+		a.trim.limit = 100 * streamNodeMaxEntries
+		if a.limitGiven {
+			a.trim.limit = limit
+		}
+	case a.limitGiven:
+		return a, respgo.EncodeError("ERR syntax error, LIMIT cannot be used without the special ~ option")
+	}
+	return a, nil
+}
+
+// trimArgs returns the MAXLEN or MINID clause to replicate for t, which
+// has just been applied to s. An approximate trim becomes an exact one that
+// cuts where it did, so that replicas end up with the same entries.
+func trimArgs(s *stream, t *streamTrim) []string {
+	switch {
+	case t.minID && t.approx && s.length > 0:
+		return []string{"MINID", "=", s.firstID.String()}
+	case t.minID:
+		return []string{"MINID", "=", t.threshold.String()}
+	case t.approx:
+		return []string{"MAXLEN", "=", strconv.Itoa(s.length)}
+	}
+	return []string{"MAXLEN", "=", strconv.FormatInt(t.maxLen, 10)}
+}
+
+// parseAddID parses the ID argument of XADD: "*" to generate it, "ms-*" to
+// generate the sequence only, or an explicit ID.
+func parseAddID(arg string) (id streamID, autoMs, autoSeq, ok bool) {
+	if arg == "*" {
+		return streamID{}, true, true, true
+	}
+	if ms, found := strings.CutSuffix(arg, "-*"); found {
+		id, ok = parseStreamID(ms, 0)
+		return id, false, true, ok && !strings.Contains(ms, "-")
+	}
+	id, ok = parseStreamID(arg, 0)
+	return id, false, false, ok
+}
+
+func (kv *KVStore) xaddCommand(args []string) []byte {
+	if len(args) < 5 {
+		return wrongArgs("xadd")
+	}
+	key := args[1]
+	a, errReply := parseAddOrTrimArgs(args, true)
+	if errReply != nil {
+		return errReply
+	}
+	id, autoMs, autoSeq, ok := parseAddID(args[a.idArg])
+	if !ok {
+		return errInvalidStreamID
+	}
+	if !autoSeq && id == (streamID{}) {
+		return respgo.EncodeError("ERR The ID specified in XADD must be greater than 0-0")
+	}
+	s, ok := kv.lookupStream(key)
+	if !ok {
+		return errWrongType
+	}
+	if s == nil && a.noMkStream {
+		return nilBulk
+	}
+	last := streamID{}
+	if s != nil {
+		last = s.lastID
+	}
+	switch {
+	case autoMs:
+		if last == maxStreamID {
+			return respgo.EncodeError("ERR The stream has exhausted the last possible ID, unable to add more items")
+		}
+		id = streamID{uint64(time.Now().UnixMilli()), 0}
+		if !last.less(id) {
+			id, _ = last.next()
+		}
+	case autoSeq && id.ms == last.ms:
+		if id, ok = last.next(); !ok || id.ms != last.ms {
+			return respgo.EncodeError("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+		}
+	case autoSeq && id.ms < last.ms, !autoSeq && !last.less(id):
+		return respgo.EncodeError("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+
+	if s == nil {
+		s = &stream{}
+		kv.storeValue(key, s)
+	}
+	s.add(id, args[a.idArg+1:])
+	kv.dirty++
+
+	// replicas get the generated ID, and an exact trim in place of an
+	// approximate one
+	rewritten := []string{"XADD", key}
+	if a.noMkStream {
+		rewritten = append(rewritten, "NOMKSTREAM")
+	}
+	if a.trim != nil {
+		s.trim(*a.trim)
+		rewritten = append(rewritten, trimArgs(s, a.trim)...)
+	}
+	rewritten = append(rewritten, id.String())
+	kv.rewriteCommand(append(rewritten, args[a.idArg+1:]...)...)
+
+	kv.signalKeyAsReady(key)
+	return respgo.EncodeBulkString(id.String())
+}
+
+func (kv *KVStore) xtrimCommand(args []string) []byte {
+	if len(args) < 4 {
+		return wrongArgs("xtrim")
+	}
+	key := args[1]
+	a, errReply := parseAddOrTrimArgs(args, false)
+	if errReply != nil {
+		return errReply
+	}
+	s, ok := kv.lookupStream(key)
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		return respgo.EncodeInteger(0)
+	}
+	removed := s.trim(*a.trim)
+	if removed > 0 {
+		kv.dirty++
+		kv.rewriteCommand(append([]string{"XTRIM", key}, trimArgs(s, a.trim)...)...)
+	}
+	return respgo.EncodeInteger(int(removed))
+}
+
+func (kv *KVStore) xdelCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("xdel")
+	}
+	ids := make([]streamID, 0, len(args)-2)
+	for _, raw := range args[2:] {
+		id, ok := parseStreamID(raw, 0)
+		if !ok {
+			return errInvalidStreamID
+		}
+		ids = append(ids, id)
+	}
+	s, ok := kv.lookupStream(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		return respgo.EncodeInteger(0)
+	}
+	deleted := 0
+	for _, id := range ids {
+		if s.delete(id) {
+			deleted++
+		}
+	}
+	kv.dirty += deleted
+	return respgo.EncodeInteger(deleted)
+}
+
+func (kv *KVStore) xlenCommand(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs("xlen")
+	}
+	s, ok := kv.lookupStream(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		return respgo.EncodeInteger(0)
+	}
+	return respgo.EncodeInteger(s.length)
+}
+
+// xrangeCommand implements XRANGE and, with rev set, XREVRANGE, which takes
+// its bounds end first.
+func (kv *KVStore) xrangeCommand(args []string, rev bool) []byte {
+	name := strings.ToLower(args[0])
+	if len(args) != 4 && len(args) != 6 {
+		return wrongArgs(name)
+	}
+	startArg, endArg := args[2], args[3]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, errReply := parseRangeID(startArg, false)
+	if errReply != nil {
+		return errReply
+	}
+	end, errReply := parseRangeID(endArg, true)
+	if errReply != nil {
+		return errReply
+	}
+	count := int64(-1)
+	if len(args) == 6 {
+		if strings.ToUpper(args[4]) != "COUNT" {
+			return errSyntax
+		}
+		n, ok := parseInt(args[5])
+		if !ok {
+			return errNotInteger
+		}
+		count = max(n, 0)
+	}
+	s, ok := kv.lookupStream(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		return respgo.EncodeArray(nil)
+	}
+	if count == 0 {
+		return nilArray
+	}
+	entries := s.rangeEntries(start, end, max(count, 0), rev)
+	items := make([][]byte, 0, len(entries))
+	for _, se := range entries {
+		items = append(items, encodeStreamEntry(se))
+	}
+	return respgo.EncodeRawArray(items...)
+}
+
+// encodeOptionalEntry encodes an entry, or a nil if there is none.
+func encodeOptionalEntry(entries []StreamEntry) []byte {
+	if len(entries) == 0 {
+		return nilBulk
+	}
+	return encodeStreamEntry(entries[0])
+}
+
+// groupLag encodes the lag of g, which is nil when it cannot be told.
+func groupLag(s *stream, g *consumerGroup) []byte {
+	if lag, ok := s.lag(g); ok {
+		return respgo.EncodeInteger(int(lag))
+	}
+	return nilBulk
+}
+
+func (kv *KVStore) xinfoCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs("xinfo")
+	}
+	sub := strings.ToUpper(args[1])
+	arityErr := respgo.EncodeError("ERR unknown subcommand or wrong number of arguments for '" + args[1] + "'. Try XINFO HELP.")
+	switch {
+	case sub == "STREAM" && len(args) >= 3:
+	case sub == "GROUPS" && len(args) == 3:
+	case sub == "CONSUMERS" && len(args) == 4:
+	case sub == "STREAM" || sub == "GROUPS" || sub == "CONSUMERS":
+		return arityErr
+	default:
+		return respgo.EncodeError("ERR unknown subcommand '" + args[1] + "'. Try XINFO HELP.")
+	}
+	key := args[2]
+	s, ok := kv.lookupStream(key)
+	if !ok {
+		return errWrongType
+	}
+	if s == nil {
+		return respgo.EncodeError("ERR no such key")
+	}
+	now := time.Now().UnixMilli()
+
+	switch sub {
+	case "GROUPS":
+		names := make([]string, 0, len(s.groups))
+		for name := range s.groups {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		out := make([][]byte, 0, len(names))
+		for _, name := range names {
+			g := s.groups[name]
+			out = append(out, respgo.EncodeRawArray(
+				respgo.EncodeBulkString("name"), respgo.EncodeBulkString(name),
+				respgo.EncodeBulkString("consumers"), respgo.EncodeInteger(len(g.consumers)),
+				respgo.EncodeBulkString("pending"), respgo.EncodeInteger(len(g.pending)),
+				respgo.EncodeBulkString("last-delivered-id"), respgo.EncodeBulkString(g.lastDelivered.String()),
+				respgo.EncodeBulkString("entries-read"), encodeEntriesRead(g),
+				respgo.EncodeBulkString("lag"), groupLag(s, g),
+			))
+		}
+		return respgo.EncodeRawArray(out...)
+	case "CONSUMERS":
+		g := s.groups[args[3]]
+		if g == nil {
+			return respgo.EncodeError("NOGROUP No such consumer group '" + args[3] + "' for key name '" + key + "'")
+		}
+		var out [][]byte
+		for _, c := range g.sortedConsumers() {
+			inactive := int64(-1)
+			if c.activeTime >= 0 {
+				inactive = now - c.activeTime
+			}
+			out = append(out, respgo.EncodeRawArray(
+				respgo.EncodeBulkString("name"), respgo.EncodeBulkString(c.name),
+				respgo.EncodeBulkString("pending"), respgo.EncodeInteger(len(c.pending)),
+				respgo.EncodeBulkString("idle"), respgo.EncodeInteger(int(now-c.seenTime)),
+				respgo.EncodeBulkString("inactive"), respgo.EncodeInteger(int(inactive)),
+			))
+		}
+		return respgo.EncodeRawArray(out...)
+	}
+
+	full := false
+	count := int64(10)
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "FULL":
+			full = true
+		case opt == "COUNT" && full && i+1 < len(args):
+			n, ok := parseInt(args[i+1])
+			if !ok {
+				return errNotInteger
+			}
+			count = max(n, 0)
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	fields := [][]byte{
+		respgo.EncodeBulkString("length"), respgo.EncodeInteger(s.length),
+		respgo.EncodeBulkString("radix-tree-keys"), respgo.EncodeInteger(s.nodes()),
+		respgo.EncodeBulkString("radix-tree-nodes"), respgo.EncodeInteger(s.nodes()),
+		respgo.EncodeBulkString("last-generated-id"), respgo.EncodeBulkString(s.lastID.String()),
+		respgo.EncodeBulkString("max-deleted-entry-id"), respgo.EncodeBulkString(s.maxDeletedID.String()),
+		respgo.EncodeBulkString("entries-added"), respgo.EncodeInteger(int(s.entriesAdded)),
+		respgo.EncodeBulkString("recorded-first-entry-id"), respgo.EncodeBulkString(s.firstID.String()),
+	}
+	if !full {
+		fields = append(fields,
+			respgo.EncodeBulkString("groups"), respgo.EncodeInteger(len(s.groups)),
+			respgo.EncodeBulkString("first-entry"), encodeOptionalEntry(s.rangeEntries(streamID{}, maxStreamID, 1, false)),
+			respgo.EncodeBulkString("last-entry"), encodeOptionalEntry(s.rangeEntries(streamID{}, maxStreamID, 1, true)),
+		)
+		return respgo.EncodeRawArray(fields...)
+	}
+
+	var entries [][]byte
+	for _, se := range s.rangeEntries(streamID{}, maxStreamID, count, false) {
+		entries = append(entries, encodeStreamEntry(se))
+	}
+	names := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	groups := make([][]byte, 0, len(names))
+	for _, name := range names {
+		g := s.groups[name]
+		var pending [][]byte
+		for _, e := range g.pending {
+			if count > 0 && int64(len(pending)) == count {
+				break
+			}
+			pending = append(pending, respgo.EncodeRawArray(
+				respgo.EncodeBulkString(e.id.String()),
+				respgo.EncodeBulkString(e.consumer.name),
+				respgo.EncodeInteger(int(e.deliveryTime)),
+				respgo.EncodeInteger(int(e.deliveryCount)),
+			))
+		}
+		var consumers [][]byte
+		for _, c := range g.sortedConsumers() {
+			var own [][]byte
+			for _, e := range c.pending {
+				if count > 0 && int64(len(own)) == count {
+					break
+				}
+				own = append(own, respgo.EncodeRawArray(
+					respgo.EncodeBulkString(e.id.String()),
+					respgo.EncodeInteger(int(e.deliveryTime)),
+					respgo.EncodeInteger(int(e.deliveryCount)),
+				))
+			}
+			consumers = append(consumers, respgo.EncodeRawArray(
+				respgo.EncodeBulkString("name"), respgo.EncodeBulkString(c.name),
+				respgo.EncodeBulkString("seen-time"), respgo.EncodeInteger(int(c.seenTime)),
+				respgo.EncodeBulkString("active-time"), respgo.EncodeInteger(int(c.activeTime)),
+				respgo.EncodeBulkString("pel-count"), respgo.EncodeInteger(len(c.pending)),
+				respgo.EncodeBulkString("pending"), respgo.EncodeRawArray(own...),
+			))
+		}
+		groups = append(groups, respgo.EncodeRawArray(
+			respgo.EncodeBulkString("name"), respgo.EncodeBulkString(name),
+			respgo.EncodeBulkString("last-delivered-id"), respgo.EncodeBulkString(g.lastDelivered.String()),
+			respgo.EncodeBulkString("entries-read"), encodeEntriesRead(g),
+			respgo.EncodeBulkString("lag"), groupLag(s, g),
+			respgo.EncodeBulkString("pel-count"), respgo.EncodeInteger(len(g.pending)),
+			respgo.EncodeBulkString("pending"), respgo.EncodeRawArray(pending...),
+			respgo.EncodeBulkString("consumers"), respgo.EncodeRawArray(consumers...),
+		))
+	}
+	fields = append(fields,
+		respgo.EncodeBulkString("entries"), respgo.EncodeRawArray(entries...),
+		respgo.EncodeBulkString("groups"), respgo.EncodeRawArray(groups...),
+	)
+	return respgo.EncodeRawArray(fields...)
+}
+
+// encodeEntriesRead encodes the entries-read counter of g, nil if unknown.
+func encodeEntriesRead(g *consumerGroup) []byte {
+	if g.entriesRead < 0 {
+		return nilBulk
+	}
+	return respgo.EncodeInteger(int(g.entriesRead))
+}
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestXreadBlocking(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("XADD", "s", "1-1", "f", "old")
+	blocked := func(key string, n int) {
+		t.Helper()
+		waitFor(t, kv, "clients to block", func() bool { return len(kv.dbs[0].blocked[key]) == n })
+	}
+
+	// every reader blocked on a stream is woken by an XADD to it, and "$"
+	// is what was last in the stream when they blocked
+	r1, r2 := connect(t, kv), connect(t, kv)
+	r1.send("XREAD", "BLOCK", "0", "STREAMS", "s", "$")
+	r2.send("XREAD", "COUNT", "1", "BLOCK", "0", "STREAMS", "s", "$")
+	blocked("s", 2)
+	c.do("XADD", "other", "1-1", "f", "v")
+	c.do("XADD", "empty", "MAXLEN", "0", "1-1", "f", "v")
+	blocked("s", 2)
+	c.do("MULTI")
+	c.do("XADD", "s", "2-1", "f", "a")
+	c.do("XADD", "s", "2-2", "f", "b")
+	c.do("EXEC")
+	for _, tc := range []struct {
+		r    *testClient
+		want string
+	}{
+		{r1, "[[s [[2-1 [f a]] [2-2 [f b]]]]]"},
+		{r2, "[[s [[2-1 [f a]]]]]"},
+	} {
+		if got := formatReply(tc.r.read()); got != tc.want {
+			t.Errorf("blocked XREAD = %s, want %s", got, tc.want)
+		}
+	}
+	blocked("s", 0)
+
+	// "$" on an empty stream, next to a missing key, waits for the first
+	// entry of either
+	r1.send("XREAD", "BLOCK", "0", "STREAMS", "empty", "missing", "$", "$")
+	blocked("missing", 1)
+	c.do("XADD", "missing", "5-1", "k", "v")
+	if got, want := formatReply(r1.read()), "[[missing [[5-1 [k v]]]]]"; got != want {
+		t.Errorf("XREAD on empty and missing streams = %s, want %s", got, want)
+	}
+
+	runSteps(c, []step{
+		// data that is already there is served without blocking
+		{"XREAD BLOCK 0 STREAMS s other 1-1 0", "[[s [[2-1 [f a]] [2-2 [f b]]]] [other [[1-1 [f v]]]]]"},
+		{"XREAD COUNT 1 STREAMS s 0-0", "[[s [[1-1 [f old]]]]]"},
+		{"XREAD STREAMS s $", "(nil)"},
+		{"XREAD BLOCK 10 STREAMS s $", "(nil)"},
+		// inside MULTI a blocking read answers at once
+		{"MULTI", "+OK"},
+		{"XREAD BLOCK 0 STREAMS s $", "+QUEUED"},
+		{"EXEC", "[(nil)]"},
+
+		{"SET str v", "+OK"},
+		{"XREAD BLOCK 0 STREAMS s str 0 0", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"XREAD STREAMS s", "-ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."},
+		{"XREAD STREAMS s x", "-ERR Invalid stream ID specified as stream command argument"},
+		{"XREAD BLOCK x STREAMS s $", "-ERR timeout is not an integer or out of range"},
+		{"XREAD BLOCK -1 STREAMS s $", "-ERR timeout is negative"},
+		{"XREAD s 0", "-ERR syntax error"},
+	})
+
+	// a timeout unblocks with a null reply
+	start := time.Now()
+	if got := c.do("XREAD", "BLOCK", "50", "STREAMS", "s", "$"); got != nil {
+		t.Errorf("XREAD BLOCK 50 = %v, want nil", got)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("XREAD BLOCK 50 returned after %v", d)
+	}
+	blocked("s", 0)
+}
+
+func TestStreamAddAndRange(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("SET", "str", "v")
+	runSteps(c, []step{
+		{"XADD s 1-1 a 1", "1-1"},
+		{"XADD s 1-* b 2", "1-2"},
+		{"XADD s 2 c 3", "2-0"},
+		{"XADD s 2-* d 4 e 5", "2-1"},
+		{"XADD s 2-1 x y", "-ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+		{"XADD s 1-* x y", "-ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+		{"XADD new 0-0 x y", "-ERR The ID specified in XADD must be greater than 0-0"},
+		{"XADD new 0-* x y", "0-1"},
+		{"XADD s 1-2-3 x y", "-ERR Invalid stream ID specified as stream command argument"},
+		{"XADD s 3-1 x", "-ERR wrong number of arguments for 'xadd' command"},
+		{"XADD missing NOMKSTREAM * x y", "(nil)"},
+		{"EXISTS missing", "0"},
+		{"XADD str * x y", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"XLEN s", "4"},
+		{"XLEN missing", "0"},
+
+		{"XRANGE s - +", "[[1-1 [a 1]] [1-2 [b 2]] [2-0 [c 3]] [2-1 [d 4 e 5]]]"},
+		// a bare timestamp covers its whole millisecond
+		{"XRANGE s 1 1", "[[1-1 [a 1]] [1-2 [b 2]]]"},
+		{"XRANGE s (1-1 (2-1", "[[1-2 [b 2]] [2-0 [c 3]]]"},
+		{"XRANGE s - + COUNT 1", "[[1-1 [a 1]]]"},
+		{"XRANGE s 2 1", "[]"},
+		{"XRANGE missing - +", "[]"},
+		{"XREVRANGE s + - COUNT 3", "[[2-1 [d 4 e 5]] [2-0 [c 3]] [1-2 [b 2]]]"},
+		{"XREVRANGE s (2-0 -", "[[1-2 [b 2]] [1-1 [a 1]]]"},
+		{"XRANGE s (18446744073709551615-18446744073709551615 +", "-ERR invalid start ID for the interval"},
+		{"XRANGE s - (0-0", "-ERR invalid end ID for the interval"},
+		{"XRANGE s x +", "-ERR Invalid stream ID specified as stream command argument"},
+		{"XRANGE s - + LIMIT 1", "-ERR syntax error"},
+
+		// XDEL leaves the last ID in place, so new IDs keep growing
+		{"XDEL s 2-1 1-1 9-9", "2"},
+		{"XDEL s 2-1", "0"},
+		{"XRANGE s - +", "[[1-2 [b 2]] [2-0 [c 3]]]"},
+		{"XADD s 2-1 x y", "-ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+		{"XLEN s", "2"},
+		{"XDEL s x", "-ERR Invalid stream ID specified as stream command argument"},
+	})
+}
+
+func TestStreamTrim(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	fill := func(key string, n int) {
+		t.Helper()
+		c.do("DEL", key)
+		for i := 1; i <= n; i++ {
+			c.do("XADD", key, strconv.Itoa(i)+"-0", "i", strconv.Itoa(i))
+		}
+	}
+	// streamNodeMaxEntries entries go in a block, and approximate trimming
+	// only drops whole blocks
+	fill("s", 250)
+	runSteps(c, []step{
+		{"XTRIM s MAXLEN ~ 120", "100"},
+		{"XLEN s", "150"},
+		{"XTRIM s MAXLEN 120", "30"},
+		{"XRANGE s - + COUNT 1", "[[131-0 [i 131]]]"},
+		// a block goes once all its entries are below the threshold
+		{"XTRIM s MINID ~ 211", "70"},
+		{"XTRIM s MINID ~ 211", "0"},
+		{"XTRIM s MINID 211", "10"},
+		{"XRANGE s - + COUNT 1", "[[211-0 [i 211]]]"},
+		{"XTRIM s MAXLEN 0", "40"},
+		{"XLEN s", "0"},
+		{"EXISTS s", "1"},
+		{"XTRIM missing MAXLEN 0", "0"},
+	})
+	fill("s", 350)
+	runSteps(c, []step{
+		{"XTRIM s MAXLEN ~ 0 LIMIT 150", "100"},
+		{"XTRIM s MAXLEN ~ 0 LIMIT 0", "250"},
+	})
+	fill("s", 5)
+	runSteps(c, []step{
+		{"XADD s MAXLEN 3 6-0 i 6", "6-0"},
+		{"XRANGE s - +", "[[4-0 [i 4]] [5-0 [i 5]] [6-0 [i 6]]]"},
+		{"XADD s MINID = 6 7-0 i 7", "7-0"},
+		{"XRANGE s - +", "[[6-0 [i 6]] [7-0 [i 7]]]"},
+
+		{"XTRIM s MAXLEN -1", "-ERR The MAXLEN argument must be >= 0."},
+		{"XTRIM s MAXLEN ~ 1 LIMIT -1", "-ERR The LIMIT argument must be >= 0."},
+		{"XTRIM s MAXLEN 1 LIMIT 10", "-ERR syntax error, LIMIT cannot be used without the special ~ option"},
+		{"XTRIM s LIMIT 10", "-ERR syntax error, LIMIT cannot be used without specifying a trimming strategy"},
+		{"XTRIM s MAXLEN 1 MINID 1", "-ERR syntax error, MAXLEN and MINID options at the same time are not compatible"},
+		{"XTRIM s MINID x", "-ERR Invalid stream ID specified as stream command argument"},
+		{"XTRIM s", "-ERR wrong number of arguments for 'xtrim' command"},
+		{"XTRIM s SOON 1", "-ERR syntax error"},
+	})
+}
+
+func TestStreamTrimPropagatesExactly(t *testing.T) {
+	master := newTestStore(t)
+	replica := attachReplica(t, master)
+	c := connect(t, master)
+	for i := 1; i <= 250; i++ {
+		c.do("XADD", "s", "MAXLEN", "~", "120", strconv.Itoa(i)+"-0", "i", strconv.Itoa(i))
+	}
+	c.do("XTRIM", "s", "MINID", "~", "220")
+	if got := c.do("WAIT", "1", "5000"); got != 1 {
+		t.Fatalf("WAIT = %v, want 1", got)
+	}
+	want := formatReply(c.do("XRANGE", "s", "-", "+"))
+	if got := formatReply(connect(t, replica).do("XRANGE", "s", "-", "+")); got != want {
+		t.Errorf("the replica's stream after approximate trims = %s, want %s", got, want)
+	}
+}
+
+func TestStreamInfo(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	for _, id := range []string{"1-1", "2-1", "3-1", "4-1"} {
+		c.do("XADD", "s", id, "f", id[:1])
+	}
+	c.do("XGROUP", "CREATE", "s", "g", "0")
+	c.do("XGROUP", "CREATE", "s", "h", "$")
+	c.do("XREADGROUP", "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "s", ">")
+	c.do("XGROUP", "CREATECONSUMER", "s", "g", "bob")
+	runSteps(c, []step{
+		{"XINFO STREAM s", "[length 4 radix-tree-keys 1 radix-tree-nodes 1 last-generated-id 4-1 max-deleted-entry-id 0-0 entries-added 4 recorded-first-entry-id 1-1 groups 2 first-entry [1-1 [f 1]] last-entry [4-1 [f 4]]]"},
+		{"XINFO GROUPS s", "[[name g consumers 2 pending 2 last-delivered-id 2-1 entries-read 2 lag 2] [name h consumers 0 pending 0 last-delivered-id 4-1 entries-read (nil) lag 0]]"},
+		// a deletion after what g has read makes its lag unknown
+		{"XDEL s 3-1", "1"},
+		{"XINFO GROUPS s", "[[name g consumers 2 pending 2 last-delivered-id 2-1 entries-read 2 lag (nil)] [name h consumers 0 pending 0 last-delivered-id 4-1 entries-read (nil) lag 0]]"},
+		{"XDEL s 1-1", "1"},
+		{"XINFO STREAM s", "[length 2 radix-tree-keys 1 radix-tree-nodes 1 last-generated-id 4-1 max-deleted-entry-id 3-1 entries-added 4 recorded-first-entry-id 2-1 groups 2 first-entry [2-1 [f 2]] last-entry [4-1 [f 4]]]"},
+		{"XINFO STREAM missing", "-ERR no such key"},
+		{"XINFO STREAM s COUNT 1", "-ERR syntax error"},
+		{"XINFO CONSUMERS s nog", "-NOGROUP No such consumer group 'nog' for key name 's'"},
+		{"XINFO GROUPS", "-ERR unknown subcommand or wrong number of arguments for 'GROUPS'. Try XINFO HELP."},
+		{"XINFO TREE s", "-ERR unknown subcommand 'TREE'. Try XINFO HELP."},
+	})
+	full, _ := c.do("XINFO", "STREAM", "s", "FULL", "COUNT", "1").([]any)
+	if len(full) != 18 || formatReply(full[15]) != "[[2-1 [f 2]]]" {
+		t.Errorf("XINFO STREAM s FULL COUNT 1 = %s, want just the first entry", formatReply(full))
+	}
+	reply, _ := c.do("XINFO", "CONSUMERS", "s", "g").([]any)
+	if len(reply) != 2 {
+		t.Fatalf("XINFO CONSUMERS s g = %v, want two consumers", reply)
+	}
+	for i, want := range []struct {
+		name     string
+		pending  int
+		inactive bool
+	}{{"alice", 2, false}, {"bob", 0, true}} {
+		info := reply[i].([]any)
+		if info[1] != want.name || info[3] != want.pending || (info[7] == -1) != want.inactive {
+			t.Errorf("XINFO CONSUMERS entry %d = %v, want %s with %d pending", i, formatReply(info), want.name, want.pending)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Streams keep their entries in blocks, modelled on the listpacks Redis
+// hangs off its stream radix tree. A block holds up to streamNodeMaxEntries
+// entries or about streamNodeMaxBytes bytes. Each entry is encoded as
+//
+//	flags | ms delta | seq | payload length | payload
+//
+// where the ms delta is from the block's master ID and seq is a delta from
+// the master's sequence when the millisecond is the same. The payload is
+// either the values alone, when the entry has the same field names as the
+// block's master entry, or a field count followed by field/value pairs.
+// All integers are uvarints and all strings are length-prefixed.
+
+const streamNodeMaxBytes = 4096
+
+const (
+	entryDeleted    = 1 << 0
+	entrySameFields = 1 << 1
+)
+
+type streamBlock struct {
+	// master is the ID of the first entry ever added to the block, which
+	// the other IDs are encoded relative to, and last the ID of the last.
+	master, last streamID
+	// masterFields are the field names of the master entry.
+	masterFields []string
+	data         []byte
+	// count includes deleted entries, live does not.
+	count, live int
+}
+
+// blockEntry is an entry of a block as found at some offset.
+type blockEntry struct {
+	id      streamID
+	flags   byte
+	off     int
+	payload []byte
+	// next is the offset of the following entry.
+	next int
+}
+
+func (e blockEntry) deleted() bool {
+	return e.flags&entryDeleted != 0
+}
+
+func newStreamBlock(id streamID, fields []string) *streamBlock {
+	names := make([]string, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		names = append(names, fields[i])
+	}
+	return &streamBlock{master: id, last: id, masterFields: names}
+}
+
+// full reports whether the block has no room for another entry.
+func (b *streamBlock) full() bool {
+	return b.count >= streamNodeMaxEntries || len(b.data) >= streamNodeMaxBytes
+}
+
+// sameFields reports whether fields has the master entry's field names.
+func (b *streamBlock) sameFields(fields []string) bool {
+	if len(fields) != 2*len(b.masterFields) {
+		return false
+	}
+	for i, name := range b.masterFields {
+		if fields[2*i] != name {
+			return false
+		}
+	}
+	return true
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// append encodes an entry at the end of the block. id must be above the
+// block's last ID.
+func (b *streamBlock) append(id streamID, fields []string) {
+	var payload []byte
+	flags := byte(0)
+	if b.sameFields(fields) {
+		flags |= entrySameFields
+		for i := 1; i < len(fields); i += 2 {
+			payload = appendString(payload, fields[i])
+		}
+	} else {
+		payload = binary.AppendUvarint(payload, uint64(len(fields)/2))
+		for _, s := range fields {
+			payload = appendString(payload, s)
+		}
+	}
+	seq := id.seq
+	if id.ms == b.master.ms {
+		seq -= b.master.seq
+	}
+	b.data = append(b.data, flags)
+	b.data = binary.AppendUvarint(b.data, id.ms-b.master.ms)
+	b.data = binary.AppendUvarint(b.data, seq)
+	b.data = binary.AppendUvarint(b.data, uint64(len(payload)))
+	b.data = append(b.data, payload...)
+	b.last = id
+	b.count++
+	b.live++
+}
+
+// at decodes the header of the entry at off.
+func (b *streamBlock) at(off int) blockEntry {
+	e := blockEntry{flags: b.data[off], off: off}
+	p := off + 1
+	msDelta, n := binary.Uvarint(b.data[p:])
+	p += n
+	seq, n := binary.Uvarint(b.data[p:])
+	p += n
+	size, n := binary.Uvarint(b.data[p:])
+	p += n
+	e.id = streamID{b.master.ms + msDelta, seq}
+	if msDelta == 0 {
+		e.id.seq += b.master.seq
+	}
+	e.payload = b.data[p : p+int(size)]
+	e.next = p + int(size)
+	return e
+}
+
+// offsets returns the offset of every entry, in order.
+func (b *streamBlock) offsets() []int {
+	out := make([]int, 0, b.count)
+	for off := 0; off < len(b.data); off = b.at(off).next {
+		out = append(out, off)
+	}
+	return out
+}
+
+// find returns the entry with the given ID, deleted or not.
+func (b *streamBlock) find(id streamID) (blockEntry, bool) {
+	for off := 0; off < len(b.data); {
+		e := b.at(off)
+		if e.id == id {
+			return e, true
+		}
+		if id.less(e.id) {
+			break
+		}
+		off = e.next
+	}
+	return blockEntry{}, false
+}
+
+// markDeleted turns a live entry into a tombstone.
+func (b *streamBlock) markDeleted(e blockEntry) {
+	b.data[e.off] |= entryDeleted
+	b.live--
+}
+
+func readString(buf []byte) (string, []byte) {
+	n, size := binary.Uvarint(buf)
+	buf = buf[size:]
+	return string(buf[:n]), buf[n:]
+}
+
+// decode returns the entry with its fields.
+func (b *streamBlock) decode(e blockEntry) StreamEntry {
+	buf := e.payload
+	var fields []string
+	if e.flags&entrySameFields != 0 {
+		fields = make([]string, 0, 2*len(b.masterFields))
+		for _, name := range b.masterFields {
+			var v string
+			v, buf = readString(buf)
+			fields = append(fields, name, v)
+		}
+	} else {
+		n, size := binary.Uvarint(buf)
+		buf = buf[size:]
+		fields = make([]string, 0, 2*n)
+		for i := uint64(0); i < 2*n; i++ {
+			var s string
+			s, buf = readString(buf)
+			fields = append(fields, s)
+		}
+	}
+	return StreamEntry{ID: e.id, Fields: fields}
+}
+
+// searchBlock returns the index of the block that would hold id: the last
+// one whose master ID is not above it, or -1 if there is none.
+func (s *stream) searchBlock(id streamID) int {
+	return sort.Search(len(s.blocks), func(i int) bool {
+		return id.less(s.blocks[i].master)
+	}) - 1
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStreamBlocks(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	s := &stream{}
+	var model []StreamEntry
+	randomFields := func() []string {
+		switch rng.IntN(4) {
+		case 0:
+			// another layout, field order included
+			return []string{"b", "x", "a", strconv.Itoa(rng.IntN(100))}
+		case 1:
+			// a value big enough to fill a block early
+			return []string{"a", strings.Repeat("v", 1000), "b", ""}
+		case 2:
+			return []string{"a", "1", "a", "2", "c", "3"}
+		}
+		return []string{"a", strconv.Itoa(rng.IntN(100)), "b", "y"}
+	}
+	id := streamID{1000, 0}
+	for i := range 3000 {
+		if rng.IntN(3) == 0 {
+			id = streamID{id.ms + uint64(rng.IntN(3000)), 0}
+		} else {
+			id.seq += uint64(1 + rng.IntN(3))
+		}
+		fields := randomFields()
+		s.add(id, fields)
+		model = append(model, StreamEntry{ID: id, Fields: fields})
+		if i%4 == 0 && len(model) > 0 {
+			j := rng.IntN(len(model))
+			if !s.delete(model[j].ID) || s.delete(model[j].ID) {
+				t.Fatalf("deleting %v did not report its removal once", model[j].ID)
+			}
+			model = slices.Delete(model, j, j+1)
+		}
+	}
+	if s.length != len(model) {
+		t.Fatalf("length = %d, want %d", s.length, len(model))
+	}
+	for _, b := range s.blocks {
+		if b.count > streamNodeMaxEntries || b.live == 0 {
+			t.Fatalf("a block holds %d entries, %d of them live", b.count, b.live)
+		}
+	}
+
+	same := func(got, want []StreamEntry) bool {
+		return slices.EqualFunc(got, want, func(a, b StreamEntry) bool {
+			return a.ID == b.ID && slices.Equal(a.Fields, b.Fields)
+		})
+	}
+	for range 500 {
+		start := model[rng.IntN(len(model))].ID
+		end := model[rng.IntN(len(model))].ID
+		// bounds that fall between entries too
+		if rng.IntN(2) == 0 {
+			start.seq++
+		}
+		count := int64(rng.IntN(20))
+		var want []StreamEntry
+		for _, e := range model {
+			if !e.ID.less(start) && !end.less(e.ID) {
+				want = append(want, e)
+			}
+		}
+		if got := s.rangeEntries(start, end, 0, false); !same(got, want) {
+			t.Fatalf("rangeEntries(%v, %v) returned %d entries, want %d", start, end, len(got), len(want))
+		}
+		slices.Reverse(want)
+		if count > 0 && int64(len(want)) > count {
+			want = want[:count]
+		}
+		if got := s.rangeEntries(start, end, count, true); !same(got, want) {
+			t.Fatalf("rangeEntries(%v, %v, %d, rev) returned %d entries, want %d", start, end, count, len(got), len(want))
+		}
+	}
+	for _, e := range model[:50] {
+		got, ok := s.entry(e.ID)
+		if !ok || !same([]StreamEntry{got}, []StreamEntry{e}) {
+			t.Fatalf("entry(%v) = %v, %v", e.ID, got, ok)
+		}
+	}
+	if s.firstID != model[0].ID {
+		t.Errorf("firstID = %v, want %v", s.firstID, model[0].ID)
+	}
+}
+
+func TestStreamBlockSharesMasterFields(t *testing.T) {
+	b := newStreamBlock(streamID{5, 0}, []string{"temp", "1", "hum", "2"})
+	b.append(streamID{5, 0}, []string{"temp", "1", "hum", "2"})
+	before := len(b.data)
+	b.append(streamID{5, 1}, []string{"temp", "3", "hum", "4"})
+	shared := len(b.data) - before
+	before = len(b.data)
+	b.append(streamID{6, 0}, []string{"hum", "4", "temp", "3"})
+	own := len(b.data) - before
+	// flags, ms delta, seq, payload length and two one-byte values, each
+	// with a length
+	if shared != 8 || own <= shared {
+		t.Errorf("an entry with the master's fields took %d bytes, one with its own %d", shared, own)
+	}
+	for off, want := range map[int]string{0: "5-0 [temp 1 hum 2]", b.offsets()[1]: "5-1 [temp 3 hum 4]", b.offsets()[2]: "6-0 [hum 4 temp 3]"} {
+		e := b.decode(b.at(off))
+		if got := e.ID.String() + " " + formatReply(toAny(e.Fields)); got != want {
+			t.Errorf("entry at %d = %s, want %s", off, got, want)
+		}
+	}
+}
+
+// toAny converts a slice of strings the way readReply returns arrays.
+func toAny(s []string) []any {
+	out := make([]any, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
+
+func TestStreamFieldOrder(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	runSteps(c, []step{
+		{"XADD s 1-1 z 1 a 2 m 3", "1-1"},
+		{"XADD s 1-2 m 3 z 1 a 2", "1-2"},
+		{"XADD s 1-3 a 1 a 2", "1-3"},
+		{"XRANGE s - +", "[[1-1 [z 1 a 2 m 3]] [1-2 [m 3 z 1 a 2]] [1-3 [a 1 a 2]]]"},
+		{"XREAD STREAMS s 1-1", "[[s [[1-2 [m 3 z 1 a 2]] [1-3 [a 1 a 2]]]]]"},
+	})
+}
@@ -0,0 +1,799 @@
+package store
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// pendingEntry is an entry delivered to a consumer of a group that has not
+// been acknowledged yet.
+type pendingEntry struct {
+	id       streamID
+	consumer *consumer
+	// deliveryTime is when the entry was last delivered, in unix ms.
+	deliveryTime  int64
+	deliveryCount int64
+}
+
+// pel is a pending entries list, kept ordered by ID. A group has one
+// holding all its pending entries, and each consumer one holding its own.
+type pel []*pendingEntry
+
+// search returns the index of the first entry whose ID is not below id.
+func (p pel) search(id streamID) int {
+	return sort.Search(len(p), func(i int) bool { return !p[i].id.less(id) })
+}
+
+func (p pel) get(id streamID) (*pendingEntry, bool) {
+	i := p.search(id)
+	if i < len(p) && p[i].id == id {
+		return p[i], true
+	}
+	return nil, false
+}
+
+func (p *pel) add(e *pendingEntry) {
+	i := p.search(e.id)
+	*p = slices.Insert(*p, i, e)
+}
+
+func (p *pel) remove(id streamID) bool {
+	i := p.search(id)
+	if i == len(*p) || (*p)[i].id != id {
+		return false
+	}
+	*p = slices.Delete(*p, i, i+1)
+	return true
+}
+
+type consumer struct {
+	name string
+	// seenTime is the last time the consumer tried to read or claim, and
+	// activeTime the last time it actually got something, or -1.
+	seenTime   int64
+	activeTime int64
+	pending    pel
+}
+
+// consumerGroup tracks which entries of a stream have been handed to its
+// consumers and which of those are still unacknowledged.
+type consumerGroup struct {
+	lastDelivered streamID
+	// entriesRead counts the entries the group has been given, or is -1
+	// when that is not known.
+	entriesRead int64
+	pending     pel
+	consumers   map[string]*consumer
+}
+
+func newConsumerGroup(lastDelivered streamID, entriesRead int64) *consumerGroup {
+	return &consumerGroup{
+		lastDelivered: lastDelivered,
+		entriesRead:   entriesRead,
+		consumers:     make(map[string]*consumer),
+	}
+}
+
+// consumer returns the named consumer, creating it if needed, and reports
+// whether it was created.
+func (g *consumerGroup) consumer(name string, now int64) (*consumer, bool) {
+	if c, ok := g.consumers[name]; ok {
+		c.seenTime = now
+		return c, false
+	}
+	c := &consumer{name: name, seenTime: now, activeTime: -1}
+	g.consumers[name] = c
+	return c, true
+}
+
+// deliver records that id was handed to c, taking it over from whichever
+// consumer had it pending before.
+func (g *consumerGroup) deliver(id streamID, c *consumer, now int64) *pendingEntry {
+	e, ok := g.pending.get(id)
+	if !ok {
+		e = &pendingEntry{id: id}
+		g.pending.add(e)
+	} else {
+		e.consumer.pending.remove(id)
+	}
+	e.consumer = c
+	e.deliveryTime = now
+	e.deliveryCount = 1
+	c.pending.add(e)
+	return e
+}
+
+// reassign moves a pending entry to c.
+func (g *consumerGroup) reassign(e *pendingEntry, c *consumer) {
+	if e.consumer == c {
+		return
+	}
+	if e.consumer != nil {
+		e.consumer.pending.remove(e.id)
+	}
+	e.consumer = c
+	c.pending.add(e)
+}
+
+// ack drops id from the pending lists and reports whether it was pending.
+func (g *consumerGroup) ack(id streamID) bool {
+	e, ok := g.pending.get(id)
+	if !ok {
+		return false
+	}
+	g.pending.remove(id)
+	if e.consumer != nil {
+		e.consumer.pending.remove(id)
+	}
+	return true
+}
+
+// sortedConsumers returns the consumers ordered by name, which is the
+// order Redis lists them in.
+func (g *consumerGroup) sortedConsumers() []*consumer {
+	out := make([]*consumer, 0, len(g.consumers))
+	for _, c := range g.consumers {
+		out = append(out, c)
+	}
+	slices.SortFunc(out, func(a, b *consumer) int { return strings.Compare(a.name, b.name) })
+	return out
+}
+
+// lookupStream returns the stream stored at key, or nil if there is none.
+// ok is false if key holds another type. The caller must hold kv.mu.
+func (kv *KVStore) lookupStream(key string) (s *stream, ok bool) {
+	return lookupTyped[*stream](kv, key, objStream)
+}
+
+// lookupGroup returns the stream at key and its named consumer group, or
+// the error to reply with if either is missing.
+func (kv *KVStore) lookupGroup(key, group string) (*stream, *consumerGroup, []byte) {
+	s, ok := kv.lookupStream(key)
+	if !ok {
+		return nil, nil, errWrongType
+	}
+	if s == nil || s.groups[group] == nil {
+		return nil, nil, respgo.EncodeError("NOGROUP No such key '" + key + "' or consumer group '" + group + "'")
+	}
+	return s, s.groups[group], nil
+}
+
+// propagateClaim queues an XCLAIM that makes a replica's view of a pending
+// entry match ours, which is how Redis replicates all group reads and
+// claims. The caller must hold kv.mu.
+func (kv *KVStore) propagateClaim(key, group string, g *consumerGroup, e *pendingEntry) {
+	kv.alsoPropagate("XCLAIM", key, group, e.consumer.name, "0", e.id.String(),
+		"TIME", strconv.FormatInt(e.deliveryTime, 10),
+		"RETRYCOUNT", strconv.FormatInt(e.deliveryCount, 10),
+		"FORCE", "JUSTID", "LASTID", g.lastDelivered.String())
+}
+
+// parseGroupID parses the ID argument of XGROUP CREATE and SETID, where "$"
+// stands for the last ID of the stream.
+func parseGroupID(s *stream, arg string) (streamID, bool) {
+	if arg == "$" {
+		if s == nil {
+			return streamID{}, true
+		}
+		return s.lastID, true
+	}
+	return parseStreamID(arg, 0)
+}
+
+func (kv *KVStore) xgroupCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs("xgroup")
+	}
+	sub := strings.ToUpper(args[1])
+	arityErr := respgo.EncodeError("ERR unknown subcommand or wrong number of arguments for '" + args[1] + "'. Try XGROUP HELP.")
+	switch sub {
+	case "CREATE":
+		if len(args) < 5 {
+			return arityErr
+		}
+	case "SETID":
+		if len(args) < 5 {
+			return arityErr
+		}
+	case "DESTROY":
+		if len(args) != 4 {
+			return arityErr
+		}
+	case "CREATECONSUMER", "DELCONSUMER":
+		if len(args) != 5 {
+			return arityErr
+		}
+	default:
+		return respgo.EncodeError("ERR unknown subcommand '" + args[1] + "'. Try XGROUP HELP.")
+	}
+
+	key, name := args[2], args[3]
+	mkstream := false
+	entriesRead := int64(-1)
+	if sub == "CREATE" || sub == "SETID" {
+		for i := 5; i < len(args); i++ {
+			switch opt := strings.ToUpper(args[i]); {
+			case opt == "MKSTREAM" && sub == "CREATE":
+				mkstream = true
+			case opt == "ENTRIESREAD" && i+1 < len(args):
+				n, ok := parseInt(args[i+1])
+				if !ok {
+					return errNotInteger
+				}
+				if n < 0 && n != -1 {
+					return respgo.EncodeError("ERR value for ENTRIESREAD must be positive or -1")
+				}
+				entriesRead = n
+				i++
+			default:
+				return errSyntax
+			}
+		}
+	}
+
+	s, ok := kv.lookupStream(key)
+	if !ok {
+		return errWrongType
+	}
+	if s == nil && !(sub == "CREATE" && mkstream) {
+		return respgo.EncodeError("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	}
+	var g *consumerGroup
+	if s != nil {
+		g = s.groups[name]
+	}
+	if g == nil && sub != "CREATE" && sub != "DESTROY" {
+		return respgo.EncodeError("NOGROUP No such consumer group '" + name + "' for key name '" + key + "'")
+	}
+
+	switch sub {
+	case "CREATE":
+		id, ok := parseGroupID(s, args[4])
+		if !ok {
+			return errInvalidStreamID
+		}
+		if g != nil {
+			return respgo.EncodeError("BUSYGROUP Consumer Group name already exists")
+		}
+		if s == nil {
+			s = &stream{}
+			kv.storeValue(key, s)
+		}
+		if s.groups == nil {
+			s.groups = make(map[string]*consumerGroup)
+		}
+		s.groups[name] = newConsumerGroup(id, entriesRead)
+		kv.dirty++
+		return respgo.EncodeSimpleString("OK")
+	case "SETID":
+		id, ok := parseGroupID(s, args[4])
+		if !ok {
+			return errInvalidStreamID
+		}
+		g.lastDelivered = id
+		g.entriesRead = entriesRead
+		kv.dirty++
+		return respgo.EncodeSimpleString("OK")
+	case "DESTROY":
+		if g == nil {
+			return respgo.EncodeInteger(0)
+		}
+		delete(s.groups, name)
+		kv.dirty++
+		return respgo.EncodeInteger(1)
+	case "CREATECONSUMER":
+		if _, created := g.consumer(args[4], time.Now().UnixMilli()); !created {
+			return respgo.EncodeInteger(0)
+		}
+		kv.dirty++
+		return respgo.EncodeInteger(1)
+	}
+	// DELCONSUMER
+	c, found := g.consumers[args[4]]
+	if !found {
+		return respgo.EncodeInteger(0)
+	}
+	pending := len(c.pending)
+	for _, e := range slices.Clone(c.pending) {
+		g.ack(e.id)
+	}
+	delete(g.consumers, args[4])
+	kv.dirty++
+	return respgo.EncodeInteger(pending)
+}
+
+func (kv *KVStore) xreadgroupCommand(args []string, connection *Connection) []byte {
+	var group, consumerName string
+	hasGroup, noack, block := false, false, false
+	count := int64(0)
+	var timeout time.Duration
+	streamsAt := -1
+	for i := 1; i < len(args) && streamsAt < 0; i++ {
+		left := len(args) - i - 1
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "GROUP" && left >= 2:
+			group, consumerName = args[i+1], args[i+2]
+			hasGroup = true
+			i += 2
+		case opt == "COUNT" && left >= 1:
+			n, ok := parseInt(args[i+1])
+			if !ok {
+				return errNotInteger
+			}
+			count = max(n, 0)
+			i++
+		case opt == "BLOCK" && left >= 1:
+			ms, ok := parseInt(args[i+1])
+			if !ok {
+				return respgo.EncodeError("ERR timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return respgo.EncodeError("ERR timeout is negative")
+			}
+			block = true
+			timeout = time.Duration(min(ms, math.MaxInt64/int64(time.Millisecond))) * time.Millisecond
+			i++
+		case opt == "NOACK":
+			noack = true
+		case opt == "STREAMS":
+			streamsAt = i
+		default:
+			return errSyntax
+		}
+	}
+	if streamsAt < 0 {
+		return errSyntax
+	}
+	if !hasGroup {
+		return respgo.EncodeError("ERR Missing GROUP option for XREADGROUP")
+	}
+	rest := args[streamsAt+1:]
+	if len(rest) == 0 || len(rest)%2 != 0 {
+		return respgo.EncodeError("ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+	keys, rawIDs := rest[:len(rest)/2], rest[len(rest)/2:]
+	// a zero ID with newEntries set stands for ">", new entries only
+	ids := make([]streamID, len(keys))
+	newEntries := make([]bool, len(keys))
+	for i, raw := range rawIDs {
+		switch raw {
+		case ">":
+			newEntries[i] = true
+		case "$":
+			return respgo.EncodeError("ERR The $ ID is meaningful in the context of XREAD only")
+		default:
+			id, ok := parseStreamID(raw, 0)
+			if !ok {
+				return errInvalidStreamID
+			}
+			ids[i] = id
+		}
+	}
+	for _, key := range keys {
+		s, ok := kv.lookupStream(key)
+		if !ok {
+			return errWrongType
+		}
+		if s == nil || s.groups[group] == nil {
+			return respgo.EncodeError("NOGROUP No such key '" + key + "' or consumer group '" + group + "' in XREADGROUP with GROUP option")
+		}
+	}
+
+	serve := func() ([]byte, bool) {
+		// the effects are replicated as XCLAIMs and SETIDs, not verbatim
+		kv.preventPropagation()
+		now := time.Now().UnixMilli()
+		var streams [][]byte
+		for i, key := range keys {
+			s, _ := kv.lookupStream(key)
+			if s == nil || s.groups[group] == nil {
+				return respgo.EncodeError("NOGROUP No such key '" + key + "' or consumer group '" + group + "' in XREADGROUP with GROUP option"), true
+			}
+			g := s.groups[group]
+			c, created := g.consumer(consumerName, now)
+			if created {
+				kv.dirty++
+				kv.alsoPropagate("XGROUP", "CREATECONSUMER", key, group, consumerName)
+			}
+
+			if !newEntries[i] {
+				// the consumer's own pending entries, for recovery after a
+				// crash; entries deleted since are returned without fields
+				var items [][]byte
+				for _, e := range c.pending[c.pending.search(ids[i]):] {
+					if count > 0 && int64(len(items)) == count {
+						break
+					}
+					if e.id == ids[i] {
+						continue
+					}
+					e.deliveryTime = now
+					e.deliveryCount++
+					if se, ok := s.entry(e.id); ok {
+						items = append(items, encodeStreamEntry(se))
+					} else {
+						items = append(items, respgo.EncodeRawArray(respgo.EncodeBulkString(e.id.String()), nilArray))
+					}
+				}
+				streams = append(streams, respgo.EncodeRawArray(respgo.EncodeBulkString(key), respgo.EncodeRawArray(items...)))
+				continue
+			}
+
+			entries := s.after(g.lastDelivered, count)
+			if len(entries) == 0 {
+				continue
+			}
+			items := make([][]byte, 0, len(entries))
+			for _, se := range entries {
+				id := se.ID
+				s.markRead(g, id)
+				if !noack {
+					e := g.deliver(id, c, now)
+					kv.propagateClaim(key, group, g, e)
+				}
+				items = append(items, encodeStreamEntry(se))
+			}
+			if noack {
+				kv.alsoPropagate("XGROUP", "SETID", key, group, g.lastDelivered.String())
+			}
+			c.activeTime = now
+			kv.dirty += len(entries)
+			streams = append(streams, respgo.EncodeRawArray(respgo.EncodeBulkString(key), respgo.EncodeRawArray(items...)))
+		}
+		if len(streams) == 0 {
+			return nil, false
+		}
+		return respgo.EncodeRawArray(streams...), true
+	}
+	if !block {
+		if reply, ok := serve(); ok {
+			return reply
+		}
+		return nilArray
+	}
+	return kv.blockOrReply(connection, keys, timeout, serve, nilArray)
+}
+
+func (kv *KVStore) xackCommand(args []string) []byte {
+	if len(args) < 4 {
+		return wrongArgs("xack")
+	}
+	ids := make([]streamID, 0, len(args)-3)
+	for _, raw := range args[3:] {
+		id, ok := parseStreamID(raw, 0)
+		if !ok {
+			return errInvalidStreamID
+		}
+		ids = append(ids, id)
+	}
+	s, ok := kv.lookupStream(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if s == nil || s.groups[args[2]] == nil {
+		return respgo.EncodeInteger(0)
+	}
+	g := s.groups[args[2]]
+	acked := 0
+	for _, id := range ids {
+		if g.ack(id) {
+			acked++
+		}
+	}
+	kv.dirty += acked
+	return respgo.EncodeInteger(acked)
+}
+
+func (kv *KVStore) xpendingCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("xpending")
+	}
+	key, group := args[1], args[2]
+	extended := len(args) > 3
+	minIdle := int64(0)
+	var start, end streamID
+	count := int64(0)
+	consumerName := ""
+	if extended {
+		rest := args[3:]
+		if strings.ToUpper(rest[0]) == "IDLE" {
+			if len(rest) < 2 {
+				return errSyntax
+			}
+			n, ok := parseInt(rest[1])
+			if !ok {
+				return errNotInteger
+			}
+			minIdle = n
+			rest = rest[2:]
+		}
+		if len(rest) < 3 || len(rest) > 4 {
+			return errSyntax
+		}
+		var errReply []byte
+		if start, errReply = parseRangeID(rest[0], false); errReply != nil {
+			return errReply
+		}
+		if end, errReply = parseRangeID(rest[1], true); errReply != nil {
+			return errReply
+		}
+		n, ok := parseInt(rest[2])
+		if !ok {
+			return errNotInteger
+		}
+		count = max(n, 0)
+		if len(rest) == 4 {
+			consumerName = rest[3]
+		}
+	}
+
+	_, g, errReply := kv.lookupGroup(key, group)
+	if errReply != nil {
+		return errReply
+	}
+
+	if !extended {
+		if len(g.pending) == 0 {
+			return respgo.EncodeRawArray(respgo.EncodeInteger(0), nilBulk, nilBulk, nilArray)
+		}
+		var perConsumer [][]byte
+		for _, c := range g.sortedConsumers() {
+			if len(c.pending) > 0 {
+				perConsumer = append(perConsumer, respgo.EncodeArray([]string{c.name, strconv.Itoa(len(c.pending))}))
+			}
+		}
+		return respgo.EncodeRawArray(
+			respgo.EncodeInteger(len(g.pending)),
+			respgo.EncodeBulkString(g.pending[0].id.String()),
+			respgo.EncodeBulkString(g.pending[len(g.pending)-1].id.String()),
+			respgo.EncodeRawArray(perConsumer...),
+		)
+	}
+
+	list := g.pending
+	if consumerName != "" {
+		c, found := g.consumers[consumerName]
+		if !found {
+			return respgo.EncodeArray(nil)
+		}
+		list = c.pending
+	}
+	now := time.Now().UnixMilli()
+	var out [][]byte
+	for _, e := range list[list.search(start):] {
+		if int64(len(out)) == count || end.less(e.id) {
+			break
+		}
+		idle := now - e.deliveryTime
+		if idle < minIdle {
+			continue
+		}
+		out = append(out, respgo.EncodeRawArray(
+			respgo.EncodeBulkString(e.id.String()),
+			respgo.EncodeBulkString(e.consumer.name),
+			respgo.EncodeInteger(int(idle)),
+			respgo.EncodeInteger(int(e.deliveryCount)),
+		))
+	}
+	return respgo.EncodeRawArray(out...)
+}
+
+// claimReply encodes a claimed entry, or just its ID.
+func claimReply(s *stream, id streamID, justID bool) []byte {
+	if justID {
+		return respgo.EncodeBulkString(id.String())
+	}
+	se, _ := s.entry(id)
+	return encodeStreamEntry(se)
+}
+
+func (kv *KVStore) xclaimCommand(args []string) []byte {
+	if len(args) < 6 {
+		return wrongArgs("xclaim")
+	}
+	key, group, consumerName := args[1], args[2], args[3]
+	minIdle, ok := parseInt(args[4])
+	if !ok {
+		return respgo.EncodeError("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+	minIdle = max(minIdle, 0)
+
+	j := 5
+	var ids []streamID
+	for ; j < len(args); j++ {
+		id, ok := parseStreamID(args[j], 0)
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+	now := time.Now().UnixMilli()
+	deliveryTime := int64(-1)
+	retryCount := int64(-1)
+	force, justID := false, false
+	var lastID streamID
+	hasLastID := false
+	for ; j < len(args); j++ {
+		hasNext := j+1 < len(args)
+		switch opt := strings.ToUpper(args[j]); {
+		case opt == "FORCE":
+			force = true
+		case opt == "JUSTID":
+			justID = true
+		case opt == "IDLE" && hasNext:
+			n, ok := parseInt(args[j+1])
+			if !ok {
+				return respgo.EncodeError("ERR Invalid IDLE option argument for XCLAIM")
+			}
+			deliveryTime = now - n
+			j++
+		case opt == "TIME" && hasNext:
+			n, ok := parseInt(args[j+1])
+			if !ok {
+				return respgo.EncodeError("ERR Invalid TIME option argument for XCLAIM")
+			}
+			deliveryTime = n
+			j++
+		case opt == "RETRYCOUNT" && hasNext:
+			n, ok := parseInt(args[j+1])
+			if !ok {
+				return respgo.EncodeError("ERR Invalid RETRYCOUNT option argument for XCLAIM")
+			}
+			retryCount = n
+			j++
+		case opt == "LASTID" && hasNext:
+			if lastID, ok = parseStreamID(args[j+1], 0); !ok {
+				return errInvalidStreamID
+			}
+			hasLastID = true
+			j++
+		default:
+			return respgo.EncodeError("ERR Unrecognized XCLAIM option '" + args[j] + "'")
+		}
+	}
+	if deliveryTime < 0 || deliveryTime > now {
+		// a delivery time in the future makes no sense
+		deliveryTime = now
+	}
+
+	s, g, errReply := kv.lookupGroup(key, group)
+	if errReply != nil {
+		return errReply
+	}
+	kv.preventPropagation()
+	if hasLastID && g.lastDelivered.less(lastID) {
+		g.lastDelivered = lastID
+		kv.dirty++
+		kv.alsoPropagate("XGROUP", "SETID", key, group, lastID.String())
+	}
+
+	var c *consumer
+	var out [][]byte
+	for _, id := range ids {
+		e, pending := g.pending.get(id)
+		_, exists := s.entry(id)
+		switch {
+		case !pending && force && exists:
+			e = &pendingEntry{id: id, deliveryTime: now, deliveryCount: 1}
+			g.pending.add(e)
+		case !pending:
+			continue
+		case now-e.deliveryTime < minIdle:
+			continue
+		}
+		if !exists {
+			// the entry was deleted from the stream: forget it
+			g.ack(id)
+			kv.dirty++
+			kv.alsoPropagate("XACK", key, group, id.String())
+			continue
+		}
+		if c == nil {
+			c, _ = g.consumer(consumerName, now)
+		}
+		g.reassign(e, c)
+		e.deliveryTime = deliveryTime
+		if retryCount >= 0 {
+			e.deliveryCount = retryCount
+		} else if !justID {
+			e.deliveryCount++
+		}
+		c.activeTime = now
+		kv.dirty++
+		kv.propagateClaim(key, group, g, e)
+		out = append(out, claimReply(s, id, justID))
+	}
+	return respgo.EncodeRawArray(out...)
+}
+
+// xautoclaimAttemptsFactor bounds how many pending entries XAUTOCLAIM
+// looks at per entry it may claim.
+const xautoclaimAttemptsFactor = 10
+
+func (kv *KVStore) xautoclaimCommand(args []string) []byte {
+	if len(args) < 6 {
+		return wrongArgs("xautoclaim")
+	}
+	key, group, consumerName := args[1], args[2], args[3]
+	minIdle, ok := parseInt(args[4])
+	if !ok {
+		return respgo.EncodeError("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	minIdle = max(minIdle, 0)
+	start, errReply := parseRangeID(args[5], false)
+	if errReply != nil {
+		return errReply
+	}
+	count := int64(100)
+	justID := false
+	for j := 6; j < len(args); j++ {
+		switch opt := strings.ToUpper(args[j]); {
+		case opt == "JUSTID":
+			justID = true
+		case opt == "COUNT" && j+1 < len(args):
+			n, ok := parseInt(args[j+1])
+			if !ok {
+				return errNotInteger
+			}
+			if n < 1 || n > math.MaxInt64/xautoclaimAttemptsFactor {
+				return respgo.EncodeError("ERR COUNT must be > 0")
+			}
+			count = n
+			j++
+		default:
+			return errSyntax
+		}
+	}
+
+	s, g, errReply := kv.lookupGroup(key, group)
+	if errReply != nil {
+		return errReply
+	}
+	kv.preventPropagation()
+	now := time.Now().UnixMilli()
+	var c *consumer
+	var claimed, deleted [][]byte
+	attempts := count * xautoclaimAttemptsFactor
+	i := g.pending.search(start)
+	for ; attempts > 0 && int64(len(claimed)) < count && i < len(g.pending); attempts-- {
+		e := g.pending[i]
+		if _, exists := s.entry(e.id); !exists {
+			g.ack(e.id)
+			kv.dirty++
+			kv.alsoPropagate("XACK", key, group, e.id.String())
+			deleted = append(deleted, respgo.EncodeBulkString(e.id.String()))
+			continue
+		}
+		i++
+		if now-e.deliveryTime < minIdle {
+			continue
+		}
+		if c == nil {
+			c, _ = g.consumer(consumerName, now)
+		}
+		g.reassign(e, c)
+		e.deliveryTime = now
+		if !justID {
+			e.deliveryCount++
+		}
+		c.activeTime = now
+		kv.dirty++
+		kv.propagateClaim(key, group, g, e)
+		claimed = append(claimed, claimReply(s, e.id, justID))
+	}
+	cursor := streamID{}
+	if i < len(g.pending) {
+		cursor = g.pending[i].id
+	}
+	return respgo.EncodeRawArray(
+		respgo.EncodeBulkString(cursor.String()),
+		respgo.EncodeRawArray(claimed...),
+		respgo.EncodeRawArray(deleted...),
+	)
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"testing"
+)
+
+// pendingRows runs an extended XPENDING and formats its rows without the
+// idle times, which depend on the clock.
+func pendingRows(c *testClient, args ...string) string {
+	c.t.Helper()
+	reply, ok := c.do(append([]string{"XPENDING"}, args...)...).([]any)
+	if !ok {
+		c.t.Fatalf("XPENDING %v did not return an array", args)
+	}
+	for _, row := range reply {
+		row.([]any)[2] = "-"
+	}
+	return formatReply(reply)
+}
+
+func TestStreamGroups(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("SET", "str", "v")
+	for _, id := range []string{"1-1", "2-1", "3-1"} {
+		c.do("XADD", "s", id, "f", string('a'+id[0]-'1'))
+	}
+	runSteps(c, []step{
+		{"XGROUP CREATE s g 0", "+OK"},
+		{"XGROUP CREATE s g 0", "-BUSYGROUP Consumer Group name already exists"},
+		{"XGROUP CREATE nostream g $", "-ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."},
+		{"XGROUP CREATE made g $ MKSTREAM", "+OK"},
+		{"XLEN made", "0"},
+		{"XGROUP CREATE s g2 x", "-ERR Invalid stream ID specified as stream command argument"},
+		{"XGROUP CREATE str g $", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+
+		// new entries go to whoever asks first, then the history of a
+		// consumer can be read back from any ID
+		{"XREADGROUP GROUP g alice COUNT 2 STREAMS s >", "[[s [[1-1 [f a]] [2-1 [f b]]]]]"},
+		{"XREADGROUP GROUP g bob STREAMS s >", "[[s [[3-1 [f c]]]]]"},
+		{"XREADGROUP GROUP g bob STREAMS s >", "(nil)"},
+		{"XREADGROUP GROUP g alice STREAMS s 0", "[[s [[1-1 [f a]] [2-1 [f b]]]]]"},
+		{"XREADGROUP GROUP g alice STREAMS s 1-1", "[[s [[2-1 [f b]]]]]"},
+		{"XREADGROUP GROUP g carol STREAMS s 0", "[[s []]]"},
+		{"XPENDING s g", "[3 1-1 3-1 [[alice 2] [bob 1]]]"},
+		{"XACK s g 1-1 9-9", "1"},
+		{"XACK s g 1-1", "0"},
+		{"XACK s nogroup 2-1", "0"},
+		{"XACK s g x", "-ERR Invalid stream ID specified as stream command argument"},
+		{"XPENDING s g", "[2 2-1 3-1 [[alice 1] [bob 1]]]"},
+		// a pending entry deleted from the stream comes back without fields
+		{"XDEL s 3-1", "1"},
+		{"XREADGROUP GROUP g bob STREAMS s 0", "[[s [[3-1 (nil)]]]]"},
+
+		{"XREADGROUP GROUP g alice STREAMS s", "-ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '$' must be specified."},
+		{"XREADGROUP GROUP g alice STREAMS s $", "-ERR The $ ID is meaningful in the context of XREAD only"},
+		{"XREADGROUP GROUP nog alice STREAMS s >", "-NOGROUP No such key 's' or consumer group 'nog' in XREADGROUP with GROUP option"},
+		{"XREADGROUP STREAMS s >", "-ERR Missing GROUP option for XREADGROUP"},
+		{"XREADGROUP GROUP g alice STREAMS str >", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+	// 2-1 has been delivered three times: once new and twice as history
+	if got, want := pendingRows(c, "s", "g", "-", "+", "10"), "[[2-1 alice - 3] [3-1 bob - 2]]"; got != want {
+		t.Errorf("XPENDING s g - + 10 = %s, want %s", got, want)
+	}
+
+	runSteps(c, []step{
+		{"XCLAIM s g carol 0 2-1", "[[2-1 [f b]]]"},
+		{"XCLAIM s g carol 0 2-1 JUSTID", "[2-1]"},
+		{"XCLAIM s g carol 3600000 2-1", "[]"},
+		// claiming an entry deleted from the stream acknowledges it instead
+		{"XCLAIM s g carol 0 3-1", "[]"},
+		{"XPENDING s g", "[1 2-1 2-1 [[carol 1]]]"},
+		{"XCLAIM s g dave 0 1-1", "[]"},
+		{"XCLAIM s g dave 0 1-1 FORCE JUSTID", "[1-1]"},
+		{"XCLAIM s g dave 0 1-1 RETRYCOUNT 7 JUSTID", "[1-1]"},
+		{"XCLAIM s g dave 0 2-1 IDLE 3600000 JUSTID LASTID 9-9", "[2-1]"},
+		{"XCLAIM s g dave x 1-1", "-ERR Invalid min-idle-time argument for XCLAIM"},
+		{"XCLAIM s g dave 0 1-1 IDLE x", "-ERR Invalid IDLE option argument for XCLAIM"},
+		{"XCLAIM s g dave 0 1-1 SOON", "-ERR Unrecognized XCLAIM option 'SOON'"},
+		{"XCLAIM s nog dave 0 1-1", "-NOGROUP No such key 's' or consumer group 'nog'"},
+		{"XPENDING s g IDLE 3600000000 - + 10", "[]"},
+		{"XPENDING s g - + 10 nobody", "[]"},
+		{"XPENDING s g - + x", "-ERR value is not an integer or out of range"},
+		{"XPENDING s nog", "-NOGROUP No such key 's' or consumer group 'nog'"},
+	})
+	if got, want := pendingRows(c, "s", "g", "IDLE", "3000000", "-", "+", "10"), "[[2-1 dave - 4]]"; got != want {
+		t.Errorf("XPENDING s g IDLE 3000000 - + 10 = %s, want %s", got, want)
+	}
+	if got, want := pendingRows(c, "s", "g", "(1-1", "+", "10", "dave"), "[[2-1 dave - 4]]"; got != want {
+		t.Errorf("XPENDING s g (1-1 + 10 dave = %s, want %s", got, want)
+	}
+	if got, want := pendingRows(c, "s", "g", "-", "+", "1"), "[[1-1 dave - 7]]"; got != want {
+		t.Errorf("XPENDING s g - + 1 = %s, want %s", got, want)
+	}
+
+	// LASTID moved the group past everything, so reading new entries waits
+	// for the next one
+	c.do("XADD", "s", "10-1", "f", "j")
+	runSteps(c, []step{
+		{"XREADGROUP GROUP g erin STREAMS s >", "[[s [[10-1 [f j]]]]]"},
+		{"XREADGROUP GROUP g erin NOACK STREAMS s >", "(nil)"},
+	})
+}
+
+func TestStreamAutoclaim(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	for _, id := range []string{"1-1", "2-1", "3-1", "4-1"} {
+		c.do("XADD", "s", id, "n", id[:1])
+	}
+	c.do("XGROUP", "CREATE", "s", "g", "0")
+	c.do("XREADGROUP", "GROUP", "g", "erin", "STREAMS", "s", ">")
+	c.do("XDEL", "s", "3-1")
+	runSteps(c, []step{
+		// a deleted entry is dropped from the pending list and reported,
+		// however long it has been idle
+		{"XAUTOCLAIM s g frank 3600000 0", "[0-0 [] [3-1]]"},
+		// the cursor is where the next call picks up
+		{"XAUTOCLAIM s g frank 0 0 COUNT 1", "[2-1 [[1-1 [n 1]]] []]"},
+		{"XAUTOCLAIM s g frank 0 2-1 COUNT 2 JUSTID", "[0-0 [2-1 4-1] []]"},
+		{"XPENDING s g", "[3 1-1 4-1 [[frank 3]]]"},
+		{"XAUTOCLAIM s g gina 0 (1-1 JUSTID", "[0-0 [2-1 4-1] []]"},
+		{"XPENDING s g", "[3 1-1 4-1 [[frank 1] [gina 2]]]"},
+		{"XAUTOCLAIM s g frank 0 0 COUNT 0", "-ERR COUNT must be > 0"},
+		{"XAUTOCLAIM s g frank x 0", "-ERR Invalid min-idle-time argument for XAUTOCLAIM"},
+		{"XAUTOCLAIM s g frank 0 0 SOON", "-ERR syntax error"},
+		{"XAUTOCLAIM s nog frank 0 0", "-NOGROUP No such key 's' or consumer group 'nog'"},
+	})
+	// JUSTID claims do not count as deliveries
+	if got, want := pendingRows(c, "s", "g", "-", "+", "10"), "[[1-1 frank - 2] [2-1 gina - 1] [4-1 gina - 1]]"; got != want {
+		t.Errorf("XPENDING s g - + 10 = %s, want %s", got, want)
+	}
+}
+
+func TestStreamGroupAdmin(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("XADD", "s", "1-1", "f", "a")
+	c.do("XADD", "s", "2-1", "f", "b")
+	c.do("XGROUP", "CREATE", "s", "g", "0")
+	c.do("XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", ">")
+	runSteps(c, []step{
+		{"XGROUP CREATECONSUMER s g bob", "1"},
+		{"XGROUP CREATECONSUMER s g bob", "0"},
+		{"XGROUP CREATECONSUMER s nog bob", "-NOGROUP No such consumer group 'nog' for key name 's'"},
+		{"XGROUP DELCONSUMER s g nobody", "0"},
+		{"XGROUP DELCONSUMER s g alice", "2"},
+		{"XPENDING s g", "[0 (nil) (nil) (nil)]"},
+		{"XGROUP SETID s g 1-1", "+OK"},
+		{"XREADGROUP GROUP g bob STREAMS s >", "[[s [[2-1 [f b]]]]]"},
+		{"XGROUP SETID s g 0 ENTRIESREAD -2", "-ERR value for ENTRIESREAD must be positive or -1"},
+		{"XGROUP SETID s g $ MKSTREAM", "-ERR syntax error"},
+		{"XGROUP SETID s nog 0", "-NOGROUP No such consumer group 'nog' for key name 's'"},
+		{"XGROUP DESTROY s g", "1"},
+		{"XGROUP DESTROY s g", "0"},
+		{"XGROUP DESTROY nostream g", "-ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."},
+		{"XGROUP DESTROY s", "-ERR unknown subcommand or wrong number of arguments for 'DESTROY'. Try XGROUP HELP."},
+		{"XGROUP REMOVE s g", "-ERR unknown subcommand 'REMOVE'. Try XGROUP HELP."},
+	})
+}
+
+func TestXreadgroupBlocking(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("XGROUP", "CREATE", "s", "g", "$", "MKSTREAM")
+	r1, r2 := connect(t, kv), connect(t, kv)
+	r1.send("XREADGROUP", "GROUP", "g", "alice", "BLOCK", "0", "STREAMS", "s", ">")
+	waitFor(t, kv, "alice to block", func() bool { return len(kv.dbs[0].blocked["s"]) == 1 })
+	r2.send("XREADGROUP", "GROUP", "g", "bob", "BLOCK", "0", "STREAMS", "s", ">")
+	waitFor(t, kv, "bob to block", func() bool { return len(kv.dbs[0].blocked["s"]) == 2 })
+
+	// each entry goes to one consumer of the group, first come first served
+	c.do("XADD", "s", "1-1", "f", "a")
+	if got, want := formatReply(r1.read()), "[[s [[1-1 [f a]]]]]"; got != want {
+		t.Errorf("alice's XREADGROUP = %s, want %s", got, want)
+	}
+	waitFor(t, kv, "alice to be unblocked", func() bool { return len(kv.dbs[0].blocked["s"]) == 1 })
+	c.do("XADD", "s", "2-1", "f", "b")
+	if got, want := formatReply(r2.read()), "[[s [[2-1 [f b]]]]]"; got != want {
+		t.Errorf("bob's XREADGROUP = %s, want %s", got, want)
+	}
+	if got, want := formatReply(c.do("XPENDING", "s", "g")), "[2 1-1 2-1 [[alice 1] [bob 1]]]"; got != want {
+		t.Errorf("XPENDING s g = %s, want %s", got, want)
+	}
+	if got := c.do("XREADGROUP", "GROUP", "g", "bob", "BLOCK", "10", "STREAMS", "s", ">"); got != nil {
+		t.Errorf("XREADGROUP BLOCK 10 with nothing new = %v, want nil", got)
+	}
+}
@@ -0,0 +1,801 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// setKey stores a string under key, replacing a value of any type.
+// expireAt is an absolute unix-ms deadline, or 0 for none. With keepTTL the
+// key keeps whatever deadline it already had instead. The caller must hold
+// kv.mu.
+func (kv *KVStore) setKey(key, value string, expireAt int64, keepTTL bool) {
+	deadline, volatile := kv.expires.get(key)
+	kv.removeKey(key)
+	kv.updateString(key, value)
+	switch {
+	case expireAt > 0:
+		kv.setExpiry(key, expireAt)
+	case keepTTL && volatile:
+		kv.setExpiry(key, deadline)
+	}
+}
+
+// setCommand implements SET key value [NX | XX] [GET]
+// [EX seconds | PX milliseconds | EXAT unix-seconds | PXAT unix-milliseconds
+// | KEEPTTL].
+func (kv *KVStore) setCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("set")
+	}
+	key, value := args[1], args[2]
+
+	var nx, xx, get, keepTTL bool
+	var expireOpt, expireArg string
+	for j := 3; j < len(args); j++ {
+		opt := strings.ToUpper(args[j])
+		hasNext := j+1 < len(args)
+		switch {
+		case opt == "NX" && !xx:
+			nx = true
+		case opt == "XX" && !nx:
+			xx = true
+		case opt == "GET":
+			get = true
+		case opt == "KEEPTTL" && expireOpt == "":
+			keepTTL = true
+		case (opt == "EX" || opt == "PX" || opt == "EXAT" || opt == "PXAT") &&
+			!keepTTL && (expireOpt == "" || expireOpt == opt) && hasNext:
+			expireOpt, expireArg = opt, args[j+1]
+			j++
+		default:
+			return errSyntax
+		}
+	}
+
+	var expireAt int64
+	if expireOpt != "" {
+		n, err := strconv.ParseInt(expireArg, 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		unit := int64(1)
+		if expireOpt == "EX" || expireOpt == "EXAT" {
+			unit = 1000
+		}
+		absolute := expireOpt == "EXAT" || expireOpt == "PXAT"
+		at, ok := resolveDeadline(n, unit, absolute)
+		if n <= 0 || !ok {
+			return respgo.EncodeError("ERR invalid expire time in 'set' command")
+		}
+		expireAt = at
+	}
+
+	old, isString, _ := kv.lookupString(key)
+	found := kv.keyExists(key)
+	if get && found && !isString {
+		return errWrongType
+	}
+
+	reply := respgo.EncodeSimpleString("OK")
+	if get {
+		reply = []byte("$-1\r\n")
+		if isString {
+			reply = respgo.EncodeBulkString(old)
+		}
+	}
+	if (nx && found) || (xx && !found) {
+		if !get {
+			return []byte("$-1\r\n")
+		}
+		return reply
+	}
+
+	kv.setKey(key, value, expireAt, keepTTL)
+	kv.dirty++
+
+	// replicas get the deadline we resolved, not the relative one we were
+	// given, so the key expires at the same instant everywhere
+	propagated := []string{"SET", key, value}
+	if keepTTL {
+		propagated = append(propagated, "KEEPTTL")
+	}
+	if expireAt > 0 {
+		propagated = append(propagated, "PXAT", strconv.FormatInt(expireAt, 10))
+	}
+	kv.rewriteCommand(propagated...)
+	return reply
+}
+
+// Set stores value under key, replacing whatever the key held before. A
+// non-negative expiry (in milliseconds) gives the key a deadline; otherwise
+// it is persistent. The caller must hold kv.mu.
+func (kv *KVStore) Set(key, value string, expiry int) {
+	var expireAt int64
+	if expiry >= 0 {
+		expireAt = time.Now().UnixMilli() + int64(expiry)
+	}
+	kv.setKey(key, value, expireAt, false)
+}
+
+// parseInt parses s the way Redis parses integers: an optional minus sign
+// and decimal digits, with no leading zeros, plus sign or whitespace.
+func parseInt(s string) (int64, bool) {
+	digits := strings.TrimPrefix(s, "-")
+	if digits == "" || (digits[0] == '0' && (len(digits) > 1 || len(s) > 1)) {
+		return 0, false
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// longDoublePrec is the mantissa size of the x87 long double Redis uses for
+// INCRBYFLOAT arithmetic; doing the same here gives byte-identical results.
+const longDoublePrec = 64
+
+// parseLongDouble parses a float argument. NaN and anything with
+// surrounding whitespace are rejected, infinities are accepted.
+func parseLongDouble(s string) (*big.Float, bool) {
+	if s == "" || strings.TrimSpace(s) != s {
+		return nil, false
+	}
+	f, _, err := big.ParseFloat(s, 10, longDoublePrec, big.ToNearestEven)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// incrFloat adds incr to cur and formats the sum like Redis does, reporting
+// false if the result is not finite.
+func incrFloat(cur, incr *big.Float) (string, bool) {
+	sum := new(big.Float).SetPrec(longDoublePrec).Add(cur, incr)
+	// the largest finite long double has a binary exponent of 16384
+	if sum.IsInf() || sum.MantExp(nil) > 16384 {
+		return "", false
+	}
+	out := sum.Text('f', 17)
+	if strings.Contains(out, ".") {
+		out = strings.TrimRight(out, "0")
+		out = strings.TrimSuffix(out, ".")
+	}
+	if out == "-0" {
+		out = "0"
+	}
+	return out, true
+}
+
+// parseDouble parses a float argument such as a sorted set score. NaN,
+// out-of-range values and surrounding whitespace are rejected.
+func parseDouble(s string) (float64, bool) {
+	if s == "" || strings.TrimSpace(s) != s {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// parseRangeDouble parses one end of a score range. Unlike parseDouble it
+// accepts values too large to represent, which become infinite, as strtod
+// does for Redis.
+func parseRangeDouble(s string) (float64, bool) {
+	if s == "" || strings.TrimSpace(s) != s {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if (err != nil && !errors.Is(err, strconv.ErrRange)) || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// formatDouble formats a float for a reply the way Redis does: the
+// shortest digits that round-trip, written plainly unless that would take
+// too many zeros, in which case scientific notation is used.
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case f == 0 && math.Signbit(f):
+		return "-0"
+	case f == 0:
+		return "0"
+	}
+	sign := ""
+	if f < 0 {
+		sign = "-"
+		f = -f
+	}
+	// "d.ddddde±x": split into the digits and the power of ten of the last
+	// digit, so that f = digits * 10^k
+	e := strconv.FormatFloat(f, 'e', -1, 64)
+	mant, exp, _ := strings.Cut(e, "e")
+	digits := strings.Replace(mant, ".", "", 1)
+	x, _ := strconv.Atoi(exp)
+	n := len(digits)
+	k := x - (n - 1)
+	absExp := x
+	if absExp < 0 {
+		absExp = -absExp
+	}
+
+	switch {
+	case k >= 0 && absExp < n+7:
+		return sign + digits + strings.Repeat("0", k)
+	case k < 0 && (k > -7 || absExp < 4):
+		if offset := n + k; offset > 0 {
+			return sign + digits[:offset] + "." + digits[offset:]
+		} else {
+			return sign + "0." + strings.Repeat("0", -offset) + digits
+		}
+	}
+	out := sign + digits[:1]
+	if n > 1 {
+		out += "." + digits[1:]
+	}
+	if x < 0 {
+		return out + "e-" + strconv.Itoa(absExp)
+	}
+	return out + "e+" + strconv.Itoa(absExp)
+}
+
+// maxStringSize is the longest string APPEND and SETRANGE may build,
+// Redis's default proto-max-bulk-len.
+const maxStringSize = 512 * 1024 * 1024
+
+var errStringTooLong = respgo.EncodeError("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+
+// sharedIntegersCount is how many small integers Redis keeps shared
+// objects for, which OBJECT REFCOUNT reports as shared.
+const sharedIntegersCount = 10000
+
+// intEncoded parses v if Redis would store it with the integer encoding:
+// a canonical 64-bit integer of at most 20 characters.
+func intEncoded(v string) (int64, bool) {
+	if len(v) > 20 {
+		return 0, false
+	}
+	return parseInt(v)
+}
+
+// strValue is the value of a string key. A string that is integer-encoded
+// is held as the integer, like Redis's int encoding, so that INCR and
+// friends need not parse and format it.
+type strValue struct {
+	s     string
+	n     int64
+	isInt bool
+}
+
+func newStrValue(v string) strValue {
+	if n, ok := intEncoded(v); ok {
+		return strValue{n: n, isInt: true}
+	}
+	return strValue{s: v}
+}
+
+func (v strValue) String() string {
+	if v.isInt {
+		return strconv.FormatInt(v.n, 10)
+	}
+	return v.s
+}
+
+// putString stores v at key, which holds a string or nothing, keeping its
+// deadline. The caller must hold kv.mu.
+func (kv *KVStore) putString(key string, v strValue) {
+	o := kv.lookupObject(key)
+	if o == nil {
+		o = &object{typ: objString}
+		kv.keys.set(key, o)
+	}
+	o.str, o.lru = v, time.Now().UnixMilli()
+}
+
+// lookupString returns the string stored at key and whether there is one,
+// formatting it if it is integer-encoded. ok is false if key holds another
+// type. The caller must hold kv.mu.
+func (kv *KVStore) lookupString(key string) (v string, found, ok bool) {
+	o := kv.lookupObject(key)
+	if o == nil || o.typ != objString {
+		return "", false, o == nil
+	}
+	return o.str.String(), true, true
+}
+
+// updateString is putString for a value that is integer-encoded if it can
+// be. The caller must hold kv.mu.
+func (kv *KVStore) updateString(key, v string) {
+	kv.putString(key, newStrValue(v))
+}
+
+func (kv *KVStore) getCommand(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs("get")
+	}
+	v, found, ok := kv.lookupString(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if !found {
+		return nilBulk
+	}
+	return respgo.EncodeBulkString(v)
+}
+
+func (kv *KVStore) getdelCommand(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs("getdel")
+	}
+	v, found, ok := kv.lookupString(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if !found {
+		return nilBulk
+	}
+	kv.removeKey(args[1])
+	kv.dirty++
+	kv.rewriteCommand("DEL", args[1])
+	return respgo.EncodeBulkString(v)
+}
+
+func (kv *KVStore) getsetCommand(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs("getset")
+	}
+	v, found, ok := kv.lookupString(args[1])
+	if !ok {
+		return errWrongType
+	}
+	kv.setKey(args[1], args[2], 0, false)
+	kv.dirty++
+	kv.rewriteCommand("SET", args[1], args[2])
+	if !found {
+		return nilBulk
+	}
+	return respgo.EncodeBulkString(v)
+}
+
+// getexCommand implements GETEX key [EX seconds | PX milliseconds |
+// EXAT unix-seconds | PXAT unix-milliseconds | PERSIST].
+func (kv *KVStore) getexCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs("getex")
+	}
+	key := args[1]
+	var expireOpt string
+	var when int64
+	persist := false
+	for j := 2; j < len(args); j++ {
+		opt := strings.ToUpper(args[j])
+		switch {
+		case opt == "PERSIST" && expireOpt == "" && !persist:
+			persist = true
+		case (opt == "EX" || opt == "PX" || opt == "EXAT" || opt == "PXAT") &&
+			expireOpt == "" && !persist && j+1 < len(args):
+			n, err := strconv.ParseInt(args[j+1], 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			expireOpt, when = opt, n
+			j++
+		default:
+			return errSyntax
+		}
+	}
+	var expireAt int64
+	if expireOpt != "" {
+		unit := int64(1)
+		if expireOpt == "EX" || expireOpt == "EXAT" {
+			unit = 1000
+		}
+		at, ok := resolveDeadline(when, unit, expireOpt == "EXAT" || expireOpt == "PXAT")
+		if when <= 0 || !ok {
+			return respgo.EncodeError("ERR invalid expire time in 'getex' command")
+		}
+		expireAt = at
+	}
+
+	v, found, ok := kv.lookupString(key)
+	if !ok {
+		return errWrongType
+	}
+	if !found {
+		return nilBulk
+	}
+	switch {
+	case expireAt > 0 && expireAt <= time.Now().UnixMilli():
+		kv.removeKey(key)
+		kv.dirty++
+		kv.rewriteCommand("DEL", key)
+	case expireAt > 0:
+		kv.setExpiry(key, expireAt)
+		kv.dirty++
+		kv.rewriteCommand("PEXPIREAT", key, strconv.FormatInt(expireAt, 10))
+	case persist && kv.removeExpiry(key):
+		kv.dirty++
+		kv.rewriteCommand("PERSIST", key)
+	}
+	return respgo.EncodeBulkString(v)
+}
+
+// setexCommand implements SETEX and PSETEX, whose TTL is in units of unit
+// milliseconds.
+func (kv *KVStore) setexCommand(args []string, unit int64) []byte {
+	name := strings.ToLower(args[0])
+	if len(args) != 4 {
+		return wrongArgs(name)
+	}
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	at, ok := resolveDeadline(n, unit, false)
+	if n <= 0 || !ok {
+		return respgo.EncodeError("ERR invalid expire time in '" + name + "' command")
+	}
+	kv.setKey(args[1], args[3], at, false)
+	kv.dirty++
+	kv.rewriteCommand("SET", args[1], args[3], "PXAT", strconv.FormatInt(at, 10))
+	return respgo.EncodeSimpleString("OK")
+}
+
+func (kv *KVStore) setnxCommand(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs("setnx")
+	}
+	if kv.keyExists(args[1]) {
+		return respgo.EncodeInteger(0)
+	}
+	kv.setKey(args[1], args[2], 0, false)
+	kv.dirty++
+	return respgo.EncodeInteger(1)
+}
+
+func (kv *KVStore) mgetCommand(args []string) []byte {
+	if len(args) < 2 {
+		return wrongArgs("mget")
+	}
+	out := make([][]byte, 0, len(args)-1)
+	for _, key := range args[1:] {
+		// keys of other types read as missing
+		if v, found, _ := kv.lookupString(key); found {
+			out = append(out, respgo.EncodeBulkString(v))
+		} else {
+			out = append(out, nilBulk)
+		}
+	}
+	return respgo.EncodeRawArray(out...)
+}
+
+// msetCommand implements MSET and, with nx set, MSETNX, which sets nothing
+// if any of the keys exists.
+func (kv *KVStore) msetCommand(args []string, nx bool) []byte {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return wrongArgs(strings.ToLower(args[0]))
+	}
+	if nx {
+		for i := 1; i < len(args); i += 2 {
+			if kv.keyExists(args[i]) {
+				return respgo.EncodeInteger(0)
+			}
+		}
+	}
+	for i := 1; i < len(args); i += 2 {
+		kv.setKey(args[i], args[i+1], 0, false)
+	}
+	kv.dirty += (len(args) - 1) / 2
+	if nx {
+		return respgo.EncodeInteger(1)
+	}
+	return respgo.EncodeSimpleString("OK")
+}
+
+func (kv *KVStore) appendCommand(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs("append")
+	}
+	v, _, ok := kv.lookupString(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if len(v)+len(args[2]) > maxStringSize {
+		return errStringTooLong
+	}
+	v += args[2]
+	kv.updateString(args[1], v)
+	kv.dirty++
+	return respgo.EncodeInteger(len(v))
+}
+
+func (kv *KVStore) strlenCommand(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs("strlen")
+	}
+	v, _, ok := kv.lookupString(args[1])
+	if !ok {
+		return errWrongType
+	}
+	return respgo.EncodeInteger(len(v))
+}
+
+// getrangeCommand implements GETRANGE and its old name SUBSTR.
+func (kv *KVStore) getrangeCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs(strings.ToLower(args[0]))
+	}
+	start, ok1 := parseInt(args[2])
+	end, ok2 := parseInt(args[3])
+	if !ok1 || !ok2 {
+		return errNotInteger
+	}
+	v, _, ok := kv.lookupString(args[1])
+	if !ok {
+		return errWrongType
+	}
+	n := int64(len(v))
+	if start < 0 && end < 0 && start > end {
+		return respgo.EncodeBulkString("")
+	}
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end = max(n+end, 0)
+	}
+	end = min(end, n-1)
+	if n == 0 || start > end {
+		return respgo.EncodeBulkString("")
+	}
+	return respgo.EncodeBulkString(v[start : end+1])
+}
+
+func (kv *KVStore) setrangeCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs("setrange")
+	}
+	offset, ok := parseInt(args[2])
+	if !ok {
+		return errNotInteger
+	}
+	if offset < 0 {
+		return respgo.EncodeError("ERR offset is out of range")
+	}
+	value := args[3]
+	v, found, ok := kv.lookupString(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if value == "" {
+		// nothing to write, and a missing key is not created
+		return respgo.EncodeInteger(len(v))
+	}
+	if offset+int64(len(value)) > maxStringSize {
+		return errStringTooLong
+	}
+	buf := []byte(v)
+	if need := int(offset) + len(value); need > len(buf) {
+		buf = append(buf, make([]byte, need-len(buf))...)
+	}
+	copy(buf[offset:], value)
+	if !found {
+		kv.setKey(args[1], string(buf), 0, false)
+	} else {
+		kv.updateString(args[1], string(buf))
+	}
+	kv.dirty++
+	return respgo.EncodeInteger(len(buf))
+}
+
+// incrBy adds incr to the integer stored at key and replies with the
+// result. The caller must hold kv.mu.
+func (kv *KVStore) incrBy(key string, incr int64) []byte {
+	var cur int64
+	switch o := kv.lookupObject(key); {
+	case o == nil:
+	case o.typ != objString:
+		return errWrongType
+	case !o.str.isInt:
+		// a string that is not integer-encoded is not an integer
+		return errNotInteger
+	default:
+		cur = o.str.n
+	}
+	if (incr < 0 && cur < 0 && incr < math.MinInt64-cur) ||
+		(incr > 0 && cur > 0 && incr > math.MaxInt64-cur) {
+		return respgo.EncodeError("ERR increment or decrement would overflow")
+	}
+	cur += incr
+	kv.putString(key, strValue{n: cur, isInt: true})
+	kv.dirty++
+	return respgo.EncodeInteger(int(cur))
+}
+
+// incrCommand implements INCR and DECR, which add sign.
+func (kv *KVStore) incrCommand(args []string, sign int64) []byte {
+	if len(args) != 2 {
+		return wrongArgs(strings.ToLower(args[0]))
+	}
+	return kv.incrBy(args[1], sign)
+}
+
+// incrbyCommand implements INCRBY and DECRBY, which subtracts.
+func (kv *KVStore) incrbyCommand(args []string, decr bool) []byte {
+	name := strings.ToLower(args[0])
+	if len(args) != 3 {
+		return wrongArgs(name)
+	}
+	incr, ok := parseInt(args[2])
+	if !ok {
+		return errNotInteger
+	}
+	if decr {
+		if incr == math.MinInt64 {
+			return respgo.EncodeError("ERR decrement would overflow")
+		}
+		incr = -incr
+	}
+	return kv.incrBy(args[1], incr)
+}
+
+func (kv *KVStore) incrbyfloatCommand(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs("incrbyfloat")
+	}
+	incr, ok := parseLongDouble(args[2])
+	if !ok {
+		return respgo.EncodeError("ERR value is not a valid float")
+	}
+	v, found, ok := kv.lookupString(args[1])
+	if !ok {
+		return errWrongType
+	}
+	cur, _ := parseLongDouble("0")
+	if found {
+		if cur, ok = parseLongDouble(v); !ok {
+			return respgo.EncodeError("ERR value is not a valid float")
+		}
+	}
+	out, ok := incrFloat(cur, incr)
+	if !ok {
+		return respgo.EncodeError("ERR increment would produce NaN or Infinity")
+	}
+	kv.updateString(args[1], out)
+	kv.dirty++
+	// replicas must not redo float arithmetic that may round differently
+	kv.rewriteCommand("SET", args[1], out, "KEEPTTL")
+	return respgo.EncodeBulkString(out)
+}
+
+// lcsCommand implements LCS key1 key2 [LEN] [IDX] [MINMATCHLEN len]
+// [WITHMATCHLEN], finding the longest common subsequence by dynamic
+// programming the way Redis does.
+func (kv *KVStore) lcsCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("lcs")
+	}
+	a, _, okA := kv.lookupString(args[1])
+	b, _, okB := kv.lookupString(args[2])
+	if !okA || !okB {
+		return errWrongType
+	}
+	var getLen, getIdx, withMatchLen bool
+	minMatchLen := int64(0)
+	for j := 3; j < len(args); j++ {
+		switch opt := strings.ToUpper(args[j]); {
+		case opt == "LEN":
+			getLen = true
+		case opt == "IDX":
+			getIdx = true
+		case opt == "WITHMATCHLEN":
+			withMatchLen = true
+		case opt == "MINMATCHLEN" && j+1 < len(args):
+			n, ok := parseInt(args[j+1])
+			if !ok {
+				return errNotInteger
+			}
+			minMatchLen = max(n, 0)
+			j++
+		default:
+			return errSyntax
+		}
+	}
+	if getLen && getIdx {
+		return respgo.EncodeError("ERR If you want both the length and indexes, please just use IDX.")
+	}
+	if uint64(len(a)+1)*uint64(len(b)+1) > maxStringSize/4 {
+		return respgo.EncodeError("ERR Insufficient memory, transient memory for LCS exceeds proto-max-bulk-len")
+	}
+
+	// lcs[i*(len(b)+1)+j] is the LCS length of a[:i] and b[:j]
+	w := len(b) + 1
+	lcs := make([]uint32, (len(a)+1)*w)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				lcs[i*w+j] = lcs[(i-1)*w+j-1] + 1
+			} else {
+				lcs[i*w+j] = max(lcs[(i-1)*w+j], lcs[i*w+j-1])
+			}
+		}
+	}
+	total := lcs[len(a)*w+len(b)]
+	if getLen {
+		return respgo.EncodeInteger(int(total))
+	}
+
+	// walk back from the end, collecting the subsequence and the ranges
+	// where it matches contiguously in both strings
+	result := make([]byte, total)
+	var matches [][]byte
+	idx := total
+	i, j := len(a), len(b)
+	aStart, aEnd, bStart, bEnd := len(a), 0, 0, 0
+	for i > 0 && j > 0 {
+		emit := false
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+			if aStart == len(a) {
+				aStart, aEnd, bStart, bEnd = i-1, i-1, j-1, j-1
+			} else if aStart == i && bStart == j {
+				aStart--
+				bStart--
+			} else {
+				emit = true
+			}
+			if aStart == 0 || bStart == 0 {
+				emit = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if lcs[(i-1)*w+j] > lcs[i*w+j-1] {
+				i--
+			} else {
+				j--
+			}
+			if aStart != len(a) {
+				emit = true
+			}
+		}
+		if emit {
+			matchLen := aEnd - aStart + 1
+			if getIdx && (minMatchLen == 0 || int64(matchLen) >= minMatchLen) {
+				match := [][]byte{
+					respgo.EncodeRawArray(respgo.EncodeInteger(aStart), respgo.EncodeInteger(aEnd)),
+					respgo.EncodeRawArray(respgo.EncodeInteger(bStart), respgo.EncodeInteger(bEnd)),
+				}
+				if withMatchLen {
+					match = append(match, respgo.EncodeInteger(matchLen))
+				}
+				matches = append(matches, respgo.EncodeRawArray(match...))
+			}
+			aStart = len(a)
+		}
+	}
+	if !getIdx {
+		return respgo.EncodeBulkString(string(result))
+	}
+	return respgo.EncodeRawArray(
+		respgo.EncodeBulkString("matches"), respgo.EncodeRawArray(matches...),
+		respgo.EncodeBulkString("len"), respgo.EncodeInteger(int(total)),
+	)
+}
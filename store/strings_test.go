@@ -0,0 +1,127 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestIntegerEncodedStrings(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("SET", "n", "41")
+	if got := c.do("INCR", "n"); got != 42 {
+		t.Fatalf("INCR = %v, want 42", got)
+	}
+	kv.mu.Lock()
+	v := kv.lookupObject("n").str
+	kv.mu.Unlock()
+	if !v.isInt || v.n != 42 {
+		t.Fatalf("n is stored as %+v, want the int64 42", v)
+	}
+	runSteps(c, []step{
+		{"OBJECT ENCODING n", "int"},
+		{"OBJECT REFCOUNT n", strconv.Itoa(sharedRefcount)},
+		{"GET n", "42"},
+		{"STRLEN n", "2"},
+		{"TYPE n", "+string"},
+		{"INCRBY n -50", "-8"},
+		{"APPEND n x", "3"},
+		{"OBJECT ENCODING n", "embstr"},
+		{"INCR n", "-ERR value is not an integer or out of range"},
+		{"SET n 9223372036854775807", "+OK"},
+		{"INCR n", "-ERR increment or decrement would overflow"},
+		{"GET n", "9223372036854775807"},
+		{"SET padded 007", "+OK"},
+		{"OBJECT ENCODING padded", "embstr"},
+		{"MGET n padded missing", "[9223372036854775807 007 (nil)]"},
+	})
+
+	c.do("SET", "n", "-3")
+	dump := c.do("DUMP", "n").(string)
+	c.do("RESTORE", "copy", "0", dump)
+	if got := c.do("OBJECT", "ENCODING", "copy"); got != "int" {
+		t.Errorf("OBJECT ENCODING of the restored copy = %v, want int", got)
+	}
+	if got := c.do("DECR", "copy"); got != -4 {
+		t.Errorf("DECR of the restored copy = %v, want -4", got)
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("RPUSH", "list", "a")
+	runSteps(c, []step{
+		{"SET k v1", "+OK"},
+		{"SET k v2 NX", "(nil)"},
+		{"GET k", "v1"},
+		{"SET k v2 XX", "+OK"},
+		{"SET new v XX", "(nil)"},
+		{"EXISTS new", "0"},
+		{"SET new v NX", "+OK"},
+		{"SET k v3 GET", "v2"},
+		{"SET missing v GET", "(nil)"},
+		{"SET k v4 NX GET", "v3"},
+		{"GET k", "v3"},
+		{"SET fresh v NX GET", "(nil)"},
+		{"GET fresh", "v"},
+		{"SET list v GET", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"LLEN list", "1"},
+		// without GET, SET replaces a value of any type
+		{"SET list v", "+OK"},
+		{"TYPE list", "+string"},
+
+		{"SET k v EX 100", "+OK"},
+		{"TTL k", "100"},
+		{"SET k v PX 100000", "+OK"},
+		{"TTL k", "100"},
+		{"SET k v EXAT 4102444800", "+OK"},
+		{"EXPIRETIME k", "4102444800"},
+		{"SET k v PXAT 4102444800000", "+OK"},
+		{"PEXPIRETIME k", "4102444800000"},
+		{"SET k v2 KEEPTTL", "+OK"},
+		{"EXPIRETIME k", "4102444800"},
+		{"SET k v3", "+OK"},
+		{"TTL k", "-1"},
+		{"SET k v ex 100 ex 200", "+OK"},
+		{"TTL k", "200"},
+		// a deadline that has passed leaves nothing behind
+		{"SET k v PXAT 1", "+OK"},
+		{"GET k", "(nil)"},
+
+		{"SET k v NX XX", "-ERR syntax error"},
+		{"SET k v XX NX", "-ERR syntax error"},
+		{"SET k v EX 10 PX 100", "-ERR syntax error"},
+		{"SET k v EX 10 KEEPTTL", "-ERR syntax error"},
+		{"SET k v KEEPTTL PXAT 100", "-ERR syntax error"},
+		{"SET k v EX", "-ERR syntax error"},
+		{"SET k v FOREVER", "-ERR syntax error"},
+		{"SET k v EX ten", "-ERR value is not an integer or out of range"},
+		{"SET k v EX 0", "-ERR invalid expire time in 'set' command"},
+		{"SET k v PX -5", "-ERR invalid expire time in 'set' command"},
+		{"SET k v EX 9223372036854775807", "-ERR invalid expire time in 'set' command"},
+		{"SET k", "-ERR wrong number of arguments for 'set' command"},
+		{"EXISTS k", "0"},
+	})
+}
+
+func TestSetPropagatesDeadlines(t *testing.T) {
+	master := newTestStore(t)
+	replica := attachReplica(t, master)
+	c := connect(t, master)
+	c.do("SET", "ex", "v", "EX", "100")
+	c.do("SET", "kept", "v", "EX", "100")
+	c.do("SET", "kept", "v2", "KEEPTTL")
+	c.do("SET", "nx", "v", "NX", "PX", "100000")
+	c.do("SET", "nx", "v2", "NX", "PX", "5")
+	if got := c.do("WAIT", "1", "5000"); got != 1 {
+		t.Fatalf("WAIT = %v, want 1", got)
+	}
+	rc := connect(t, replica)
+	for _, key := range []string{"ex", "kept", "nx"} {
+		want := formatReply(c.do("PEXPIRETIME", key)) + " " + formatReply(c.do("GET", key))
+		if got := formatReply(rc.do("PEXPIRETIME", key)) + " " + formatReply(rc.do("GET", key)); got != want {
+			t.Errorf("%s on the replica has deadline and value %s, want %s", key, got, want)
+		}
+	}
+}
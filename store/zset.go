@@ -0,0 +1,1116 @@
+package store
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/siddarthpai/wardrobe/respgo"
+)
+
+// zset is the value of a sorted set key. dict maps members to scores for
+// O(1) lookups, and zsl keeps the same members ordered for ranges and ranks.
+type zset struct {
+	dict *dict[float64]
+	zsl  *skiplist
+}
+
+func newZSet() *zset {
+	return &zset{dict: newDict[float64](), zsl: newSkiplist()}
+}
+
+func (z *zset) len() int {
+	return z.dict.len()
+}
+
+func (z *zset) score(member string) (float64, bool) {
+	return z.dict.get(member)
+}
+
+// set adds member or moves it to score, and reports whether it is new.
+func (z *zset) set(member string, score float64) bool {
+	cur, ok := z.dict.get(member)
+	switch {
+	case !ok:
+		z.zsl.insert(score, member)
+	case cur != score:
+		z.zsl.updateScore(cur, member, score)
+	}
+	return z.dict.set(member, score)
+}
+
+func (z *zset) remove(member string) bool {
+	score, ok := z.dict.get(member)
+	if !ok {
+		return false
+	}
+	z.zsl.delete(score, member)
+	z.dict.delete(member)
+	return true
+}
+
+// rank returns the 0-based rank of member, counted from the highest score
+// when reverse is set.
+func (z *zset) rank(member string, reverse bool) (int, bool) {
+	score, ok := z.dict.get(member)
+	if !ok {
+		return 0, false
+	}
+	r := z.zsl.rank(score, member)
+	if reverse {
+		return z.len() - r, true
+	}
+	return r - 1, true
+}
+
+// step returns the node after n in the given direction.
+func (z *zset) step(n *zslNode, rev bool) *zslNode {
+	if rev {
+		return n.backward
+	}
+	return n.level[0].forward
+}
+
+// rangeByRank returns the nodes between two ranks, inclusive, which may be
+// negative to count from the end, as ZRANGE does.
+func (z *zset) rangeByRank(start, end int64, rev bool) []*zslNode {
+	n := int64(z.len())
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	start = max(start, 0)
+	if start > end || start >= n {
+		return nil
+	}
+	end = min(end, n-1)
+
+	var x *zslNode
+	if rev {
+		x = z.zsl.byRank(int(n - start))
+	} else {
+		x = z.zsl.byRank(int(start + 1))
+	}
+	nodes := make([]*zslNode, 0, end-start+1)
+	for i := start; i <= end && x != nil; i++ {
+		nodes = append(nodes, x)
+		x = z.step(x, rev)
+	}
+	return nodes
+}
+
+// rangeWhere walks from first in the given direction while within holds,
+// skipping offset nodes and returning at most limit, or all if limit is
+// negative. A negative offset returns nothing, as in Redis.
+func (z *zset) rangeWhere(first *zslNode, rev bool, offset, limit int64, within func(*zslNode) bool) []*zslNode {
+	if offset < 0 {
+		return nil
+	}
+	x := first
+	for ; x != nil && offset > 0; offset-- {
+		x = z.step(x, rev)
+	}
+	var nodes []*zslNode
+	for ; x != nil && limit != 0 && within(x); limit-- {
+		nodes = append(nodes, x)
+		x = z.step(x, rev)
+	}
+	return nodes
+}
+
+func (z *zset) rangeByScore(r scoreRange, rev bool, offset, limit int64) []*zslNode {
+	if rev {
+		return z.rangeWhere(z.zsl.lastInScoreRange(r), true, offset, limit, func(n *zslNode) bool {
+			return r.gteMin(n.score)
+		})
+	}
+	return z.rangeWhere(z.zsl.firstInScoreRange(r), false, offset, limit, func(n *zslNode) bool {
+		return r.lteMax(n.score)
+	})
+}
+
+func (z *zset) rangeByLex(r lexRange, rev bool, offset, limit int64) []*zslNode {
+	if rev {
+		return z.rangeWhere(z.zsl.lastInLexRange(r), true, offset, limit, func(n *zslNode) bool {
+			return r.gteMin(n.member)
+		})
+	}
+	return z.rangeWhere(z.zsl.firstInLexRange(r), false, offset, limit, func(n *zslNode) bool {
+		return r.lteMax(n.member)
+	})
+}
+
+// countBetween returns the number of nodes from first to last inclusive.
+func (z *zset) countBetween(first, last *zslNode) int {
+	if first == nil || last == nil {
+		return 0
+	}
+	return z.zsl.rank(last.score, last.member) - z.zsl.rank(first.score, first.member) + 1
+}
+
+// lookupZSet returns the sorted set stored at key, or nil if there is none.
+// ok is false if key holds another type. The caller must hold kv.mu.
+func (kv *KVStore) lookupZSet(key string) (z *zset, ok bool) {
+	return lookupTyped[*zset](kv, key, objZSet)
+}
+
+// zsetForWrite is lookupZSet for commands that add members: a missing
+// sorted set is created. The caller must hold kv.mu.
+func (kv *KVStore) zsetForWrite(key string) (z *zset, ok bool) {
+	z, ok = kv.lookupZSet(key)
+	if ok && z == nil {
+		z = newZSet()
+		kv.storeValue(key, z)
+	}
+	return z, ok
+}
+
+// zsetChanged deletes a sorted set that just lost its last member. The
+// caller must hold kv.mu.
+func (kv *KVStore) zsetChanged(key string, z *zset) {
+	if z.len() == 0 {
+		kv.removeKey(key)
+	}
+}
+
+var (
+	errNotFloat      = respgo.EncodeError("ERR value is not a valid float")
+	errScoreRange    = respgo.EncodeError("ERR min or max is not a float")
+	errLexRange      = respgo.EncodeError("ERR min or max not valid string range item")
+	errScoreNaN      = respgo.EncodeError("ERR resulting score is not a number (NaN)")
+	errNotPositive   = respgo.EncodeError("ERR value is out of range, must be positive")
+	errNumkeysZero   = respgo.EncodeError("ERR numkeys should be greater than 0")
+	errNumkeysTooBig = respgo.EncodeError("ERR Number of keys can't be greater than number of args")
+)
+
+// parseScoreRange parses the min and max of ZRANGEBYSCORE and friends. A
+// bound prefixed with "(" is exclusive.
+func parseScoreRange(minArg, maxArg string) (scoreRange, bool) {
+	var r scoreRange
+	var ok bool
+	minArg, r.minex = strings.CutPrefix(minArg, "(")
+	if r.min, ok = parseRangeDouble(minArg); !ok {
+		return r, false
+	}
+	maxArg, r.maxex = strings.CutPrefix(maxArg, "(")
+	r.max, ok = parseRangeDouble(maxArg)
+	return r, ok
+}
+
+func parseLexBound(s string) (lexBound, bool) {
+	switch {
+	case s == "+":
+		return lexBound{inf: 1}, true
+	case s == "-":
+		return lexBound{inf: -1}, true
+	case strings.HasPrefix(s, "("):
+		return lexBound{value: s[1:], ex: true}, true
+	case strings.HasPrefix(s, "["):
+		return lexBound{value: s[1:]}, true
+	}
+	return lexBound{}, false
+}
+
+// parseLexRange parses the min and max of ZRANGEBYLEX and friends: "-" and
+// "+" for the extremes, or a member prefixed with "[" or "(".
+func parseLexRange(minArg, maxArg string) (lexRange, bool) {
+	lo, ok := parseLexBound(minArg)
+	if !ok {
+		return lexRange{}, false
+	}
+	hi, ok := parseLexBound(maxArg)
+	return lexRange{min: lo, max: hi}, ok
+}
+
+// zsetReply encodes nodes as a flat array of members, each followed by its
+// score when withScores is set.
+func zsetReply(nodes []*zslNode, withScores bool) []byte {
+	out := make([]string, 0, len(nodes)*2)
+	for _, n := range nodes {
+		out = append(out, n.member)
+		if withScores {
+			out = append(out, formatDouble(n.score))
+		}
+	}
+	return respgo.EncodeArray(out)
+}
+
+func (kv *KVStore) zaddCommand(args []string) []byte {
+	var nx, xx, gt, lt, ch, incr bool
+	i := 2
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break flags
+		}
+	}
+	if len(args) < 4 {
+		return wrongArgs("zadd")
+	}
+	elements := len(args) - i
+	if elements == 0 || elements%2 != 0 {
+		return errSyntax
+	}
+	if nx && xx {
+		return respgo.EncodeError("ERR XX and NX options at the same time are not compatible")
+	}
+	if (gt && nx) || (lt && nx) || (gt && lt) {
+		return respgo.EncodeError("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && elements > 2 {
+		return respgo.EncodeError("ERR INCR option supports a single increment-element pair")
+	}
+	scores := make([]float64, 0, elements/2)
+	for j := i; j < len(args); j += 2 {
+		score, ok := parseDouble(args[j])
+		if !ok {
+			return errNotFloat
+		}
+		scores = append(scores, score)
+	}
+
+	key := args[1]
+	z, ok := kv.lookupZSet(key)
+	if !ok {
+		return errWrongType
+	}
+	if z == nil {
+		if xx {
+			if incr {
+				return nilBulk
+			}
+			return respgo.EncodeInteger(0)
+		}
+		z, _ = kv.zsetForWrite(key)
+	}
+
+	added, updated := 0, 0
+	skipped := false
+	var result float64
+	for n, score := range scores {
+		member := args[i+2*n+1]
+		cur, exists := z.score(member)
+		if !exists {
+			if xx {
+				skipped = true
+				continue
+			}
+			z.set(member, score)
+			added++
+			result = score
+			continue
+		}
+		if nx {
+			skipped = true
+			continue
+		}
+		if incr {
+			score += cur
+			if math.IsNaN(score) {
+				kv.zsetChanged(key, z)
+				return errScoreNaN
+			}
+		}
+		if (gt && score <= cur) || (lt && score >= cur) {
+			skipped = true
+			continue
+		}
+		result = score
+		if score != cur {
+			z.set(member, score)
+			updated++
+		}
+	}
+	kv.zsetChanged(key, z)
+	kv.dirty += added + updated
+
+	if incr {
+		if skipped {
+			return nilBulk
+		}
+		return respgo.EncodeBulkString(formatDouble(result))
+	}
+	if ch {
+		return respgo.EncodeInteger(added + updated)
+	}
+	return respgo.EncodeInteger(added)
+}
+
+func (kv *KVStore) zincrbyCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs("zincrby")
+	}
+	incr, ok := parseDouble(args[2])
+	if !ok {
+		return errNotFloat
+	}
+	z, ok := kv.zsetForWrite(args[1])
+	if !ok {
+		return errWrongType
+	}
+	cur, _ := z.score(args[3])
+	score := cur + incr
+	if math.IsNaN(score) {
+		kv.zsetChanged(args[1], z)
+		return errScoreNaN
+	}
+	z.set(args[3], score)
+	kv.dirty++
+	return respgo.EncodeBulkString(formatDouble(score))
+}
+
+func (kv *KVStore) zremCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("zrem")
+	}
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if z == nil {
+		return respgo.EncodeInteger(0)
+	}
+	removed := 0
+	for _, member := range args[2:] {
+		if z.remove(member) {
+			removed++
+		}
+	}
+	kv.zsetChanged(args[1], z)
+	kv.dirty += removed
+	return respgo.EncodeInteger(removed)
+}
+
+func (kv *KVStore) zcardCommand(args []string) []byte {
+	if len(args) != 2 {
+		return wrongArgs("zcard")
+	}
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if z == nil {
+		return respgo.EncodeInteger(0)
+	}
+	return respgo.EncodeInteger(z.len())
+}
+
+func (kv *KVStore) zscoreCommand(args []string) []byte {
+	if len(args) != 3 {
+		return wrongArgs("zscore")
+	}
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if z == nil {
+		return nilBulk
+	}
+	score, found := z.score(args[2])
+	if !found {
+		return nilBulk
+	}
+	return respgo.EncodeBulkString(formatDouble(score))
+}
+
+func (kv *KVStore) zmscoreCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("zmscore")
+	}
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	frames := make([][]byte, 0, len(args)-2)
+	for _, member := range args[2:] {
+		var score float64
+		found := false
+		if z != nil {
+			score, found = z.score(member)
+		}
+		if found {
+			frames = append(frames, respgo.EncodeBulkString(formatDouble(score)))
+		} else {
+			frames = append(frames, nilBulk)
+		}
+	}
+	return respgo.EncodeRawArray(frames...)
+}
+
+// zrankCommand implements ZRANK and ZREVRANK.
+func (kv *KVStore) zrankCommand(args []string, reverse bool) []byte {
+	name := strings.ToLower(args[0])
+	if len(args) < 3 || len(args) > 4 {
+		return wrongArgs(name)
+	}
+	withScore := false
+	if len(args) == 4 {
+		if strings.ToUpper(args[3]) != "WITHSCORE" {
+			return errSyntax
+		}
+		withScore = true
+	}
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	var rank int
+	found := false
+	if z != nil {
+		rank, found = z.rank(args[2], reverse)
+	}
+	switch {
+	case !found && withScore:
+		return nilArray
+	case !found:
+		return nilBulk
+	case withScore:
+		score, _ := z.score(args[2])
+		return respgo.EncodeRawArray(
+			respgo.EncodeInteger(rank),
+			respgo.EncodeBulkString(formatDouble(score)),
+		)
+	}
+	return respgo.EncodeInteger(rank)
+}
+
+func (kv *KVStore) zcountCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs("zcount")
+	}
+	r, ok := parseScoreRange(args[2], args[3])
+	if !ok {
+		return errScoreRange
+	}
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if z == nil {
+		return respgo.EncodeInteger(0)
+	}
+	return respgo.EncodeInteger(z.countBetween(z.zsl.firstInScoreRange(r), z.zsl.lastInScoreRange(r)))
+}
+
+func (kv *KVStore) zlexcountCommand(args []string) []byte {
+	if len(args) != 4 {
+		return wrongArgs("zlexcount")
+	}
+	r, ok := parseLexRange(args[2], args[3])
+	if !ok {
+		return errLexRange
+	}
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if z == nil {
+		return respgo.EncodeInteger(0)
+	}
+	return respgo.EncodeInteger(z.countBetween(z.zsl.firstInLexRange(r), z.zsl.lastInLexRange(r)))
+}
+
+type zrangeKind int
+
+const (
+	zrangeByRank zrangeKind = iota
+	zrangeByScore
+	zrangeByLex
+)
+
+// zrangeCommand implements ZRANGE and ZRANGESTORE, and the older
+// ZREVRANGE, ZRANGEBYSCORE, ZREVRANGEBYSCORE, ZRANGEBYLEX and
+// ZREVRANGEBYLEX, which are ZRANGE with kind and rev fixed. store is set for
+// ZRANGESTORE, whose destination comes before the source key.
+func (kv *KVStore) zrangeCommand(args []string, kind zrangeKind, rev, store bool) []byte {
+	name := strings.ToLower(args[0])
+	first := 1
+	if store {
+		first = 2
+	}
+	if len(args) < first+3 {
+		return wrongArgs(name)
+	}
+	// only ZRANGE and ZRANGESTORE take BYSCORE, BYLEX and REV
+	modern := name == "zrange" || name == "zrangestore"
+	withScores, limited := false, false
+	offset, limit := int64(0), int64(-1)
+	for j := first + 3; j < len(args); j++ {
+		switch opt := strings.ToUpper(args[j]); {
+		case opt == "WITHSCORES" && !store:
+			withScores = true
+		case opt == "LIMIT" && j+2 < len(args):
+			var ok1, ok2 bool
+			offset, ok1 = parseInt(args[j+1])
+			limit, ok2 = parseInt(args[j+2])
+			if !ok1 || !ok2 {
+				return errNotInteger
+			}
+			limited = true
+			j += 2
+		case opt == "BYSCORE" && modern && kind == zrangeByRank:
+			kind = zrangeByScore
+		case opt == "BYLEX" && modern && kind == zrangeByRank:
+			kind = zrangeByLex
+		case opt == "REV" && modern && !rev:
+			rev = true
+		default:
+			return errSyntax
+		}
+	}
+	if limited && kind == zrangeByRank {
+		return respgo.EncodeError("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if withScores && kind == zrangeByLex {
+		return respgo.EncodeError("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	src := args[first]
+	minArg, maxArg := args[first+1], args[first+2]
+	if rev && kind != zrangeByRank {
+		// reversed score and lex ranges are given as max then min
+		minArg, maxArg = maxArg, minArg
+	}
+	var collect func(z *zset) []*zslNode
+	switch kind {
+	case zrangeByRank:
+		start, ok1 := parseInt(minArg)
+		end, ok2 := parseInt(maxArg)
+		if !ok1 || !ok2 {
+			return errNotInteger
+		}
+		collect = func(z *zset) []*zslNode { return z.rangeByRank(start, end, rev) }
+	case zrangeByScore:
+		r, ok := parseScoreRange(minArg, maxArg)
+		if !ok {
+			return errScoreRange
+		}
+		collect = func(z *zset) []*zslNode { return z.rangeByScore(r, rev, offset, limit) }
+	case zrangeByLex:
+		r, ok := parseLexRange(minArg, maxArg)
+		if !ok {
+			return errLexRange
+		}
+		collect = func(z *zset) []*zslNode { return z.rangeByLex(r, rev, offset, limit) }
+	}
+
+	z, ok := kv.lookupZSet(src)
+	if !ok {
+		return errWrongType
+	}
+	var nodes []*zslNode
+	if z != nil {
+		nodes = collect(z)
+	}
+	if !store {
+		return zsetReply(nodes, withScores)
+	}
+
+	result := newZSet()
+	for _, n := range nodes {
+		result.set(n.member, n.score)
+	}
+	kv.storeZSet(args[1], result)
+	return respgo.EncodeInteger(result.len())
+}
+
+// storeZSet replaces whatever dst holds with z, or deletes dst if z is
+// empty, as the sorted set commands with a destination do. The caller must
+// hold kv.mu.
+func (kv *KVStore) storeZSet(dst string, z *zset) {
+	if kv.removeKey(dst) {
+		kv.dirty++
+	}
+	if z.len() > 0 {
+		kv.storeValue(dst, z)
+		kv.dirty++
+	}
+}
+
+// zremrangeCommand implements ZREMRANGEBYRANK, ZREMRANGEBYSCORE and
+// ZREMRANGEBYLEX.
+func (kv *KVStore) zremrangeCommand(args []string, kind zrangeKind) []byte {
+	name := strings.ToLower(args[0])
+	if len(args) != 4 {
+		return wrongArgs(name)
+	}
+	var remove func(z *zset) []string
+	switch kind {
+	case zrangeByRank:
+		start, ok1 := parseInt(args[2])
+		end, ok2 := parseInt(args[3])
+		if !ok1 || !ok2 {
+			return errNotInteger
+		}
+		remove = func(z *zset) []string {
+			n := int64(z.len())
+			if start < 0 {
+				start += n
+			}
+			if end < 0 {
+				end += n
+			}
+			start = max(start, 0)
+			if start > end || start >= n {
+				return nil
+			}
+			end = min(end, n-1)
+			return z.zsl.deleteRangeByRank(int(start+1), int(end+1))
+		}
+	case zrangeByScore:
+		r, ok := parseScoreRange(args[2], args[3])
+		if !ok {
+			return errScoreRange
+		}
+		remove = func(z *zset) []string { return z.zsl.deleteRangeByScore(r) }
+	case zrangeByLex:
+		r, ok := parseLexRange(args[2], args[3])
+		if !ok {
+			return errLexRange
+		}
+		remove = func(z *zset) []string { return z.zsl.deleteRangeByLex(r) }
+	}
+
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if z == nil {
+		return respgo.EncodeInteger(0)
+	}
+	removed := remove(z)
+	for _, member := range removed {
+		z.dict.delete(member)
+	}
+	kv.zsetChanged(args[1], z)
+	kv.dirty += len(removed)
+	return respgo.EncodeInteger(len(removed))
+}
+
+// zpop removes up to count members from the lowest end of z, or the highest
+// when max is set, and returns them as member, score pairs.
+func (kv *KVStore) zpop(key string, z *zset, count int64, max bool) []string {
+	var out []string
+	for ; count > 0 && z.len() > 0; count-- {
+		n := z.zsl.header.level[0].forward
+		if max {
+			n = z.zsl.tail
+		}
+		out = append(out, n.member, formatDouble(n.score))
+		z.remove(n.member)
+		kv.dirty++
+	}
+	kv.zsetChanged(key, z)
+	return out
+}
+
+// zpopCommand implements ZPOPMIN and ZPOPMAX.
+func (kv *KVStore) zpopCommand(args []string, max bool) []byte {
+	name := strings.ToLower(args[0])
+	if len(args) < 2 {
+		return wrongArgs(name)
+	}
+	if len(args) > 3 {
+		return errSyntax
+	}
+	count := int64(1)
+	if len(args) == 3 {
+		var ok bool
+		if count, ok = parseInt(args[2]); !ok {
+			return errNotInteger
+		}
+		if count < 0 {
+			return errNotPositive
+		}
+	}
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if z == nil {
+		return respgo.EncodeArray(nil)
+	}
+	return respgo.EncodeArray(kv.zpop(args[1], z, count, max))
+}
+
+func (kv *KVStore) zmpopCommand(args []string) []byte {
+	if len(args) < 4 {
+		return wrongArgs("zmpop")
+	}
+	numkeys, ok := parseInt(args[1])
+	if !ok {
+		return errNotInteger
+	}
+	if numkeys <= 0 {
+		return errNumkeysZero
+	}
+	if numkeys > int64(len(args)-2) {
+		return errNumkeysTooBig
+	}
+	keys := args[2 : 2+numkeys]
+	rest := args[2+numkeys:]
+	if len(rest) == 0 {
+		return errSyntax
+	}
+	var popMax bool
+	switch strings.ToUpper(rest[0]) {
+	case "MIN":
+	case "MAX":
+		popMax = true
+	default:
+		return errSyntax
+	}
+	count := int64(1)
+	switch {
+	case len(rest) == 1:
+	case len(rest) == 3 && strings.ToUpper(rest[1]) == "COUNT":
+		if count, ok = parseInt(rest[2]); !ok {
+			return errNotInteger
+		}
+		if count <= 0 {
+			return respgo.EncodeError("ERR count should be greater than 0")
+		}
+	default:
+		return errSyntax
+	}
+
+	for _, key := range keys {
+		z, ok := kv.lookupZSet(key)
+		if !ok {
+			return errWrongType
+		}
+		if z == nil {
+			continue
+		}
+		popped := kv.zpop(key, z, count, popMax)
+		pairs := make([][]byte, 0, len(popped)/2)
+		for i := 0; i < len(popped); i += 2 {
+			pairs = append(pairs, respgo.EncodeArray(popped[i:i+2]))
+		}
+		cmd := "ZPOPMIN"
+		if popMax {
+			cmd = "ZPOPMAX"
+		}
+		kv.rewriteCommand(cmd, key, strconv.Itoa(len(pairs)))
+		return respgo.EncodeRawArray(respgo.EncodeBulkString(key), respgo.EncodeRawArray(pairs...))
+	}
+	return nilArray
+}
+
+func (kv *KVStore) zrandmemberCommand(args []string) []byte {
+	if len(args) < 2 || len(args) > 4 {
+		return wrongArgs("zrandmember")
+	}
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if len(args) == 2 {
+		if z == nil {
+			return nilBulk
+		}
+		member, _ := z.dict.random()
+		return respgo.EncodeBulkString(member)
+	}
+
+	count, ok := parseInt(args[2])
+	if !ok {
+		return errNotInteger
+	}
+	withScores := false
+	if len(args) == 4 {
+		if strings.ToUpper(args[3]) != "WITHSCORES" {
+			return errSyntax
+		}
+		withScores = true
+	}
+	if count == math.MinInt64 || (withScores && count < -math.MaxInt64/2) {
+		return respgo.EncodeError("ERR value is out of range")
+	}
+	if z == nil || count == 0 {
+		return respgo.EncodeArray(nil)
+	}
+
+	var out []string
+	z.dict.sample(count, func(member string, score float64) {
+		out = append(out, member)
+		if withScores {
+			out = append(out, formatDouble(score))
+		}
+	})
+	return respgo.EncodeArray(out)
+}
+
+func (kv *KVStore) zscanCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("zscan")
+	}
+	cursor, opts, errReply := parseScanArgs(args[2:], false, false)
+	if errReply != nil {
+		return errReply
+	}
+	z, ok := kv.lookupZSet(args[1])
+	if !ok {
+		return errWrongType
+	}
+	if z == nil {
+		return scanReply(0, nil)
+	}
+	var out []string
+	cursor = z.dict.scan(cursor, opts.count, func(member string, score float64) {
+		if opts.matches(member) {
+			out = append(out, member, formatDouble(score))
+		}
+	})
+	return scanReply(cursor, out)
+}
+
+// zsetSource is an input of the sorted set algebra commands. Plain sets are
+// accepted too, with every member scoring 1.
+type zsetSource struct {
+	key    string
+	size   int
+	weight float64
+	score  func(member string) (float64, bool)
+	each   func(fn func(member string, score float64))
+}
+
+// lookupZSetSource returns key as a zsetSource. ok is false if key holds
+// neither a sorted set nor a set. The caller must hold kv.mu.
+func (kv *KVStore) lookupZSetSource(key string) (src zsetSource, ok bool) {
+	src = zsetSource{
+		key:    key,
+		weight: 1,
+		score:  func(string) (float64, bool) { return 0, false },
+		each:   func(func(string, float64)) {},
+	}
+	o := kv.lookupObject(key)
+	switch {
+	case o == nil:
+		return src, true
+	case o.typ == objZSet:
+		z := o.ptr.(*zset)
+		src.size = z.len()
+		src.score = z.score
+		src.each = func(fn func(string, float64)) {
+			for x := z.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+				fn(x.member, x.score)
+			}
+		}
+		return src, true
+	case o.typ == objSet:
+		s := o.ptr.(*set)
+		src.size = s.len()
+		src.score = func(member string) (float64, bool) {
+			return 1, s.contains(member)
+		}
+		src.each = func(fn func(string, float64)) {
+			s.each(func(member string) bool {
+				fn(member, 1)
+				return true
+			})
+		}
+		return src, true
+	}
+	return src, false
+}
+
+// zaggregate combines two scores of the same member as AGGREGATE says.
+func zaggregate(aggregate string, a, b float64) float64 {
+	switch aggregate {
+	case "MIN":
+		return min(a, b)
+	case "MAX":
+		return max(a, b)
+	}
+	if sum := a + b; !math.IsNaN(sum) {
+		return sum
+	}
+	// inf + -inf
+	return 0
+}
+
+// zweighted scales a score by a source's weight, mapping the NaN of 0 * inf
+// to 0 as Redis does.
+func zweighted(score, weight float64) float64 {
+	if v := score * weight; !math.IsNaN(v) {
+		return v
+	}
+	return 0
+}
+
+// zsetOpCommand implements ZUNION, ZINTER and ZDIFF along with their STORE
+// variants. op is "union", "inter" or "diff".
+func (kv *KVStore) zsetOpCommand(args []string, op string, store bool) []byte {
+	name := strings.ToLower(args[0])
+	numkeysAt := 1
+	if store {
+		numkeysAt = 2
+	}
+	if len(args) < numkeysAt+2 {
+		return wrongArgs(name)
+	}
+	numkeys, ok := parseInt(args[numkeysAt])
+	if !ok {
+		return errNotInteger
+	}
+	if numkeys < 1 {
+		return respgo.EncodeError("ERR at least 1 input key is needed for '" + name + "' command")
+	}
+	if numkeys > int64(len(args)-numkeysAt-1) {
+		return errSyntax
+	}
+	keys := args[numkeysAt+1 : numkeysAt+1+int(numkeys)]
+
+	weights := make([]float64, len(keys))
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := "SUM"
+	withScores := false
+	for j := numkeysAt + 1 + len(keys); j < len(args); j++ {
+		remaining := len(args) - j - 1
+		switch opt := strings.ToUpper(args[j]); {
+		case opt == "WEIGHTS" && op != "diff" && remaining >= len(keys):
+			for i := range weights {
+				j++
+				if weights[i], ok = parseDouble(args[j]); !ok {
+					return respgo.EncodeError("ERR weight value is not a float")
+				}
+			}
+		case opt == "AGGREGATE" && op != "diff" && remaining >= 1:
+			j++
+			aggregate = strings.ToUpper(args[j])
+			if aggregate != "SUM" && aggregate != "MIN" && aggregate != "MAX" {
+				return errSyntax
+			}
+		case opt == "WITHSCORES" && !store:
+			withScores = true
+		default:
+			return errSyntax
+		}
+	}
+
+	srcs := make([]zsetSource, len(keys))
+	for i, key := range keys {
+		if srcs[i], ok = kv.lookupZSetSource(key); !ok {
+			return errWrongType
+		}
+		srcs[i].weight = weights[i]
+	}
+
+	acc := newDict[float64]()
+	switch op {
+	case "union":
+		for _, src := range srcs {
+			src.each(func(member string, score float64) {
+				score = zweighted(score, src.weight)
+				if cur, ok := acc.get(member); ok {
+					score = zaggregate(aggregate, cur, score)
+				}
+				acc.set(member, score)
+			})
+		}
+	case "inter":
+		// walk the smallest input and probe the others
+		slices.SortStableFunc(srcs, func(a, b zsetSource) int { return a.size - b.size })
+		srcs[0].each(func(member string, score float64) {
+			score = zweighted(score, srcs[0].weight)
+			for _, other := range srcs[1:] {
+				s, ok := other.score(member)
+				if !ok {
+					return
+				}
+				score = zaggregate(aggregate, score, zweighted(s, other.weight))
+			}
+			acc.set(member, score)
+		})
+	case "diff":
+		srcs[0].each(func(member string, score float64) {
+			for _, other := range srcs[1:] {
+				if _, ok := other.score(member); ok {
+					return
+				}
+			}
+			acc.set(member, score)
+		})
+	}
+
+	result := newZSet()
+	acc.each(func(member string, score float64) bool {
+		result.set(member, score)
+		return true
+	})
+	if store {
+		kv.storeZSet(args[1], result)
+		return respgo.EncodeInteger(result.len())
+	}
+	return zsetReply(result.rangeByRank(0, -1, false), withScores)
+}
+
+func (kv *KVStore) zintercardCommand(args []string) []byte {
+	if len(args) < 3 {
+		return wrongArgs("zintercard")
+	}
+	numkeys, ok := parseInt(args[1])
+	if !ok {
+		return errNotInteger
+	}
+	if numkeys <= 0 {
+		return errNumkeysZero
+	}
+	if numkeys > int64(len(args)-2) {
+		return errNumkeysTooBig
+	}
+	keys := args[2 : 2+numkeys]
+	limit := int64(0)
+	switch rest := args[2+numkeys:]; {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.ToUpper(rest[0]) == "LIMIT":
+		if limit, ok = parseInt(rest[1]); !ok {
+			return errNotInteger
+		}
+		if limit < 0 {
+			return respgo.EncodeError("ERR LIMIT can't be negative")
+		}
+	default:
+		return errSyntax
+	}
+
+	srcs := make([]zsetSource, len(keys))
+	for i, key := range keys {
+		if srcs[i], ok = kv.lookupZSetSource(key); !ok {
+			return errWrongType
+		}
+	}
+	slices.SortStableFunc(srcs, func(a, b zsetSource) int { return a.size - b.size })
+	count := int64(0)
+	srcs[0].each(func(member string, _ float64) {
+		if limit > 0 && count >= limit {
+			return
+		}
+		for _, other := range srcs[1:] {
+			if _, ok := other.score(member); !ok {
+				return
+			}
+		}
+		count++
+	})
+	return respgo.EncodeInteger(int(count))
+}
@@ -0,0 +1,266 @@
+package store
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// checkSkiplist checks zsl against want, the members it should hold in
+// order: links, backward pointers, spans, ranks and rank lookups.
+func checkSkiplist(t *testing.T, zsl *skiplist, want []*zslNode) {
+	t.Helper()
+	if zsl.length != len(want) {
+		t.Fatalf("length = %d, want %d", zsl.length, len(want))
+	}
+	var prev *zslNode
+	n := zsl.header.level[0].forward
+	for i, w := range want {
+		if n == nil || n.member != w.member || n.score != w.score {
+			t.Fatalf("node %d = %v, want %s at %v", i, n, w.member, w.score)
+		}
+		if n.backward != prev {
+			t.Fatalf("node %s has the wrong backward link", n.member)
+		}
+		if r := zsl.rank(n.score, n.member); r != i+1 {
+			t.Fatalf("rank(%s) = %d, want %d", n.member, r, i+1)
+		}
+		if got := zsl.byRank(i + 1); got != n {
+			t.Fatalf("byRank(%d) = %v, want %s", i+1, got, n.member)
+		}
+		prev, n = n, n.level[0].forward
+	}
+	if n != nil || zsl.tail != prev {
+		t.Fatal("the list does not end at its tail")
+	}
+	// every span is the number of level 0 steps its link skips
+	pos := make(map[*zslNode]int)
+	for i, x := 1, zsl.header.level[0].forward; x != nil; i, x = i+1, x.level[0].forward {
+		pos[x] = i
+	}
+	for level := 0; level < zsl.level; level++ {
+		for x := zsl.header; x.level[level].forward != nil; x = x.level[level].forward {
+			if span := pos[x.level[level].forward] - pos[x]; x.level[level].span != span {
+				t.Fatalf("span at level %d after %v = %d, want %d", level, x.member, x.level[level].span, span)
+			}
+		}
+	}
+	if r := zsl.rank(-1, "missing"); r != 0 {
+		t.Errorf("rank of a missing member = %d, want 0", r)
+	}
+}
+
+func TestSkiplistRanks(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	zsl := newSkiplist()
+	scores := make(map[string]float64)
+	sorted := func() []*zslNode {
+		var out []*zslNode
+		for m, s := range scores {
+			out = append(out, &zslNode{member: m, score: s})
+		}
+		slices.SortFunc(out, func(a, b *zslNode) int {
+			return cmp.Or(cmp.Compare(a.score, b.score), cmp.Compare(a.member, b.member))
+		})
+		return out
+	}
+	for i := range 2000 {
+		m := "m" + strconv.Itoa(rng.IntN(500))
+		s := float64(rng.IntN(50))
+		cur, ok := scores[m]
+		switch {
+		case !ok:
+			zsl.insert(s, m)
+			scores[m] = s
+		case i%3 == 0:
+			if !zsl.delete(cur, m) {
+				t.Fatalf("delete(%s) found nothing", m)
+			}
+			delete(scores, m)
+		default:
+			zsl.updateScore(cur, m, s)
+			scores[m] = s
+		}
+		if i%250 == 0 {
+			checkSkiplist(t, zsl, sorted())
+		}
+	}
+	checkSkiplist(t, zsl, sorted())
+
+	want := sorted()
+	removed := zsl.deleteRangeByRank(10, 19)
+	if len(removed) != 10 || removed[0] != want[9].member || removed[9] != want[18].member {
+		t.Fatalf("deleteRangeByRank(10, 19) = %v", removed)
+	}
+	checkSkiplist(t, zsl, append(want[:9:9], want[19:]...))
+}
+
+func TestSortedSetCommands(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("SET", "str", "v")
+	runSteps(c, []step{
+		{"ZADD z 1 a 2 b 3 c", "3"},
+		{"ZADD z 1 a 5 d", "1"},
+		{"ZCARD z", "4"},
+		{"ZCARD nozset", "0"},
+		{"ZSCORE z d", "5"},
+		{"ZSCORE z missing", "(nil)"},
+		{"ZMSCORE z a missing c", "[1 (nil) 3]"},
+
+		{"ZADD z NX 10 a 6 e", "1"},
+		{"ZADD z XX 4 d 7 f", "0"},
+		{"ZADD z XX CH 4.5 d 7 f", "1"},
+		{"ZADD z GT CH 1 b 3 b", "1"},
+		{"ZADD z LT CH 9 b 2 b", "1"},
+		{"ZSCORE z b", "2"},
+		{"ZADD z INCR 10 a", "11"},
+		{"ZADD z NX INCR 10 a", "(nil)"},
+		{"ZADD z GT INCR -1 a", "(nil)"},
+		{"ZADD nozset XX 1 a", "0"},
+		{"ZADD nozset XX INCR 1 a", "(nil)"},
+		{"EXISTS nozset", "0"},
+		{"ZINCRBY z -11 a", "0"},
+		{"ZINCRBY z 2.5 new", "2.5"},
+		{"ZADD z +inf top -inf bottom", "2"},
+
+		{"ZRANGE z 0 -1", "[bottom a b new c d e top]"},
+		{"ZRANGE z 0 -1 WITHSCORES", "[bottom -inf a 0 b 2 new 2.5 c 3 d 4.5 e 6 top inf]"},
+		{"ZRANGE z -2 -1", "[e top]"},
+		{"ZRANGE z 5 100", "[d e top]"},
+		{"ZRANGE z 3 1", "[]"},
+		{"ZREVRANGE z 0 2", "[top e d]"},
+		{"ZRANGE z 0 1 REV", "[top e]"},
+		{"ZRANK z bottom", "0"},
+		{"ZRANK z c", "4"},
+		{"ZREVRANK z c", "3"},
+		{"ZRANK z c WITHSCORE", "[4 3]"},
+		{"ZRANK z missing", "(nil)"},
+		{"ZRANK z missing WITHSCORE", "(nil)"},
+
+		{"ZRANGEBYSCORE z 2 4.5", "[b new c d]"},
+		{"ZRANGEBYSCORE z (2 (4.5", "[new c]"},
+		{"ZRANGEBYSCORE z -inf 0 WITHSCORES", "[bottom -inf a 0]"},
+		{"ZRANGEBYSCORE z 0 +inf LIMIT 1 2", "[b new]"},
+		{"ZREVRANGEBYSCORE z 4.5 (2", "[d c new]"},
+		{"ZRANGE z (3 +inf BYSCORE LIMIT 0 2", "[d e]"},
+		{"ZRANGE z +inf (3 BYSCORE REV LIMIT 1 -1", "[e d]"},
+		{"ZCOUNT z (0 3", "3"},
+		{"ZCOUNT z 7 6", "0"},
+		{"ZRANGEBYSCORE z 1 x", "-ERR min or max is not a float"},
+
+		{"ZADD lex 0 a 0 b 0 c 0 d 0 e", "5"},
+		{"ZRANGEBYLEX lex [b (d", "[b c]"},
+		{"ZRANGEBYLEX lex - +", "[a b c d e]"},
+		{"ZRANGEBYLEX lex (c + LIMIT 0 1", "[d]"},
+		{"ZREVRANGEBYLEX lex + [c", "[e d c]"},
+		{"ZRANGE lex [b [d BYLEX", "[b c d]"},
+		{"ZLEXCOUNT lex (a [c", "2"},
+		{"ZRANGEBYLEX lex b d", "-ERR min or max not valid string range item"},
+
+		{"ZRANGE z 0 1 LIMIT 0 1", "-ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"},
+		{"ZRANGE lex - + BYLEX WITHSCORES", "-ERR syntax error, WITHSCORES not supported in combination with BYLEX"},
+		{"ZRANGEBYSCORE z 0 1 REV", "-ERR syntax error"},
+		{"ZADD z NX XX 1 a", "-ERR XX and NX options at the same time are not compatible"},
+		{"ZADD z GT LT 1 a", "-ERR GT, LT, and/or NX options at the same time are not compatible"},
+		{"ZADD z INCR 1 a 2 b", "-ERR INCR option supports a single increment-element pair"},
+		{"ZADD z 1 a 2", "-ERR syntax error"},
+		{"ZADD z one a", "-ERR value is not a valid float"},
+		{"ZADD str 1 a", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"ZRANGE str 0 -1", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+
+		{"ZREM z a missing", "1"},
+		{"ZREMRANGEBYRANK z 0 0", "1"},
+		{"ZREMRANGEBYSCORE z (6 +inf", "1"},
+		{"ZRANGE z 0 -1", "[b new c d e]"},
+		{"ZREMRANGEBYLEX lex [b (d", "2"},
+		{"ZRANGE lex 0 -1", "[a d e]"},
+		{"ZREMRANGEBYRANK lex 0 -1", "3"},
+		{"EXISTS lex", "0"},
+
+		{"ZPOPMIN z", "[b 2]"},
+		{"ZPOPMAX z 2", "[e 6 d 4.5]"},
+		{"ZPOPMIN z 0", "[]"},
+		{"ZPOPMIN z -1", "-ERR value is out of range, must be positive"},
+		{"ZADD y 1 x", "1"},
+		{"ZMPOP 3 nozset z y MIN COUNT 5", "[z [[new 2.5] [c 3]]]"},
+		{"ZMPOP 1 z MAX", "(nil)"},
+		{"EXISTS z", "0"},
+		{"ZMPOP 2 z y MAX", "[y [[x 1]]]"},
+		{"ZMPOP 0 z MIN", "-ERR numkeys should be greater than 0"},
+		{"ZMPOP 1 z SIDEWAYS", "-ERR syntax error"},
+	})
+}
+
+func TestSortedSetAlgebra(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("ZADD", "a", "1", "x", "2", "y", "3", "z")
+	c.do("ZADD", "b", "10", "y", "20", "z", "30", "w")
+	c.do("SADD", "s", "x", "w")
+	runSteps(c, []step{
+		{"ZUNION 2 a b WITHSCORES", "[x 1 y 12 z 23 w 30]"},
+		{"ZUNION 2 a b WEIGHTS 2 1 AGGREGATE MAX WITHSCORES", "[x 2 y 10 z 20 w 30]"},
+		{"ZINTER 2 a b AGGREGATE MIN WITHSCORES", "[y 2 z 3]"},
+		{"ZINTER 2 a nozset", "[]"},
+		{"ZDIFF 2 a b WITHSCORES", "[x 1]"},
+		// sets take part with a score of 1
+		{"ZINTER 2 a s WITHSCORES", "[x 2]"},
+		{"ZUNIONSTORE dst 2 a b", "4"},
+		{"ZRANGE dst 0 -1 WITHSCORES", "[x 1 y 12 z 23 w 30]"},
+		{"ZINTERSTORE dst 2 a b WEIGHTS 1 0", "2"},
+		{"ZRANGE dst 0 -1 WITHSCORES", "[y 2 z 3]"},
+		{"ZDIFFSTORE dst 2 b a", "1"},
+		{"ZRANGE dst 0 -1", "[w]"},
+		{"ZINTERSTORE dst 2 a nozset", "0"},
+		{"EXISTS dst", "0"},
+		{"ZINTERCARD 2 a b", "2"},
+		{"ZINTERCARD 2 a b LIMIT 1", "1"},
+		{"ZINTERCARD 2 a b LIMIT -1", "-ERR LIMIT can't be negative"},
+		{"ZRANGESTORE dst a 1 -1", "2"},
+		{"ZRANGE dst 0 -1", "[y z]"},
+		{"ZRANGESTORE dst a (1 3 BYSCORE LIMIT 0 1", "1"},
+		{"ZRANGE dst 0 -1", "[y]"},
+		{"ZUNION 0 a", "-ERR at least 1 input key is needed for 'zunion' command"},
+		{"ZUNION 2 a b WEIGHTS 1", "-ERR syntax error"},
+		{"ZUNION 2 a b WEIGHTS 1 x", "-ERR weight value is not a float"},
+		{"ZUNION 2 a b AGGREGATE AVG", "-ERR syntax error"},
+	})
+}
+
+func TestSortedSetRandomMembersAndScan(t *testing.T) {
+	kv := newTestStore(t)
+	c := connect(t, kv)
+	c.do("ZADD", "z", "1", "a", "2", "b", "3", "c")
+	runSteps(c, []step{
+		{"ZRANDMEMBER nozset", "(nil)"},
+		{"ZRANDMEMBER z 0", "[]"},
+		{"ZRANDMEMBER z x", "-ERR value is not an integer or out of range"},
+		{"ZSCAN z 0", "[0 [c 3 b 2 a 1]]"},
+		{"ZSCAN z 0 MATCH a*", "[0 [a 1]]"},
+	})
+	for _, tc := range []struct {
+		count    string
+		n        int
+		distinct bool
+	}{{"2", 2, true}, {"5", 3, true}, {"-5", 5, false}} {
+		reply, ok := c.do("ZRANDMEMBER", "z", tc.count, "WITHSCORES").([]any)
+		if !ok || len(reply) != 2*tc.n {
+			t.Errorf("ZRANDMEMBER z %s WITHSCORES = %v, want %d members with scores", tc.count, reply, tc.n)
+			continue
+		}
+		seen := make(map[any]bool)
+		for i := 0; i < len(reply); i += 2 {
+			member, score := reply[i].(string), reply[i+1]
+			if want := strconv.Itoa(int(member[0]-'a') + 1); score != want {
+				t.Errorf("ZRANDMEMBER z %s paired %s with %v", tc.count, member, score)
+			}
+			if tc.distinct && seen[member] {
+				t.Errorf("ZRANDMEMBER z %s repeated %s", tc.count, member)
+			}
+			seen[member] = true
+		}
+	}
+}